@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mattchw/go-onboard/controllers"
+	"github.com/mattchw/go-onboard/models"
+)
+
+// createAdmin creates the first admin account, usage: go-server create-admin <username> [tenant,...].
+// The password is read from ADMIN_PASSWORD or, when unset, from stdin so it
+// never shows up in the process list or shell history. With tenancy enabled
+// the admin only signs in to the tenants listed.
+func createAdmin(ctx context.Context, args []string) {
+	if len(args) != 1 && len(args) != 2 {
+		log.Fatal("usage: go-server create-admin <username> [tenant,...]")
+	}
+	var tenants []string
+	if len(args) == 2 {
+		tenants = strings.Split(args[1], ",")
+	}
+
+	password := os.Getenv("ADMIN_PASSWORD")
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatal("reading password: ", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	account, err := controllers.Accounts.Bootstrap(ctx, models.AccountInput{
+		Username: args[0],
+		Password: password,
+		Tenants:  tenants,
+	})
+	if err != nil {
+		log.Fatal("creating admin: ", err)
+	}
+	log.Printf("created admin %s (%s)", account.Username, account.Id.Hex())
+}
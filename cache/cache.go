@@ -0,0 +1,315 @@
+// Package cache keeps the results of expensive reads as JSON in a Store,
+// Redis in production, with an optional in-process tier in front of it
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// refreshes take the lock of their key for at most this long
+const refreshLockTTL = 30 * time.Second
+
+// loads shared by concurrent misses give up after this long
+const loadTimeout = 30 * time.Second
+
+// xfetchBeta above 1 favors refreshing early, below 1 refreshing late
+const xfetchBeta = 1.0
+
+// entry is what is stored under a key, with the versions its tags had before
+// the value was loaded, when it goes stale and how long loading it took
+type entry struct {
+	Tags  map[string]int64 `json:"t,omitempty"`
+	Soft  int64            `json:"s"`
+	Delta int64            `json:"c"`
+	Data  json.RawMessage  `json:"d"`
+}
+
+// TTL says how long entries are served. Past Soft they are stale, they are
+// still served until Hard while they are loaded again.
+type TTL struct {
+	Soft time.Duration
+	Hard time.Duration
+}
+
+// MaxTTL bounds Hard. Tag versions are kept this long after they were last
+// bumped or registered, an entry expiring after its tag versions could be
+// served again once they restart from 0.
+const MaxTTL = 24 * time.Hour
+
+// normalize makes Hard at least Soft, entries are never stale without it, and
+// at most MaxTTL
+func (ttl TTL) normalize() TTL {
+	if ttl.Hard < ttl.Soft {
+		ttl.Hard = ttl.Soft
+	}
+	if ttl.Hard > MaxTTL {
+		ttl.Hard = MaxTTL
+	}
+	if ttl.Soft > ttl.Hard {
+		ttl.Soft = ttl.Hard
+	}
+	return ttl
+}
+
+// Stats counts the hits and misses of each tier and the loads they caused.
+// Stale hits are served from the store past their soft TTL.
+type Stats struct {
+	LocalHits   int64 `json:"localHits"`
+	LocalMisses int64 `json:"localMisses"`
+	StoreHits   int64 `json:"storeHits"`
+	StaleHits   int64 `json:"staleHits"`
+	StoreMisses int64 `json:"storeMisses"`
+	Loads       int64 `json:"loads"`
+	LoadErrors  int64 `json:"loadErrors"`
+	Refreshes   int64 `json:"refreshes"`
+}
+
+// Cache holds values of type T. Concurrent misses of a key share one call of
+// its loader, failed loads are returned to every caller and never cached.
+type Cache[T any] struct {
+	// first so the counters are 64-bit aligned for atomic
+	stats Stats
+	store Store
+	local *Local
+	group singleflight.Group
+}
+
+// Constructor, values are only kept in store when local is nil. Caches
+// sharing a store or a local tier must not share keys.
+func New[T any](store Store, local *Local) *Cache[T] {
+	return &Cache[T]{store: store, local: local}
+}
+
+// GetOrLoad returns the value cached under key, or the one loader returns,
+// which is then cached for ttl. The cache failing only costs a load, it is
+// logged and the value is loaded instead. Every caller gets its own copy of
+// the value, so it can be changed without affecting the others.
+//
+// The entry is registered under tags, invalidating any of them discards it.
+// Tag versions are read before loading, so a value loaded while a write
+// commits is discarded by the invalidation following that write.
+//
+// Past ttl.Soft the entry is served stale while one replica, holding the
+// lock of key, loads it again in the background. Hot entries are refreshed that way
+// a little before ttl.Soft too, more likely the longer they take to load
+// (XFetch), so they rarely go stale at all. Loads get a context with the
+// values of ctx but without its deadline, they are shared by other callers.
+func (ch *Cache[T]) GetOrLoad(ctx context.Context, key string, ttl TTL, loader func(ctx context.Context) (T, error), tags ...string) (T, error) {
+	var value T
+	ttl = ttl.normalize()
+
+	var epoch uint64
+	if ch.local != nil {
+		// read before the store, so invalidations arriving meanwhile are not missed
+		epoch = ch.local.Epoch()
+		if data, ok := ch.local.Get(key); ok {
+			atomic.AddInt64(&ch.stats.LocalHits, 1)
+			return value, json.Unmarshal(data, &value)
+		}
+		atomic.AddInt64(&ch.stats.LocalMisses, 1)
+	}
+
+	cached, versions, err := ch.read(ctx, key, tags)
+	if err != nil {
+		log.Printf("cache: reading %s failed, loading it: %v", key, err)
+	} else if cached != nil && current(cached.Tags, versions) {
+		if err := json.Unmarshal(cached.Data, &value); err == nil {
+			now := time.Now()
+			soft := time.UnixMilli(cached.Soft)
+			if now.Before(soft) {
+				atomic.AddInt64(&ch.stats.StoreHits, 1)
+				ch.keepLocal(key, cached.Data, tags, soft.Sub(now), epoch)
+			} else {
+				atomic.AddInt64(&ch.stats.StaleHits, 1)
+			}
+			if !now.Before(soft) || xfetch(now, soft, time.Duration(cached.Delta)*time.Millisecond) {
+				ch.refresh(ctx, key, ttl, loader, tags, versions, epoch)
+			}
+			return value, nil
+		}
+		log.Printf("cache: discarding unreadable entry %s: %v", key, err)
+	}
+	atomic.AddInt64(&ch.stats.StoreMisses, 1)
+
+	// waiters leave when their own context is done, the load goes on for the
+	// others, so it must not end with the context of the caller that started it
+	result := ch.group.DoChan(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detached{ctx}, loadTimeout)
+		defer cancel()
+		return ch.load(ctx, key, ttl, loader, tags, versions, epoch)
+	})
+
+	select {
+	case <-ctx.Done():
+		return value, ctx.Err()
+	case res := <-result:
+		if res.Err != nil {
+			return value, res.Err
+		}
+		if err := json.Unmarshal(res.Val.([]byte), &value); err != nil {
+			return value, fmt.Errorf("cache: decoding %s: %w", key, err)
+		}
+		return value, nil
+	}
+}
+
+// Invalidate discards every entry registered under one of tags, in the store
+// and in the local tier of every replica
+func (ch *Cache[T]) Invalidate(ctx context.Context, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	if ch.local != nil {
+		defer ch.local.Invalidate(tags...)
+	}
+	return ch.store.Invalidate(ctx, tags...)
+}
+
+// Delete drops the entries under keys, the next reads load them again. Local
+// tiers of other replicas keep their copies until they expire.
+func (ch *Cache[T]) Delete(ctx context.Context, keys ...string) error {
+	if ch.local != nil {
+		ch.local.Delete(keys...)
+	}
+	return ch.store.Delete(ctx, keys...)
+}
+
+// Stats returns the hits and misses so far
+func (ch *Cache[T]) Stats() Stats {
+	return Stats{
+		LocalHits:   atomic.LoadInt64(&ch.stats.LocalHits),
+		LocalMisses: atomic.LoadInt64(&ch.stats.LocalMisses),
+		StoreHits:   atomic.LoadInt64(&ch.stats.StoreHits),
+		StaleHits:   atomic.LoadInt64(&ch.stats.StaleHits),
+		StoreMisses: atomic.LoadInt64(&ch.stats.StoreMisses),
+		Loads:       atomic.LoadInt64(&ch.stats.Loads),
+		LoadErrors:  atomic.LoadInt64(&ch.stats.LoadErrors),
+		Refreshes:   atomic.LoadInt64(&ch.stats.Refreshes),
+	}
+}
+
+// load calls loader and caches what it returns, versions are those of tags
+// before the call
+func (ch *Cache[T]) load(ctx context.Context, key string, ttl TTL, loader func(ctx context.Context) (T, error), tags []string, versions map[string]int64, epoch uint64) ([]byte, error) {
+	atomic.AddInt64(&ch.stats.Loads, 1)
+	started := time.Now()
+	loaded, err := loader(ctx)
+	if err != nil {
+		atomic.AddInt64(&ch.stats.LoadErrors, 1)
+		return nil, err
+	}
+	data, err := json.Marshal(loaded)
+	if err != nil {
+		return nil, fmt.Errorf("cache: encoding %s: %w", key, err)
+	}
+
+	// without the versions of its tags the entry could outlive an invalidation
+	if versions != nil {
+		now := time.Now()
+		ch.write(ctx, key, ttl.Hard, tags, entry{
+			Tags:  versions,
+			Soft:  now.Add(ttl.Soft).UnixMilli(),
+			Delta: now.Sub(started).Milliseconds(),
+			Data:  data,
+		})
+		ch.keepLocal(key, data, tags, ttl.Soft, epoch)
+	}
+	return data, nil
+}
+
+// refresh loads key again in the background, unless this replica already
+// does or another one holds the lock of key
+func (ch *Cache[T]) refresh(ctx context.Context, key string, ttl TTL, loader func(ctx context.Context) (T, error), tags []string, versions map[string]int64, epoch uint64) {
+	// DoChan runs the refresh on a goroutine of its own, nobody waits for it
+	ch.group.DoChan("refresh:"+key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detached{ctx}, refreshLockTTL)
+		defer cancel()
+
+		token, err := ch.store.Lock(ctx, key, refreshLockTTL)
+		if err != nil || token == "" {
+			return nil, err
+		}
+		defer func() {
+			if err := ch.store.Unlock(ctx, key, token); err != nil {
+				log.Printf("cache: releasing the lock of %s failed: %v", key, err)
+			}
+		}()
+
+		atomic.AddInt64(&ch.stats.Refreshes, 1)
+		if _, err := ch.load(ctx, key, ttl, loader, tags, versions, epoch); err != nil {
+			log.Printf("cache: refreshing %s failed, serving it stale: %v", key, err)
+		}
+		return nil, nil
+	})
+}
+
+func (ch *Cache[T]) keepLocal(key string, data []byte, tags []string, ttl time.Duration, epoch uint64) {
+	if ch.local != nil {
+		ch.local.Set(key, data, tags, ttl, epoch)
+	}
+}
+
+// read returns the entry under key, nil when there is none, and the current
+// versions of tags, both from the same moment
+func (ch *Cache[T]) read(ctx context.Context, key string, tags []string) (*entry, map[string]int64, error) {
+	raw, versions, err := ch.store.Get(ctx, key, tags)
+	if err != nil || raw == nil {
+		return nil, versions, err
+	}
+	var cached entry
+	if err := json.Unmarshal(raw, &cached); err != nil {
+		log.Printf("cache: discarding unreadable entry %s: %v", key, err)
+		return nil, versions, nil
+	}
+	return &cached, versions, nil
+}
+
+func (ch *Cache[T]) write(ctx context.Context, key string, ttl time.Duration, tags []string, e entry) {
+	data, err := json.Marshal(e)
+	if err == nil {
+		err = ch.store.Set(ctx, key, data, ttl, tags)
+	}
+	if err != nil {
+		log.Printf("cache: writing %s failed: %v", key, err)
+	}
+}
+
+// xfetch decides whether to refresh an entry before it goes stale at soft,
+// the more likely the closer soft is and the longer loading took
+func xfetch(now time.Time, soft time.Time, delta time.Duration) bool {
+	if delta <= 0 {
+		return false
+	}
+	// 1-Float64 is in (0, 1], its log in (-Inf, 0]
+	early := time.Duration(float64(delta) * xfetchBeta * -math.Log(1-rand.Float64()))
+	return !now.Add(early).Before(soft)
+}
+
+// detached keeps the values of a context, not its deadline or cancellation
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// current reports whether an entry registered with versions is still valid
+// given the latest versions of its tags
+func current(registered map[string]int64, latest map[string]int64) bool {
+	for tag, version := range latest {
+		if registered[tag] != version {
+			return false
+		}
+	}
+	return true
+}
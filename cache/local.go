@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// invalidations are broadcast on this channel as a JSON array of tags
+const invalidationChannel = "cache:invalidate"
+
+// Subscriber receives the invalidations of other replicas, *redis.Client is one
+type Subscriber interface {
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+// Local is the in-process tier in front of Redis, shared by the caches of a
+// replica. It holds at most size entries for at most ttl each, dropping the
+// least recently used first. Invalidations reach it through Redis pub/sub, the
+// ttl bounds how long an entry outlives an invalidation that got lost.
+type Local struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+	tags  map[string]map[string]struct{}
+	// epoch changes with every invalidation, values read before it changed
+	// are not kept
+	epoch     uint64
+	evictions int64
+}
+
+type localItem struct {
+	key     string
+	data    []byte
+	tags    []string
+	expires time.Time
+}
+
+// LocalStats describes the local tier
+type LocalStats struct {
+	Entries   int   `json:"entries"`
+	Size      int   `json:"size"`
+	Evictions int64 `json:"evictions"`
+}
+
+// Constructor
+func NewLocal(size int, ttl time.Duration) *Local {
+	return &Local{
+		size:  size,
+		ttl:   ttl,
+		now:   time.Now,
+		order: list.New(),
+		items: map[string]*list.Element{},
+		tags:  map[string]map[string]struct{}{},
+	}
+}
+
+// Epoch returns the current epoch, to be passed to Set
+func (l *Local) Epoch() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.epoch
+}
+
+// Get returns the value under key, if it has not expired
+func (l *Local) Get(key string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := element.Value.(*localItem)
+	if !l.now().Before(item.expires) {
+		l.remove(element)
+		return nil, false
+	}
+	l.order.MoveToFront(element)
+	return item.data, true
+}
+
+// Set keeps data under key for ttl at most, registered under tags. Values read
+// in an earlier epoch may predate an invalidation and are dropped.
+func (l *Local) Set(key string, data []byte, tags []string, ttl time.Duration, epoch uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if epoch != l.epoch {
+		return
+	}
+	if ttl <= 0 || ttl > l.ttl {
+		ttl = l.ttl
+	}
+	if element, ok := l.items[key]; ok {
+		l.remove(element)
+	}
+
+	element := l.order.PushFront(&localItem{key: key, data: data, tags: tags, expires: l.now().Add(ttl)})
+	l.items[key] = element
+	for _, tag := range tags {
+		if l.tags[tag] == nil {
+			l.tags[tag] = map[string]struct{}{}
+		}
+		l.tags[tag][key] = struct{}{}
+	}
+
+	for l.order.Len() > l.size {
+		l.remove(l.order.Back())
+		l.evictions++
+	}
+}
+
+// Invalidate drops the entries registered under tags
+func (l *Local) Invalidate(tags ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.epoch++
+	for _, tag := range tags {
+		for key := range l.tags[tag] {
+			if element, ok := l.items[key]; ok {
+				l.remove(element)
+			}
+		}
+	}
+}
+
+// Delete drops the entries under keys
+func (l *Local) Delete(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.epoch++
+	for _, key := range keys {
+		if element, ok := l.items[key]; ok {
+			l.remove(element)
+		}
+	}
+}
+
+// Clear drops every entry
+func (l *Local) Clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.epoch++
+	l.order.Init()
+	l.items = map[string]*list.Element{}
+	l.tags = map[string]map[string]struct{}{}
+}
+
+// Stats returns the number of entries and evictions
+func (l *Local) Stats() LocalStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return LocalStats{Entries: l.order.Len(), Size: l.size, Evictions: l.evictions}
+}
+
+// Listen applies the invalidations broadcast by every replica until ctx is
+// done. Invalidations sent while the subscription is down are lost, so the
+// tier is cleared whenever it is (re)established.
+func (l *Local) Listen(ctx context.Context, rdb Subscriber) {
+	pubsub := rdb.Subscribe(ctx, invalidationChannel)
+	defer pubsub.Close()
+
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("cache: receiving invalidations failed: %v", err)
+			l.Clear()
+			time.Sleep(time.Second)
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			l.Clear()
+		case *redis.Message:
+			var tags []string
+			if err := json.Unmarshal([]byte(msg.Payload), &tags); err != nil {
+				log.Printf("cache: discarding invalidation %q: %v", msg.Payload, err)
+				continue
+			}
+			l.Invalidate(tags...)
+		}
+	}
+}
+
+// remove drops element and its registrations, l.mu is held
+func (l *Local) remove(element *list.Element) {
+	item := l.order.Remove(element).(*localItem)
+	delete(l.items, item.key)
+	for _, tag := range item.tags {
+		delete(l.tags[tag], item.key)
+		if len(l.tags[tag]) == 0 {
+			delete(l.tags, tag)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalTier(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	local := NewLocal(2, time.Minute)
+	local.now = func() time.Time { return now }
+
+	local.Set("a", []byte("1"), []string{"users"}, time.Hour, local.Epoch())
+	local.Set("b", []byte("2"), nil, 10*time.Second, local.Epoch())
+	_, ok := local.Get("a")
+	require.True(t, ok)
+
+	// the least recently used entry makes room
+	local.Set("c", []byte("3"), nil, time.Hour, local.Epoch())
+	_, ok = local.Get("b")
+	require.False(t, ok)
+	require.Equal(t, LocalStats{Entries: 2, Size: 2, Evictions: 1}, local.Stats())
+
+	// entries expire with the shorter of their ttl and the tier's
+	now = now.Add(time.Minute)
+	_, ok = local.Get("a")
+	require.False(t, ok)
+
+	// values read before an invalidation are not kept
+	epoch := local.Epoch()
+	local.Invalidate("users")
+	local.Set("a", []byte("stale"), []string{"users"}, time.Hour, epoch)
+	_, ok = local.Get("a")
+	require.False(t, ok)
+
+	local.Set("a", []byte("1"), []string{"users"}, time.Hour, local.Epoch())
+	local.Invalidate("users")
+	_, ok = local.Get("a")
+	require.False(t, ok)
+}
@@ -0,0 +1,379 @@
+package cache
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Backend selects where cached entries are kept
+type Backend string
+
+const (
+	// Redis shares entries between replicas
+	RedisBackend Backend = "redis"
+	// Memory keeps entries in the process, for a single replica
+	MemoryBackend Backend = "memory"
+	// None caches nothing, every read loads
+	NoBackend Backend = "none"
+)
+
+// ParseBackend validates a backend name, empty is Redis
+func ParseBackend(value string) (Backend, error) {
+	switch backend := Backend(value); backend {
+	case "":
+		return RedisBackend, nil
+	case RedisBackend, MemoryBackend, NoBackend:
+		return backend, nil
+	}
+	return RedisBackend, fmt.Errorf("cache: unknown backend %q, expected redis, memory or none", value)
+}
+
+// Store keeps the entries of caches, the versions of their tags and the locks
+// of their refreshes
+type Store interface {
+	// Get returns the value under key, nil when there is none, and the
+	// versions of tags, both from the same moment. Tags never invalidated
+	// have version 0.
+	Get(ctx context.Context, key string, tags []string) ([]byte, map[string]int64, error)
+	// Set keeps value under key for ttl, and the versions of the tags it was
+	// registered with for at least MaxTTL
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags []string) error
+	Delete(ctx context.Context, keys ...string) error
+	// Invalidate bumps the versions of tags in one step and keeps them for
+	// MaxTTL
+	Invalidate(ctx context.Context, tags ...string) error
+	// Lock takes the lock of key for ttl and returns its token, empty when
+	// somebody else holds it
+	Lock(ctx context.Context, key string, ttl time.Duration) (string, error)
+	// Unlock releases the lock of key if it still holds token
+	Unlock(ctx context.Context, key string, token string) error
+}
+
+// entries, tag versions and locks are kept under these prefixes, apart from
+// the other keys of the Redis they share
+const (
+	entryPrefix = "cache:"
+	tagPrefix   = "tag:"
+	lockPrefix  = "lock:"
+)
+
+// invalidate bumps the versions of tags in one step, readers see either all
+// of them or none, and broadcasts the tags to the local tiers
+var invalidate = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	redis.call("INCR", key)
+	redis.call("PEXPIRE", key, ARGV[3])
+end
+redis.call("PUBLISH", ARGV[1], ARGV[2])
+return #KEYS
+`)
+
+// set writes an entry and keeps the versions of its tags, those never bumped
+// do not exist and stay at 0
+var set = redis.NewScript(`
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+for i = 2, #KEYS do
+	redis.call("PEXPIRE", KEYS[i], ARGV[3])
+end
+return #KEYS
+`)
+
+// unlock releases a lock only if it still holds the token of its owner
+var unlock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// RedisStore keeps entries in Redis, shared by every replica. Invalidations
+// are broadcast to the local tiers listening on it.
+type RedisStore struct {
+	rdb redis.Cmdable
+}
+
+// Constructor
+func NewRedisStore(rdb redis.Cmdable) *RedisStore {
+	return &RedisStore{rdb: rdb}
+}
+
+// implement Get, the entry and the versions come from one MGET
+func (rs *RedisStore) Get(ctx context.Context, key string, tags []string) ([]byte, map[string]int64, error) {
+	keys := []string{entryPrefix + key}
+	for _, tag := range tags {
+		keys = append(keys, tagPrefix+tag)
+	}
+	values, err := rs.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	versions := map[string]int64{}
+	for i, tag := range tags {
+		if value, ok := values[i+1].(string); ok {
+			versions[tag], _ = strconv.ParseInt(value, 10, 64)
+		} else {
+			versions[tag] = 0
+		}
+	}
+	if value, ok := values[0].(string); ok {
+		return []byte(value), versions, nil
+	}
+	return nil, versions, nil
+}
+
+// implement Set
+func (rs *RedisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags []string) error {
+	if len(tags) == 0 {
+		return rs.rdb.Set(ctx, entryPrefix+key, value, ttl).Err()
+	}
+	keys := []string{entryPrefix + key}
+	for _, tag := range tags {
+		keys = append(keys, tagPrefix+tag)
+	}
+	return set.Run(ctx, rs.rdb, keys, value, ttl.Milliseconds(), MaxTTL.Milliseconds()).Err()
+}
+
+// implement Delete
+func (rs *RedisStore) Delete(ctx context.Context, keys ...string) error {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = entryPrefix + key
+	}
+	return rs.rdb.Del(ctx, prefixed...).Err()
+}
+
+// implement Invalidate
+func (rs *RedisStore) Invalidate(ctx context.Context, tags ...string) error {
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = tagPrefix + tag
+	}
+	payload, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	return invalidate.Run(ctx, rs.rdb, keys, invalidationChannel, payload, MaxTTL.Milliseconds()).Err()
+}
+
+// implement Lock
+func (rs *RedisStore) Lock(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	locked, err := rs.rdb.SetNX(ctx, lockPrefix+key, token, ttl).Result()
+	if err != nil || !locked {
+		return "", err
+	}
+	return token, nil
+}
+
+// implement Unlock
+func (rs *RedisStore) Unlock(ctx context.Context, key string, token string) error {
+	return unlock.Run(ctx, rs.rdb, []string{lockPrefix + key}, token).Err()
+}
+
+// MemoryStore keeps entries in the process, for tests, local development
+// and single replicas. Expired entries, tag versions and locks are dropped
+// when read and swept once a minute as others are written.
+type MemoryStore struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]memoryEntry
+	versions map[string]memoryVersion
+	locks    map[string]memoryEntry
+	swept    time.Time
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+type memoryVersion struct {
+	version int64
+	expires time.Time
+}
+
+// Constructor
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		now:      time.Now,
+		entries:  map[string]memoryEntry{},
+		versions: map[string]memoryVersion{},
+		locks:    map[string]memoryEntry{},
+	}
+}
+
+// implement Get
+func (ms *MemoryStore) Get(ctx context.Context, key string, tags []string) ([]byte, map[string]int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.now()
+	versions := map[string]int64{}
+	for _, tag := range tags {
+		if version, ok := ms.versions[tag]; ok && now.Before(version.expires) {
+			versions[tag] = version.version
+		} else {
+			versions[tag] = 0
+		}
+	}
+	entry, ok := ms.entries[key]
+	if !ok {
+		return nil, versions, nil
+	}
+	if !now.Before(entry.expires) {
+		delete(ms.entries, key)
+		return nil, versions, nil
+	}
+	return entry.value, versions, nil
+}
+
+// implement Set
+func (ms *MemoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags []string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.now()
+	ms.sweep(now)
+	ms.entries[key] = memoryEntry{value: value, expires: now.Add(ttl)}
+	for _, tag := range tags {
+		if version, ok := ms.versions[tag]; ok && now.Before(version.expires) {
+			version.expires = now.Add(MaxTTL)
+			ms.versions[tag] = version
+		}
+	}
+	return nil
+}
+
+// implement Delete
+func (ms *MemoryStore) Delete(ctx context.Context, keys ...string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, key := range keys {
+		delete(ms.entries, key)
+	}
+	return nil
+}
+
+// implement Invalidate
+func (ms *MemoryStore) Invalidate(ctx context.Context, tags ...string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.now()
+	ms.sweep(now)
+	for _, tag := range tags {
+		version := ms.versions[tag]
+		if !now.Before(version.expires) {
+			version.version = 0
+		}
+		ms.versions[tag] = memoryVersion{version: version.version + 1, expires: now.Add(MaxTTL)}
+	}
+	return nil
+}
+
+// implement Lock
+func (ms *MemoryStore) Lock(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.now()
+	ms.sweep(now)
+	if lock, ok := ms.locks[key]; ok && now.Before(lock.expires) {
+		return "", nil
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	ms.locks[key] = memoryEntry{value: []byte(token), expires: now.Add(ttl)}
+	return token, nil
+}
+
+// implement Unlock
+func (ms *MemoryStore) Unlock(ctx context.Context, key string, token string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if lock, ok := ms.locks[key]; ok && string(lock.value) == token {
+		delete(ms.locks, key)
+	}
+	return nil
+}
+
+// sweep drops what expired, at most once a minute
+func (ms *MemoryStore) sweep(now time.Time) {
+	if now.Sub(ms.swept) <= time.Minute {
+		return
+	}
+	for key, entry := range ms.entries {
+		if !now.Before(entry.expires) {
+			delete(ms.entries, key)
+		}
+	}
+	for tag, version := range ms.versions {
+		if !now.Before(version.expires) {
+			delete(ms.versions, tag)
+		}
+	}
+	for key, lock := range ms.locks {
+		if !now.Before(lock.expires) {
+			delete(ms.locks, key)
+		}
+	}
+	ms.swept = now
+}
+
+// NoopStore keeps nothing, every read misses and loads
+type NoopStore struct{}
+
+// implement Get
+func (NoopStore) Get(ctx context.Context, key string, tags []string) ([]byte, map[string]int64, error) {
+	return nil, map[string]int64{}, nil
+}
+
+// implement Set
+func (NoopStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags []string) error {
+	return nil
+}
+
+// implement Delete
+func (NoopStore) Delete(ctx context.Context, keys ...string) error {
+	return nil
+}
+
+// implement Invalidate
+func (NoopStore) Invalidate(ctx context.Context, tags ...string) error {
+	return nil
+}
+
+// implement Lock, nothing is stale so there is nothing to refresh
+func (NoopStore) Lock(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return "", nil
+}
+
+// implement Unlock
+func (NoopStore) Unlock(ctx context.Context, key string, token string) error {
+	return nil
+}
+
+func newToken() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := crand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
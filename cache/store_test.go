@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+
+	require.NoError(t, store.Set(ctx, "users", []byte("[]"), time.Minute, nil))
+	value, versions, err := store.Get(ctx, "users", []string{"users:list"})
+	require.NoError(t, err)
+	require.Equal(t, "[]", string(value))
+	require.Equal(t, map[string]int64{"users:list": 0}, versions)
+
+	require.NoError(t, store.Invalidate(ctx, "users:list"))
+	_, versions, _ = store.Get(ctx, "users", []string{"users:list"})
+	require.Equal(t, int64(1), versions["users:list"])
+
+	now = now.Add(time.Minute)
+	value, _, err = store.Get(ctx, "users", nil)
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	// a lock is held until it is released with its token or expires
+	token, err := store.Lock(ctx, "users", time.Minute)
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+	other, _ := store.Lock(ctx, "users", time.Minute)
+	require.Empty(t, other)
+	require.NoError(t, store.Unlock(ctx, "users", "not-the-token"))
+	other, _ = store.Lock(ctx, "users", time.Minute)
+	require.Empty(t, other)
+	now = now.Add(time.Minute)
+	other, _ = store.Lock(ctx, "users", time.Minute)
+	require.NotEmpty(t, other)
+}
+
+func TestMemoryStoreExpiresTagVersions(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+
+	require.NoError(t, store.Invalidate(ctx, "users:list", "users"))
+	// writing an entry registered under a tag keeps its version
+	now = now.Add(MaxTTL - time.Minute)
+	require.NoError(t, store.Set(ctx, "users", []byte("[]"), time.Minute, []string{"users:list"}))
+	now = now.Add(2 * time.Minute)
+	_, versions, err := store.Get(ctx, "users", []string{"users:list", "users"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"users:list": 1, "users": 0}, versions)
+
+	// expired versions restart from 0
+	require.NoError(t, store.Invalidate(ctx, "users"))
+	_, versions, _ = store.Get(ctx, "users", []string{"users"})
+	require.Equal(t, int64(1), versions["users"])
+}
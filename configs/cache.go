@@ -0,0 +1,38 @@
+package configs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattchw/go-onboard/cache"
+)
+
+// CacheBackend selects where cached reads are kept, set with CACHE_BACKEND
+var CacheBackend cache.Backend = EnvCacheBackend()
+
+// LoadCacheStore returns the store of cached reads, only the Redis one is
+// shared by replicas and only it needs Redis
+func LoadCacheStore() cache.Store {
+	switch CacheBackend {
+	case cache.MemoryBackend:
+		fmt.Println("Caching in memory, replicas do not share their caches")
+		return cache.NewMemoryStore()
+	case cache.NoBackend:
+		fmt.Println("Caching is off")
+		return cache.NoopStore{}
+	}
+	return cache.NewRedisStore(RDB)
+}
+
+// LoadLocalCache returns the in-process tier in front of Redis, nil with the
+// other backends. Entries live CACHE_LOCAL_TTL at most, how long a replica may
+// serve a value after an invalidation it missed.
+func LoadLocalCache() *cache.Local {
+	if CacheBackend != cache.RedisBackend {
+		return nil
+	}
+	local := cache.NewLocal(EnvCount("CACHE_LOCAL_SIZE", 10000), EnvDuration("CACHE_LOCAL_TTL", 5*time.Second))
+	go local.Listen(context.Background(), RDB)
+	return local
+}
@@ -0,0 +1,56 @@
+package configs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mattchw/go-onboard/encryption"
+)
+
+// NewKeyStore returns the store of the wrapped data keys, nil when no master key is configured
+func NewKeyStore() *encryption.KeyStore {
+	path := EnvEncryptionMasterKeyFile()
+	if path == "" {
+		return nil
+	}
+
+	master, err := encryption.LoadMasterKey(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return encryption.NewKeyStore(GetCollection(DB, "encryption_keys"), master)
+}
+
+// LoadKeyring returns the keyring of the field-level encryption, nil when no
+// master key is configured
+func LoadKeyring() *encryption.Keyring {
+	store := NewKeyStore()
+	if store == nil {
+		fmt.Println("Field-level encryption disabled, ENCRYPTION_MASTER_KEY_FILE is not set")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	keyring, err := store.Load(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// pick up keys rotated by other processes
+	go func() {
+		for range time.Tick(time.Minute) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := store.Reload(ctx, keyring); err != nil {
+				log.Printf("failed to reload encryption keys: %v", err)
+			}
+			cancel()
+		}
+	}()
+
+	fmt.Println("Field-level encryption enabled, active key", keyring.ActiveKeyId())
+	return keyring
+}
@@ -1,18 +1,39 @@
 package configs
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/mattchw/go-onboard/cache"
+	"github.com/mattchw/go-onboard/mail"
+	"github.com/mattchw/go-onboard/oidc"
+	"github.com/mattchw/go-onboard/ratelimit"
+	"github.com/mattchw/go-onboard/tenancy"
 )
 
+var envOnce sync.Once
+
+// loadEnv reads .env once when there is one. Deployments pass the settings as
+// environment variables instead, so a missing file is not an error.
+func loadEnv() {
+	envOnce.Do(func() {
+		err := godotenv.Load()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Fatal("Error loading .env file: ", err)
+		}
+	})
+}
+
 func EnvMongoURI() string {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
+	loadEnv()
 
 	mongo_auth := ""
 
@@ -25,19 +46,13 @@ func EnvMongoURI() string {
 }
 
 func EnvMongoDatabase() string {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
+	loadEnv()
 
 	return os.Getenv("MONGO_DATABASE")
 }
 
 func EnvRedisAddress() string {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
+	loadEnv()
 
 	if os.Getenv("REDIS_HOST") != "" && os.Getenv("REDIS_PORT") != "" {
 		return os.Getenv("REDIS_HOST") + ":" + os.Getenv("REDIS_PORT")
@@ -45,3 +60,385 @@ func EnvRedisAddress() string {
 
 	return ""
 }
+
+// EnvAPISunset returns the announced sunset date of an API version, zero if none
+func EnvAPISunset(version string) time.Time {
+	loadEnv()
+
+	value := os.Getenv("API_" + strings.ToUpper(version) + "_SUNSET")
+	if value == "" {
+		return time.Time{}
+	}
+
+	sunset, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		log.Fatal("Invalid API_" + strings.ToUpper(version) + "_SUNSET, expected YYYY-MM-DD")
+	}
+	return sunset
+}
+
+// EnvJobWorkers returns how many job workers to run, fallback when JOBS_WORKERS is unset
+func EnvJobWorkers(fallback int) int {
+	loadEnv()
+
+	value := os.Getenv("JOBS_WORKERS")
+	if value == "" {
+		return fallback
+	}
+
+	workers, err := strconv.Atoi(value)
+	if err != nil || workers < 0 {
+		log.Fatal("Invalid JOBS_WORKERS, expected a non-negative number")
+	}
+	return workers
+}
+
+// EnvEncryptionMasterKeyFile returns the path of the field-level encryption master key, empty when disabled
+func EnvEncryptionMasterKeyFile() string {
+	loadEnv()
+
+	return os.Getenv("ENCRYPTION_MASTER_KEY_FILE")
+}
+
+// EnvTenancyMode returns how tenant data is isolated, empty when tenancy is disabled
+func EnvTenancyMode() tenancy.Mode {
+	loadEnv()
+
+	mode, err := tenancy.ParseMode(os.Getenv("TENANCY_MODE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return mode
+}
+
+// EnvCacheBackend returns where cached reads are kept, redis unless CACHE_BACKEND is memory or none
+func EnvCacheBackend() cache.Backend {
+	loadEnv()
+
+	backend, err := cache.ParseBackend(os.Getenv("CACHE_BACKEND"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return backend
+}
+
+// EnvTenants returns the known tenant ids, empty to accept any valid tenant id
+func EnvTenants() []string {
+	loadEnv()
+
+	var tenants []string
+	for _, tenant := range strings.Split(os.Getenv("TENANTS"), ",") {
+		tenant = strings.TrimSpace(tenant)
+		if tenant == "" {
+			continue
+		}
+		if !tenancy.ValidTenant(tenant) {
+			log.Fatal("Invalid tenant id in TENANTS: " + tenant)
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants
+}
+
+// EnvTenantBaseDomain returns the domain tenants are subdomains of, empty to not resolve tenants from the host
+func EnvTenantBaseDomain() string {
+	loadEnv()
+
+	return os.Getenv("TENANT_BASE_DOMAIN")
+}
+
+// EnvRateLimit returns the limit RATE_LIMIT_<NAME> written as <requests>/<period>, fallback when unset
+func EnvRateLimit(name string, fallback string) ratelimit.Limit {
+	loadEnv()
+
+	value := os.Getenv("RATE_LIMIT_" + strings.ToUpper(name))
+	if value == "" {
+		value = fallback
+	}
+
+	limit, err := ratelimit.ParseLimit(value)
+	if err != nil {
+		log.Fatal("Invalid RATE_LIMIT_" + strings.ToUpper(name) + ": " + err.Error())
+	}
+	return limit
+}
+
+// EnvDevMode reports whether DEV_MODE=true, it lets the server start with
+// throwaway keys where production needs them configured
+func EnvDevMode() bool {
+	loadEnv()
+
+	value := os.Getenv("DEV_MODE")
+	if value == "" {
+		return false
+	}
+	dev, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatal("Invalid DEV_MODE, expected true or false")
+	}
+	return dev
+}
+
+// EnvJWTKeysDir returns the directory holding the <kid>.pem token signing keys, empty for a throwaway key in dev mode
+func EnvJWTKeysDir() string {
+	loadEnv()
+
+	return os.Getenv("JWT_KEYS_DIR")
+}
+
+// EnvJWTSigningKey returns the kid new tokens are signed with, empty for the key whose id sorts last
+func EnvJWTSigningKey() string {
+	loadEnv()
+
+	return os.Getenv("JWT_SIGNING_KEY")
+}
+
+// EnvJWTIssuer returns the iss claim of issued tokens
+func EnvJWTIssuer() string {
+	loadEnv()
+
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "go-onboard"
+}
+
+// EnvTrustedProxies returns the addresses and CIDR ranges of the proxies in
+// front of the server, only requests coming from them name the client IP
+func EnvTrustedProxies() []string {
+	loadEnv()
+
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// EnvProxyHeader returns the header trusted proxies put the client IP in, X-Forwarded-For unless PROXY_HEADER is set
+func EnvProxyHeader() string {
+	loadEnv()
+
+	if header := os.Getenv("PROXY_HEADER"); header != "" {
+		return header
+	}
+	return "X-Forwarded-For"
+}
+
+// EnvDuration returns the duration in the environment variable name, fallback when unset
+func EnvDuration(name string, fallback time.Duration) time.Duration {
+	loadEnv()
+
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Fatal("Invalid " + name + ", expected a positive duration like 15m")
+	}
+	return duration
+}
+
+// EnvPartnersFile returns the path of the partners signing requests, empty when there are none
+func EnvPartnersFile() string {
+	loadEnv()
+
+	return os.Getenv("PARTNERS_FILE")
+}
+
+// EnvRBACPolicyFile returns the path of the roles and permissions policy, empty for the built-in one
+func EnvRBACPolicyFile() string {
+	loadEnv()
+
+	return os.Getenv("RBAC_POLICY_FILE")
+}
+
+// EnvOIDCIssuer returns the issuer of identity provider tokens to accept, empty to accept none
+func EnvOIDCIssuer() string {
+	loadEnv()
+
+	return os.Getenv("OIDC_ISSUER")
+}
+
+// EnvOIDCAudience returns the audience identity provider tokens have to be issued for
+func EnvOIDCAudience() string {
+	loadEnv()
+
+	audience := os.Getenv("OIDC_AUDIENCE")
+	if audience == "" && os.Getenv("OIDC_ISSUER") != "" {
+		log.Fatal("OIDC_AUDIENCE is required with OIDC_ISSUER")
+	}
+	return audience
+}
+
+// EnvOIDCRequiredScopes returns the scopes every identity provider token needs
+func EnvOIDCRequiredScopes() []string {
+	loadEnv()
+
+	return strings.Fields(strings.ReplaceAll(os.Getenv("OIDC_REQUIRED_SCOPES"), ",", " "))
+}
+
+// EnvOIDCRoleClaim returns the claim holding the groups of the subject
+func EnvOIDCRoleClaim() string {
+	loadEnv()
+
+	if claim := os.Getenv("OIDC_ROLE_CLAIM"); claim != "" {
+		return claim
+	}
+	return "groups"
+}
+
+// EnvOIDCUserClaim returns the claim holding the local user id of the subject, empty to map none
+func EnvOIDCUserClaim() string {
+	loadEnv()
+
+	return os.Getenv("OIDC_USER_CLAIM")
+}
+
+// EnvOIDCTenantClaim returns the claim holding the tenant of the subject, empty to map none
+func EnvOIDCTenantClaim() string {
+	loadEnv()
+
+	return os.Getenv("OIDC_TENANT_CLAIM")
+}
+
+// EnvOIDCRoleMap returns the local roles of identity provider groups, in the
+// order of OIDC_ROLE_MAP like idp-admins=admin,idp-editors=editor
+func EnvOIDCRoleMap() []oidc.RoleMapping {
+	loadEnv()
+
+	var mappings []oidc.RoleMapping
+	for _, entry := range strings.Split(os.Getenv("OIDC_ROLE_MAP"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		value, role, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(value) == "" || strings.TrimSpace(role) == "" {
+			log.Fatal("Invalid OIDC_ROLE_MAP entry " + entry + ", expected group=role")
+		}
+		mappings = append(mappings, oidc.RoleMapping{Value: strings.TrimSpace(value), Role: strings.TrimSpace(role)})
+	}
+	return mappings
+}
+
+// EnvSessionCookieSecure reports whether session cookies are only sent over HTTPS, true unless SESSION_COOKIE_SECURE=false
+func EnvSessionCookieSecure() bool {
+	loadEnv()
+
+	value := os.Getenv("SESSION_COOKIE_SECURE")
+	if value == "" {
+		return true
+	}
+	secure, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatal("Invalid SESSION_COOKIE_SECURE, expected true or false")
+	}
+	return secure
+}
+
+// EnvCount returns the positive number in the named variable, fallback when it is not set
+func EnvCount(name string, fallback int) int {
+	loadEnv()
+
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		log.Fatal("Invalid " + name + ", expected a positive number")
+	}
+	return count
+}
+
+// EnvTOTPIssuer returns the name authenticator apps show for this service, go-onboard unless TOTP_ISSUER is set
+func EnvTOTPIssuer() string {
+	loadEnv()
+
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "go-onboard"
+}
+
+// EnvPublicURL returns where the console of the API is reached, links in emails point there
+func EnvPublicURL() string {
+	loadEnv()
+
+	if url := os.Getenv("PUBLIC_URL"); url != "" {
+		return url
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		return "http://localhost:" + port
+	}
+	return "http://localhost"
+}
+
+// EnvMailFrom returns the sender of emails
+func EnvMailFrom() string {
+	loadEnv()
+
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		return from
+	}
+	return "go-onboard <no-reply@localhost>"
+}
+
+// EnvSMTPConfig returns the SMTP server emails are sent through, an empty host when SMTP_HOST is unset
+func EnvSMTPConfig() mail.SMTPConfig {
+	loadEnv()
+
+	config := mail.SMTPConfig{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     587,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     EnvMailFrom(),
+	}
+	if value := os.Getenv("SMTP_PORT"); value != "" {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			log.Fatal("Invalid SMTP_PORT, expected a port number")
+		}
+		config.Port = port
+	}
+	if value := os.Getenv("SMTP_INSECURE"); value != "" {
+		insecure, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Fatal("Invalid SMTP_INSECURE, expected true or false")
+		}
+		config.Insecure = insecure
+	}
+	return config
+}
+
+// EnvMailDir returns the directory emails are written to instead of being sent
+func EnvMailDir() string {
+	loadEnv()
+
+	return os.Getenv("MAIL_DIR")
+}
+
+// EnvMailTemplatesDir returns the directory of templates replacing the built-in emails
+func EnvMailTemplatesDir() string {
+	loadEnv()
+
+	return os.Getenv("MAIL_TEMPLATES_DIR")
+}
+
+// EnvActionTokenSecret returns the key signing password reset and email verification links
+func EnvActionTokenSecret() string {
+	loadEnv()
+
+	secret := os.Getenv("ACTION_TOKEN_SECRET")
+	if secret != "" && len(secret) < 32 {
+		log.Fatal("Invalid ACTION_TOKEN_SECRET, expected at least 32 characters")
+	}
+	return secret
+}
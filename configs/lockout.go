@@ -0,0 +1,17 @@
+package configs
+
+import (
+	"github.com/mattchw/go-onboard/lockout"
+)
+
+// Lockout slows down and locks accounts after failed attempts, shared by all replicas through Redis
+var Lockout lockout.Guard = lockout.NewRedisGuard(RDB, LoadLockoutPolicy())
+
+func LoadLockoutPolicy() lockout.Policy {
+	policy := lockout.DefaultPolicy
+	policy.MaxFailures = EnvCount("LOCKOUT_MAX_FAILURES", policy.MaxFailures)
+	policy.MaxIPFailures = EnvCount("LOCKOUT_MAX_IP_FAILURES", policy.MaxIPFailures)
+	policy.Window = EnvDuration("LOCKOUT_WINDOW", policy.Window)
+	policy.LockFor = EnvDuration("LOCKOUT_DURATION", policy.LockFor)
+	return policy
+}
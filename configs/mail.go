@@ -0,0 +1,65 @@
+package configs
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/mattchw/go-onboard/mail"
+	"github.com/mattchw/go-onboard/tokens"
+)
+
+// Mailer sends emails through SMTP_HOST, writes them to MAIL_DIR or, when
+// neither is set, logs them
+var Mailer mail.Mailer = LoadMailer()
+
+// MailTemplates render emails, MAIL_TEMPLATES_DIR replaces the built-in ones
+var MailTemplates *mail.Templates = LoadMailTemplates()
+
+func LoadMailer() mail.Mailer {
+	if smtp := EnvSMTPConfig(); smtp.Host != "" {
+		fmt.Println("Sending emails through", smtp.Host)
+		return mail.NewSMTPMailer(smtp)
+	}
+	if dir := EnvMailDir(); dir != "" {
+		mailer, err := mail.NewFileMailer(dir, EnvMailFrom())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Writing emails to", dir)
+		return mailer
+	}
+	fmt.Println("SMTP_HOST and MAIL_DIR are not set, logging emails instead of sending them")
+	return mail.NewLogMailer(nil)
+}
+
+func LoadMailTemplates() *mail.Templates {
+	dir := EnvMailTemplatesDir()
+	if dir == "" {
+		return mail.DefaultTemplates()
+	}
+	templates, err := mail.LoadTemplates(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return templates
+}
+
+// LoadActionTokens signs the single-use tokens of password reset and email
+// verification links with ACTION_TOKEN_SECRET, only the server sends them
+func LoadActionTokens() (*tokens.ActionSigner, error) {
+	secret := []byte(EnvActionTokenSecret())
+	if len(secret) == 0 {
+		if !EnvDevMode() {
+			return nil, errors.New("ACTION_TOKEN_SECRET is not set, set DEV_MODE=true to sign email links with a throwaway key")
+		}
+		// links sent before a restart stop working and other replicas reject them
+		fmt.Println("ACTION_TOKEN_SECRET is not set, signing email links with a throwaway key")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return tokens.NewActionSigner(secret, RDB), nil
+}
@@ -6,11 +6,13 @@ import (
 	"log"
 	"time"
 
+	"github.com/mattchw/go-onboard/tenancy"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// Client instance
+// Client instance, it connects in the background so nothing needs MongoDB
+// up front
 var DB *mongo.Client = ConnectDB()
 
 func ConnectDB() *mongo.Client {
@@ -19,19 +21,25 @@ func ConnectDB() *mongo.Client {
 		log.Fatal(err)
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	err = client.Connect(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return client
+}
 
-	// ping the database
-	err = client.Ping(ctx, nil)
-	if err != nil {
-		log.Fatal(err)
+// PingDB checks that MongoDB is reachable
+func PingDB() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := DB.Ping(ctx, nil); err != nil {
+		return err
 	}
 	fmt.Println("Connected to MongoDB")
-	return client
+	return nil
 }
 
 // getting database collections
@@ -39,3 +47,6 @@ func GetCollection(client *mongo.Client, collectionName string) *mongo.Collectio
 	collection := client.Database(EnvMongoDatabase()).Collection(collectionName)
 	return collection
 }
+
+// Tenants routes collections to the tenant of a request
+var Tenants *tenancy.Router = tenancy.NewRouter(DB, EnvMongoDatabase(), EnvTenancyMode())
@@ -0,0 +1,46 @@
+package configs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mattchw/go-onboard/oidc"
+)
+
+// OIDC verifies the access tokens of the company identity provider, nil when
+// OIDC_ISSUER is not set
+var OIDC *oidc.Verifier = LoadOIDC()
+
+func LoadOIDC() *oidc.Verifier {
+	issuer := EnvOIDCIssuer()
+	if issuer == "" {
+		return nil
+	}
+
+	roles := EnvOIDCRoleMap()
+	for _, mapping := range roles {
+		if _, err := Policy.Role(mapping.Role); err != nil {
+			log.Fatal("Invalid OIDC_ROLE_MAP: ", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	verifier, err := oidc.Discover(ctx, oidc.Config{
+		Issuer:         issuer,
+		Audience:       EnvOIDCAudience(),
+		RequiredScopes: EnvOIDCRequiredScopes(),
+		RoleClaim:      EnvOIDCRoleClaim(),
+		Roles:          roles,
+		UserClaim:      EnvOIDCUserClaim(),
+		TenantClaim:    EnvOIDCTenantClaim(),
+		Leeway:         EnvDuration("OIDC_LEEWAY", 30*time.Second),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Accepting tokens of", issuer)
+	return verifier
+}
@@ -0,0 +1,49 @@
+package configs
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/partners"
+)
+
+// Partners verifies the signed requests of partners, nil without PARTNERS_FILE
+var Partners *partners.Verifier = LoadPartners()
+
+func LoadPartners() *partners.Verifier {
+	path := EnvPartnersFile()
+	if path == "" {
+		return nil
+	}
+
+	registry, err := partners.Load(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for id, partner := range registry {
+		if partner.Role != "" {
+			if _, err := Policy.Role(partner.Role); err != nil {
+				log.Fatalf("partner %s: %v", id, err)
+			}
+		}
+		for _, scope := range partner.Scopes {
+			if !validScope(scope) {
+				log.Fatalf("partner %s: unknown scope %s", id, scope)
+			}
+		}
+	}
+
+	fmt.Println("Loaded", len(registry), "partners from", path)
+	return partners.NewVerifier(registry, partners.NewRedisNonces(RDB), EnvDuration("SIGNATURE_MAX_SKEW", 5*time.Minute))
+}
+
+func validScope(scope string) bool {
+	for _, known := range models.Scopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
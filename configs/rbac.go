@@ -0,0 +1,25 @@
+package configs
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mattchw/go-onboard/rbac"
+)
+
+// Policy defines the roles, their permissions and their field rules
+var Policy *rbac.Policy = LoadPolicy()
+
+func LoadPolicy() *rbac.Policy {
+	path := EnvRBACPolicyFile()
+	if path == "" {
+		return rbac.Default()
+	}
+
+	policy, err := rbac.Load(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Loaded roles", policy.RoleNames(), "from", path)
+	return policy
+}
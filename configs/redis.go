@@ -3,30 +3,35 @@ package configs
 import (
 	"context"
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/go-redis/redis/v9"
+	"github.com/mattchw/go-onboard/ratelimit"
 )
 
-// Client instance
-var RDB *redis.Client = ConnectRedis()
+// Client instance, it connects on first use so nothing needs Redis up front
+var RDB *redis.Client = NewRedisClient()
 
-func ConnectRedis() *redis.Client {
-	rdb := redis.NewClient(&redis.Options{
+func NewRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
 		Addr:     EnvRedisAddress(),
 		Password: "", // no password set
 		DB:       0,  // use default DB
 	})
+}
 
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+// PingRedis checks that Redis is reachable
+func PingRedis() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	// ping redis
-	res, err := rdb.Ping(ctx).Result()
+	res, err := RDB.Ping(ctx).Result()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-
 	fmt.Println("Connected to Redis", res)
-	return rdb
+	return nil
 }
+
+// RateLimiter shares rate limits between all replicas through Redis
+var RateLimiter ratelimit.Limiter = ratelimit.NewRedisLimiter(RDB)
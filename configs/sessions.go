@@ -0,0 +1,27 @@
+package configs
+
+import (
+	"time"
+
+	"github.com/mattchw/go-onboard/sessions"
+)
+
+// SessionStore keeps the cookie sessions of the admin console in Redis
+var SessionStore *sessions.RedisStore = sessions.NewRedisStore(RDB,
+	EnvDuration("SESSION_IDLE_TIMEOUT", 30*time.Minute),
+	EnvDuration("SESSION_LIFETIME", 12*time.Hour),
+)
+
+// SessionCookieSecure marks session cookies for HTTPS only
+var SessionCookieSecure bool = EnvSessionCookieSecure()
+
+// SessionCookie names the session cookie. With the __Host- prefix browsers
+// only keep it when it is secure and set for the whole host, not a subdomain.
+var SessionCookie string = sessionCookie()
+
+func sessionCookie() string {
+	if SessionCookieSecure {
+		return "__Host-session"
+	}
+	return "session"
+}
@@ -0,0 +1,57 @@
+package configs
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mattchw/go-onboard/tokens"
+)
+
+// TokenStore keeps refresh token sessions and revoked access tokens in Redis
+var TokenStore tokens.Store = tokens.NewRedisStore(RDB, EnvDuration("JWT_REFRESH_TTL", 30*24*time.Hour))
+
+// LoadTokenIssuer signs access tokens with the keys of LoadTokenKeys, only the
+// server loads them so the other commands run without JWT_KEYS_DIR
+func LoadTokenIssuer() *tokens.Issuer {
+	return tokens.NewIssuer(LoadTokenKeys(), EnvJWTIssuer(), EnvDuration("JWT_ACCESS_TTL", 15*time.Minute))
+}
+
+func LoadTokenKeys() *tokens.Keyring {
+	dir := EnvJWTKeysDir()
+	if dir == "" {
+		if !EnvDevMode() {
+			log.Fatal("JWT_KEYS_DIR is not set, set DEV_MODE=true to sign tokens with a throwaway key")
+		}
+		// tokens do not survive a restart and other replicas reject them
+		fmt.Println("JWT_KEYS_DIR is not set, signing tokens with a throwaway key")
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		key, err := tokens.NewKey("ephemeral", private)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return tokens.NewKeyring(key)
+	}
+
+	keyring, err := tokens.LoadKeyring(dir, EnvJWTSigningKey())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// pick up rotated keys without a restart
+	go func() {
+		for range time.Tick(time.Minute) {
+			if err := keyring.Reload(dir, EnvJWTSigningKey()); err != nil {
+				log.Printf("failed to reload token keys: %v", err)
+			}
+		}
+	}()
+
+	fmt.Println("Signing tokens with key", keyring.ActiveKeyId())
+	return keyring
+}
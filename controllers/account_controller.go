@@ -0,0 +1,214 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/encryption"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/passwords"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/services"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Accounts authenticates requests and manages the admin accounts
+var Accounts *services.AccountServiceImpl
+
+func newAccountService(keyring *encryption.Keyring) *services.AccountServiceImpl {
+	accounts := services.NewAccountServiceImpl(configs.GetCollection(configs.DB, "accounts")).
+		WithLockout(configs.Lockout, auditService).
+		WithKeyring(keyring).
+		WithVerifyCache(passwords.NewVerifyCache(configs.EnvCount("PASSWORD_CACHE_SIZE", 10000), configs.EnvDuration("PASSWORD_CACHE_TTL", time.Minute)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := accounts.EnsureIndexes(ctx); err != nil {
+		log.Fatal(err)
+	}
+	return accounts
+}
+
+func CreateAccount(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(callerScope(c), 10*time.Second)
+	defer cancel()
+
+	var input models.AccountInput
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	// accounts were all admins before roles existed, it stays the default
+	if input.Role == "" {
+		input.Role = models.RoleAdmin
+	}
+	if _, err := configs.Policy.Role(input.Role); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Unknown role")
+	}
+
+	account, err := Accounts.Create(ctx, input, input.Role)
+	if err != nil {
+		return accountError(c, err, "Error creating account")
+	}
+
+	audit(ctx, c, "account.create", account.Id.Hex(), map[string]interface{}{
+		"username": account.Username,
+		"role":     account.Role,
+		"tenants":  account.Tenants,
+	})
+	sendVerification(ctx, account)
+	return responses.Success(c, http.StatusCreated, "Account created successfully", account)
+}
+
+func GetAccounts(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(callerScope(c), 10*time.Second)
+	defer cancel()
+
+	accounts, err := Accounts.List(ctx)
+	if err != nil {
+		return responses.Error(c, http.StatusInternalServerError, "Error getting accounts")
+	}
+	return responses.List(c, http.StatusOK, "Accounts retrieved successfully", accounts, nil)
+}
+
+func GetAccount(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(callerScope(c), 10*time.Second)
+	defer cancel()
+
+	accountId, err := primitive.ObjectIDFromHex(c.Params("accountId"))
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid account id")
+	}
+
+	account, err := Accounts.Get(ctx, accountId)
+	if err != nil {
+		return accountError(c, err, "Error getting account")
+	}
+	return responses.Success(c, http.StatusOK, "Account retrieved successfully", account)
+}
+
+// UpdateAccount changes the password or role of an account, or disables it
+func UpdateAccount(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(callerScope(c), 10*time.Second)
+	defer cancel()
+
+	accountId, err := primitive.ObjectIDFromHex(c.Params("accountId"))
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid account id")
+	}
+	var input models.AccountInput
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+	if input.Disabled != nil && *input.Disabled && isCaller(c, accountId) {
+		return responses.Error(c, http.StatusConflict, "Accounts cannot disable themselves")
+	}
+	if input.Role != "" {
+		if _, err := configs.Policy.Role(input.Role); err != nil {
+			return responses.Error(c, http.StatusBadRequest, "Unknown role")
+		}
+		if isCaller(c, accountId) {
+			return responses.Error(c, http.StatusConflict, "Accounts cannot change their own role")
+		}
+	}
+
+	account, err := Accounts.Update(ctx, accountId, input)
+	if err != nil {
+		return accountError(c, err, "Error updating account")
+	}
+
+	audit(ctx, c, "account.update", accountId.Hex(), map[string]interface{}{
+		"passwordChanged": input.Password != "",
+		"role":            account.Role,
+		"tenants":         account.Tenants,
+		"disabled":        account.Disabled,
+	})
+	if input.Email != "" {
+		sendVerification(ctx, account)
+	}
+	return responses.Success(c, http.StatusOK, "Account updated successfully", account)
+}
+
+func DeleteAccount(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(callerScope(c), 10*time.Second)
+	defer cancel()
+
+	accountId, err := primitive.ObjectIDFromHex(c.Params("accountId"))
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid account id")
+	}
+	// keeps at least one admin able to sign in
+	if isCaller(c, accountId) {
+		return responses.Error(c, http.StatusConflict, "Accounts cannot delete themselves")
+	}
+
+	if err := Accounts.Delete(ctx, accountId); err != nil {
+		return accountError(c, err, "Error deleting account")
+	}
+
+	audit(ctx, c, "account.delete", accountId.Hex(), nil)
+	return responses.Success(c, http.StatusOK, "Account deleted successfully", nil)
+}
+
+// UnlockAccount lifts the lock put on an account after failed attempts to sign in
+func UnlockAccount(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(callerScope(c), 10*time.Second)
+	defer cancel()
+
+	accountId, err := primitive.ObjectIDFromHex(c.Params("accountId"))
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid account id")
+	}
+	account, err := Accounts.Get(ctx, accountId)
+	if err != nil {
+		return accountError(c, err, "Error getting account")
+	}
+
+	lockedFor, err := Accounts.LockedFor(ctx, account)
+	if err == nil {
+		err = Accounts.Unlock(ctx, account)
+	}
+	if err != nil {
+		return responses.Error(c, http.StatusServiceUnavailable, "Error unlocking account")
+	}
+
+	audit(ctx, c, "account.unlock", accountId.Hex(), map[string]interface{}{
+		"username":  account.Username,
+		"wasLocked": lockedFor > 0,
+	})
+	return responses.Success(c, http.StatusOK, "Account unlocked successfully", account)
+}
+
+func isCaller(c *fiber.Ctx, accountId primitive.ObjectID) bool {
+	account, ok := c.Locals(middlewares.AccountKey).(*models.Account)
+	return ok && account.Id == accountId
+}
+
+// callerScope limits the accounts a request reaches to the tenants of the
+// calling account, callers without tenants reach every account
+func callerScope(c *fiber.Ctx) context.Context {
+	account := c.Locals(middlewares.AccountKey).(*models.Account)
+	return services.WithinTenants(c.UserContext(), account.Tenants)
+}
+
+func accountError(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, services.ErrAccountNotFound):
+		return responses.Error(c, http.StatusNotFound, "Account not found")
+	case errors.Is(err, services.ErrAccountExists):
+		return responses.Error(c, http.StatusConflict, err.Error())
+	case errors.Is(err, services.ErrTenantsOutOfScope):
+		return responses.Error(c, http.StatusForbidden, err.Error())
+	case errors.Is(err, services.ErrInvalidUsername), errors.Is(err, services.ErrInvalidEmail),
+		errors.Is(err, services.ErrInvalidUserId), errors.Is(err, services.ErrInvalidTenants),
+		errors.Is(err, passwords.ErrTooShort):
+		return responses.Error(c, http.StatusBadRequest, err.Error())
+	}
+	return responses.Error(c, http.StatusInternalServerError, message)
+}
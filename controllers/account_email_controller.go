@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/passwords"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/tokens"
+)
+
+// AccountEmails sends password reset and email verification links and consumes their tokens
+var AccountEmails *services.AccountEmailServiceImpl
+
+func newAccountEmailService(links *tokens.ActionSigner) *services.AccountEmailServiceImpl {
+	return services.NewAccountEmailServiceImpl(
+		Accounts, links, configs.Mailer, configs.MailTemplates, configs.EnvPublicURL(),
+	).WithTTLs(configs.EnvDuration("PASSWORD_RESET_TTL", time.Hour), configs.EnvDuration("EMAIL_VERIFICATION_TTL", 48*time.Hour))
+}
+
+// RequestPasswordReset emails a reset link to the accounts with a verified
+// address. The response is the same whether there are any, and the emails
+// are sent after it so its timing tells nothing either.
+func RequestPasswordReset(c *fiber.Ctx) error {
+	var input models.PasswordResetRequest
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := AccountEmails.RequestPasswordReset(ctx, input.Email); err != nil {
+			log.Printf("failed to send password reset links: %v", err)
+		}
+	}()
+
+	return responses.Success(c, http.StatusAccepted, "If the address belongs to an account, a reset link was sent to it", nil)
+}
+
+// ResetPassword sets a new password with the token of a reset link. The
+// account is signed out of its sessions and refresh tokens and unlocked.
+func ResetPassword(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var input models.PasswordResetInput
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	account, err := AccountEmails.ResetPassword(ctx, input.Token, input.Password)
+	if err != nil {
+		return actionError(c, err, "Error resetting password")
+	}
+
+	if _, err := Sessions.RevokeAll(ctx, account.Id); err != nil {
+		log.Printf("failed to revoke sessions of %s after a password reset: %v", account.Username, err)
+	}
+	if _, err := Auth.RevokeAll(ctx, account.Id); err != nil {
+		log.Printf("failed to revoke refresh tokens of %s after a password reset: %v", account.Username, err)
+	}
+	if err := Accounts.Unlock(ctx, account); err != nil {
+		log.Printf("failed to unlock %s after a password reset: %v", account.Username, err)
+	}
+
+	c.Locals("username", account.Username)
+	audit(ctx, c, "account.password_reset", account.Id.Hex(), nil)
+	return responses.Success(c, http.StatusOK, "Password reset successfully", nil)
+}
+
+// SendEmailVerification emails the caller a link verifying their address
+func SendEmailVerification(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 30*time.Second)
+	defer cancel()
+
+	account := c.Locals(middlewares.AccountKey).(*models.Account)
+	if err := AccountEmails.SendVerification(ctx, account); err != nil {
+		return actionError(c, err, "Error sending verification email")
+	}
+	return responses.Success(c, http.StatusAccepted, "Verification email sent", nil)
+}
+
+// VerifyEmail marks an address verified with the token of a verification link
+func VerifyEmail(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var input models.EmailVerificationInput
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	account, err := AccountEmails.VerifyEmail(ctx, input.Token)
+	if err != nil {
+		return actionError(c, err, "Error verifying email")
+	}
+
+	c.Locals("username", account.Username)
+	audit(ctx, c, "account.email_verify", account.Id.Hex(), map[string]interface{}{"email": account.Email})
+	return responses.Success(c, http.StatusOK, "Email verified successfully", account)
+}
+
+// sendVerification emails a new address its verification link, failures
+// are logged and the link can be asked for again
+func sendVerification(ctx context.Context, account *models.Account) {
+	if account.Email == "" || account.EmailVerified {
+		return
+	}
+	if err := AccountEmails.SendVerification(ctx, account); err != nil {
+		log.Printf("failed to send verification email to %s: %v", account.Username, err)
+	}
+}
+
+func actionError(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, tokens.ErrInvalidAction), errors.Is(err, tokens.ErrActionUsed):
+		return responses.Error(c, http.StatusBadRequest, "Invalid or expired token")
+	case errors.Is(err, passwords.ErrTooShort):
+		return responses.Error(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, services.ErrNoEmail), errors.Is(err, services.ErrEmailVerified):
+		return responses.Error(c, http.StatusConflict, err.Error())
+	}
+	return responses.Error(c, http.StatusServiceUnavailable, message)
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/services"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APIKeys authenticates service-to-service clients and manages their keys
+var APIKeys *services.APIKeyServiceImpl
+
+func newAPIKeyService() *services.APIKeyServiceImpl {
+	keys := services.NewAPIKeyServiceImpl(configs.GetCollection(configs.DB, "api_keys"), configs.RDB)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := keys.EnsureIndexes(ctx); err != nil {
+		log.Fatal(err)
+	}
+	return keys
+}
+
+// CreateAPIKey returns the new key, it is the only time the key is shown
+func CreateAPIKey(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var input models.APIKeyInput
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	if input.Role != "" {
+		if _, err := configs.Policy.Role(input.Role); err != nil {
+			return responses.Error(c, http.StatusBadRequest, "Unknown role")
+		}
+	}
+
+	key, err := APIKeys.Create(ctx, input, actor(c))
+	if err != nil {
+		return apiKeyError(c, err, "Error creating API key")
+	}
+
+	audit(ctx, c, "apikey.create", key.Id.Hex(), map[string]interface{}{
+		"name":   key.Name,
+		"prefix": key.Prefix,
+		"role":   key.Role,
+		"scopes": key.Scopes,
+	})
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return responses.Success(c, http.StatusCreated, "API key created successfully", key)
+}
+
+func GetAPIKeys(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	keys, err := APIKeys.List(ctx)
+	if err != nil {
+		return responses.Error(c, http.StatusInternalServerError, "Error getting API keys")
+	}
+	return responses.List(c, http.StatusOK, "API keys retrieved successfully", keys, nil)
+}
+
+// RevokeAPIKey stops the key from working at once, on every replica
+func RevokeAPIKey(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	keyId, err := primitive.ObjectIDFromHex(c.Params("keyId"))
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid API key id")
+	}
+
+	if err := APIKeys.Revoke(ctx, keyId); err != nil {
+		return apiKeyError(c, err, "Error revoking API key")
+	}
+
+	audit(ctx, c, "apikey.revoke", keyId.Hex(), nil)
+	return responses.Success(c, http.StatusOK, "API key revoked successfully", nil)
+}
+
+func apiKeyError(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, services.ErrAPIKeyNotFound):
+		return responses.Error(c, http.StatusNotFound, "API key not found")
+	case errors.Is(err, services.ErrInvalidScope), errors.Is(err, services.ErrAPIKeyName), errors.Is(err, services.ErrAPIKeyExpired):
+		return responses.Error(c, http.StatusBadRequest, err.Error())
+	}
+	return responses.Error(c, http.StatusInternalServerError, message)
+}
@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/lockout"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/tokens"
+)
+
+// Auth issues, refreshes and revokes tokens, it verifies them for middlewares.VerifyToken
+var Auth *services.AuthServiceImpl
+
+// Login exchanges the credentials of an account for an access and a refresh token
+func Login(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var input models.LoginInput
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	pair, err := Auth.Login(ctx, input)
+	if err != nil {
+		return tokenError(c, err, "Error signing in")
+	}
+
+	c.Locals("username", input.Username)
+	audit(ctx, c, "auth.login", input.Username, nil)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return responses.Success(c, http.StatusOK, "Signed in successfully", pair)
+}
+
+// RefreshToken exchanges a refresh token for a new pair, the old refresh token stops working
+func RefreshToken(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var input models.RefreshInput
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	pair, err := Auth.Refresh(ctx, input.RefreshToken)
+	if err != nil {
+		return tokenError(c, err, "Error refreshing token")
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return responses.Success(c, http.StatusOK, "Token refreshed successfully", pair)
+}
+
+// Logout ends the session of the refresh token and revokes the access token of the request
+func Logout(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var input models.RefreshInput
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	claims, _ := c.Locals(middlewares.ClaimsKey).(map[string]interface{})
+	if err := Auth.Logout(ctx, input.RefreshToken, claims); err != nil {
+		return responses.Error(c, http.StatusServiceUnavailable, "Error signing out")
+	}
+
+	if claims != nil {
+		audit(ctx, c, "auth.logout", actor(c), nil)
+	}
+	return responses.Success(c, http.StatusOK, "Signed out successfully", nil)
+}
+
+func tokenError(c *fiber.Ctx, err error, message string) error {
+	var throttled *lockout.ThrottledError
+	if errors.As(err, &throttled) {
+		return middlewares.TooManyAttempts(c, throttled)
+	}
+	switch {
+	case errors.Is(err, services.ErrInvalidCredential):
+		return responses.Error(c, http.StatusUnauthorized, "Invalid username or password")
+	case errors.Is(err, services.ErrOTPRequired):
+		return responses.Error(c, http.StatusUnauthorized, "Two-factor authentication code required")
+	case errors.Is(err, services.ErrInvalidOTP):
+		return responses.Error(c, http.StatusUnauthorized, "Invalid two-factor authentication code")
+	case errors.Is(err, tokens.ErrInvalidRefresh), errors.Is(err, tokens.ErrRefreshReused):
+		return responses.Error(c, http.StatusUnauthorized, "Invalid or expired refresh token")
+	}
+	return responses.Error(c, http.StatusServiceUnavailable, message)
+}
@@ -0,0 +1,24 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/responses"
+)
+
+// GetCacheStats reports the hits and misses of each cache tier on this replica
+func GetCacheStats(c *fiber.Ctx) error {
+	stats := map[string]interface{}{
+		"backend": configs.CacheBackend,
+		"caches": map[string]interface{}{
+			"users": usersCache.Stats(),
+			"user":  userCache.Stats(),
+		},
+	}
+	if localCache != nil {
+		stats["local"] = localCache.Stats()
+	}
+	return responses.Success(c, http.StatusOK, "Cache stats retrieved successfully", stats)
+}
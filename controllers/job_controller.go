@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/jobs"
+	"github.com/mattchw/go-onboard/responses"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// JobManager is shared by the job endpoints and the in-process workers
+var JobManager *jobs.Manager
+
+func newJobManager() *jobs.Manager {
+	jobs.RegisterUserJobs(userService, allUsersChanged)
+
+	manager, err := jobs.NewManager(configs.DB.Database(configs.EnvMongoDatabase()), configs.RDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return manager
+}
+
+type createJobRequest struct {
+	Type   string                 `json:"type" xml:"type"`
+	Params map[string]interface{} `json:"params" xml:"-"`
+}
+
+func CreateJob(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var request createJobRequest
+	if err := responses.Bind(c, &request); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	job, err := JobManager.Enqueue(ctx, request.Type, request.Params)
+	if errors.Is(err, jobs.ErrUnknownType) {
+		return responses.Error(c, http.StatusBadRequest, "Unknown job type", jobs.Types())
+	}
+	if errors.Is(err, jobs.ErrInvalidParams) {
+		return responses.Error(c, http.StatusBadRequest, "Invalid job params", err.Error())
+	}
+	if err != nil {
+		return responses.Error(c, http.StatusInternalServerError, "Error creating job")
+	}
+
+	c.Location("/jobs/" + job.Id.Hex())
+	return responses.Success(c, http.StatusAccepted, "Job queued successfully", job)
+}
+
+func GetJob(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	jobId, err := primitive.ObjectIDFromHex(c.Params("jobId"))
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid job id")
+	}
+
+	job, err := JobManager.Get(ctx, jobId)
+	if errors.Is(err, jobs.ErrNotFound) {
+		return responses.Error(c, http.StatusNotFound, "Job not found")
+	}
+	if err != nil {
+		return responses.Error(c, http.StatusInternalServerError, "Error getting job")
+	}
+
+	return responses.Success(c, http.StatusOK, "Job retrieved successfully", job)
+}
+
+func CancelJob(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	jobId, err := primitive.ObjectIDFromHex(c.Params("jobId"))
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid job id")
+	}
+
+	job, err := JobManager.Cancel(ctx, jobId)
+	if errors.Is(err, jobs.ErrNotFound) {
+		return responses.Error(c, http.StatusNotFound, "Job not found")
+	}
+	if errors.Is(err, jobs.ErrFinished) {
+		return responses.Error(c, http.StatusConflict, "Job already finished")
+	}
+	if err != nil {
+		return responses.Error(c, http.StatusInternalServerError, "Error cancelling job")
+	}
+
+	return responses.Success(c, http.StatusAccepted, "Job cancellation requested", job)
+}
+
+// GetJobResult streams the artifact stored in GridFS by a succeeded job
+func GetJobResult(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	jobId, err := primitive.ObjectIDFromHex(c.Params("jobId"))
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid job id")
+	}
+
+	stream, _, err := JobManager.OpenResult(ctx, jobId)
+	if errors.Is(err, jobs.ErrNotFound) {
+		return responses.Error(c, http.StatusNotFound, "Job not found")
+	}
+	if errors.Is(err, jobs.ErrNoResult) {
+		return responses.Error(c, http.StatusConflict, "Job has no result")
+	}
+	if err != nil {
+		return responses.Error(c, http.StatusInternalServerError, "Error getting job result")
+	}
+
+	file := stream.GetFile()
+	contentType := fiber.MIMEOctetStream
+	if value, err := file.Metadata.LookupErr("contentType"); err == nil {
+		if str, ok := value.StringValueOK(); ok {
+			contentType = str
+		}
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Attachment(file.Name)
+	return c.Status(http.StatusOK).SendStream(io.Reader(stream), int(file.Length))
+}
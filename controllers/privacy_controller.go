@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/services"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var auditService *services.AuditServiceImpl
+
+// ExportUserData returns a zip with every piece of personal data held about a user
+func ExportUserData(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	userId, err := primitive.ObjectIDFromHex(c.Params("userId"))
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid user id")
+	}
+
+	privacyService := services.NewPrivacyServiceImpl(configs.Tenants, userService, configs.DB.Database(configs.EnvMongoDatabase()))
+	archive, err := privacyService.Export(ctx, userId)
+	if errors.Is(err, services.ErrUserNotFound) {
+		return responses.Error(c, http.StatusNotFound, "User not found")
+	}
+	if err != nil {
+		return responses.Error(c, http.StatusInternalServerError, "Error exporting user data")
+	}
+
+	audit(ctx, c, "user.data_export", userId.Hex(), nil)
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Attachment("user-" + userId.Hex() + ".zip")
+	return c.Status(http.StatusOK).Send(archive)
+}
+
+// EraseUser anonymizes the personal data of a user everywhere it is stored
+func EraseUser(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	userId, err := primitive.ObjectIDFromHex(c.Params("userId"))
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid user id")
+	}
+
+	privacyService := services.NewPrivacyServiceImpl(configs.Tenants, userService, configs.DB.Database(configs.EnvMongoDatabase()))
+	tombstone, alreadyErased, err := privacyService.Erase(ctx, userId, actor(c))
+	if errors.Is(err, services.ErrUserNotFound) {
+		return responses.Error(c, http.StatusNotFound, "User not found")
+	}
+	if err != nil {
+		return responses.Error(c, http.StatusInternalServerError, "Error erasing user")
+	}
+
+	// cached user lists still hold the erased data
+	usersChanged(ctx, userId)
+
+	audit(ctx, c, "user.erase", userId.Hex(), map[string]interface{}{
+		"alreadyErased": alreadyErased,
+	})
+
+	return responses.Success(c, http.StatusOK, "User erased successfully", tombstone)
+}
+
+// actor names the authenticated caller for the audit log
+func actor(c *fiber.Ctx) string {
+	if username, ok := c.Locals("username").(string); ok && username != "" {
+		return username
+	}
+	return "anonymous"
+}
+
+// audit failures are logged, they must not fail a request that already took effect
+func audit(ctx context.Context, c *fiber.Ctx, action string, target string, details map[string]interface{}) {
+	err := auditService.Record(ctx, models.AuditEvent{
+		Action:  action,
+		Actor:   actor(c),
+		Target:  target,
+		Details: details,
+	})
+	if err != nil {
+		log.Printf("failed to record audit event %s on %s: %v", action, target, err)
+	}
+}
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Sessions signs the admin console in with cookies, it resolves them for middlewares.VerifySession
+var Sessions *services.SessionServiceImpl
+
+// SessionLogin exchanges the credentials of an account for a session cookie,
+// the response holds the CSRF token of the session
+func SessionLogin(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var input models.LoginInput
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	token, session, err := Sessions.Login(ctx, input, c.Get(fiber.HeaderUserAgent), middlewares.ClientAddress(c))
+	if err != nil {
+		return tokenError(c, err, "Error signing in")
+	}
+
+	c.Cookie(sessionCookie(token, session.ExpiresAt))
+	c.Locals("username", input.Username)
+	audit(ctx, c, "auth.login", input.Username, map[string]interface{}{"session": session.Id})
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return responses.Success(c, http.StatusOK, "Signed in successfully", session)
+}
+
+// GetCurrentSession returns the session of the request with its CSRF token,
+// for a console reloaded while signed in
+func GetCurrentSession(c *fiber.Ctx) error {
+	session, ok := c.Locals(middlewares.SessionKey).(*sessions.Session)
+	if !ok {
+		return responses.Error(c, http.StatusUnauthorized, "Not signed in")
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	current := *session
+	current.Current = true
+	return responses.Success(c, http.StatusOK, "Session retrieved successfully", current)
+}
+
+// SessionLogout ends the session of the request and clears its cookie
+func SessionLogout(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	session, ok := c.Locals(middlewares.SessionKey).(*sessions.Session)
+	if !ok {
+		return responses.Error(c, http.StatusUnauthorized, "Not signed in")
+	}
+	account := c.Locals(middlewares.AccountKey).(*models.Account)
+
+	if err := Sessions.Revoke(ctx, account.Id, session.Id); err != nil && !errors.Is(err, sessions.ErrNoSession) {
+		return responses.Error(c, http.StatusServiceUnavailable, "Error signing out")
+	}
+
+	c.Cookie(sessionCookie("", time.Unix(0, 0)))
+	audit(ctx, c, "auth.logout", actor(c), map[string]interface{}{"session": session.Id})
+	return responses.Success(c, http.StatusOK, "Signed out successfully", nil)
+}
+
+// GetSessions lists the active sessions of the caller
+func GetSessions(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	account := c.Locals(middlewares.AccountKey).(*models.Account)
+	list, err := Sessions.List(ctx, account.Id)
+	if err != nil {
+		return responses.Error(c, http.StatusServiceUnavailable, "Error getting sessions")
+	}
+
+	if current, ok := c.Locals(middlewares.SessionKey).(*sessions.Session); ok {
+		for i := range list {
+			list[i].Current = list[i].Id == current.Id
+		}
+	}
+	return responses.List(c, http.StatusOK, "Sessions retrieved successfully", list, nil)
+}
+
+// RevokeSession ends one of the sessions of the caller, like one left signed in on another device
+func RevokeSession(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	account := c.Locals(middlewares.AccountKey).(*models.Account)
+	sessionId := c.Params("sessionId")
+	if err := Sessions.Revoke(ctx, account.Id, sessionId); err != nil {
+		return sessionError(c, err, "Error revoking session")
+	}
+
+	audit(ctx, c, "session.revoke", sessionId, nil)
+	return responses.Success(c, http.StatusOK, "Session revoked successfully", nil)
+}
+
+// RevokeAccountSessions signs an account out of every session, cookie and
+// refresh token alike
+func RevokeAccountSessions(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(callerScope(c), 10*time.Second)
+	defer cancel()
+
+	accountId, err := primitive.ObjectIDFromHex(c.Params("accountId"))
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid account id")
+	}
+	if _, err := Accounts.Get(ctx, accountId); err != nil {
+		return accountError(c, err, "Error getting account")
+	}
+
+	count, err := Sessions.RevokeAll(ctx, accountId)
+	if err != nil {
+		return sessionError(c, err, "Error revoking sessions")
+	}
+	families, err := Auth.RevokeAll(ctx, accountId)
+	if err != nil {
+		return sessionError(c, err, "Error revoking sessions")
+	}
+	count += families
+
+	audit(ctx, c, "session.revoke_all", accountId.Hex(), map[string]interface{}{"sessions": count})
+	return responses.Success(c, http.StatusOK, "Sessions revoked successfully", map[string]int{"revoked": count})
+}
+
+// sessionCookie is readable by no script and sent with no request from another site
+func sessionCookie(value string, expires time.Time) *fiber.Cookie {
+	return &fiber.Cookie{
+		Name:     configs.SessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   configs.SessionCookieSecure,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteStrictMode,
+	}
+}
+
+func sessionError(c *fiber.Ctx, err error, message string) error {
+	if errors.Is(err, sessions.ErrNoSession) {
+		return responses.Error(c, http.StatusNotFound, "Session not found")
+	}
+	return responses.Error(c, http.StatusServiceUnavailable, message)
+}
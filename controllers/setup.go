@@ -0,0 +1,34 @@
+package controllers
+
+import (
+	"github.com/mattchw/go-onboard/cache"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/encryption"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/tokens"
+)
+
+// Setup builds the services of the controllers, it runs before the routes
+// serve or the workers start. Importing the package connects to nothing.
+// keyring encrypts PII fields, nil without a master key, and caches keeps
+// cached reads with local in front of it, nil without an in-process tier.
+func Setup(keyring *encryption.Keyring, caches cache.Store, local *cache.Local) {
+	auditService = services.NewAuditServiceImpl(configs.GetCollection(configs.DB, "audit_log"))
+	userService = services.NewEncryptedUserServiceImpl(configs.Tenants.Source("users"), keyring)
+	usersCache = cache.New[[]services.UserDocument](caches, local)
+	userCache = cache.New[services.UserDocument](caches, local)
+	localCache = local
+
+	Accounts = newAccountService(keyring)
+	Sessions = services.NewSessionServiceImpl(Accounts, configs.SessionStore)
+	APIKeys = newAPIKeyService()
+	JobManager = newJobManager()
+}
+
+// SetupAuth builds the services signing access tokens with issuer and email
+// links with links, it runs after Setup. Only the server signs them, the
+// other commands skip it.
+func SetupAuth(issuer *tokens.Issuer, links *tokens.ActionSigner) {
+	Auth = services.NewAuthServiceImpl(Accounts, issuer, configs.TokenStore)
+	AccountEmails = newAccountEmailService(links)
+}
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/totp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// size in pixels of the QR code of an enrollment
+const qrCodeSize = 256
+
+// BeginTOTP starts setting up two-factor authentication for the caller, it is
+// enabled once ConfirmTOTP gets a code of the returned secret
+func BeginTOTP(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	account := c.Locals(middlewares.AccountKey).(*models.Account)
+	enrollment, err := Accounts.BeginTOTP(ctx, account, configs.EnvTOTPIssuer())
+	if err != nil {
+		return totpError(c, err, "Error setting up two-factor authentication")
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return responses.Success(c, http.StatusOK, "Two-factor authentication set up, confirm it with a code", enrollment)
+}
+
+// GetTOTPQRCode returns the pending secret of the caller as a PNG QR code
+func GetTOTPQRCode(c *fiber.Ctx) error {
+	account := c.Locals(middlewares.AccountKey).(*models.Account)
+	uri, err := Accounts.PendingTOTPURI(account, configs.EnvTOTPIssuer())
+	if err != nil {
+		return totpError(c, err, "Error getting QR code")
+	}
+	png, err := totp.QRCode(uri, qrCodeSize)
+	if err != nil {
+		return responses.Error(c, http.StatusInternalServerError, "Error getting QR code")
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set(fiber.HeaderContentType, "image/png")
+	return c.Status(http.StatusOK).Send(png)
+}
+
+// ConfirmTOTP enables two-factor authentication with a code of the pending secret
+func ConfirmTOTP(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var input models.TOTPInput
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	account := c.Locals(middlewares.AccountKey).(*models.Account)
+	codes, err := Accounts.ConfirmTOTP(ctx, account, input.Code)
+	if err != nil {
+		return totpError(c, err, "Error enabling two-factor authentication")
+	}
+
+	audit(ctx, c, "totp.enable", account.Id.Hex(), nil)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return responses.Success(c, http.StatusOK, "Two-factor authentication enabled", models.RecoveryCodes{Codes: codes})
+}
+
+// DisableTOTP turns two-factor authentication of the caller off, it takes a
+// current code or a recovery code
+func DisableTOTP(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var input models.TOTPInput
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	account := c.Locals(middlewares.AccountKey).(*models.Account)
+	if err := Accounts.DisableTOTP(ctx, account, input.Code); err != nil {
+		return totpError(c, err, "Error disabling two-factor authentication")
+	}
+
+	audit(ctx, c, "totp.disable", account.Id.Hex(), nil)
+	return responses.Success(c, http.StatusOK, "Two-factor authentication disabled", nil)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the caller
+func RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
+
+	var input models.TOTPInput
+	if err := responses.Bind(c, &input); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+
+	account := c.Locals(middlewares.AccountKey).(*models.Account)
+	codes, err := Accounts.RegenerateRecoveryCodes(ctx, account, input.Code)
+	if err != nil {
+		return totpError(c, err, "Error generating recovery codes")
+	}
+
+	audit(ctx, c, "totp.recovery_codes", account.Id.Hex(), nil)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return responses.Success(c, http.StatusOK, "Recovery codes generated successfully", models.RecoveryCodes{Codes: codes})
+}
+
+// ResetAccountTOTP turns two-factor authentication of an account off, for
+// someone who lost both their authenticator and their recovery codes
+func ResetAccountTOTP(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(callerScope(c), 10*time.Second)
+	defer cancel()
+
+	accountId, err := primitive.ObjectIDFromHex(c.Params("accountId"))
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid account id")
+	}
+	account, err := Accounts.Get(ctx, accountId)
+	if err != nil {
+		return accountError(c, err, "Error getting account")
+	}
+
+	if err := Accounts.ResetTOTP(ctx, account); err != nil {
+		return responses.Error(c, http.StatusInternalServerError, "Error resetting two-factor authentication")
+	}
+
+	audit(ctx, c, "totp.reset", accountId.Hex(), map[string]interface{}{
+		"username":   account.Username,
+		"wasEnabled": account.TOTPEnabled,
+	})
+	return responses.Success(c, http.StatusOK, "Two-factor authentication reset successfully", nil)
+}
+
+func totpError(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, services.ErrTOTPEnabled), errors.Is(err, services.ErrTOTPNotEnabled):
+		return responses.Error(c, http.StatusConflict, err.Error())
+	case errors.Is(err, services.ErrNoPendingTOTP):
+		return responses.Error(c, http.StatusNotFound, err.Error())
+	case errors.Is(err, services.ErrInvalidOTP):
+		return responses.Error(c, http.StatusBadRequest, "Invalid two-factor authentication code")
+	}
+	return responses.Error(c, http.StatusInternalServerError, message)
+}
@@ -1,237 +1,338 @@
 package controllers
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
-	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
+	"log"
 	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/cache"
+	"github.com/mattchw/go-onboard/middlewares"
 	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/rbac"
+	"github.com/mattchw/go-onboard/responses"
 	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/tenancy"
 
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var userCollection *mongo.Collection = configs.GetCollection(configs.DB, "users")
+// userService works on the users of the request's tenant and encrypts PII
+// fields when a master key is configured
+var userService *services.UserServiceImpl
 
-func CacheFetch(ctx context.Context, key string, ttl time.Duration, result interface{}, code func() interface{}) {
-	str, _ := configs.RDB.Get(ctx, key).Result()
-	if str == "" {
-		fmt.Println("---> cache miss")
-		value := code()
-		jsonStr, _ := json.Marshal(value)
-		str = string(jsonStr)
-		configs.RDB.Set(ctx, key, str, ttl).Result()
-	} else {
-		fmt.Println("---> cache exists")
+// usersCache keeps the user lists of GET /users for a few seconds, encrypted
+// like they are stored so the cache never holds PII in plaintext
+var usersCache *cache.Cache[[]services.UserDocument]
+
+// userCache keeps the users of GET /users/:userId, encrypted as well
+var userCache *cache.Cache[services.UserDocument]
+
+// localCache is the in-process tier in front of the caches, nil without one
+var localCache *cache.Local
+
+// entries are served stale for a while as they are loaded again, writes
+// invalidate them right away either way
+var (
+	usersTTL = cache.TTL{Soft: 10 * time.Second, Hard: time.Minute}
+	userTTL  = cache.TTL{Soft: 30 * time.Second, Hard: 5 * time.Minute}
+)
+
+// userTags are the cache tags of a single user, namespaced by tenant like the
+// keys. Single users are tagged user:<id>, lists users:list, and both users.
+func userTags(ctx context.Context, userId primitive.ObjectID) []string {
+	return []string{tenancy.Key(ctx, "user:"+userId.Hex()), tenancy.Key(ctx, "users")}
+}
+
+// userListTags are the cache tags of a user list
+func userListTags(ctx context.Context) []string {
+	return []string{tenancy.Key(ctx, "users:list"), tenancy.Key(ctx, "users")}
+}
+
+// usersChanged invalidates the cached lists and the cached entries of
+// userIds after a write committed. The write stands when this fails, the
+// entries then expire with their TTL.
+func usersChanged(ctx context.Context, userIds ...primitive.ObjectID) {
+	tags := []string{tenancy.Key(ctx, "users:list")}
+	for _, userId := range userIds {
+		tags = append(tags, tenancy.Key(ctx, "user:"+userId.Hex()))
 	}
+	if err := usersCache.Invalidate(ctx, tags...); err != nil {
+		log.Printf("failed to invalidate users cache: %v", err)
+	}
+}
 
-	json.Unmarshal([]byte(str), &result)
+// allUsersChanged invalidates every cached user entry of the tenant
+func allUsersChanged(ctx context.Context) {
+	if err := usersCache.Invalidate(ctx, tenancy.Key(ctx, "users")); err != nil {
+		log.Printf("failed to invalidate users cache: %v", err)
+	}
+}
+
+// callerRole returns the role middlewares.Permit authorized the request with,
+// its field rules apply to the users read and written
+func callerRole(c *fiber.Ctx) *rbac.Role {
+	role, _ := c.Locals(middlewares.RoleKey).(*rbac.Role)
+	return role
+}
+
+// userNotFound is also what policies.OwnUser answers for users of others
+// userError answers a failed call of the user service, a request whose tenant
+// cannot be used gets the same answer as from middlewares.ResolveTenant
+func userError(c *fiber.Ctx, err error, message string, details ...interface{}) error {
+	switch {
+	case errors.Is(err, tenancy.ErrNoTenant):
+		return responses.Error(c, http.StatusBadRequest, "Missing tenant")
+	case errors.Is(err, tenancy.ErrInvalidTenant):
+		return responses.Error(c, http.StatusBadRequest, "Invalid tenant")
+	}
+	return responses.Error(c, http.StatusInternalServerError, message, details...)
+}
+
+func userNotFound(c *fiber.Ctx) error {
+	return responses.Error(c, http.StatusNotFound, "User not found")
+}
+
+func fieldForbidden(c *fiber.Ctx, err error) error {
+	var fieldErr *rbac.FieldError
+	if errors.As(err, &fieldErr) {
+		return responses.Error(c, http.StatusForbidden, "Field "+fieldErr.Field+" cannot be written")
+	}
+	return responses.Error(c, http.StatusForbidden, "Forbidden")
 }
 
 func GetUsers(c *fiber.Ctx) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	var users []models.User
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
 	defer cancel()
 
-	CacheFetch(ctx, "users", 10*time.Second, &users, func() interface{} {
-		// find all users
-		results, err := userCollection.Find(ctx, bson.M{})
-		if err != nil {
-			return c.Status(http.StatusInternalServerError).JSON(
-				fiber.Map{
-					"status":  "error",
-					"message": "Error getting user",
-				})
-		}
+	// tenants share redis, their lists are cached under separate keys
+	docs, err := usersCache.GetOrLoad(ctx, tenancy.Key(ctx, "users"), usersTTL, func(ctx context.Context) ([]services.UserDocument, error) {
+		return userService.FindDocuments(ctx, models.UserFilter{})
+	}, userListTags(ctx)...)
+	if err != nil {
+		return userError(c, err, "Error getting user")
+	}
+	users, err := userService.DecodeAll(docs)
+	if err != nil {
+		return userError(c, err, "Error getting user")
+	}
 
-		// decode all users
-		defer results.Close(ctx)
-		for results.Next(ctx) {
-			var user models.User
-			if err = results.Decode(&user); err != nil {
-				return c.Status(http.StatusInternalServerError).JSON(
-					fiber.Map{
-						"status":  "error",
-						"message": "Error decoding user",
-					})
-			}
-
-			users = append(users, user)
-		}
+	callerRole(c).Redact(users)
+	return responses.List(c, http.StatusOK, "User retrieved successfully", users, nil)
+}
+
+// GetUsersPage lists users one page at a time, it serves GET /users from v2 on
+func GetUsersPage(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
+	defer cancel()
 
-		users_json, _ := json.Marshal(users)
+	page, pageErr := strconv.ParseInt(c.Query("page", "1"), 10, 64)
+	limit, limitErr := strconv.ParseInt(c.Query("limit", "20"), 10, 64)
+	if pageErr != nil || limitErr != nil || page < 1 || limit < 1 || limit > 100 {
+		return responses.Error(c, http.StatusBadRequest, "Invalid pagination parameters")
+	}
 
-		// set redis cache for 30 seconds
-		err = configs.RDB.Set(ctx, "users", users_json, 0).Err()
-		if err != nil {
-			panic(err)
-		}
+	total, err := userService.Count(ctx, models.UserFilter{})
+	if err != nil {
+		return userError(c, err, "Error getting user count")
+	}
 
-		return users
-	})
+	findOptions := options.Find().
+		SetSort(bson.M{"_id": 1}).
+		SetSkip((page - 1) * limit).
+		SetLimit(limit)
+	users, err := userService.Find(ctx, models.UserFilter{}, findOptions)
+	if err != nil {
+		return userError(c, err, "Error getting user")
+	}
 
-	return c.Status(http.StatusOK).JSON(
-		fiber.Map{
-			"status":  "success",
-			"message": "User retrieved successfully",
-			"items":   users,
-		})
+	callerRole(c).Redact(users)
+	return responses.List(c, http.StatusOK, "User retrieved successfully", users, &responses.PageMeta{
+		Page:  page,
+		Limit: limit,
+		Total: total,
+	})
 }
 
 func GetUsersCount(c *fiber.Ctx) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
 	defer cancel()
 
-	count, err := userCollection.CountDocuments(ctx, bson.M{})
+	count, err := userService.Count(ctx, models.UserFilter{})
 	if err != nil {
-		return c.Status(http.StatusInternalServerError).JSON(
-			fiber.Map{
-				"status":  "error",
-				"message": "Error getting user count",
-			})
+		return userError(c, err, "Error getting user count")
 	}
 
-	return c.Status(http.StatusOK).JSON(
-		fiber.Map{
-			"status":  "success",
-			"message": "User count retrieved successfully",
-			"data":    count,
-		})
+	return responses.Success(c, http.StatusOK, "User count retrieved successfully", count)
+}
+
+// ExportUsers streams the users matching the query filters as newline-delimited JSON
+func ExportUsers(c *fiber.Ctx) error {
+	var filter models.UserFilter
+	if err := c.QueryParser(&filter); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid filter", err.Error())
+	}
+
+	compress := c.AcceptsEncodings("gzip") == "gzip"
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	c.Vary(fiber.HeaderAcceptEncoding)
+	if compress {
+		c.Set(fiber.HeaderContentEncoding, "gzip")
+	}
+
+	// the writer runs after the handler returned, so it must not touch c
+	base := c.UserContext()
+	c.Status(http.StatusOK).Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithCancel(base)
+		defer cancel()
+
+		var out io.Writer = w
+		if compress {
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+
+		count, err := userService.Export(ctx, filter, out)
+		if err != nil {
+			log.Printf("user export aborted after %d users: %v", count, err)
+		}
+	})
+
+	return nil
 }
 
 func CreateUser(c *fiber.Ctx) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
 	defer cancel()
 	var user models.User
 
 	// validate the request body
-	if err := c.BodyParser(&user); err != nil {
-		return c.Status(http.StatusBadRequest).JSON(
-			fiber.Map{
-				"status":  "error",
-				"message": "Invalid request body",
-				"error":   err,
-			})
+	if err := responses.Bind(c, &user); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+	}
+	if err := callerRole(c).CheckWrite(&user); err != nil {
+		return fieldForbidden(c, err)
 	}
 
 	// create the user by using user service
-	userService := services.NewUserServiceImpl(
-		configs.GetCollection(configs.DB, "users"),
-	)
-	result := userService.Create(ctx, user)
+	result, err := userService.Create(ctx, user)
+	if errors.Is(err, services.ErrInvalidUser) {
+		return responses.Error(c, http.StatusBadRequest, "Invalid user", err.Error())
+	}
+	if err != nil {
+		return userError(c, err, "Error creating user")
+	}
+	usersChanged(ctx)
 
-	return c.Status(http.StatusCreated).JSON(
-		fiber.Map{
-			"status":  "success",
-			"message": "User created successfully",
-			"data":    result,
-		})
+	return responses.Success(c, http.StatusCreated, "User created successfully", result)
 }
 
 func GetUser(c *fiber.Ctx) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
 	userId := c.Params("userId")
-	var user models.User
 	defer cancel()
 
-	objId, _ := primitive.ObjectIDFromHex(userId)
+	objId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid user id")
+	}
 
-	err := userCollection.FindOne(ctx, bson.M{"_id": objId}).Decode(&user)
+	doc, err := userCache.GetOrLoad(ctx, tenancy.Key(ctx, "user:"+objId.Hex()), userTTL, func(ctx context.Context) (services.UserDocument, error) {
+		return userService.FindOneDocument(ctx, objId)
+	}, userTags(ctx, objId)...)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return userNotFound(c)
+	}
 	if err != nil {
-		return c.Status(http.StatusInternalServerError).JSON(
-			fiber.Map{
-				"status":  "error",
-				"message": "Error getting user",
-			})
+		return userError(c, err, "Error getting user")
+	}
+	user, err := userService.Decode(doc)
+	if err != nil {
+		return userError(c, err, "Error getting user")
 	}
 
-	return c.Status(http.StatusOK).JSON(
-		fiber.Map{
-			"status":  "success",
-			"message": "User retrieved successfully",
-			"data":    user,
-		})
+	callerRole(c).Redact(&user)
+	return responses.Success(c, http.StatusOK, "User retrieved successfully", user)
 }
 
 func UpdateUser(c *fiber.Ctx) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
 	userId := c.Params("userId")
 	var user models.User
 	defer cancel()
 
-	objId, _ := primitive.ObjectIDFromHex(userId)
+	objId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid user id")
+	}
 
 	// validate the request body
-	if err := c.BodyParser(&user); err != nil {
-		return c.Status(http.StatusBadRequest).JSON(
-			fiber.Map{
-				"status":  "error",
-				"message": "Invalid request body",
-			})
-	}
-
-	result, err := userCollection.UpdateOne(ctx, bson.M{"_id": objId}, bson.M{
-		"$set": bson.M{
-			"firstName": user.FirstName,
-			"lastName":  user.LastName,
-			"bio":       user.Bio,
-			"age":       user.Age,
-		},
-	})
+	if err := responses.Bind(c, &user); err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body")
+	}
+
+	// updates replace every field, the ones the caller cannot write keep their value
+	role := callerRole(c)
+	if err := role.CheckWrite(&user); err != nil {
+		return fieldForbidden(c, err)
+	}
+	if role.Restricts() {
+		current, err := userService.FindOne(ctx, objId)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return userNotFound(c)
+		}
+		if err != nil {
+			return userError(c, err, "Error getting user")
+		}
+		role.Protect(&user, &current)
+	}
+
+	result, err := userService.Update(ctx, objId, user)
 	if err != nil {
-		return c.Status(http.StatusInternalServerError).JSON(
-			fiber.Map{
-				"status":  "error",
-				"message": "Error updating user",
-				"error":   err,
-			})
+		return userError(c, err, "Error updating user", err.Error())
 	}
+	if result.MatchedCount == 0 {
+		return userNotFound(c)
+	}
+	usersChanged(ctx, objId)
 
-	return c.Status(http.StatusOK).JSON(
-		fiber.Map{
-			"status":  "success",
-			"message": "User updated successfully",
-			"data":    result,
-		})
+	return responses.Success(c, http.StatusOK, "User updated successfully", result)
 }
 
 func DeleteUser(c *fiber.Ctx) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(c.UserContext(), 10*time.Second)
 	userId := c.Params("userId")
-	var user models.User
 	defer cancel()
 
-	objId, _ := primitive.ObjectIDFromHex(userId)
+	objId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		return responses.Error(c, http.StatusBadRequest, "Invalid user id")
+	}
 
-	err := userCollection.FindOne(ctx, bson.M{"id": objId}).Decode(&user)
+	user, err := userService.FindOne(ctx, objId)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return userNotFound(c)
+	}
 	if err != nil {
-		return c.Status(http.StatusInternalServerError).JSON(
-			fiber.Map{
-				"status":  "error",
-				"message": "Error getting user",
-			})
+		return userError(c, err, "Error getting user")
 	}
 
 	// delete user
-	result, err := userCollection.DeleteOne(ctx, user.Id)
+	result, err := userService.DeleteOne(ctx, user.Id)
 	if err != nil {
-		return c.Status(http.StatusInternalServerError).JSON(
-			fiber.Map{
-				"status":  "error",
-				"message": "Error deleting user",
-			})
-	}
-
-	return c.Status(http.StatusOK).JSON(
-		fiber.Map{
-			"status":  "success",
-			"message": "User deleted successfully",
-			"data":    result,
-		})
+		return userError(c, err, "Error deleting user")
+	}
+	usersChanged(ctx, user.Id)
+
+	return responses.Success(c, http.StatusOK, "User deleted successfully", result)
 }
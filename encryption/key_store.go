@@ -0,0 +1,113 @@
+package encryption
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// wrapped data key as stored in the encryption_keys collection
+type keyDocument struct {
+	Id         string    `bson:"_id"`
+	WrappedKey []byte    `bson:"wrappedKey"`
+	Active     bool      `bson:"active"`
+	CreatedAt  time.Time `bson:"createdAt"`
+}
+
+// KeyStore keeps the data keys in Mongo, wrapped by the master key
+type KeyStore struct {
+	collection *mongo.Collection
+	master     []byte
+}
+
+// Constructor
+func NewKeyStore(coll *mongo.Collection, master []byte) *KeyStore {
+	return &KeyStore{
+		collection: coll,
+		master:     master,
+	}
+}
+
+// Load unwraps all data keys into a keyring, creating the first key when there is none
+func (ks *KeyStore) Load(ctx context.Context) (*Keyring, error) {
+	keys, active, err := ks.unwrapAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if active == "" {
+		if active, err = ks.Rotate(ctx); err != nil {
+			return nil, err
+		}
+		if keys, active, err = ks.unwrapAll(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return NewKeyring(keys, active)
+}
+
+// Reload refreshes a keyring with keys rotated by another process
+func (ks *KeyStore) Reload(ctx context.Context, keyring *Keyring) error {
+	keys, active, err := ks.unwrapAll(ctx)
+	if err != nil {
+		return err
+	}
+	return keyring.Replace(keys, active)
+}
+
+// Rotate creates a new data key and makes it the active one. Older keys stay
+// available for decryption until every document was re-encrypted.
+func (ks *KeyStore) Rotate(ctx context.Context) (string, error) {
+	key, err := GenerateDataKey()
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := WrapKey(ks.master, key)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = ks.collection.InsertOne(ctx, keyDocument{
+		Id:         key.Id,
+		WrappedKey: wrapped,
+		Active:     true,
+		CreatedAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	_, err = ks.collection.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$ne": key.Id}, "active": true},
+		bson.M{"$set": bson.M{"active": false}},
+	)
+	return key.Id, err
+}
+
+// the newest active key wins should two rotations race
+func (ks *KeyStore) unwrapAll(ctx context.Context) ([]DataKey, string, error) {
+	cursor, err := ks.collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, "", err
+	}
+	var docs []keyDocument
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, "", err
+	}
+
+	keys := make([]DataKey, 0, len(docs))
+	active := ""
+	for _, doc := range docs {
+		key, err := UnwrapKey(ks.master, doc.Id, doc.WrappedKey)
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, key)
+		if doc.Active {
+			active = doc.Id
+		}
+	}
+	return keys, active, nil
+}
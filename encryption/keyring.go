@@ -0,0 +1,241 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Mode selects how a field is encrypted
+type Mode byte
+
+const (
+	// Randomized encryption gives a different ciphertext every time
+	Randomized Mode = 'R'
+	// Deterministic encryption gives the same ciphertext for the same value and
+	// key, which keeps equality queries working at the cost of revealing equality
+	Deterministic Mode = 'D'
+)
+
+// encrypted values look like enc:v1:<mode>:<key id>:<base64 nonce+ciphertext>
+const valuePrefix = "enc:v1:"
+
+// data keys hold an AES-256 key followed by the HMAC key deriving deterministic nonces
+const dataKeySize = 64
+
+var (
+	ErrUnknownKey       = errors.New("encryption: unknown data key")
+	ErrMalformedValue   = errors.New("encryption: malformed encrypted value")
+	ErrNoActiveKey      = errors.New("encryption: no active data key")
+	ErrInvalidKeyLength = errors.New("encryption: invalid key length")
+)
+
+// DataKey encrypts field values, it is stored wrapped by the master key
+type DataKey struct {
+	Id       string
+	Material []byte
+}
+
+// GenerateDataKey creates a new random data key
+func GenerateDataKey() (DataKey, error) {
+	id := make([]byte, 8)
+	material := make([]byte, dataKeySize)
+	if _, err := rand.Read(id); err != nil {
+		return DataKey{}, err
+	}
+	if _, err := rand.Read(material); err != nil {
+		return DataKey{}, err
+	}
+	return DataKey{Id: hex.EncodeToString(id), Material: material}, nil
+}
+
+// Keyring holds the unwrapped data keys. New values are encrypted with the
+// active key, values encrypted with any known key can be decrypted.
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   map[string]DataKey
+	active string
+}
+
+// Constructor
+func NewKeyring(keys []DataKey, active string) (*Keyring, error) {
+	k := &Keyring{}
+	if err := k.Replace(keys, active); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Replace swaps the keys of the keyring, used when keys were rotated elsewhere
+func (k *Keyring) Replace(keys []DataKey, active string) error {
+	byId := make(map[string]DataKey, len(keys))
+	for _, key := range keys {
+		if len(key.Material) != dataKeySize {
+			return ErrInvalidKeyLength
+		}
+		byId[key.Id] = key
+	}
+	if _, ok := byId[active]; !ok {
+		return ErrNoActiveKey
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = byId
+	k.active = active
+	return nil
+}
+
+// ActiveKeyId returns the id of the key new values are encrypted with
+func (k *Keyring) ActiveKeyId() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// Encrypt encrypts the value of a field with the active key. The field name
+// is authenticated so ciphertexts cannot be moved between fields.
+func (k *Keyring) Encrypt(field string, plaintext []byte, mode Mode) (string, error) {
+	k.mu.RLock()
+	key := k.keys[k.active]
+	k.mu.RUnlock()
+
+	return encryptWith(key, field, plaintext, mode)
+}
+
+// Decrypt reverses Encrypt with whichever key the value was encrypted with
+func (k *Keyring) Decrypt(field string, value string) ([]byte, error) {
+	mode, keyId, payload, err := parse(value)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.RLock()
+	key, ok := k.keys[keyId]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < aead.NonceSize() {
+		return nil, ErrMalformedValue
+	}
+	plaintext, err := aead.Open(nil, payload[:aead.NonceSize()], payload[aead.NonceSize():], additionalData(field, mode))
+	if err != nil {
+		return nil, fmt.Errorf("encryption: decrypting %s: %w", field, err)
+	}
+	return plaintext, nil
+}
+
+// DeterministicValues returns the deterministic ciphertext of a value under
+// every known key, matching documents written before and after a rotation
+func (k *Keyring) DeterministicValues(field string, plaintext []byte) ([]string, error) {
+	k.mu.RLock()
+	keys := make([]DataKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	k.mu.RUnlock()
+
+	values := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value, err := encryptWith(key, field, plaintext, Deterministic)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// IsEncrypted reports whether a stored value was produced by Encrypt
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, valuePrefix)
+}
+
+// KeyId returns the id of the key a value was encrypted with
+func KeyId(value string) string {
+	_, keyId, _, err := parse(value)
+	if err != nil {
+		return ""
+	}
+	return keyId
+}
+
+// ValueMode returns the mode a value was encrypted in
+func ValueMode(value string) Mode {
+	mode, _, _, err := parse(value)
+	if err != nil {
+		return 0
+	}
+	return mode
+}
+
+func encryptWith(key DataKey, field string, plaintext []byte, mode Mode) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	switch mode {
+	case Randomized:
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+	case Deterministic:
+		// synthetic nonce: the same field, value and key always give the same nonce
+		mac := hmac.New(sha256.New, key.Material[32:])
+		mac.Write([]byte(field))
+		mac.Write([]byte{0})
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+	default:
+		return "", fmt.Errorf("encryption: unknown mode %q", mode)
+	}
+
+	payload := aead.Seal(nonce, nonce, plaintext, additionalData(field, mode))
+	return valuePrefix + string(mode) + ":" + key.Id + ":" + base64.RawStdEncoding.EncodeToString(payload), nil
+}
+
+func parse(value string) (Mode, string, []byte, error) {
+	if !IsEncrypted(value) {
+		return 0, "", nil, ErrMalformedValue
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, valuePrefix), ":", 3)
+	if len(parts) != 3 || len(parts[0]) != 1 {
+		return 0, "", nil, ErrMalformedValue
+	}
+	payload, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, "", nil, ErrMalformedValue
+	}
+	return Mode(parts[0][0]), parts[1], payload, nil
+}
+
+func newAEAD(key DataKey) (cipher.AEAD, error) {
+	if len(key.Material) != dataKeySize {
+		return nil, ErrInvalidKeyLength
+	}
+	block, err := aes.NewCipher(key.Material[:32])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func additionalData(field string, mode Mode) []byte {
+	return []byte(string(mode) + ":" + field)
+}
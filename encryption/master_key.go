@@ -0,0 +1,70 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+)
+
+// LoadMasterKey reads the 32 byte master key from a keyfile, either raw or base64 encoded
+func LoadMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: reading master key: %w", err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("encryption: master key must be 32 bytes, raw or base64 encoded")
+	}
+	return key, nil
+}
+
+// WrapKey encrypts a data key with the master key, the key id is authenticated
+func WrapKey(master []byte, key DataKey) ([]byte, error) {
+	aead, err := masterAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key.Material, []byte(key.Id)), nil
+}
+
+// UnwrapKey decrypts a data key wrapped by WrapKey
+func UnwrapKey(master []byte, id string, wrapped []byte) (DataKey, error) {
+	aead, err := masterAEAD(master)
+	if err != nil {
+		return DataKey{}, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return DataKey{}, ErrMalformedValue
+	}
+
+	material, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return DataKey{}, fmt.Errorf("encryption: unwrapping key %s, wrong master key? %w", id, err)
+	}
+	return DataKey{Id: id, Material: material}, nil
+}
+
+func masterAEAD(master []byte) (cipher.AEAD, error) {
+	if len(master) != 32 {
+		return nil, ErrInvalidKeyLength
+	}
+	block, err := aes.NewCipher(master)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
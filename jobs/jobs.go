@@ -0,0 +1,178 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattchw/go-onboard/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrUnknownType   = errors.New("unknown job type")
+	ErrInvalidParams = errors.New("invalid job params")
+	ErrNotFound      = errors.New("job not found")
+	ErrFinished      = errors.New("job already finished")
+	ErrNoResult      = errors.New("job has no result")
+)
+
+// Params are the arguments a job was submitted with
+type Params map[string]interface{}
+
+// NewParams converts a struct to params using its json tags
+func NewParams(v interface{}) (Params, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var params Params
+	return params, json.Unmarshal(data, &params)
+}
+
+// Decode copies the params into a struct using its json tags
+func (p Params) Decode(v interface{}) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Handler executes a job, it must return promptly once ctx is cancelled
+type Handler func(ctx context.Context, run *Run) error
+
+// Definition describes a job type
+type Definition struct {
+	// Validate checks the params when the job is submitted, optional
+	Validate func(params Params) error
+	// Prepare completes valid params before they are stored, optional
+	Prepare func(params Params) (Params, error)
+	// Permission a caller needs to submit the job besides jobs:manage, the one
+	// of the requests the job stands in for. Optional.
+	Permission string
+	Run        Handler
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Definition{}
+)
+
+// Register makes a job type available for submission and to the workers
+func Register(jobType string, definition Definition) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[jobType] = definition
+}
+
+// Types returns the registered job types
+func Types() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	types := make([]string, 0, len(registry))
+	for jobType := range registry {
+		types = append(types, jobType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Permission returns the permission needed to submit jobs of jobType, empty
+// for unknown types and types needing none
+func Permission(jobType string) string {
+	definition, _ := lookup(jobType)
+	return definition.Permission
+}
+
+func lookup(jobType string) (Definition, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	definition, ok := registry[jobType]
+	return definition, ok
+}
+
+// Run gives a handler access to the job it executes
+type Run struct {
+	Job *models.Job
+
+	manager      *Manager
+	cancel       context.CancelFunc
+	artifact     *gridfs.UploadStream
+	result       map[string]interface{}
+	lastProgress time.Time
+}
+
+// Params returns the params the job was submitted with
+func (r *Run) Params() Params {
+	return Params(r.Job.Params)
+}
+
+// Progress records how far the job got. Writes are throttled to one per
+// second and double as a check for cancellation requests missed on pub/sub.
+func (r *Run) Progress(ctx context.Context, done int64, total int64) error {
+	r.Job.Progress = models.JobProgress{Done: done, Total: total}
+	if time.Since(r.lastProgress) < time.Second && done != total {
+		return nil
+	}
+	r.lastProgress = time.Now()
+
+	var job models.Job
+	err := r.manager.jobs.FindOneAndUpdate(ctx,
+		bson.M{"_id": r.Job.Id},
+		bson.M{"$set": bson.M{"progress": r.Job.Progress}},
+		options.FindOneAndUpdate().SetProjection(bson.M{"cancelRequested": 1}),
+	).Decode(&job)
+	if err != nil {
+		return err
+	}
+	if job.CancelRequested {
+		r.cancel()
+	}
+	return nil
+}
+
+// SetResult stores a small summary of the outcome on the job document
+func (r *Run) SetResult(result map[string]interface{}) {
+	r.result = result
+}
+
+// CreateArtifact opens the GridFS file holding the result of the job. A job
+// has at most one artifact, it is kept only if the job succeeds.
+func (r *Run) CreateArtifact(filename string, contentType string) (*gridfs.UploadStream, error) {
+	if r.artifact != nil {
+		return nil, errors.New("job artifact already created")
+	}
+
+	metadata := bson.M{
+		"jobId":       r.Job.Id,
+		"contentType": contentType,
+	}
+	// artifacts are looked up per tenant when users ask for their data
+	if r.Job.TenantId != "" {
+		metadata["tenantId"] = r.Job.TenantId
+	}
+	upload, err := r.manager.artifacts.OpenUploadStream(filename, options.GridFSUpload().SetMetadata(metadata))
+	if err != nil {
+		return nil, err
+	}
+	r.artifact = upload
+	return upload, nil
+}
+
+func (r *Run) artifactId() *primitive.ObjectID {
+	if r.artifact == nil {
+		return nil
+	}
+	if id, ok := r.artifact.FileID.(primitive.ObjectID); ok {
+		return &id
+	}
+	return nil
+}
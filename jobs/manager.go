@@ -0,0 +1,225 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/tenancy"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// Redis list the workers consume job ids from
+	queueKey = "jobs:queue"
+	// Redis lists holding the ids each worker took until it is done with them
+	processingPrefix = "jobs:processing:"
+	// Redis keys the worker pools keep alive, the processing lists of a pool
+	// whose key expired are given back to the queue
+	alivePrefix = "jobs:alive:"
+	// Redis channel announcing cancellation of running jobs
+	cancelChannel = "jobs:cancel"
+)
+
+// Redis is what jobs need from Redis, *redis.Client is one
+type Redis interface {
+	redis.Cmdable
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+// Manager keeps job state in Mongo and hands job ids to the workers through Redis
+type Manager struct {
+	jobs      *mongo.Collection
+	artifacts *gridfs.Bucket
+	rdb       Redis
+}
+
+// Constructor
+func NewManager(db *mongo.Database, rdb Redis) (*Manager, error) {
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(models.JobArtifactsBucket))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manager{
+		jobs:      db.Collection(models.JobsCollection),
+		artifacts: bucket,
+		rdb:       rdb,
+	}, nil
+}
+
+// Enqueue stores a new job and queues it for the workers
+func (m *Manager) Enqueue(ctx context.Context, jobType string, params Params) (*models.Job, error) {
+	definition, ok := lookup(jobType)
+	if !ok {
+		return nil, ErrUnknownType
+	}
+	if params == nil {
+		params = Params{}
+	}
+	if definition.Validate != nil {
+		if err := definition.Validate(params); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidParams, err)
+		}
+	}
+	if definition.Prepare != nil {
+		prepared, err := definition.Prepare(params)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidParams, err)
+		}
+		params = prepared
+	}
+
+	job := &models.Job{
+		Id:        primitive.NewObjectID(),
+		Type:      jobType,
+		Status:    models.JobQueued,
+		Params:    params,
+		CreatedAt: time.Now().UTC(),
+	}
+	job.TenantId, _ = tenancy.FromContext(ctx)
+	if _, err := m.jobs.InsertOne(ctx, job); err != nil {
+		return nil, err
+	}
+
+	if err := m.rdb.LPush(ctx, queueKey, job.Id.Hex()).Err(); err != nil {
+		// the job would never run, do not leave it behind as queued
+		m.jobs.DeleteOne(ctx, bson.M{"_id": job.Id})
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// Get returns the current state of a job
+func (m *Manager) Get(ctx context.Context, id primitive.ObjectID) (*models.Job, error) {
+	var job models.Job
+	err := m.jobs.FindOne(ctx, scope(ctx, bson.M{"_id": id})).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Cancel stops a job. Queued jobs are cancelled right away, running ones are
+// signalled and reach the cancelled status once their handler returns.
+func (m *Manager) Cancel(ctx context.Context, id primitive.ObjectID) (*models.Job, error) {
+	now := time.Now().UTC()
+	result, err := m.jobs.UpdateOne(ctx,
+		scope(ctx, bson.M{"_id": id, "status": models.JobQueued}),
+		bson.M{"$set": bson.M{"status": models.JobCancelled, "cancelRequested": true, "finishedAt": now}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.ModifiedCount == 0 {
+		result, err = m.jobs.UpdateOne(ctx,
+			scope(ctx, bson.M{"_id": id, "status": models.JobRunning}),
+			bson.M{"$set": bson.M{"cancelRequested": true}},
+		)
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount > 0 {
+			if err := m.rdb.Publish(ctx, cancelChannel, id.Hex()).Err(); err != nil {
+				// the worker still notices on its next progress update
+				log.Printf("failed to publish cancellation of job %s: %v", id.Hex(), err)
+			}
+		}
+	}
+
+	job, err := m.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status.Done() && !job.CancelRequested {
+		return job, ErrFinished
+	}
+	return job, nil
+}
+
+// OpenResult opens the artifact of a succeeded job for reading
+func (m *Manager) OpenResult(ctx context.Context, id primitive.ObjectID) (*gridfs.DownloadStream, *models.Job, error) {
+	job, err := m.Get(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if job.Status != models.JobSucceeded || job.ResultFileId == nil {
+		return nil, job, ErrNoResult
+	}
+
+	stream, err := m.artifacts.OpenDownloadStream(*job.ResultFileId)
+	if err == gridfs.ErrFileNotFound {
+		// erased along with the personal data it held
+		return nil, job, ErrNoResult
+	}
+	if err != nil {
+		return nil, job, err
+	}
+	return stream, job, nil
+}
+
+// recover gives the ids in the processing list of a dead worker back to the
+// queue. Their jobs are reset first, a worker taking one sees it queued.
+func (m *Manager) recover(ctx context.Context, processing string) error {
+	values, err := m.rdb.LRange(ctx, processing, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		id, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			continue
+		}
+		if err := m.unclaim(ctx, id, processing); err != nil {
+			return err
+		}
+	}
+
+	// another replica may be recovering the same list, each id moves once
+	for {
+		value, err := m.rdb.LMove(ctx, processing, queueKey, "RIGHT", "LEFT").Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("queued job %s of dead worker %s again", value, processing)
+	}
+}
+
+// unclaim puts a job the worker holding processing was running back into
+// the queued status, jobs claimed by somebody else since are left alone
+func (m *Manager) unclaim(ctx context.Context, id primitive.ObjectID, processing string) error {
+	_, err := m.jobs.UpdateOne(ctx,
+		bson.M{"_id": id, "status": models.JobRunning, "worker": processing},
+		bson.M{
+			"$set":   bson.M{"status": models.JobQueued, "progress": models.JobProgress{}},
+			"$unset": bson.M{"startedAt": "", "worker": ""},
+		},
+	)
+	return err
+}
+
+// scope restricts a job filter to the tenant of ctx, jobs of other tenants
+// are reported as not found
+func scope(ctx context.Context, filter bson.M) bson.M {
+	if tenant, ok := tenancy.FromContext(ctx); ok {
+		filter[tenancy.TenantField] = tenant
+	} else {
+		filter[tenancy.TenantField] = bson.M{"$exists": false}
+	}
+	return filter
+}
@@ -0,0 +1,237 @@
+package jobs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/services"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const batchSize = 500
+
+type exportParams struct {
+	Filter models.UserFilter `json:"filter"`
+}
+
+type importParams struct {
+	Users []models.User `json:"users"`
+}
+
+// importParams as they are stored with the job, PII fields of the users are
+// encrypted until the job inserts them
+type storedImportParams struct {
+	Users []services.UserDocument `json:"users"`
+}
+
+type purgeParams struct {
+	Filter models.UserFilter `json:"filter"`
+	// purging needs an explicit confirmation since an empty filter matches everyone
+	Confirm bool `json:"confirm"`
+}
+
+// RegisterUserJobs registers the bulk operations on the users collection, they
+// go through the user service so PII fields are encrypted like any other write.
+// changed is called after every batch written, to invalidate cached users.
+func RegisterUserJobs(users *services.UserServiceImpl, changed func(ctx context.Context)) {
+	Register("users.export", Definition{
+		Permission: models.PermUsersRead,
+		Validate: func(params Params) error {
+			var p exportParams
+			return params.Decode(&p)
+		},
+		Run: func(ctx context.Context, run *Run) error {
+			return exportUsers(ctx, run, users)
+		},
+	})
+
+	Register("users.import", Definition{
+		Permission: models.PermUsersWrite,
+		Validate: func(params Params) error {
+			var p importParams
+			if err := params.Decode(&p); err != nil {
+				return err
+			}
+			if len(p.Users) == 0 {
+				return errors.New("users must not be empty")
+			}
+			for i, user := range p.Users {
+				if err := user.ValidateUser(); err != nil {
+					return fmt.Errorf("users[%d]: %v", i, err)
+				}
+			}
+			return nil
+		},
+		// the users get their ids up front, so the job is found by the users it
+		// holds when they ask for their data or its erasure
+		Prepare: func(params Params) (Params, error) {
+			var p importParams
+			if err := params.Decode(&p); err != nil {
+				return nil, err
+			}
+			stored := storedImportParams{Users: make([]services.UserDocument, len(p.Users))}
+			for i, user := range p.Users {
+				user.Id = primitive.NewObjectID()
+				doc, err := users.Encode(user)
+				if err != nil {
+					return nil, err
+				}
+				stored.Users[i] = doc
+			}
+			return NewParams(stored)
+		},
+		Run: func(ctx context.Context, run *Run) error {
+			return importUsers(ctx, run, users, changed)
+		},
+	})
+
+	Register("users.purge", Definition{
+		Permission: models.PermUsersDelete,
+		Validate: func(params Params) error {
+			var p purgeParams
+			if err := params.Decode(&p); err != nil {
+				return err
+			}
+			if !p.Confirm {
+				return errors.New("confirm must be true")
+			}
+			return nil
+		},
+		Run: func(ctx context.Context, run *Run) error {
+			return purgeUsers(ctx, run, users, changed)
+		},
+	})
+}
+
+// the export artifact is gzipped NDJSON, the same format as GET /users/export
+func exportUsers(ctx context.Context, run *Run, users *services.UserServiceImpl) error {
+	var params exportParams
+	if err := run.Params().Decode(&params); err != nil {
+		return err
+	}
+
+	total, err := users.Count(ctx, params.Filter)
+	if err != nil {
+		return err
+	}
+
+	artifact, err := run.CreateArtifact("users-"+run.Job.Id.Hex()+".ndjson.gz", "application/x-ndjson+gzip")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(artifact)
+	progress := &progressWriter{ctx: ctx, run: run, total: total}
+
+	count, err := users.Export(ctx, params.Filter, io.MultiWriter(gz, progress))
+	if err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := artifact.Close(); err != nil {
+		return err
+	}
+
+	run.SetResult(map[string]interface{}{"exported": count})
+	return run.Progress(ctx, count, total)
+}
+
+func importUsers(ctx context.Context, run *Run, users *services.UserServiceImpl, changed func(ctx context.Context)) error {
+	var stored storedImportParams
+	if err := run.Params().Decode(&stored); err != nil {
+		return err
+	}
+	params := importParams{Users: make([]models.User, len(stored.Users))}
+	for i, doc := range stored.Users {
+		user, err := users.Decode(doc)
+		if err != nil {
+			return err
+		}
+		params.Users[i] = user
+	}
+
+	total := int64(len(params.Users))
+	var imported int64
+	for start := 0; start < len(params.Users); start += batchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := start + batchSize
+		if end > len(params.Users) {
+			end = len(params.Users)
+		}
+		// a failed batch may still have written part of its users
+		inserted, err := users.InsertMany(ctx, params.Users[start:end])
+		changed(ctx)
+		if err != nil {
+			return err
+		}
+		imported += inserted
+		run.SetResult(map[string]interface{}{"imported": imported})
+		if err := run.Progress(ctx, imported, total); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// users are deleted in batches so cancellation takes effect between them
+func purgeUsers(ctx context.Context, run *Run, users *services.UserServiceImpl, changed func(ctx context.Context)) error {
+	var params purgeParams
+	if err := run.Params().Decode(&params); err != nil {
+		return err
+	}
+	total, err := users.Count(ctx, params.Filter)
+	if err != nil {
+		return err
+	}
+
+	var deleted int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		count, err := users.DeleteBatch(ctx, params.Filter, batchSize)
+		if count > 0 || err != nil {
+			changed(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			break
+		}
+		deleted += count
+		run.SetResult(map[string]interface{}{"deleted": deleted})
+		if err := run.Progress(ctx, deleted, total); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// progressWriter counts exported users by the lines written
+type progressWriter struct {
+	ctx   context.Context
+	run   *Run
+	total int64
+	done  int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.done += int64(bytes.Count(p, []byte("\n")))
+	if err := pw.run.Progress(pw.ctx, pw.done, pw.total); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,346 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/tenancy"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// a pool missing this many heartbeats in a row is considered dead
+const missedHeartbeats = 3
+
+// WorkerPool executes queued jobs with a fixed number of goroutines. Each
+// worker moves the ids it takes into a processing list of its own, so the
+// jobs of a pool that crashed are queued again once its heartbeat stops.
+type WorkerPool struct {
+	manager   *Manager
+	size      int
+	id        string
+	heartbeat time.Duration
+
+	mu      sync.Mutex
+	running map[primitive.ObjectID]context.CancelFunc
+}
+
+// Constructor
+func NewWorkerPool(manager *Manager, size int) *WorkerPool {
+	return &WorkerPool{
+		manager:   manager,
+		size:      size,
+		id:        primitive.NewObjectID().Hex(),
+		heartbeat: 10 * time.Second,
+		running:   map[primitive.ObjectID]context.CancelFunc{},
+	}
+}
+
+// WithHeartbeat returns a pool of the same size beating every interval
+func (p *WorkerPool) WithHeartbeat(interval time.Duration) *WorkerPool {
+	pool := NewWorkerPool(p.manager, p.size)
+	pool.heartbeat = interval
+	return pool
+}
+
+// Run consumes the queue until ctx is cancelled. Jobs interrupted by the
+// shutdown are queued again.
+func (p *WorkerPool) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	// alive before taking any job, so the reaper of another pool leaves them alone
+	p.beat(ctx)
+	defer p.stop()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.listenForCancellation(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.keepAlive(ctx)
+	}()
+
+	for i := 0; i < p.size; i++ {
+		wg.Add(1)
+		go func(processing string) {
+			defer wg.Done()
+			p.work(ctx, processing)
+		}(fmt.Sprintf("%s%s:%d", processingPrefix, p.id, i))
+	}
+
+	wg.Wait()
+}
+
+func (p *WorkerPool) work(ctx context.Context, processing string) {
+	for ctx.Err() == nil {
+		value, err := p.manager.rdb.BLMove(ctx, queueKey, processing, "RIGHT", "LEFT", 5*time.Second).Result()
+		if err == redis.Nil || ctx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			log.Printf("failed to read job queue: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		id, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			log.Printf("dropping malformed job id %q", value)
+		} else if !p.process(ctx, processing, id) {
+			// left in the processing list, reaped once this pool stopped
+			continue
+		}
+		p.release(processing, value)
+	}
+}
+
+// process runs the job and reports whether its id can leave the processing
+// list, ids of jobs that could not be queued again on shutdown stay there
+func (p *WorkerPool) process(ctx context.Context, processing string, id primitive.ObjectID) bool {
+	jobs := p.manager.jobs
+
+	// claim the job, it may have been cancelled while queued
+	var job models.Job
+	now := time.Now().UTC()
+	err := jobs.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": models.JobQueued},
+		bson.M{"$set": bson.M{"status": models.JobRunning, "startedAt": now, "worker": processing}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return true
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		log.Printf("failed to claim job %s, queueing it again: %v", id.Hex(), err)
+		return p.enqueue(id)
+	}
+
+	// the job works on the data of the tenant it was created for
+	runCtx, cancel := context.WithCancel(ctx)
+	if job.TenantId != "" {
+		runCtx = tenancy.WithTenant(runCtx, job.TenantId)
+	}
+	defer cancel()
+	p.mu.Lock()
+	p.running[id] = cancel
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.running, id)
+		p.mu.Unlock()
+	}()
+
+	run := &Run{Job: &job, manager: p.manager, cancel: cancel}
+	runErr := p.execute(runCtx, run)
+
+	// the job was interrupted by a shutdown, give it to another worker
+	if ctx.Err() != nil {
+		return p.requeue(run)
+	}
+
+	update := bson.M{
+		"progress":   run.Job.Progress,
+		"finishedAt": time.Now().UTC(),
+	}
+	switch {
+	case runErr == nil:
+		update["status"] = models.JobSucceeded
+		if fileId := run.artifactId(); fileId != nil {
+			update["resultFileId"] = fileId
+		}
+		if run.result != nil {
+			update["result"] = run.result
+		}
+	case runCtx.Err() != nil:
+		update["status"] = models.JobCancelled
+		p.discardArtifact(run)
+	default:
+		update["status"] = models.JobFailed
+		update["error"] = runErr.Error()
+		p.discardArtifact(run)
+	}
+
+	finishCtx, finishCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer finishCancel()
+	// a pool taken for dead had its job queued again, that run records the outcome
+	filter := bson.M{"_id": id, "worker": processing}
+	if _, err := jobs.UpdateOne(finishCtx, filter, bson.M{"$set": update, "$unset": bson.M{"worker": ""}}); err != nil {
+		log.Printf("failed to record outcome of job %s: %v", id.Hex(), err)
+	}
+	return true
+}
+
+func (p *WorkerPool) execute(ctx context.Context, run *Run) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	definition, ok := lookup(run.Job.Type)
+	if !ok {
+		return ErrUnknownType
+	}
+	err = definition.Run(ctx, run)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+func (p *WorkerPool) requeue(run *Run) bool {
+	p.discardArtifact(run)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := p.manager.unclaim(ctx, run.Job.Id, run.Job.Worker); err != nil {
+		log.Printf("failed to requeue job %s: %v", run.Job.Id.Hex(), err)
+		return false
+	}
+	return p.enqueue(run.Job.Id)
+}
+
+// enqueue hands an id to the workers again, it stays in the processing list
+// when that fails
+func (p *WorkerPool) enqueue(id primitive.ObjectID) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := p.manager.rdb.LPush(ctx, queueKey, id.Hex()).Err(); err != nil {
+		log.Printf("failed to requeue job %s: %v", id.Hex(), err)
+		return false
+	}
+	return true
+}
+
+// release drops an id from the processing list once its job is handled
+func (p *WorkerPool) release(processing string, value string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := p.manager.rdb.LRem(ctx, processing, 1, value).Err(); err != nil {
+		log.Printf("failed to release job %s: %v", value, err)
+	}
+}
+
+// keepAlive beats until ctx is cancelled and gives the jobs of dead pools
+// back to the queue, checking once per missed heartbeat window
+func (p *WorkerPool) keepAlive(ctx context.Context) {
+	beats := time.NewTicker(p.heartbeat)
+	defer beats.Stop()
+	reaps := time.NewTicker(missedHeartbeats * p.heartbeat)
+	defer reaps.Stop()
+
+	p.reap(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-beats.C:
+			p.beat(ctx)
+		case <-reaps.C:
+			p.reap(ctx)
+		}
+	}
+}
+
+func (p *WorkerPool) beat(ctx context.Context) {
+	if err := p.manager.rdb.Set(ctx, alivePrefix+p.id, time.Now().UTC().Format(time.RFC3339), missedHeartbeats*p.heartbeat).Err(); err != nil {
+		log.Printf("failed to record heartbeat of worker pool %s: %v", p.id, err)
+	}
+}
+
+// stop lets other pools know this one is gone, its processing lists are empty
+func (p *WorkerPool) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p.manager.rdb.Del(ctx, alivePrefix+p.id)
+}
+
+// reap queues again the jobs held in the processing lists of dead pools
+func (p *WorkerPool) reap(ctx context.Context) {
+	var cursor uint64
+	for {
+		keys, next, err := p.manager.rdb.Scan(ctx, cursor, processingPrefix+"*", 100).Result()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("failed to list job processing lists: %v", err)
+			}
+			return
+		}
+		for _, key := range keys {
+			pool := strings.TrimPrefix(key, processingPrefix)
+			if i := strings.LastIndex(pool, ":"); i >= 0 {
+				pool = pool[:i]
+			}
+			alive, err := p.manager.rdb.Exists(ctx, alivePrefix+pool).Result()
+			if err != nil || alive > 0 {
+				continue
+			}
+			if err := p.manager.recover(ctx, key); err != nil {
+				log.Printf("failed to recover jobs of %s: %v", key, err)
+			}
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+func (p *WorkerPool) discardArtifact(run *Run) {
+	if run.artifact == nil {
+		return
+	}
+	if err := run.artifact.Abort(); errors.Is(err, gridfs.ErrStreamClosed) {
+		// the upload was closed by the handler already, remove the stored file
+		if fileId := run.artifactId(); fileId != nil {
+			p.manager.artifacts.Delete(*fileId)
+		}
+	}
+}
+
+// cancel running jobs as soon as a cancellation is published
+func (p *WorkerPool) listenForCancellation(ctx context.Context) {
+	pubsub := p.manager.rdb.Subscribe(ctx, cancelChannel)
+	defer pubsub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pubsub.Channel():
+			if !ok {
+				return
+			}
+			id, err := primitive.ObjectIDFromHex(msg.Payload)
+			if err != nil {
+				continue
+			}
+
+			p.mu.Lock()
+			if cancel, ok := p.running[id]; ok {
+				cancel()
+			}
+			p.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package lockout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+var ErrThrottled = errors.New("lockout: too many failed attempts")
+
+// ThrottledError rejects an attempt before the credentials are checked
+type ThrottledError struct {
+	// until the next attempt is accepted
+	RetryAfter time.Duration
+	// the account is locked, not just slowed down
+	Locked bool
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%v, retry after %s", ErrThrottled, e.RetryAfter)
+}
+
+func (e *ThrottledError) Is(target error) bool {
+	return target == ErrThrottled
+}
+
+// Policy of a Guard
+type Policy struct {
+	// failed attempts on an account before it is locked
+	MaxFailures int
+	// failed attempts from an IP, on any account, before it is blocked
+	MaxIPFailures int
+	// failures are forgotten once none happened for this long
+	Window time.Duration
+	// accounts unlock by themselves after this long
+	LockFor time.Duration
+	// the delay after the first failure, it doubles with every further one
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// DefaultPolicy locks an account for 15 minutes after 5 failed attempts
+var DefaultPolicy = Policy{
+	MaxFailures:   5,
+	MaxIPFailures: 50,
+	Window:        15 * time.Minute,
+	LockFor:       15 * time.Minute,
+	BaseDelay:     time.Second,
+	MaxDelay:      30 * time.Second,
+}
+
+// Guard tracks failed attempts to authenticate as an account. Accounts are
+// named by username, so usernames without an account are slowed down and
+// locked alike and lockouts do not reveal which accounts exist.
+type Guard interface {
+	// Check returns a *ThrottledError when an attempt cannot be made yet,
+	// otherwise the attempt counts as failed until Succeed is called
+	Check(ctx context.Context, username string, ip string) error
+	// Fail records a failed attempt from ip and reports whether it locked the account
+	Fail(ctx context.Context, username string, ip string) (bool, error)
+	// Succeed forgets the failed attempts on an account
+	Succeed(ctx context.Context, username string) error
+	// Release takes back the attempt counted by Check, for attempts neither
+	// failed nor succeeded. The failed attempts before it are kept.
+	Release(ctx context.Context, username string) error
+	// Unlock lifts the lock of an account and forgets its failed attempts
+	Unlock(ctx context.Context, username string) error
+	// LockedFor returns how long the account stays locked, zero when it is not
+	LockedFor(ctx context.Context, username string) (time.Duration, error)
+}
+
+// check returns {0, 0} to allow an attempt, otherwise the reason (1 locked
+// account, 2 blocked IP, 3 delay) and milliseconds to wait. An allowed attempt
+// counts as failed until Succeed clears it, so attempts made in parallel wait
+// for each other. Time comes from the Redis server so the clocks of the
+// replicas do not matter.
+var check = redis.NewScript(`
+-- TIME is non-deterministic, replicate the effects rather than the script
+redis.replicate_commands()
+local locked = redis.call("PTTL", KEYS[1])
+if locked > 0 then
+  return {1, locked}
+end
+
+if ARGV[5] == "1" then
+  local ipFailures = tonumber(redis.call("HGET", KEYS[3], "count") or "0")
+  if ipFailures >= tonumber(ARGV[4]) then
+    return {2, redis.call("PTTL", KEYS[3])}
+  end
+end
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local failures = tonumber(redis.call("HGET", KEYS[2], "count") or "0")
+if failures > 0 then
+  local last = tonumber(redis.call("HGET", KEYS[2], "last") or "0")
+  local delay = math.min(tonumber(ARGV[2]) * 2 ^ (failures - 1), tonumber(ARGV[3]))
+  local wait = last + delay - now
+  if wait > 0 then
+    return {3, math.ceil(wait)}
+  end
+end
+
+redis.call("HINCRBY", KEYS[2], "count", 1)
+redis.call("HSET", KEYS[2], "last", now)
+redis.call("PEXPIRE", KEYS[2], ARGV[1])
+return {0, 0}
+`)
+
+// fail locks the account once its failures reach the threshold, returning 1 then
+var fail = redis.NewScript(`
+if ARGV[4] == "1" then
+  redis.call("HINCRBY", KEYS[3], "count", 1)
+  redis.call("PEXPIRE", KEYS[3], ARGV[1])
+end
+
+local failures = tonumber(redis.call("HGET", KEYS[2], "count") or "0")
+if failures >= tonumber(ARGV[3]) then
+  redis.call("DEL", KEYS[2])
+  redis.call("SET", KEYS[1], 1, "PX", ARGV[2])
+  return 1
+end
+return 0
+`)
+
+// release undoes the count of an attempt by check
+var release = redis.NewScript(`
+local failures = redis.call("HINCRBY", KEYS[1], "count", -1)
+if failures <= 0 then
+  redis.call("DEL", KEYS[1])
+end
+return failures
+`)
+
+// RedisGuard shares failed attempts between all replicas through Redis
+type RedisGuard struct {
+	rdb    redis.Cmdable
+	prefix string
+	policy Policy
+}
+
+// Constructor
+func NewRedisGuard(rdb redis.Cmdable, policy Policy) *RedisGuard {
+	return &RedisGuard{
+		rdb:    rdb,
+		prefix: "lockout:",
+		policy: policy,
+	}
+}
+
+// implement Check
+func (rg *RedisGuard) Check(ctx context.Context, username string, ip string) error {
+	result, err := check.Run(ctx, rg.rdb, rg.keys(username, ip), rg.policy.Window.Milliseconds(),
+		rg.policy.BaseDelay.Milliseconds(), rg.policy.MaxDelay.Milliseconds(), rg.policy.MaxIPFailures, hasIP(ip),
+	).Int64Slice()
+	if err != nil {
+		return err
+	}
+	if result[0] == 0 {
+		return nil
+	}
+	return &ThrottledError{
+		RetryAfter: time.Duration(result[1]) * time.Millisecond,
+		Locked:     result[0] == 1,
+	}
+}
+
+// implement Fail
+func (rg *RedisGuard) Fail(ctx context.Context, username string, ip string) (bool, error) {
+	locked, err := fail.Run(ctx, rg.rdb, rg.keys(username, ip),
+		rg.policy.Window.Milliseconds(), rg.policy.LockFor.Milliseconds(), rg.policy.MaxFailures, hasIP(ip),
+	).Int()
+	return locked == 1, err
+}
+
+// implement Succeed
+func (rg *RedisGuard) Succeed(ctx context.Context, username string) error {
+	return rg.rdb.Del(ctx, rg.failuresKey(username)).Err()
+}
+
+// implement Release
+func (rg *RedisGuard) Release(ctx context.Context, username string) error {
+	return release.Run(ctx, rg.rdb, []string{rg.failuresKey(username)}).Err()
+}
+
+// implement Unlock
+func (rg *RedisGuard) Unlock(ctx context.Context, username string) error {
+	return rg.rdb.Del(ctx, rg.lockKey(username), rg.failuresKey(username)).Err()
+}
+
+// implement LockedFor
+func (rg *RedisGuard) LockedFor(ctx context.Context, username string) (time.Duration, error) {
+	ttl, err := rg.rdb.PTTL(ctx, rg.lockKey(username)).Result()
+	if err != nil || ttl < 0 {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+func (rg *RedisGuard) keys(username string, ip string) []string {
+	return []string{rg.lockKey(username), rg.failuresKey(username), rg.prefix + "ip:" + ip}
+}
+
+func (rg *RedisGuard) lockKey(username string) string {
+	return rg.prefix + "locked:" + username
+}
+
+func (rg *RedisGuard) failuresKey(username string) string {
+	return rg.prefix + "failures:" + username
+}
+
+func hasIP(ip string) string {
+	if ip == "" {
+		return "0"
+	}
+	return "1"
+}
+
+type clientIPKey struct{}
+
+// WithClientIP returns ctx carrying the IP address of the client, attempts
+// made with it are also counted against that address
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// ClientIP returns the IP address carried by ctx, empty when there is none
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
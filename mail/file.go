@@ -0,0 +1,71 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileMailer writes each message as an .eml file into a directory, for
+// development and tests. Files are named after the time they were sent.
+type FileMailer struct {
+	dir  string
+	from string
+	now  func() time.Time
+	mu   sync.Mutex
+	sent int
+}
+
+// Constructor, the directory is created when it does not exist
+func NewFileMailer(dir string, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("mail: creating %s: %w", dir, err)
+	}
+	return &FileMailer{
+		dir:  dir,
+		from: from,
+		now:  time.Now,
+	}, nil
+}
+
+// implement Send
+func (fm *FileMailer) Send(ctx context.Context, msg Message) error {
+	now := fm.now()
+	data, err := format(fm.from, msg, now)
+	if err != nil {
+		return err
+	}
+
+	fm.mu.Lock()
+	fm.sent++
+	name := fmt.Sprintf("%s-%04d.eml", now.UTC().Format("20060102T150405.000000000"), fm.sent)
+	fm.mu.Unlock()
+	return os.WriteFile(filepath.Join(fm.dir, name), data, 0o600)
+}
+
+// LogMailer prints messages to a logger instead of sending them, for
+// development without a mail server
+type LogMailer struct {
+	logger *log.Logger
+}
+
+// Constructor, nil logs with the standard logger
+func NewLogMailer(logger *log.Logger) *LogMailer {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &LogMailer{logger: logger}
+}
+
+// implement Send
+func (lm *LogMailer) Send(ctx context.Context, msg Message) error {
+	if _, err := parseRecipient(msg.To); err != nil {
+		return err
+	}
+	lm.logger.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+	return nil
+}
@@ -0,0 +1,101 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+var ErrInvalidAddress = errors.New("mail: invalid address")
+
+// Message is an email with a plain text body and, optionally, an HTML one
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// format returns msg as an RFC 5322 message from the from address, with
+// multipart/alternative bodies when it has an HTML one
+func format(from string, msg Message, now time.Time) ([]byte, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("%w: from %q", ErrInvalidAddress, from)
+	}
+	recipient, err := parseRecipient(msg.To)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	header := func(name string, value string) {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+	}
+	header("From", sender.String())
+	header("To", recipient.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", "<"+randomHex()+"@"+domain(sender.Address)+">")
+	header("MIME-Version", "1.0")
+
+	if msg.HTML == "" {
+		header("Content-Type", `text/plain; charset="utf-8"`)
+		header("Content-Transfer-Encoding", "quoted-printable")
+		b.WriteString("\r\n")
+		writeQuoted(&b, msg.Text)
+		return b.Bytes(), nil
+	}
+
+	boundary := randomHex()
+	header("Content-Type", `multipart/alternative; boundary="`+boundary+`"`)
+	b.WriteString("\r\n")
+	for _, part := range []struct{ kind, body string }{{"text/plain", msg.Text}, {"text/html", msg.HTML}} {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: %s; charset=\"utf-8\"\r\n", part.kind)
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		writeQuoted(&b, part.body)
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes(), nil
+}
+
+func parseRecipient(to string) (*mail.Address, error) {
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return nil, fmt.Errorf("%w: to %q", ErrInvalidAddress, to)
+	}
+	return recipient, nil
+}
+
+// writeQuoted encodes body as quoted-printable, line breaks become CRLF
+func writeQuoted(b *bytes.Buffer, body string) {
+	w := quotedprintable.NewWriter(b)
+	w.Write([]byte(body))
+	w.Close()
+}
+
+func domain(address string) string {
+	_, domain, _ := strings.Cut(address, "@")
+	return domain
+}
+
+func randomHex() string {
+	raw := make([]byte, 12)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
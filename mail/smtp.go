@@ -0,0 +1,127 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+var ErrNoTLS = errors.New("mail: the SMTP server does not support STARTTLS")
+
+// SMTPConfig is how to reach an SMTP server. Port 465 uses implicit TLS,
+// other ports STARTTLS, which is required unless Insecure is set.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// allows plain text connections, only for local test servers
+	Insecure bool
+}
+
+// SMTPMailer sends messages through an SMTP server, one connection each
+type SMTPMailer struct {
+	config SMTPConfig
+	now    func() time.Time
+}
+
+// Constructor
+func NewSMTPMailer(config SMTPConfig) *SMTPMailer {
+	return &SMTPMailer{
+		config: config,
+		now:    time.Now,
+	}
+}
+
+// implement Send
+func (sm *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	data, err := format(sm.config.From, msg, sm.now())
+	if err != nil {
+		return err
+	}
+
+	client, err := sm.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if sm.config.Username != "" {
+		auth := smtp.PlainAuth("", sm.config.Username, sm.config.Password, sm.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("mail: authenticating: %w", err)
+		}
+	}
+	if err := client.Mail(address(sm.config.From)); err != nil {
+		return fmt.Errorf("mail: MAIL FROM: %w", err)
+	}
+	if err := client.Rcpt(address(msg.To)); err != nil {
+		return fmt.Errorf("mail: RCPT TO: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("mail: DATA: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("mail: writing message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("mail: sending message: %w", err)
+	}
+	return client.Quit()
+}
+
+func (sm *SMTPMailer) dial(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(sm.config.Host, fmt.Sprint(sm.config.Port))
+	tlsConfig := &tls.Config{ServerName: sm.config.Host, MinVersion: tls.VersionTLS12}
+
+	var conn net.Conn
+	var err error
+	if sm.config.Port == 465 {
+		dialer := &tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = new(net.Dialer).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mail: connecting to %s: %w", addr, err)
+	}
+	// the client has no context of its own, its connection gets the deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, sm.config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mail: greeting from %s: %w", addr, err)
+	}
+	if sm.config.Port == 465 {
+		return client, nil
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("mail: STARTTLS: %w", err)
+		}
+	} else if !sm.config.Insecure {
+		client.Close()
+		return nil, ErrNoTLS
+	}
+	return client, nil
+}
+
+// address returns the bare address of a formatted one, for the envelope
+func address(formatted string) string {
+	if parsed, err := mail.ParseAddress(formatted); err == nil {
+		return parsed.Address
+	}
+	return formatted
+}
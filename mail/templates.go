@@ -0,0 +1,129 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	texttemplate "text/template"
+)
+
+// names of the templates the API sends
+const (
+	TemplatePasswordReset = "password_reset"
+	TemplateVerifyEmail   = "verify_email"
+)
+
+//go:embed templates
+var defaultTemplates embed.FS
+
+var ErrUnknownTemplate = errors.New("mail: unknown template")
+
+// Templates render messages. A template called name has a text part in
+// name.txt, which defines the subject in a "subject" template, and an
+// optional HTML part in name.html whose values are escaped.
+type Templates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+// DefaultTemplates returns the templates built into the binary
+func DefaultTemplates() *Templates {
+	templates, err := parseTemplates(nil, defaultTemplates, "templates")
+	if err != nil {
+		panic(err)
+	}
+	return templates
+}
+
+// LoadTemplates reads templates from dir, files there replace the built-in
+// part of the same name
+func LoadTemplates(dir string) (*Templates, error) {
+	return parseTemplates(DefaultTemplates(), os.DirFS(dir), ".")
+}
+
+// Render returns the message of the template called name to the to address
+func (t *Templates) Render(name string, to string, data interface{}) (Message, error) {
+	text, ok := t.text[name]
+	if !ok {
+		return Message{}, fmt.Errorf("%w %q", ErrUnknownTemplate, name)
+	}
+
+	msg := Message{To: to}
+	var b bytes.Buffer
+	if err := text.ExecuteTemplate(&b, "subject", data); err != nil {
+		return Message{}, fmt.Errorf("mail: rendering subject of %s: %w", name, err)
+	}
+	// a subject spanning lines would inject headers
+	msg.Subject = strings.Join(strings.Fields(b.String()), " ")
+
+	b.Reset()
+	if err := text.Execute(&b, data); err != nil {
+		return Message{}, fmt.Errorf("mail: rendering %s: %w", name, err)
+	}
+	msg.Text = b.String()
+
+	if html, ok := t.html[name]; ok {
+		b.Reset()
+		if err := html.Execute(&b, data); err != nil {
+			return Message{}, fmt.Errorf("mail: rendering %s.html: %w", name, err)
+		}
+		msg.HTML = b.String()
+	}
+	return msg, nil
+}
+
+func parseTemplates(base *Templates, fsys fs.FS, dir string) (*Templates, error) {
+	templates := &Templates{
+		text: map[string]*texttemplate.Template{},
+		html: map[string]*htmltemplate.Template{},
+	}
+	if base != nil {
+		for name, tmpl := range base.text {
+			templates.text[name] = tmpl
+		}
+		for name, tmpl := range base.html {
+			templates.html[name] = tmpl
+		}
+	}
+
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("mail: reading templates: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("mail: reading templates: %w", err)
+		}
+
+		ext := path.Ext(entry.Name())
+		name := strings.TrimSuffix(entry.Name(), ext)
+		switch ext {
+		case ".txt":
+			tmpl, err := texttemplate.New(name).Option("missingkey=error").Parse(string(data))
+			if err != nil {
+				return nil, fmt.Errorf("mail: parsing %s: %w", entry.Name(), err)
+			}
+			if tmpl.Lookup("subject") == nil {
+				return nil, fmt.Errorf("mail: %s does not define a subject", entry.Name())
+			}
+			templates.text[name] = tmpl
+		case ".html":
+			tmpl, err := htmltemplate.New(name).Option("missingkey=error").Parse(string(data))
+			if err != nil {
+				return nil, fmt.Errorf("mail: parsing %s: %w", entry.Name(), err)
+			}
+			templates.html[name] = tmpl
+		}
+	}
+	return templates, nil
+}
@@ -1,43 +1,153 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/gofiber/fiber/v2/middleware/timeout"
-	"github.com/joho/godotenv"
+	"github.com/mattchw/go-onboard/cache"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/controllers"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/openapi"
 	"github.com/mattchw/go-onboard/routes"
+	"github.com/mattchw/go-onboard/tenancy"
 )
 
 // Main function
 func main() {
 	fmt.Println("!... Hello World ...!")
 
-	// load env file
-	envErr := godotenv.Load()
-	if envErr != nil {
-		log.Fatal("Error loading .env file")
+	// stop serving and let running jobs requeue on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// every command needs MongoDB, nothing connected to it before
+	if err := configs.PingDB(); err != nil {
+		log.Fatal(err)
+	}
+
+	// `go-server worker` runs the job workers only, the queue is in Redis
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		if err := configs.PingRedis(); err != nil {
+			log.Fatal(err)
+		}
+		controllers.Setup(configs.LoadKeyring(), configs.LoadCacheStore(), nil)
+		runWorkers(ctx, configs.EnvJobWorkers(4))
+		return
+	}
+	// `go-server create-admin <username> [tenant,...]` creates the first admin account
+	if len(os.Args) > 1 && os.Args[1] == "create-admin" {
+		controllers.Setup(configs.LoadKeyring(), cache.NoopStore{}, nil)
+		createAdmin(ctx, os.Args[2:])
+		return
+	}
+	// `go-server rotate-keys` rotates the field encryption key and re-encrypts users
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		rotateKeys(ctx, configs.LoadKeyring())
+		return
+	}
+
+	// only the Redis cache backend needs Redis to start, rate limits let
+	// requests through and the other features relying on it fail until it is up
+	if err := configs.PingRedis(); err != nil {
+		if configs.CacheBackend == cache.RedisBackend {
+			log.Fatal(err)
+		}
+		log.Printf("Redis is unreachable, starting without it: %v", err)
 	}
+	controllers.Setup(configs.LoadKeyring(), configs.LoadCacheStore(), configs.LoadLocalCache())
+	links, err := configs.LoadActionTokens()
+	if err != nil {
+		log.Fatal(err)
+	}
+	controllers.SetupAuth(configs.LoadTokenIssuer(), links)
 
 	app := fiber.New(fiber.Config{
 		AppName: "Go onboard v1.0.0",
+		// the client IP is only taken from the proxy header of trusted proxies,
+		// lockouts and rate limits by IP rely on it
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          configs.EnvTrustedProxies(),
+		ProxyHeader:             configs.EnvProxyHeader(),
 	})
 
 	// recover from any panics
 	app.Use(recover.New())
-	// default timeout
-	app.Use(timeout.New(func(c *fiber.Ctx) (err error) { return c.Next() }, 1*time.Second))
+	// there is no global timeout, handlers bound their work with a context
+	// deadline and streamed exports and job results run as long as the client reads
+	// negotiate the API version before anything writes a response
+	app.Use(middlewares.Versioning(routes.APIVersions(), "v1"))
+	// limits shared by all replicas, per client IP and per API key
+	app.Use(middlewares.RateLimit(configs.RateLimiter,
+		middlewares.RateLimitRule{Name: "ip", Limit: configs.EnvRateLimit("ip", "600/1m"), Key: middlewares.RateLimitByIP},
+		middlewares.RateLimitRule{Name: "api_key", Limit: configs.EnvRateLimit("api_key", "1200/1m"), Key: middlewares.RateLimitByAPIKey("X-API-Key")},
+	))
+	// reject requests that do not match the OpenAPI document
+	spec := openapi.MustLoad()
+	app.Use(middlewares.ValidateRequest(spec))
+	app.Get("/openapi.json", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(spec.JSON())
+	})
 	app.Get("/healthcheck", func(c *fiber.Ctx) error {
-		time.Sleep(5 * time.Second)
 		return c.SendString("OK!!!")
 	})
+	// failed attempts to authenticate are counted per client IP too
+	app.Use(middlewares.ClientIP)
+	// verify bearer tokens, API keys, partner signatures and session cookies before the tenant is resolved from their claims
+	verifiers := middlewares.IssuerVerifiers{configs.EnvJWTIssuer(): controllers.Auth}
+	if configs.OIDC != nil {
+		verifiers[configs.OIDC.Issuer()] = configs.OIDC
+	}
+	app.Use(middlewares.VerifyToken(verifiers))
+	app.Use(middlewares.VerifyAPIKey(controllers.APIKeys, "X-API-Key"))
+	if configs.Partners != nil {
+		app.Use(middlewares.VerifySignature(configs.Partners))
+	}
+	app.Use(middlewares.VerifySession(controllers.Sessions, configs.SessionCookie))
+	// scope the API to the tenant of the request, routes above serve every tenant
+	if configs.Tenants.Mode() != tenancy.Disabled {
+		sources := []middlewares.TenantSource{
+			middlewares.TenantClaim("tenant"),
+			middlewares.TenantHeader("X-Tenant-ID"),
+		}
+		if domain := configs.EnvTenantBaseDomain(); domain != "" {
+			sources = append(sources, middlewares.TenantSubdomain(domain))
+		}
+		app.Use(middlewares.ResolveTenant(configs.EnvTenants(), sources...))
+	}
 	// routes
 	routes.UserRoute(app)
+	routes.JobRoute(app)
+	routes.AccountRoute(app)
+	routes.AuthRoute(app)
+	routes.SessionRoute(app)
+	routes.TOTPRoute(app)
+	routes.AccountEmailRoute(app)
+	routes.APIKeyRoute(app)
+	routes.CacheRoute(app)
+
+	// in-process job workers, set JOBS_WORKERS=0 when running `go-server worker` separately
+	workersDone := make(chan struct{})
+	go func() {
+		defer close(workersDone)
+		runWorkers(ctx, configs.EnvJobWorkers(2))
+	}()
+	go func() {
+		<-ctx.Done()
+		app.Shutdown()
+	}()
 
 	port := os.Getenv("PORT")
-	app.Listen(":" + port)
+	if err := app.Listen(":" + port); err != nil {
+		log.Println(err)
+	}
+	stop()
+	<-workersDone
 }
@@ -0,0 +1,68 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/services"
+)
+
+// APIKeyKey holds the *models.APIKey of a request authenticated with an API key
+const APIKeyKey = "apiKey"
+
+// APIKeyAuthenticator checks an API key
+type APIKeyAuthenticator interface {
+	Authenticate(ctx context.Context, key string) (*models.APIKey, error)
+}
+
+// VerifyAPIKey middleware authenticates the API key sent in header, if there
+// is one. Its claims go under ClaimsKey like those of a bearer token, with the
+// scopes of the key in a space separated scope claim, so TokenReq accepts
+// either credential and Permit limits keys to their scopes.
+func VerifyAPIKey(keys APIKeyAuthenticator, header string) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		key := strings.TrimSpace(c.Get(header))
+		if key == "" {
+			return c.Next()
+		}
+		if _, ok := c.Locals(ClaimsKey).(map[string]interface{}); ok {
+			return responses.Error(c, http.StatusBadRequest, "Send either a bearer token or an API key")
+		}
+
+		ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
+		defer cancel()
+		apiKey, err := keys.Authenticate(ctx, key)
+		if errors.Is(err, services.ErrInvalidAPIKey) {
+			return responses.Error(c, http.StatusUnauthorized, "Invalid API key")
+		}
+		if err != nil {
+			log.Printf("API key authentication failed: %v", err)
+			return responses.Error(c, http.StatusServiceUnavailable, "Authentication unavailable")
+		}
+
+		role := apiKey.Role
+		if role == "" {
+			role = models.RoleService
+		}
+		claims := map[string]interface{}{
+			"sub":   "apikey:" + apiKey.Id.Hex(),
+			"name":  "apikey:" + apiKey.Prefix,
+			"role":  role,
+			"scope": strings.Join(apiKey.Scopes, " "),
+		}
+		if apiKey.TenantId != "" {
+			claims["tenant"] = apiKey.TenantId
+		}
+		c.Locals(ClaimsKey, claims)
+		c.Locals(APIKeyKey, apiKey)
+		c.Locals("username", claims["name"])
+		return c.Next()
+	}
+}
@@ -1,15 +1,183 @@
 package middlewares
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/basicauth"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mattchw/go-onboard/lockout"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/sessions"
+	"github.com/mattchw/go-onboard/tokens"
 )
 
-// AuthReq middleware
-func AuthReq() func(*fiber.Ctx) error {
-	return basicauth.New(basicauth.Config{
-		Users: map[string]string{
-			"admin": "12345678",
-		},
-	})
+// AccountKey holds the *models.Account of an authenticated request
+const AccountKey = "account"
+
+// Authenticator checks the credentials of an account
+type Authenticator interface {
+	Authenticate(ctx context.Context, username string, password string) (*models.Account, error)
+}
+
+// AuthReq middleware requires HTTP basic credentials of an account or a
+// session verified by VerifySession
+func AuthReq(accounts Authenticator) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if _, ok := c.Locals(SessionKey).(*sessions.Session); ok {
+			return c.Next()
+		}
+
+		username, password, ok := basicCredentials(c.Get(fiber.HeaderAuthorization))
+		if !ok {
+			return unauthorized(c)
+		}
+
+		ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
+		defer cancel()
+		account, err := accounts.Authenticate(ctx, username, password)
+		if errors.Is(err, services.ErrInvalidCredential) {
+			return unauthorized(c)
+		}
+		// basic auth cannot carry a code, accounts with a second factor sign in
+		if errors.Is(err, services.ErrOTPRequired) {
+			return responses.Error(c, http.StatusUnauthorized, "Two-factor authentication required, sign in through /auth/session or /auth/login")
+		}
+		var throttled *lockout.ThrottledError
+		if errors.As(err, &throttled) {
+			return TooManyAttempts(c, throttled)
+		}
+		if err != nil {
+			log.Printf("authentication of %q failed: %v", username, err)
+			return responses.Error(c, http.StatusServiceUnavailable, "Authentication unavailable")
+		}
+
+		c.Locals("username", account.Username)
+		c.Locals(AccountKey, account)
+		return c.Next()
+	}
+}
+
+// ClientIP middleware puts the IP of the client in the user context, failed
+// attempts to authenticate from it are counted against it
+func ClientIP(c *fiber.Ctx) error {
+	c.SetUserContext(lockout.WithClientIP(c.UserContext(), ClientAddress(c)))
+	return c.Next()
+}
+
+// ClientAddress returns the IP of the client. The proxy header is only read
+// from the trusted proxies of the app config, when it holds a list the last
+// address is the one the proxy saw, those before it are up to the client.
+func ClientAddress(c *fiber.Ctx) string {
+	ip := c.IP()
+	if i := strings.LastIndexByte(ip, ','); i >= 0 {
+		ip = ip[i+1:]
+	}
+	return strings.TrimSpace(ip)
+}
+
+// TooManyAttempts rejects an attempt to authenticate made too soon after failed ones
+func TooManyAttempts(c *fiber.Ctx, err *lockout.ThrottledError) error {
+	c.Set(fiber.HeaderRetryAfter, seconds(err.RetryAfter))
+	if err.Locked {
+		return responses.Error(c, http.StatusTooManyRequests, "Account locked after too many failed attempts")
+	}
+	return responses.Error(c, http.StatusTooManyRequests, "Too many failed attempts")
+}
+
+// TokenVerifier checks an access token and returns its claims
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) (map[string]interface{}, error)
+}
+
+// IssuerVerifiers maps the iss claim of tokens to the verifier trusted for it
+type IssuerVerifiers map[string]TokenVerifier
+
+// implement TokenVerifier, the unverified iss claim only picks the verifier
+func (iv IssuerVerifiers) Verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return nil, tokens.ErrInvalidToken
+	}
+	issuer, _ := claims["iss"].(string)
+	verifier, ok := iv[issuer]
+	if !ok {
+		return nil, tokens.ErrInvalidToken
+	}
+	return verifier.Verify(ctx, token)
+}
+
+// VerifyToken middleware verifies the bearer token of a request, if it has
+// one, and puts its claims under ClaimsKey. It runs before ResolveTenant so
+// the tenant claim is known there, TokenReq then requires the token.
+func VerifyToken(verifier TokenVerifier) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		token, ok := bearerToken(c.Get(fiber.HeaderAuthorization))
+		if !ok {
+			return c.Next()
+		}
+
+		ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
+		defer cancel()
+		claims, err := verifier.Verify(ctx, token)
+		if errors.Is(err, tokens.ErrInvalidToken) {
+			return invalidToken(c)
+		}
+		if err != nil {
+			log.Printf("token verification failed: %v", err)
+			return responses.Error(c, http.StatusServiceUnavailable, "Authentication unavailable")
+		}
+
+		c.Locals(ClaimsKey, claims)
+		if name, ok := claims["name"].(string); ok && name != "" {
+			c.Locals("username", name)
+		}
+		return c.Next()
+	}
+}
+
+// TokenReq middleware requires a bearer token verified by VerifyToken or an
+// API key verified by VerifyAPIKey
+func TokenReq(c *fiber.Ctx) error {
+	if _, ok := c.Locals(ClaimsKey).(map[string]interface{}); !ok {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="Restricted"`)
+		return responses.Error(c, http.StatusUnauthorized, "Unauthorized")
+	}
+	return c.Next()
+}
+
+func bearerToken(header string) (string, bool) {
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
+
+func invalidToken(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="Restricted", error="invalid_token"`)
+	return responses.Error(c, http.StatusUnauthorized, "Invalid or expired token")
+}
+
+func basicCredentials(header string) (string, string, bool) {
+	if len(header) < 6 || !strings.EqualFold(header[:6], "basic ") {
+		return "", "", false
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[6:]))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(raw), ":")
+}
+
+func unauthorized(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="Restricted"`)
+	return responses.Error(c, http.StatusUnauthorized, "Unauthorized")
 }
@@ -0,0 +1,115 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/ratelimit"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/tenancy"
+)
+
+// RateLimitRule limits the requests of every identity Key returns. Rules
+// sharing a Name share their counters, so the same rule on several routes
+// limits them together.
+type RateLimitRule struct {
+	Name  string
+	Limit ratelimit.Limit
+	// identity the limit applies to, empty skips the rule for a request
+	Key func(c *fiber.Ctx) string
+}
+
+// RateLimitByIP identifies clients by their IP address
+func RateLimitByIP(c *fiber.Ctx) string {
+	return "ip:" + ClientAddress(c)
+}
+
+// RateLimitByUser identifies authenticated callers by their account or else
+// by the subject of their token, API key or signature. Names are not used,
+// those of identity providers can be shared. It must run after authentication.
+func RateLimitByUser(c *fiber.Ctx) string {
+	if account, ok := c.Locals(AccountKey).(*models.Account); ok {
+		return "user:" + account.Id.Hex()
+	}
+	claims, _ := c.Locals(ClaimsKey).(map[string]interface{})
+	if sub, ok := claims["sub"].(string); ok && sub != "" {
+		return "user:" + sub
+	}
+	return ""
+}
+
+// RateLimitByAPIKey identifies clients by the API key sent in header, the key
+// itself is hashed so it never ends up in Redis
+func RateLimitByAPIKey(header string) func(c *fiber.Ctx) string {
+	return func(c *fiber.Ctx) string {
+		key := c.Get(header)
+		if key == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:16])
+	}
+}
+
+// RateLimit middleware checks every rule applying to a request and answers
+// 429 once one of them is exhausted. The RateLimit-* headers describe the
+// rule closest to its limit. When the limiter is unreachable requests are let
+// through, an outage of Redis should not take the API down with it.
+func RateLimit(limiter ratelimit.Limiter, rules ...RateLimitRule) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var tightest *RateLimitRule
+		var tightestResult ratelimit.Result
+
+		for i := range rules {
+			rule := &rules[i]
+			identity := rule.Key(c)
+			if identity == "" {
+				continue
+			}
+
+			key := tenancy.Key(c.UserContext(), rule.Name+":"+identity)
+			ctx, cancel := context.WithTimeout(c.UserContext(), time.Second)
+			result, err := limiter.Allow(ctx, key, rule.Limit)
+			cancel()
+			if err != nil {
+				log.Printf("rate limit %s unavailable, letting request through: %v", rule.Name, err)
+				continue
+			}
+
+			if tightest == nil || !result.Allowed || (tightestResult.Allowed && result.Remaining < tightestResult.Remaining) {
+				tightest, tightestResult = rule, result
+			}
+			if !result.Allowed {
+				break
+			}
+		}
+
+		if tightest == nil {
+			return c.Next()
+		}
+
+		c.Set("RateLimit-Limit", strconv.Itoa(tightest.Limit.Requests))
+		c.Set("RateLimit-Remaining", strconv.Itoa(tightestResult.Remaining))
+		c.Set("RateLimit-Reset", seconds(tightestResult.ResetAfter))
+		c.Set("RateLimit-Policy", strconv.Itoa(tightest.Limit.Requests)+";w="+seconds(tightest.Limit.Period))
+
+		if !tightestResult.Allowed {
+			c.Set(fiber.HeaderRetryAfter, seconds(tightestResult.RetryAfter))
+			return responses.Error(c, http.StatusTooManyRequests, "Too many requests")
+		}
+		return c.Next()
+	}
+}
+
+// headers carry whole seconds, rounded up so clients never retry too early
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
@@ -0,0 +1,80 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/sessions"
+)
+
+// SessionKey holds the *sessions.Session of a request signed in with a cookie
+const SessionKey = "session"
+
+// CSRFHeader carries the CSRF token of the session on requests changing anything
+const CSRFHeader = "X-CSRF-Token"
+
+// SessionAuthenticator resolves the session of a cookie token
+type SessionAuthenticator interface {
+	Authenticate(ctx context.Context, token string, ip string) (*sessions.Session, *models.Account, error)
+}
+
+// VerifySession middleware signs in requests carrying a session cookie. The
+// account is put under AccountKey, so AuthReq accepts the request, and its
+// claims under ClaimsKey for TokenReq, Permit and the tenant claim. Requests
+// other than GET, HEAD and OPTIONS need the CSRF token of the session.
+// Credentials in headers take precedence, a cookie sent along is ignored.
+func VerifySession(store SessionAuthenticator, cookie string) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		token := c.Cookies(cookie)
+		if token == "" || c.Get(fiber.HeaderAuthorization) != "" || c.Locals(ClaimsKey) != nil {
+			return c.Next()
+		}
+
+		ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
+		defer cancel()
+		session, account, err := store.Authenticate(ctx, token, ClientAddress(c))
+		if errors.Is(err, sessions.ErrNoSession) {
+			// an expired cookie leaves the request anonymous
+			return c.Next()
+		}
+		if err != nil {
+			log.Printf("session lookup failed: %v", err)
+			return responses.Error(c, http.StatusServiceUnavailable, "Authentication unavailable")
+		}
+
+		if !safeMethod(c.Method()) && subtle.ConstantTimeCompare([]byte(c.Get(CSRFHeader)), []byte(session.CSRFToken)) != 1 {
+			return responses.Error(c, http.StatusForbidden, "Invalid CSRF token")
+		}
+
+		claims := map[string]interface{}{
+			"sub":  account.Id.Hex(),
+			"name": account.Username,
+			"role": account.Role,
+			"sid":  session.Id,
+			"amr":  services.AuthMethods(session.MFA),
+		}
+		if session.Tenant != "" {
+			claims["tenant"] = session.Tenant
+		}
+		if account.UserId != "" {
+			claims["uid"] = account.UserId
+		}
+		c.Locals(SessionKey, session)
+		c.Locals(AccountKey, account)
+		c.Locals(ClaimsKey, claims)
+		c.Locals("username", account.Username)
+		return c.Next()
+	}
+}
+
+func safeMethod(method string) bool {
+	return method == fiber.MethodGet || method == fiber.MethodHead || method == fiber.MethodOptions
+}
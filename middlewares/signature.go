@@ -0,0 +1,80 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/partners"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/signing"
+)
+
+// PartnerKey holds the *partners.Partner of a request signed by a partner
+const PartnerKey = "partner"
+
+// SignatureVerifier checks the signature of a partner request
+type SignatureVerifier interface {
+	Verify(ctx context.Context, req partners.Request) (*partners.Partner, error)
+}
+
+// VerifySignature middleware authenticates requests signed with the signing
+// package, if they carry a signature. Like API keys the partner gets claims
+// under ClaimsKey with its scopes in the scope claim.
+func VerifySignature(verifier SignatureVerifier) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		signature := c.Get(signing.HeaderSignature)
+		if signature == "" {
+			return c.Next()
+		}
+		if _, ok := c.Locals(ClaimsKey).(map[string]interface{}); ok {
+			return responses.Error(c, http.StatusBadRequest, "Send either a signature or another credential")
+		}
+
+		ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
+		defer cancel()
+		partner, err := verifier.Verify(ctx, partners.Request{
+			KeyId:     c.Get(signing.HeaderKeyId),
+			Method:    c.Method(),
+			Target:    c.OriginalURL(),
+			Timestamp: c.Get(signing.HeaderTimestamp),
+			Nonce:     c.Get(signing.HeaderNonce),
+			Signature: signature,
+			Body:      c.Body(),
+		})
+		switch {
+		case errors.Is(err, partners.ErrInvalidSignature):
+			return responses.Error(c, http.StatusUnauthorized, "Invalid signature")
+		case errors.Is(err, partners.ErrStaleRequest):
+			return responses.Error(c, http.StatusUnauthorized, "Request timestamp outside the allowed window")
+		case errors.Is(err, partners.ErrReplayedRequest):
+			return responses.Error(c, http.StatusUnauthorized, "Request already received")
+		case err != nil:
+			log.Printf("signature verification failed: %v", err)
+			return responses.Error(c, http.StatusServiceUnavailable, "Authentication unavailable")
+		}
+
+		role := partner.Role
+		if role == "" {
+			role = models.RoleService
+		}
+		claims := map[string]interface{}{
+			"sub":   "partner:" + partner.Id,
+			"name":  "partner:" + partner.Id,
+			"role":  role,
+			"scope": strings.Join(partner.Scopes, " "),
+		}
+		if partner.Tenant != "" {
+			claims["tenant"] = partner.Tenant
+		}
+		c.Locals(ClaimsKey, claims)
+		c.Locals(PartnerKey, partner)
+		c.Locals("username", claims["name"])
+		return c.Next()
+	}
+}
@@ -0,0 +1,94 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/mattchw/go-onboard/tenancy"
+)
+
+// ClaimsKey holds the verified token claims of a request as a map[string]interface{}
+const ClaimsKey = "claims"
+
+// TenantKey holds the tenant id of a request
+const TenantKey = "tenant"
+
+// TenantSource extracts a tenant id from a request, empty when it names none
+type TenantSource func(c *fiber.Ctx) string
+
+// TenantHeader reads the tenant from a request header
+func TenantHeader(name string) TenantSource {
+	return func(c *fiber.Ctx) string {
+		return strings.TrimSpace(c.Get(name))
+	}
+}
+
+// TenantSubdomain reads the tenant from the label in front of baseDomain,
+// acme.api.example.com is tenant acme for base domain api.example.com
+func TenantSubdomain(baseDomain string) TenantSource {
+	suffix := "." + strings.ToLower(strings.Trim(baseDomain, "."))
+	return func(c *fiber.Ctx) string {
+		host := strings.ToLower(c.Hostname())
+		if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host, "]") {
+			host = host[:i]
+		}
+		if !strings.HasSuffix(host, suffix) {
+			return ""
+		}
+		return strings.TrimSuffix(host, suffix)
+	}
+}
+
+// TenantClaim reads the tenant from a claim of the verified token, it only
+// sees tokens verified by middleware running before ResolveTenant
+func TenantClaim(claim string) TenantSource {
+	return func(c *fiber.Ctx) string {
+		claims, ok := c.Locals(ClaimsKey).(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		tenant, _ := claims[claim].(string)
+		return tenant
+	}
+}
+
+// ResolveTenant middleware puts the tenant of a request in its user context,
+// services then only reach the data of that tenant. Every source naming a
+// tenant has to agree, a token for one tenant cannot be combined with a
+// header or host naming another. Requests naming no tenant are rejected.
+func ResolveTenant(known []string, sources ...TenantSource) func(*fiber.Ctx) error {
+	allowed := map[string]bool{}
+	for _, tenant := range known {
+		allowed[tenant] = true
+	}
+
+	return func(c *fiber.Ctx) error {
+		tenant := ""
+		for _, source := range sources {
+			value := source(c)
+			if value == "" {
+				continue
+			}
+			if tenant != "" && value != tenant {
+				return responses.Error(c, http.StatusForbidden, "Conflicting tenants in request")
+			}
+			tenant = value
+		}
+
+		if tenant == "" {
+			return responses.Error(c, http.StatusBadRequest, "Missing tenant")
+		}
+		if !tenancy.ValidTenant(tenant) {
+			return responses.Error(c, http.StatusBadRequest, "Invalid tenant")
+		}
+		if len(allowed) > 0 && !allowed[tenant] {
+			return responses.Error(c, http.StatusNotFound, "Unknown tenant")
+		}
+
+		c.Locals(TenantKey, tenant)
+		c.SetUserContext(tenancy.WithTenant(c.UserContext(), tenant))
+		return c.Next()
+	}
+}
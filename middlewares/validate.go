@@ -0,0 +1,40 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/openapi"
+	"github.com/mattchw/go-onboard/responses"
+)
+
+// ValidateRequest middleware rejects requests that do not match the OpenAPI document
+func ValidateRequest(doc *openapi.Document) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		query, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+
+		// binary bodies are validated against the same schemas as JSON ones
+		contentType := c.Get(fiber.HeaderContentType)
+		body, transcoded, err := responses.TranscodeJSON(contentType, c.Body())
+		if err != nil {
+			return responses.Error(c, http.StatusBadRequest, "Invalid request body", err.Error())
+		}
+		if transcoded {
+			contentType = fiber.MIMEApplicationJSON
+		}
+
+		errs := doc.Validate(openapi.Request{
+			Method:      c.Method(),
+			Path:        c.Path(),
+			Query:       query,
+			ContentType: contentType,
+			Body:        body,
+		})
+		if len(errs) > 0 {
+			return responses.Invalid(c, "Invalid request", errs)
+		}
+
+		return c.Next()
+	}
+}
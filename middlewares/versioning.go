@@ -0,0 +1,83 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/responses"
+)
+
+// APIVersion describes one version of the API
+type APIVersion struct {
+	Name       string
+	Deprecated bool
+	// zero when no sunset date has been announced
+	Sunset time.Time
+	// version clients should migrate to
+	Successor string
+}
+
+// Versioning middleware negotiates the API version from the path prefix
+// (/v1/...) or, for unversioned paths, the Accept-Version header. Requests
+// asking for neither get fallback, they are only told a version is deprecated
+// when they ask for it.
+func Versioning(versions []APIVersion, fallback string) func(*fiber.Ctx) error {
+	byName := map[string]APIVersion{}
+	names := make([]string, 0, len(versions))
+	for _, version := range versions {
+		byName[version.Name] = version
+		names = append(names, version.Name)
+	}
+
+	return func(c *fiber.Ctx) error {
+		name, explicit := fallback, true
+		path := c.Path()
+		prefix := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+		if _, ok := byName[prefix]; ok {
+			name = prefix
+			path = strings.TrimPrefix(path, "/"+prefix)
+		} else if header := c.Get("Accept-Version"); header != "" {
+			name = normalizeVersion(header)
+		} else {
+			explicit = false
+		}
+
+		version, ok := byName[name]
+		if !ok {
+			return responses.Error(c, http.StatusBadRequest, "Unsupported API version", supportedVersions{
+				Supported: names,
+			})
+		}
+
+		c.Locals(responses.VersionKey, version.Name)
+		c.Set("Content-Version", version.Name)
+		c.Vary("Accept-Version")
+		if version.Deprecated && explicit {
+			c.Set("Deprecation", "true")
+			if !version.Sunset.IsZero() {
+				c.Set("Sunset", version.Sunset.UTC().Format(http.TimeFormat))
+			}
+			// the same resource under the prefix of the successor
+			if version.Successor != "" {
+				c.Append(fiber.HeaderLink, `</`+version.Successor+path+`>; rel="successor-version"`)
+			}
+		}
+
+		return c.Next()
+	}
+}
+
+type supportedVersions struct {
+	Supported []string `json:"supported" xml:"supported"`
+}
+
+// accept "2", "v2" and "V2" for the same version
+func normalizeVersion(header string) string {
+	header = strings.ToLower(strings.TrimSpace(header))
+	if !strings.HasPrefix(header, "v") {
+		header = "v" + header
+	}
+	return header
+}
@@ -0,0 +1,110 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// roles of the default policy, RBAC_POLICY_FILE can define others
+const (
+	RoleAdmin = "admin"
+	// API keys get this role unless they are created with another one
+	RoleService = "service"
+)
+
+// permissions granted by roles and, as scopes, to API keys
+const (
+	PermUsersRead      = "users:read"
+	PermUsersWrite     = "users:write"
+	PermUsersDelete    = "users:delete"
+	PermUsersExport    = "users:export"
+	PermUsersAny       = "users:any"
+	PermAccountsManage = "accounts:manage"
+	PermAPIKeysManage  = "apikeys:manage"
+	PermJobsManage     = "jobs:manage"
+	PermCacheRead      = "cache:read"
+)
+
+// Account is someone allowed to sign in to the API
+type Account struct {
+	Id           primitive.ObjectID `bson:"_id" json:"id" xml:"id"`
+	Username     string             `bson:"username" json:"username" xml:"username"`
+	PasswordHash string             `bson:"passwordHash" json:"-" xml:"-"`
+	Role         string             `bson:"role" json:"role" xml:"role"`
+	Disabled     bool               `bson:"disabled" json:"disabled" xml:"disabled"`
+	// the user the account is, roles without users:any only reach that one
+	UserId string `bson:"userId,omitempty" json:"userId,omitempty" xml:"userId,omitempty"`
+	// the tenants the account signs in to when tenancy is enabled
+	Tenants []string `bson:"tenants,omitempty" json:"tenants,omitempty" xml:"tenants>tenant,omitempty"`
+	// password resets are only sent to verified addresses
+	Email         string `bson:"email,omitempty" json:"email,omitempty" xml:"email,omitempty"`
+	EmailVerified bool   `bson:"emailVerified" json:"emailVerified" xml:"emailVerified"`
+	// two-factor authentication, the secret is only set once it is confirmed
+	TOTPEnabled   bool      `bson:"totpEnabled" json:"totpEnabled" xml:"totpEnabled"`
+	TOTPSecret    string    `bson:"totpSecret,omitempty" json:"-" xml:"-"`
+	TOTPPending   string    `bson:"totpPending,omitempty" json:"-" xml:"-"`
+	TOTPLastStep  int64     `bson:"totpLastStep,omitempty" json:"-" xml:"-"`
+	RecoveryCodes []string  `bson:"recoveryCodes,omitempty" json:"-" xml:"-"`
+	CreatedAt     time.Time `bson:"createdAt" json:"createdAt" xml:"createdAt"`
+	UpdatedAt     time.Time `bson:"updatedAt" json:"updatedAt" xml:"updatedAt"`
+}
+
+// AccountInput creates an account or, with empty fields left unchanged, updates one
+type AccountInput struct {
+	Username string `json:"username" xml:"username"`
+	Password string `json:"password" xml:"password"`
+	Role     string `json:"role,omitempty" xml:"role,omitempty"`
+	Email    string `json:"email,omitempty" xml:"email,omitempty"`
+	UserId   string `json:"userId,omitempty" xml:"userId,omitempty"`
+	Disabled *bool  `json:"disabled,omitempty" xml:"disabled,omitempty"`
+	// replaces the tenants of the account when set
+	Tenants []string `json:"tenants,omitempty" xml:"tenants>tenant,omitempty"`
+}
+
+// MemberOf reports whether the account belongs to tenant, requests resolving
+// no tenant are only made with tenancy disabled and let every account in
+func (a *Account) MemberOf(tenant string) bool {
+	if tenant == "" {
+		return true
+	}
+	for _, t := range a.Tenants {
+		if t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// PasswordResetRequest asks for a password reset link sent to a verified address
+type PasswordResetRequest struct {
+	Email string `json:"email" xml:"email"`
+}
+
+// PasswordResetInput sets a new password with the token of a reset link
+type PasswordResetInput struct {
+	Token    string `json:"token" xml:"token"`
+	Password string `json:"password" xml:"password"`
+}
+
+// EmailVerificationInput confirms an address with the token of a verification link
+type EmailVerificationInput struct {
+	Token string `json:"token" xml:"token"`
+}
+
+// TOTPEnrollment is returned when two-factor authentication is set up, the
+// secret goes into an authenticator app directly or through the URI
+type TOTPEnrollment struct {
+	Secret string `json:"secret" xml:"secret"`
+	URI    string `json:"uri" xml:"uri"`
+}
+
+// TOTPInput confirms or disables two-factor authentication with a current code
+type TOTPInput struct {
+	Code string `json:"code" xml:"code"`
+}
+
+// RecoveryCodes are shown once, each signs in a single time without a code
+type RecoveryCodes struct {
+	Codes []string `json:"recoveryCodes" xml:"recoveryCodes>code"`
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Scopes lists the permissions an API key can be limited to, the management
+// routes take the credentials of an account and never an API key
+var Scopes = []string{PermUsersRead, PermUsersWrite, PermUsersDelete, PermUsersExport}
+
+// APIKey is a long-lived credential for service-to-service clients. Only the
+// SHA-256 hash of the key is stored, the prefix identifies it in listings.
+type APIKey struct {
+	Id         primitive.ObjectID `bson:"_id" json:"id" xml:"id"`
+	Name       string             `bson:"name" json:"name" xml:"name"`
+	Prefix     string             `bson:"prefix" json:"prefix" xml:"prefix"`
+	Hash       string             `bson:"hash" json:"-" xml:"-"`
+	Role       string             `bson:"role" json:"role" xml:"role"`
+	Scopes     []string           `bson:"scopes" json:"scopes" xml:"scopes>scope"`
+	TenantId   string             `bson:"tenantId,omitempty" json:"-" xml:"-"`
+	CreatedBy  string             `bson:"createdBy" json:"createdBy" xml:"createdBy"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt" xml:"createdAt"`
+	ExpiresAt  *time.Time         `bson:"expiresAt,omitempty" json:"expiresAt,omitempty" xml:"expiresAt,omitempty"`
+	LastUsedAt *time.Time         `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty" xml:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time         `bson:"revokedAt,omitempty" json:"revokedAt,omitempty" xml:"revokedAt,omitempty"`
+}
+
+// Active reports whether the key can be used at now
+func (key *APIKey) Active(now time.Time) bool {
+	return key.RevokedAt == nil && (key.ExpiresAt == nil || now.Before(*key.ExpiresAt))
+}
+
+// APIKeyInput creates an API key
+type APIKeyInput struct {
+	Name      string     `json:"name" xml:"name"`
+	Role      string     `json:"role,omitempty" xml:"role,omitempty"`
+	Scopes    []string   `json:"scopes" xml:"scopes>scope"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" xml:"expiresAt,omitempty"`
+}
+
+// NewAPIKey is returned once on creation, the key cannot be shown again
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key" xml:"key"`
+}
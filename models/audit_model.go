@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditEvent records a security or compliance relevant action
+type AuditEvent struct {
+	Id      primitive.ObjectID     `bson:"_id" json:"id" xml:"id"`
+	Tenant  string                 `bson:"tenantId,omitempty" json:"tenantId,omitempty" xml:"tenantId,omitempty"`
+	Action  string                 `bson:"action" json:"action" xml:"action"`
+	Actor   string                 `bson:"actor" json:"actor" xml:"actor"`
+	Target  string                 `bson:"target,omitempty" json:"target,omitempty" xml:"target,omitempty"`
+	Details map[string]interface{} `bson:"details,omitempty" json:"details,omitempty" xml:"-"`
+	At      time.Time              `bson:"at" json:"at" xml:"at"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErasureTombstone proves that the personal data of a user was erased. It
+// keeps no personal data itself, only what was erased where and by whom.
+type ErasureTombstone struct {
+	UserId      primitive.ObjectID `bson:"_id" json:"userId" xml:"userId"`
+	RequestedBy string             `bson:"requestedBy" json:"requestedBy" xml:"requestedBy"`
+	// number of records anonymized or deleted per collection
+	Collections map[string]int64 `bson:"collections" json:"collections" xml:"-"`
+	ErasedAt    time.Time        `bson:"erasedAt" json:"erasedAt" xml:"erasedAt"`
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// jobs and their artifacts are kept in the configured database, whatever
+// the tenancy mode, jobs carry their tenant in tenantId
+const (
+	JobsCollection     = "jobs"
+	JobArtifactsBucket = "job_artifacts"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// Done reports whether the job reached a final status
+func (status JobStatus) Done() bool {
+	return status == JobSucceeded || status == JobFailed || status == JobCancelled
+}
+
+type JobProgress struct {
+	Done  int64 `bson:"done" json:"done" xml:"done"`
+	Total int64 `bson:"total" json:"total" xml:"total"`
+}
+
+// Job is a long-running operation executed by the worker pool
+type Job struct {
+	Id              primitive.ObjectID     `bson:"_id" json:"id" xml:"id"`
+	Type            string                 `bson:"type" json:"type" xml:"type"`
+	TenantId        string                 `bson:"tenantId,omitempty" json:"-" xml:"-"`
+	Status          JobStatus              `bson:"status" json:"status" xml:"status"`
+	Params          map[string]interface{} `bson:"params,omitempty" json:"params,omitempty" xml:"-"`
+	Progress        JobProgress            `bson:"progress" json:"progress" xml:"progress"`
+	Result          map[string]interface{} `bson:"result,omitempty" json:"result,omitempty" xml:"-"`
+	ResultFileId    *primitive.ObjectID    `bson:"resultFileId,omitempty" json:"resultFileId,omitempty" xml:"resultFileId,omitempty"`
+	Error           string                 `bson:"error,omitempty" json:"error,omitempty" xml:"error,omitempty"`
+	CancelRequested bool                   `bson:"cancelRequested" json:"cancelRequested" xml:"cancelRequested"`
+	// processing list of the worker running the job
+	Worker     string     `bson:"worker,omitempty" json:"-" xml:"-"`
+	CreatedAt  time.Time  `bson:"createdAt" json:"createdAt" xml:"createdAt"`
+	StartedAt  *time.Time `bson:"startedAt,omitempty" json:"startedAt,omitempty" xml:"startedAt,omitempty"`
+	FinishedAt *time.Time `bson:"finishedAt,omitempty" json:"finishedAt,omitempty" xml:"finishedAt,omitempty"`
+}
@@ -0,0 +1,22 @@
+package models
+
+// LoginInput are the credentials exchanged for tokens
+type LoginInput struct {
+	Username string `json:"username" xml:"username"`
+	Password string `json:"password" xml:"password"`
+	// current code of the authenticator app or a recovery code, for accounts with two-factor authentication
+	OTP string `json:"otp,omitempty" xml:"otp,omitempty"`
+}
+
+// RefreshInput carries the refresh token of /auth/refresh and /auth/logout
+type RefreshInput struct {
+	RefreshToken string `json:"refreshToken" xml:"refreshToken"`
+}
+
+// TokenPair is a short-lived access token and the refresh token renewing it
+type TokenPair struct {
+	AccessToken  string `json:"accessToken" xml:"accessToken"`
+	TokenType    string `json:"tokenType" xml:"tokenType"`
+	ExpiresIn    int64  `json:"expiresIn" xml:"expiresIn"`
+	RefreshToken string `json:"refreshToken" xml:"refreshToken"`
+}
@@ -1,25 +1,75 @@
 package models
 
 import (
+	"regexp"
+
 	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type User struct {
-	Id        primitive.ObjectID `bson:"_id" json:"id,omitempty"`
-	FirstName string             `bson:"firstName" json:"firstName" validate:"required"`
-	LastName  string             `bson:"lastName" json:"lastName" validate:"required"`
-	Bio       string             `json:"bio,omitempty"`
-	Age       int                `json:"age,omitempty"`
-	Gender    string             `json:"gender,omitempty"`
+	Id        primitive.ObjectID `bson:"_id" json:"id,omitempty" xml:"id,omitempty"`
+	FirstName string             `bson:"firstName" json:"firstName" xml:"firstName" validate:"required"`
+	LastName  string             `bson:"lastName" json:"lastName" xml:"lastName" validate:"required"`
+	Email     string             `bson:"email,omitempty" json:"email,omitempty" xml:"email,omitempty"`
+	Bio       string             `json:"bio,omitempty" xml:"bio,omitempty"`
+	Age       int                `json:"age,omitempty" xml:"age,omitempty"`
+	Gender    string             `json:"gender,omitempty" xml:"gender,omitempty"`
+}
+
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// IsEmail reports whether s looks like an email address
+func IsEmail(s string) bool {
+	return emailPattern.MatchString(s)
 }
 
 func (user User) ValidateUser() error {
 	err := validation.ValidateStruct(&user,
 		validation.Field(&user.FirstName, validation.Required),
 		validation.Field(&user.LastName, validation.Required),
+		validation.Field(&user.Email, validation.Match(emailPattern)),
 		validation.Field(&user.Age, validation.Min(1)),
 		validation.Field(&user.Gender, validation.In("Male", "Female", "Others")),
 	)
 	return err
 }
+
+// UserFilter selects users for exports and bulk operations, zero values match everything
+type UserFilter struct {
+	FirstName string `json:"firstName,omitempty" query:"firstName"`
+	LastName  string `json:"lastName,omitempty" query:"lastName"`
+	Email     string `json:"email,omitempty" query:"email"`
+	Gender    string `json:"gender,omitempty" query:"gender"`
+	MinAge    int    `json:"minAge,omitempty" query:"minAge"`
+	MaxAge    int    `json:"maxAge,omitempty" query:"maxAge"`
+}
+
+func (filter UserFilter) BSON() bson.M {
+	query := bson.M{}
+	if filter.FirstName != "" {
+		query["firstName"] = filter.FirstName
+	}
+	if filter.LastName != "" {
+		query["lastName"] = filter.LastName
+	}
+	if filter.Email != "" {
+		query["email"] = filter.Email
+	}
+	if filter.Gender != "" {
+		query["gender"] = filter.Gender
+	}
+
+	age := bson.M{}
+	if filter.MinAge > 0 {
+		age["$gte"] = filter.MinAge
+	}
+	if filter.MaxAge > 0 {
+		age["$lte"] = filter.MaxAge
+	}
+	if len(age) > 0 {
+		query["age"] = age
+	}
+	return query
+}
@@ -0,0 +1,209 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnknownKey = errors.New("oidc: unknown signing key")
+
+// JWK is a JSON web key, only public RSA, EC and Ed25519 keys are used
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JWKS caches the key set of an issuer. It is fetched again once its max-age
+// runs out and, at most once per minRefresh, when a token names a key it does
+// not know yet, which is how issuers roll their keys.
+type JWKS struct {
+	url        string
+	client     *http.Client
+	minRefresh time.Duration
+	maxAge     time.Duration
+	now        func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]publicKey
+	fetchedAt time.Time
+	expiresAt time.Time
+}
+
+type publicKey struct {
+	key crypto.PublicKey
+	alg string
+}
+
+// Constructor, maxAge applies when the response carries no Cache-Control max-age
+func NewJWKS(url string, client *http.Client, maxAge time.Duration) *JWKS {
+	return &JWKS{
+		url:        url,
+		client:     client,
+		minRefresh: time.Minute,
+		maxAge:     maxAge,
+		now:        time.Now,
+	}
+}
+
+// Key returns the key with the given id and the algorithm it is restricted
+// to, empty when the key set does not say
+func (ks *JWKS) Key(ctx context.Context, kid string) (crypto.PublicKey, string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := ks.now()
+	if ks.keys == nil || now.After(ks.expiresAt) {
+		if err := ks.refresh(ctx); err != nil {
+			if ks.keys == nil {
+				return nil, "", err
+			}
+			log.Printf("oidc: refreshing %s failed, using cached keys: %v", ks.url, err)
+		}
+	}
+
+	key, ok := ks.keys[kid]
+	if !ok && now.Sub(ks.fetchedAt) >= ks.minRefresh {
+		if err := ks.refresh(ctx); err != nil {
+			return nil, "", err
+		}
+		key, ok = ks.keys[kid]
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	return key.key, key.alg, nil
+}
+
+// refresh fetches the key set, the cached keys stay in place when it fails
+func (ks *JWKS) refresh(ctx context.Context) error {
+	ks.fetchedAt = ks.now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("oidc: fetching keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: fetching keys: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("oidc: decoding keys: %w", err)
+	}
+
+	keys := map[string]publicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			// issuers publish key types we do not use, they are skipped
+			continue
+		}
+		keys[jwk.Kid] = publicKey{key: key, alg: jwk.Alg}
+	}
+
+	ks.keys = keys
+	ks.expiresAt = ks.fetchedAt.Add(cacheMaxAge(resp.Header.Get("Cache-Control"), ks.maxAge))
+	return nil
+}
+
+// PublicKey decodes the key
+func (jwk JWK) PublicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("oidc: invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("oidc: unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("oidc: EC key %s is not on %s", jwk.Kid, jwk.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("oidc: unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("oidc: invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("oidc: unsupported key type %q", jwk.Kty)
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(raw) == 0 {
+		return nil, fmt.Errorf("oidc: invalid key parameter")
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+func cacheMaxAge(header string, fallback time.Duration) time.Duration {
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return fallback
+}
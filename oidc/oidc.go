@@ -0,0 +1,268 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mattchw/go-onboard/tokens"
+)
+
+// algorithms accepted from identity providers, never none or HMAC
+var validMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// RoleMapping gives the local Role to tokens whose role claim holds Value
+type RoleMapping struct {
+	Value string
+	Role  string
+}
+
+// Config of a resource server accepting the access tokens of an issuer
+type Config struct {
+	Issuer   string
+	Audience string
+	// every one of them has to be in the scope (or scp) claim
+	RequiredScopes []string
+	// claim holding the groups or roles of the subject, dots reach into
+	// nested objects like realm_access.roles
+	RoleClaim string
+	// checked in order, the first match decides the local role
+	Roles []RoleMapping
+	// claims holding the local user id and the tenant of the subject, the
+	// uid and tenant claims are left out of local claims when empty
+	UserClaim   string
+	TenantClaim string
+	// clock skew tolerated on exp, nbf and iat
+	Leeway time.Duration
+	// fallback lifetime of the cached key set
+	KeysMaxAge time.Duration
+	// least time between fetches for keys the cached set does not know
+	KeysMinRefresh time.Duration
+	Client         *http.Client
+}
+
+// Verifier validates the access tokens of an issuer and maps them to local claims
+type Verifier struct {
+	config Config
+	keys   *JWKS
+	now    func() time.Time
+}
+
+type discoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// Discover reads the discovery document of config.Issuer and returns a
+// verifier for its tokens
+func Discover(ctx context.Context, config Config) (*Verifier, error) {
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if config.KeysMaxAge == 0 {
+		config.KeysMaxAge = time.Hour
+	}
+
+	url := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := config.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: discovery: %s", resp.Status)
+	}
+
+	var doc discoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("oidc: decoding discovery document: %w", err)
+	}
+	// a document for another issuer would let that issuer's tokens in
+	if doc.Issuer != config.Issuer {
+		return nil, fmt.Errorf("oidc: discovery document is for issuer %q, expected %q", doc.Issuer, config.Issuer)
+	}
+	if doc.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document has no jwks_uri")
+	}
+
+	keys := NewJWKS(doc.JWKSURI, config.Client, config.KeysMaxAge)
+	if config.KeysMinRefresh > 0 {
+		keys.minRefresh = config.KeysMinRefresh
+	}
+	return &Verifier{config: config, keys: keys, now: time.Now}, nil
+}
+
+// Issuer returns the iss claim of the tokens the verifier accepts
+func (v *Verifier) Issuer() string {
+	return v.config.Issuer
+}
+
+// Verify validates an access token and returns the claims local middleware
+// understands. The scope and role claims of the issuer are replaced, role by
+// the mapped local role and scope dropped, and name holds the username.
+func (v *Verifier) Verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	parser := jwt.Parser{ValidMethods: validMethods, SkipClaimsValidation: true}
+	claims := jwt.MapClaims{}
+
+	var fetchErr error
+	_, err := parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, alg, err := v.keys.Key(ctx, kid)
+		if err != nil {
+			if !errors.Is(err, ErrUnknownKey) {
+				fetchErr = err
+			}
+			return nil, err
+		}
+		if alg != "" && alg != t.Method.Alg() {
+			return nil, fmt.Errorf("oidc: key %s does not sign %s tokens", kid, t.Method.Alg())
+		}
+		if !keyFits(key, t.Method) {
+			return nil, fmt.Errorf("oidc: key %s cannot verify %s tokens", kid, t.Method.Alg())
+		}
+		return key, nil
+	})
+	// the issuer being unreachable says nothing about the token
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", tokens.ErrInvalidToken, err)
+	}
+
+	if err := v.validate(claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", tokens.ErrInvalidToken, err)
+	}
+	return v.localClaims(claims), nil
+}
+
+func (v *Verifier) validate(claims jwt.MapClaims) error {
+	now := v.now()
+	leeway := v.config.Leeway
+	if !claims.VerifyExpiresAt(now.Add(-leeway).Unix(), true) {
+		return errors.New("expired")
+	}
+	if !claims.VerifyNotBefore(now.Add(leeway).Unix(), false) || !claims.VerifyIssuedAt(now.Add(leeway).Unix(), false) {
+		return errors.New("not valid yet")
+	}
+	if !claims.VerifyIssuer(v.config.Issuer, true) {
+		return errors.New("wrong issuer")
+	}
+	if !claims.VerifyAudience(v.config.Audience, true) {
+		return errors.New("wrong audience")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return errors.New("missing subject")
+	}
+
+	granted := map[string]bool{}
+	for _, scope := range stringList(claims["scope"]) {
+		granted[scope] = true
+	}
+	for _, scope := range stringList(claims["scp"]) {
+		granted[scope] = true
+	}
+	for _, scope := range v.config.RequiredScopes {
+		if !granted[scope] {
+			return fmt.Errorf("missing scope %s", scope)
+		}
+	}
+	return nil
+}
+
+// localClaims keeps what the issuer is trusted with, anything else it puts
+// in its tokens could otherwise pass for a local claim like uid or tenant
+func (v *Verifier) localClaims(claims jwt.MapClaims) map[string]interface{} {
+	local := map[string]interface{}{"sub": claims["sub"]}
+	if amr, ok := claims["amr"]; ok {
+		local["amr"] = amr
+	}
+	if v.config.UserClaim != "" {
+		if uid, ok := claims[v.config.UserClaim].(string); ok && uid != "" {
+			local["uid"] = uid
+		}
+	}
+	if v.config.TenantClaim != "" {
+		if tenant, ok := claims[v.config.TenantClaim].(string); ok && tenant != "" {
+			local["tenant"] = tenant
+		}
+	}
+
+	if role := v.mapRole(claims); role != "" {
+		local["role"] = role
+	}
+	for _, name := range []string{"preferred_username", "email", "sub"} {
+		if value, ok := claims[name].(string); ok && value != "" {
+			local["name"] = value
+			break
+		}
+	}
+	return local
+}
+
+func (v *Verifier) mapRole(claims jwt.MapClaims) string {
+	if v.config.RoleClaim == "" {
+		return ""
+	}
+
+	var value interface{} = map[string]interface{}(claims)
+	for _, part := range strings.Split(v.config.RoleClaim, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[part]
+	}
+
+	held := map[string]bool{}
+	for _, item := range stringList(value) {
+		held[item] = true
+	}
+	for _, mapping := range v.config.Roles {
+		if held[mapping.Value] {
+			return mapping.Role
+		}
+	}
+	return ""
+}
+
+// stringList reads claims that are either a space separated string or an array of strings
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func keyFits(key interface{}, method jwt.SigningMethod) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(method.Alg(), "RS") || strings.HasPrefix(method.Alg(), "PS")
+	case *ecdsa.PublicKey:
+		return strings.HasPrefix(method.Alg(), "ES")
+	case ed25519.PublicKey:
+		return method.Alg() == "EdDSA"
+	}
+	return false
+}
@@ -0,0 +1,315 @@
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed openapi.json
+var specJSON []byte
+
+// Document is the subset of an OpenAPI 3 document needed for request validation
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Servers    []Server            `json:"servers"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+
+	raw []byte
+}
+
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// Server is a base path the paths of the document are served under
+type Server struct {
+	URL string `json:"url"`
+}
+
+type Components struct {
+	Parameters map[string]*Parameter `json:"parameters"`
+	Schemas    map[string]*Schema    `json:"schemas"`
+}
+
+type PathItem struct {
+	Parameters []*Parameter `json:"parameters"`
+	Get        *Operation   `json:"get"`
+	Post       *Operation   `json:"post"`
+	Put        *Operation   `json:"put"`
+	Patch      *Operation   `json:"patch"`
+	Delete     *Operation   `json:"delete"`
+}
+
+type Operation struct {
+	OperationID string       `json:"operationId"`
+	Parameters  []*Parameter `json:"parameters"`
+	RequestBody *RequestBody `json:"requestBody"`
+}
+
+type Parameter struct {
+	Ref      string  `json:"$ref"`
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Load parses the OpenAPI document embedded in the binary
+func Load() (*Document, error) {
+	return Parse(specJSON)
+}
+
+// MustLoad is like Load but panics if the embedded document is invalid
+func MustLoad() *Document {
+	doc, err := Load()
+	if err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+// Parse decodes an OpenAPI document and resolves its local references
+func Parse(data []byte) (*Document, error) {
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("openapi: %w", err)
+	}
+	doc.raw = data
+
+	if err := doc.resolve(); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// JSON returns the document as it was loaded
+func (doc *Document) JSON() []byte {
+	return doc.raw
+}
+
+// Operation finds the operation serving method and path along with the
+// values of its path parameters. Literal paths win over templated ones, among
+// templates with as many parameters the one with the longest literal prefix.
+func (doc *Document) Operation(method string, path string) (*Operation, []*Parameter, map[string]string, bool) {
+	var (
+		bestOp     *Operation
+		bestParams []*Parameter
+		bestValues map[string]string
+		bestScore  = -1
+	)
+
+	// in sorted order literal segments come before templated ones, "{" sorts
+	// after letters and digits, and ties always go to the same template
+	templates := make([]string, 0, len(doc.Paths))
+	for template := range doc.Paths {
+		templates = append(templates, template)
+	}
+	sort.Strings(templates)
+
+	for _, candidate := range doc.relativePaths(path) {
+		for _, template := range templates {
+			item := doc.Paths[template]
+			values, ok := matchPath(template, candidate)
+			if !ok {
+				continue
+			}
+			op := item.operation(method)
+			if op == nil {
+				continue
+			}
+			// fewer templated segments means a more specific match
+			score := 1000 - len(values)
+			if score > bestScore {
+				bestOp, bestValues, bestScore = op, values, score
+				bestParams = mergeParameters(item.Parameters, op.Parameters)
+			}
+		}
+	}
+
+	return bestOp, bestParams, bestValues, bestOp != nil
+}
+
+// the request path itself plus the path relative to every server it is under
+func (doc *Document) relativePaths(path string) []string {
+	paths := []string{path}
+	for _, server := range doc.Servers {
+		base := strings.TrimRight(server.URL, "/")
+		if base == "" {
+			continue
+		}
+		if path == base {
+			paths = append(paths, "/")
+		} else if strings.HasPrefix(path, base+"/") {
+			paths = append(paths, strings.TrimPrefix(path, base))
+		}
+	}
+	return paths
+}
+
+func (item PathItem) operation(method string) *Operation {
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD":
+		return item.Get
+	case "POST":
+		return item.Post
+	case "PUT":
+		return item.Put
+	case "PATCH":
+		return item.Patch
+	case "DELETE":
+		return item.Delete
+	}
+	return nil
+}
+
+// operation level parameters override path level ones with the same name and location
+func mergeParameters(pathParams []*Parameter, opParams []*Parameter) []*Parameter {
+	merged := make([]*Parameter, 0, len(pathParams)+len(opParams))
+	for _, p := range pathParams {
+		overridden := false
+		for _, o := range opParams {
+			if o.Name == p.Name && o.In == p.In {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			merged = append(merged, p)
+		}
+	}
+	return append(merged, opParams...)
+}
+
+func matchPath(template string, path string) (map[string]string, bool) {
+	tSegs := strings.Split(strings.Trim(template, "/"), "/")
+	pSegs := strings.Split(strings.Trim(path, "/"), "/")
+	if len(tSegs) != len(pSegs) {
+		return nil, false
+	}
+
+	values := map[string]string{}
+	for i, seg := range tSegs {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if pSegs[i] == "" {
+				return nil, false
+			}
+			values[seg[1:len(seg)-1]] = pSegs[i]
+			continue
+		}
+		if seg != pSegs[i] {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+func (doc *Document) resolve() error {
+	for _, schema := range doc.Components.Schemas {
+		if err := doc.resolveSchema(schema, 0); err != nil {
+			return err
+		}
+	}
+	for name, param := range doc.Components.Parameters {
+		resolved, err := doc.resolveParameter(param)
+		if err != nil {
+			return err
+		}
+		doc.Components.Parameters[name] = resolved
+	}
+
+	for template, item := range doc.Paths {
+		if err := doc.resolveParameters(item.Parameters); err != nil {
+			return err
+		}
+		for _, op := range []*Operation{item.Get, item.Post, item.Put, item.Patch, item.Delete} {
+			if op == nil {
+				continue
+			}
+			if err := doc.resolveParameters(op.Parameters); err != nil {
+				return err
+			}
+			if op.RequestBody == nil {
+				continue
+			}
+			for mediaType, content := range op.RequestBody.Content {
+				if err := doc.resolveSchema(content.Schema, 0); err != nil {
+					return fmt.Errorf("openapi: %s %s: %w", template, mediaType, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (doc *Document) resolveParameters(params []*Parameter) error {
+	for i, param := range params {
+		resolved, err := doc.resolveParameter(param)
+		if err != nil {
+			return err
+		}
+		params[i] = resolved
+	}
+	return nil
+}
+
+func (doc *Document) resolveParameter(param *Parameter) (*Parameter, error) {
+	if param.Ref != "" {
+		name := strings.TrimPrefix(param.Ref, "#/components/parameters/")
+		target, ok := doc.Components.Parameters[name]
+		if !ok || name == param.Ref {
+			return nil, fmt.Errorf("openapi: unresolved reference %q", param.Ref)
+		}
+		param = target
+	}
+	return param, doc.resolveSchema(param.Schema, 0)
+}
+
+func (doc *Document) resolveSchema(schema *Schema, depth int) error {
+	if schema == nil {
+		return nil
+	}
+	if depth > 32 {
+		return fmt.Errorf("openapi: schema nesting too deep")
+	}
+
+	if schema.Ref != "" && schema.resolved == nil {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		target, ok := doc.Components.Schemas[name]
+		if !ok || name == schema.Ref {
+			return fmt.Errorf("openapi: unresolved reference %q", schema.Ref)
+		}
+		schema.resolved = target
+	}
+
+	// a pattern that does not compile would turn its validation off
+	if schema.Pattern != "" && schema.regex == nil {
+		re, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			return fmt.Errorf("openapi: invalid pattern %q: %w", schema.Pattern, err)
+		}
+		schema.regex = re
+	}
+
+	for _, prop := range schema.Properties {
+		if err := doc.resolveSchema(prop, depth+1); err != nil {
+			return err
+		}
+	}
+	return doc.resolveSchema(schema.Items, depth+1)
+}
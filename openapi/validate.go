@@ -0,0 +1,336 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is the subset of JSON schema supported by the validator
+type Schema struct {
+	Ref        string             `json:"$ref"`
+	Type       string             `json:"type"`
+	Format     string             `json:"format"`
+	Pattern    string             `json:"pattern"`
+	Enum       []interface{}      `json:"enum"`
+	Minimum    *float64           `json:"minimum"`
+	Maximum    *float64           `json:"maximum"`
+	MinLength  *int               `json:"minLength"`
+	MaxLength  *int               `json:"maxLength"`
+	MinItems   *int               `json:"minItems"`
+	MaxItems   *int               `json:"maxItems"`
+	Required   []string           `json:"required"`
+	Properties map[string]*Schema `json:"properties"`
+	Items      *Schema            `json:"items"`
+	Nullable   bool               `json:"nullable"`
+
+	AdditionalProperties *bool `json:"additionalProperties"`
+
+	resolved *Schema
+	// compiled by Parse
+	regex *regexp.Regexp
+}
+
+// FieldError describes a single part of a request that failed validation
+type FieldError struct {
+	In      string `json:"in" xml:"in"`
+	Field   string `json:"field" xml:"field"`
+	Message string `json:"message" xml:"message"`
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.In, e.Field, e.Message)
+}
+
+// Request carries the parts of an HTTP request that can be validated
+type Request struct {
+	Method      string
+	Path        string
+	Query       url.Values
+	ContentType string
+	Body        []byte
+}
+
+// Validate checks req against the matching operation. Requests for
+// operations missing from the document are not validated.
+func (doc *Document) Validate(req Request) []FieldError {
+	op, params, pathValues, ok := doc.Operation(req.Method, req.Path)
+	if !ok {
+		return nil
+	}
+
+	var errs []FieldError
+	for _, param := range params {
+		var (
+			raw     string
+			present bool
+		)
+		switch param.In {
+		case "path":
+			raw, present = pathValues[param.Name]
+			if present {
+				if unescaped, err := url.PathUnescape(raw); err == nil {
+					raw = unescaped
+				}
+			}
+		case "query":
+			_, present = req.Query[param.Name]
+			raw = req.Query.Get(param.Name)
+		default:
+			continue
+		}
+
+		if !present {
+			if param.Required {
+				errs = append(errs, FieldError{In: param.In, Field: param.Name, Message: "is required"})
+			}
+			continue
+		}
+		errs = append(errs, param.Schema.validateString(param.In, param.Name, raw)...)
+	}
+
+	if op.RequestBody != nil {
+		errs = append(errs, op.RequestBody.validate(req.ContentType, req.Body)...)
+	}
+
+	return errs
+}
+
+func (rb *RequestBody) validate(contentType string, body []byte) []FieldError {
+	if len(bytes.TrimSpace(body)) == 0 {
+		if rb.Required {
+			return []FieldError{{In: "body", Field: "", Message: "is required"}}
+		}
+		return nil
+	}
+
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	if mediaType == "" {
+		mediaType = "application/json"
+	}
+	// bodies in media types the document does not describe are left to the handlers
+	content, ok := rb.Content[mediaType]
+	if !ok || content.Schema == nil {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return []FieldError{{In: "body", Field: "", Message: "is not valid JSON: " + err.Error()}}
+	}
+
+	return content.Schema.validate("body", "", value)
+}
+
+func (s *Schema) target() *Schema {
+	if s != nil && s.resolved != nil {
+		return s.resolved.target()
+	}
+	return s
+}
+
+// parameters arrive as strings so they are converted according to the schema type first
+func (s *Schema) validateString(in string, field string, raw string) []FieldError {
+	s = s.target()
+	if s == nil {
+		return nil
+	}
+
+	var value interface{} = raw
+	switch s.Type {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			return []FieldError{{In: in, Field: field, Message: "must be a " + s.Type}}
+		}
+		value = json.Number(raw)
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return []FieldError{{In: in, Field: field, Message: "must be a boolean"}}
+		}
+		value = b
+	case "array":
+		items := []interface{}{}
+		for _, item := range strings.Split(raw, ",") {
+			items = append(items, item)
+		}
+		if s.Items != nil && s.Items.target() != nil && s.Items.target().Type != "string" {
+			var errs []FieldError
+			for i, item := range items {
+				errs = append(errs, s.Items.validateString(in, fmt.Sprintf("%s[%d]", field, i), item.(string))...)
+			}
+			if len(errs) > 0 {
+				return errs
+			}
+		}
+		value = items
+	}
+
+	return s.validate(in, field, value)
+}
+
+func (s *Schema) validate(in string, field string, value interface{}) []FieldError {
+	s = s.target()
+	if s == nil {
+		return nil
+	}
+
+	fail := func(format string, args ...interface{}) []FieldError {
+		return []FieldError{{In: in, Field: field, Message: fmt.Sprintf(format, args...)}}
+	}
+
+	if value == nil {
+		if s.Nullable || s.Type == "" {
+			return nil
+		}
+		return fail("must not be null")
+	}
+
+	if len(s.Enum) > 0 && !inEnum(s.Enum, value) {
+		return fail("must be one of %s", formatEnum(s.Enum))
+	}
+
+	switch s.Type {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		length := len([]rune(str))
+		if s.MinLength != nil && length < *s.MinLength {
+			return fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fail("must be at most %d characters long", *s.MaxLength)
+		}
+		if s.regex != nil && !s.regex.MatchString(str) {
+			return fail("must match pattern %s", s.Pattern)
+		}
+		if !validFormat(s.Format, str) {
+			return fail("must be a valid %s", s.Format)
+		}
+	case "integer", "number":
+		num, ok := value.(json.Number)
+		if !ok {
+			return fail("must be a %s", s.Type)
+		}
+		f, err := num.Float64()
+		if err != nil {
+			return fail("must be a %s", s.Type)
+		}
+		if s.Type == "integer" && f != math.Trunc(f) {
+			return fail("must be an integer")
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fail("must be greater than or equal to %s", formatNumber(*s.Minimum))
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fail("must be less than or equal to %s", formatNumber(*s.Maximum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fail("must be a boolean")
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fail("must be an array")
+		}
+		if s.MinItems != nil && len(items) < *s.MinItems {
+			return fail("must contain at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(items) > *s.MaxItems {
+			return fail("must contain at most %d items", *s.MaxItems)
+		}
+		var errs []FieldError
+		for i, item := range items {
+			errs = append(errs, s.Items.validate(in, fmt.Sprintf("%s[%d]", field, i), item)...)
+		}
+		return errs
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fail("must be an object")
+		}
+		var errs []FieldError
+		for _, name := range s.Required {
+			if _, present := obj[name]; !present {
+				errs = append(errs, FieldError{In: in, Field: joinField(field, name), Message: "is required"})
+			}
+		}
+
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, known := s.Properties[name]
+			if !known {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					errs = append(errs, FieldError{In: in, Field: joinField(field, name), Message: "is not allowed"})
+				}
+				continue
+			}
+			errs = append(errs, prop.validate(in, joinField(field, name), obj[name])...)
+		}
+		return errs
+	}
+
+	return nil
+}
+
+// validFormat checks the string formats the validator knows, others are
+// annotations and always pass
+func validFormat(format string, value string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, value)
+		return err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", value)
+		return err == nil
+	case "email":
+		address, err := mail.ParseAddress(value)
+		return err == nil && address.Address == value
+	}
+	return true
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if fmt.Sprint(allowed) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatEnum(enum []interface{}) string {
+	values := make([]string, len(enum))
+	for i, v := range enum {
+		values[i] = fmt.Sprint(v)
+	}
+	return "[" + strings.Join(values, ", ") + "]"
+}
+
+func formatNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func joinField(parent string, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
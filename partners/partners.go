@@ -0,0 +1,176 @@
+package partners
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/mattchw/go-onboard/signing"
+)
+
+// secrets shorter than this are refused, HMAC-SHA256 keys should have 256 bits
+const minSecretLength = 32
+
+var (
+	ErrInvalidSignature = errors.New("partners: invalid signature")
+	ErrStaleRequest     = errors.New("partners: request timestamp outside the allowed window")
+	ErrReplayedRequest  = errors.New("partners: request already received")
+)
+
+// Partner signs its requests with one of its secrets, more than one lets it
+// rotate them. Its requests get the role and scopes of the partner.
+type Partner struct {
+	Id      string   `json:"id"`
+	Secrets []string `json:"secrets"`
+	Role    string   `json:"role"`
+	Scopes  []string `json:"scopes"`
+	Tenant  string   `json:"tenant,omitempty"`
+}
+
+// Registry maps key ids to partners
+type Registry map[string]*Partner
+
+// Load reads partners from a JSON file holding {"partners": [...]}
+func Load(path string) (Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("partners: reading partners: %w", err)
+	}
+	return Parse(data)
+}
+
+// Parse reads partners from JSON, every partner needs an id and secrets long enough
+func Parse(data []byte) (Registry, error) {
+	var file struct {
+		Partners []*Partner `json:"partners"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("partners: parsing partners: %w", err)
+	}
+
+	registry := Registry{}
+	for _, partner := range file.Partners {
+		if partner == nil || partner.Id == "" {
+			return nil, errors.New("partners: a partner has no id")
+		}
+		if _, ok := registry[partner.Id]; ok {
+			return nil, fmt.Errorf("partners: partner %s is defined twice", partner.Id)
+		}
+		if len(partner.Secrets) == 0 {
+			return nil, fmt.Errorf("partners: partner %s has no secret", partner.Id)
+		}
+		for _, secret := range partner.Secrets {
+			if len(secret) < minSecretLength {
+				return nil, fmt.Errorf("partners: a secret of partner %s is shorter than %d characters", partner.Id, minSecretLength)
+			}
+		}
+		registry[partner.Id] = partner
+	}
+	return registry, nil
+}
+
+// Request is what the signature of a request covers, as received
+type Request struct {
+	KeyId     string
+	Method    string
+	Target    string
+	Timestamp string
+	Nonce     string
+	Signature string
+	Body      []byte
+}
+
+// NonceCache remembers the nonces of received requests
+type NonceCache interface {
+	// Claim reports whether the nonce of the partner is new, it is then
+	// remembered for ttl
+	Claim(ctx context.Context, partner string, nonce string, ttl time.Duration) (bool, error)
+}
+
+// Verifier checks the signatures of partner requests. Timestamps may be
+// skew away from the clock of the server in either direction, nonces are
+// remembered as long as their request could still be accepted.
+type Verifier struct {
+	partners Registry
+	nonces   NonceCache
+	skew     time.Duration
+	now      func() time.Time
+}
+
+// Constructor
+func NewVerifier(partners Registry, nonces NonceCache, skew time.Duration) *Verifier {
+	return &Verifier{
+		partners: partners,
+		nonces:   nonces,
+		skew:     skew,
+		now:      time.Now,
+	}
+}
+
+// WithClock returns a copy of the verifier reading the time from now
+func (v *Verifier) WithClock(now func() time.Time) *Verifier {
+	copy := *v
+	copy.now = now
+	return &copy
+}
+
+// Verify returns the partner that signed req. The nonce is only claimed once
+// the signature checked out, so unsigned requests cannot fill the cache.
+func (v *Verifier) Verify(ctx context.Context, req Request) (*Partner, error) {
+	partner, ok := v.partners[req.KeyId]
+	if !ok || req.Nonce == "" || len(req.Nonce) > 128 {
+		return nil, ErrInvalidSignature
+	}
+
+	unix, err := strconv.ParseInt(req.Timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	if age := v.now().Sub(time.Unix(unix, 0)); age > v.skew || age < -v.skew {
+		return nil, ErrStaleRequest
+	}
+
+	stringToSign := signing.StringToSign(req.Method, req.Target, req.Timestamp, req.Nonce, signing.BodyHash(req.Body))
+	valid := false
+	for _, secret := range partner.Secrets {
+		if signing.Valid([]byte(secret), stringToSign, req.Signature) {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, ErrInvalidSignature
+	}
+
+	fresh, err := v.nonces.Claim(ctx, partner.Id, req.Nonce, 2*v.skew)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, ErrReplayedRequest
+	}
+	return partner, nil
+}
+
+// RedisNonces keeps nonces in Redis, shared by every replica
+type RedisNonces struct {
+	rdb    redis.Cmdable
+	prefix string
+}
+
+// Constructor
+func NewRedisNonces(rdb redis.Cmdable) *RedisNonces {
+	return &RedisNonces{
+		rdb:    rdb,
+		prefix: "nonce:",
+	}
+}
+
+// implement Claim
+func (rn *RedisNonces) Claim(ctx context.Context, partner string, nonce string, ttl time.Duration) (bool, error) {
+	return rn.rdb.SetNX(ctx, rn.prefix+partner+":"+nonce, 1, ttl).Result()
+}
@@ -0,0 +1,75 @@
+package passwords
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// VerifyCache remembers successful verifications for a short while, so
+// clients sending their password with every request, like basic auth, do not
+// pay for a full argon2id hash each time. Entries are keyed by an HMAC of the
+// hash and the password under a random key of the process, the password is
+// never kept and a new hash, after a password change, misses.
+type VerifyCache struct {
+	key  []byte
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]time.Time
+}
+
+// Constructor
+func NewVerifyCache(size int, ttl time.Duration) *VerifyCache {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &VerifyCache{
+		key:     key,
+		size:    size,
+		ttl:     ttl,
+		entries: map[[sha256.Size]byte]time.Time{},
+	}
+}
+
+// Verify is like the package Verify, passwords that matched hash within the
+// ttl are not hashed again. Failures are never cached.
+func (vc *VerifyCache) Verify(hash string, password string) error {
+	mac := hmac.New(sha256.New, vc.key)
+	mac.Write([]byte(hash))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	var entry [sha256.Size]byte
+	copy(entry[:], mac.Sum(nil))
+
+	now := time.Now()
+	vc.mu.Lock()
+	expires, ok := vc.entries[entry]
+	vc.mu.Unlock()
+	if ok && now.Before(expires) {
+		return nil
+	}
+
+	if err := Verify(hash, password); err != nil {
+		return err
+	}
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if len(vc.entries) >= vc.size {
+		for key, expires := range vc.entries {
+			if !now.Before(expires) {
+				delete(vc.entries, key)
+			}
+		}
+	}
+	// when still full the verification is simply not remembered
+	if len(vc.entries) < vc.size {
+		vc.entries[entry] = now.Add(vc.ttl)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package policies
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/rbac"
+	"github.com/mattchw/go-onboard/responses"
+)
+
+// OwnUser lets callers whose role grants users:any act on every user and
+// others only on the user they are, named by the uid claim or the user id of
+// their account. It runs after Permit, between the routes and the
+// controllers. Users the caller cannot act on are reported missing, like
+// users that do not exist, so their existence does not leak.
+func OwnUser(param string) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if actsOnAnyUser(c) {
+			return c.Next()
+		}
+		if self := CallerUserId(c); self == "" || self != c.Params(param) {
+			return responses.Error(c, http.StatusNotFound, "User not found")
+		}
+		return c.Next()
+	}
+}
+
+// AnyUser requires a role granting users:any, for routes reaching every user
+func AnyUser(c *fiber.Ctx) error {
+	if !actsOnAnyUser(c) {
+		return responses.Error(c, http.StatusForbidden, "Missing permission "+models.PermUsersAny)
+	}
+	return c.Next()
+}
+
+// CallerUserId returns the id of the user the caller is, empty when they are none
+func CallerUserId(c *fiber.Ctx) string {
+	if claims, ok := c.Locals(middlewares.ClaimsKey).(map[string]interface{}); ok {
+		if uid, ok := claims["uid"].(string); ok {
+			return uid
+		}
+	}
+	if account, ok := c.Locals(middlewares.AccountKey).(*models.Account); ok {
+		return account.UserId
+	}
+	return ""
+}
+
+func actsOnAnyUser(c *fiber.Ctx) bool {
+	role, ok := c.Locals(middlewares.RoleKey).(*rbac.Role)
+	return ok && role.Can(models.PermUsersAny)
+}
@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Limit allows Requests per Period, all of them may be used in a burst
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseLimit parses limits written as <requests>/<period>, e.g. 100/1m
+func ParseLimit(value string) (Limit, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("ratelimit: invalid limit %q, expected <requests>/<period>", value)
+	}
+	requests, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || requests < 1 {
+		return Limit{}, fmt.Errorf("ratelimit: invalid request count in %q", value)
+	}
+	period, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || period <= 0 {
+		return Limit{}, fmt.Errorf("ratelimit: invalid period in %q", value)
+	}
+	return Limit{Requests: requests, Period: period}, nil
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+// Result of a rate limit check
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// until the next request is allowed, zero when Allowed
+	RetryAfter time.Duration
+	// until the limit is fully replenished
+	ResetAfter time.Duration
+}
+
+// Limiter counts requests against limits shared by every replica
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// GCRA (the generic cell rate algorithm, an exact token bucket) keeps a single
+// "theoretical arrival time" per key. Time comes from the Redis server so the
+// clocks of the replicas do not matter. All durations are in microseconds.
+var gcra = redis.NewScript(`
+-- TIME is non-deterministic, replicate the effects rather than the script
+redis.replicate_commands()
+
+local key = KEYS[1]
+local interval = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local tat = tonumber(redis.call("GET", key))
+if not tat or tat < now then
+  tat = now
+end
+
+local new_tat = tat + interval
+local allow_at = new_tat - period
+local diff = now - allow_at
+
+if diff < 0 then
+  return {0, 0, -diff, tat - now}
+end
+
+redis.call("SET", key, new_tat, "PX", math.ceil((new_tat - now) / 1000))
+return {1, math.floor(diff / interval), 0, new_tat - now}
+`)
+
+// RedisLimiter keeps the state of the limits in Redis
+type RedisLimiter struct {
+	rdb    redis.Scripter
+	prefix string
+}
+
+// Constructor
+func NewRedisLimiter(rdb redis.Scripter) *RedisLimiter {
+	return &RedisLimiter{
+		rdb:    rdb,
+		prefix: "ratelimit:",
+	}
+}
+
+// implement Allow, every call is one atomic script execution
+func (rl *RedisLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	period := limit.Period.Microseconds()
+	interval := period / int64(limit.Requests)
+	if interval < 1 {
+		interval = 1
+	}
+
+	values, err := gcra.Run(ctx, rl.rdb, []string{rl.prefix + key}, interval, period).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(values) != 4 {
+		return Result{}, fmt.Errorf("ratelimit: unexpected script result %v", values)
+	}
+
+	return Result{
+		Allowed:    values[0] == 1,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Microsecond,
+		ResetAfter: time.Duration(values[3]) * time.Microsecond,
+	}, nil
+}
@@ -0,0 +1,206 @@
+package rbac
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//go:embed policy.json
+var defaultPolicy []byte
+
+var (
+	ErrUnknownRole = errors.New("rbac: unknown role")
+	ErrNoRoles     = errors.New("rbac: the policy defines no roles")
+)
+
+// FieldError rejects a request writing a field its role cannot write
+type FieldError struct {
+	Field string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("rbac: field %s cannot be written", e.Field)
+}
+
+// Role grants permissions like users:read. A permission of * grants every
+// permission and users:* every permission on users. Fields are named like in
+// JSON, hidden fields are left out of responses and cannot be written either.
+type Role struct {
+	Name           string   `json:"-"`
+	Permissions    []string `json:"permissions"`
+	HiddenFields   []string `json:"hiddenFields"`
+	ReadOnlyFields []string `json:"readOnlyFields"`
+}
+
+// Policy maps role names to roles. Permissions listed in MFARequired, matched
+// like the permissions of roles, are only granted to callers who signed in
+// with a second factor.
+type Policy struct {
+	Roles       map[string]*Role `json:"roles"`
+	MFARequired []string         `json:"mfaRequired"`
+}
+
+// Default returns the policy built into the binary
+func Default() *Policy {
+	policy, err := Parse(defaultPolicy)
+	if err != nil {
+		panic(err)
+	}
+	return policy
+}
+
+// Load reads a policy from a JSON file
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("rbac: reading policy: %w", err)
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Policy, error) {
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("rbac: parsing policy: %w", err)
+	}
+	if len(policy.Roles) == 0 {
+		return nil, ErrNoRoles
+	}
+	for name, role := range policy.Roles {
+		if role == nil {
+			return nil, fmt.Errorf("rbac: role %s is empty", name)
+		}
+		role.Name = name
+	}
+	return &policy, nil
+}
+
+// Role returns the role with the given name
+func (p *Policy) Role(name string) (*Role, error) {
+	role, ok := p.Roles[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownRole, name)
+	}
+	return role, nil
+}
+
+// RoleNames returns the names of the roles, sorted
+func (p *Policy) RoleNames() []string {
+	names := make([]string, 0, len(p.Roles))
+	for name := range p.Roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RequiresMFA reports whether permission needs a second factor
+func (p *Policy) RequiresMFA(permission string) bool {
+	return matches(p.MFARequired, permission)
+}
+
+// Can reports whether the role grants permission
+func (r *Role) Can(permission string) bool {
+	return matches(r.Permissions, permission)
+}
+
+// Redact zeroes the hidden fields of a struct, a pointer to one or a slice of
+// them. Hidden fields should be optional ones, omitted from encodings when zero.
+func (r *Role) Redact(v interface{}) {
+	if r == nil || len(r.HiddenFields) == 0 {
+		return
+	}
+	redact(reflect.ValueOf(v), r.HiddenFields)
+}
+
+// CheckWrite returns a *FieldError when v sets a field the role cannot write
+func (r *Role) CheckWrite(v interface{}) error {
+	if r == nil {
+		return nil
+	}
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+	for _, fields := range [][]string{r.HiddenFields, r.ReadOnlyFields} {
+		for _, name := range fields {
+			if field, ok := fieldByJSONName(value, name); ok && !field.IsZero() {
+				return &FieldError{Field: name}
+			}
+		}
+	}
+	return nil
+}
+
+// Restricts reports whether the role cannot write some fields
+func (r *Role) Restricts() bool {
+	return r != nil && len(r.HiddenFields)+len(r.ReadOnlyFields) > 0
+}
+
+// Protect copies the fields the role cannot write from current into update,
+// both pointers to structs of the same type. Updates replacing whole
+// documents then leave those fields as they are.
+func (r *Role) Protect(update interface{}, current interface{}) {
+	if !r.Restricts() {
+		return
+	}
+	dst := reflect.Indirect(reflect.ValueOf(update))
+	src := reflect.Indirect(reflect.ValueOf(current))
+	if dst.Kind() != reflect.Struct || dst.Type() != src.Type() {
+		return
+	}
+	for _, fields := range [][]string{r.HiddenFields, r.ReadOnlyFields} {
+		for _, name := range fields {
+			to, ok := fieldByJSONName(dst, name)
+			if from, _ := fieldByJSONName(src, name); ok && to.CanSet() {
+				to.Set(from)
+			}
+		}
+	}
+}
+
+func matches(patterns []string, permission string) bool {
+	resource, _, _ := strings.Cut(permission, ":")
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == permission || pattern == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+func redact(value reflect.Value, fields []string) {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !value.IsNil() {
+			redact(value.Elem(), fields)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			redact(value.Index(i), fields)
+		}
+	case reflect.Struct:
+		for _, name := range fields {
+			if field, ok := fieldByJSONName(value, name); ok && field.CanSet() {
+				field.Set(reflect.Zero(field.Type()))
+			}
+		}
+	}
+}
+
+func fieldByJSONName(value reflect.Value, name string) (reflect.Value, bool) {
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if tag == name {
+			return value.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
@@ -0,0 +1,188 @@
+package responses
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// media types rendered and decoded next to JSON and XML
+const (
+	MIMEMessagePack  = "application/msgpack"
+	MIMEXMessagePack = "application/x-msgpack"
+	MIMECBOR         = "application/cbor"
+)
+
+// offered in order of preference, the first one is used when Accept is missing
+var renderable = []string{
+	fiber.MIMEApplicationJSON,
+	MIMEMessagePack,
+	MIMEXMessagePack,
+	MIMECBOR,
+	fiber.MIMEApplicationXML,
+	fiber.MIMETextXML,
+}
+
+var mapStringInterfaceType = reflect.TypeOf(map[string]interface{}(nil))
+
+// maps are decoded with string keys so bodies can be transcoded to JSON
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: mapStringInterfaceType,
+}.DecMode()
+
+// ObjectIDs travel as hex strings in MessagePack like they do in JSON
+func init() {
+	msgpack.Register(primitive.ObjectID{},
+		func(e *msgpack.Encoder, v reflect.Value) error {
+			return e.EncodeString(v.Interface().(primitive.ObjectID).Hex())
+		},
+		func(d *msgpack.Decoder, v reflect.Value) error {
+			hex, err := d.DecodeString()
+			if err != nil {
+				return err
+			}
+			id, err := primitive.ObjectIDFromHex(hex)
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(id))
+			return nil
+		})
+}
+
+// Render writes body in the format negotiated through the Accept header,
+// falling back to JSON when none of the offered formats is acceptable
+func Render(c *fiber.Ctx, status int, body interface{}) error {
+	c.Vary(fiber.HeaderAccept)
+
+	mediaType := c.Accepts(renderable...)
+	data, err := Marshal(mediaType, body)
+	if err != nil {
+		return err
+	}
+	if mediaType == "" {
+		mediaType = fiber.MIMEApplicationJSON
+	}
+	if mediaType == fiber.MIMEApplicationJSON || strings.HasSuffix(mediaType, "xml") {
+		mediaType += "; charset=utf-8"
+	}
+
+	c.Set(fiber.HeaderContentType, mediaType)
+	return c.Status(status).Send(data)
+}
+
+// Marshal encodes v in the given media type, JSON is used for unknown types
+func Marshal(mediaType string, v interface{}) ([]byte, error) {
+	switch mediaType {
+	case MIMEMessagePack, MIMEXMessagePack:
+		var buf bytes.Buffer
+		encoder := msgpack.NewEncoder(&buf)
+		encoder.SetCustomStructTag("json")
+		if err := encoder.Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case MIMECBOR:
+		value, err := jsonValue(v)
+		if err != nil {
+			return nil, err
+		}
+		return cbor.Marshal(value)
+	case fiber.MIMEApplicationXML, fiber.MIMETextXML:
+		data, err := xml.Marshal(xmlValue(v))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(xml.Header), data...), nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// Bind decodes the request body into out according to its Content-Type
+func Bind(c *fiber.Ctx, out interface{}) error {
+	switch mediaType(c.Get(fiber.HeaderContentType)) {
+	case MIMEMessagePack, MIMEXMessagePack:
+		decoder := msgpack.NewDecoder(bytes.NewReader(c.Body()))
+		decoder.SetCustomStructTag("json")
+		return decoder.Decode(out)
+	case MIMECBOR:
+		// through JSON, so ObjectIDs are read from hex strings
+		data, _, err := TranscodeJSON(MIMECBOR, c.Body())
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, out)
+	default:
+		// JSON, XML and forms
+		return c.BodyParser(out)
+	}
+}
+
+// TranscodeJSON converts a MessagePack or CBOR body to JSON. Bodies in any
+// other media type are returned unchanged with ok set to false.
+func TranscodeJSON(contentType string, body []byte) (data []byte, ok bool, err error) {
+	var value interface{}
+	switch mediaType(contentType) {
+	case MIMEMessagePack, MIMEXMessagePack:
+		err = msgpack.Unmarshal(body, &value)
+	case MIMECBOR:
+		err = cborDecMode.Unmarshal(body, &value)
+	default:
+		return body, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	data, err = json.Marshal(value)
+	return data, err == nil, err
+}
+
+// jsonValue converts v to what it looks like in JSON, so CBOR carries
+// ObjectIDs as hex strings and uses the same names
+func jsonValue(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return numbers(value), nil
+}
+
+// numbers turns the json.Numbers of value into integers where they are whole
+func numbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = numbers(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = numbers(item)
+		}
+	}
+	return value
+}
+
+func mediaType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
@@ -0,0 +1,117 @@
+package responses
+
+import (
+	"encoding/xml"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// VersionKey is the fiber.Ctx locals key holding the negotiated API version
+const VersionKey = "apiVersion"
+
+// PageMeta describes the page of a paginated collection
+type PageMeta struct {
+	Page  int64 `json:"page" xml:"page"`
+	Limit int64 `json:"limit" xml:"limit"`
+	Total int64 `json:"total" xml:"total"`
+}
+
+// ErrorBody is the error object of the v2 envelope
+type ErrorBody struct {
+	Status  int         `json:"status" xml:"status"`
+	Message string      `json:"message" xml:"message"`
+	Details interface{} `json:"details,omitempty" xml:"details,omitempty"`
+}
+
+// envelope of v1 responses
+type v1Body struct {
+	XMLName xml.Name    `json:"-" xml:"response"`
+	Status  string      `json:"status" xml:"status"`
+	Message string      `json:"message" xml:"message"`
+	Data    interface{} `json:"data,omitempty" xml:"data,omitempty"`
+	Items   interface{} `json:"items,omitempty" xml:"items,omitempty"`
+	Error   interface{} `json:"error,omitempty" xml:"error,omitempty"`
+	// only set by request validation, as before versioning
+	Errors interface{} `json:"errors,omitempty" xml:"errors,omitempty"`
+}
+
+// envelope of v2 responses
+type v2Body struct {
+	XMLName xml.Name    `json:"-" xml:"response"`
+	Data    interface{} `json:"data,omitempty" xml:"data,omitempty"`
+	Meta    *PageMeta   `json:"meta,omitempty" xml:"meta,omitempty"`
+	Error   *ErrorBody  `json:"error,omitempty" xml:"error,omitempty"`
+}
+
+// Version returns the API version negotiated for the request
+func Version(c *fiber.Ctx) string {
+	if version, ok := c.Locals(VersionKey).(string); ok {
+		return version
+	}
+	return "v1"
+}
+
+// Success writes data in the envelope of the negotiated API version
+func Success(c *fiber.Ctx, status int, message string, data interface{}) error {
+	if Version(c) == "v1" {
+		return Render(c, status, v1Body{
+			Status:  "success",
+			Message: message,
+			Data:    data,
+		})
+	}
+
+	return Render(c, status, v2Body{Data: data})
+}
+
+// List writes a collection, meta is only part of the envelope from v2 on
+func List(c *fiber.Ctx, status int, message string, items interface{}, meta *PageMeta) error {
+	if Version(c) == "v1" {
+		return Render(c, status, v1Body{
+			Status:  "success",
+			Message: message,
+			Items:   items,
+		})
+	}
+
+	return Render(c, status, v2Body{Data: items, Meta: meta})
+}
+
+// Error writes an error in the envelope of the negotiated API version
+func Error(c *fiber.Ctx, status int, message string, details ...interface{}) error {
+	var detail interface{}
+	if len(details) > 0 {
+		detail = details[0]
+	}
+
+	if Version(c) == "v1" {
+		return Render(c, status, v1Body{
+			Status:  "error",
+			Message: message,
+			Error:   detail,
+		})
+	}
+
+	return Render(c, status, v2Body{
+		Error: &ErrorBody{
+			Status:  status,
+			Message: message,
+			Details: detail,
+		},
+	})
+}
+
+// Invalid writes the errors of a request failing validation, v1 lists them
+// under "errors" while v2 uses the details of its error object
+func Invalid(c *fiber.Ctx, message string, errs interface{}) error {
+	if Version(c) == "v1" {
+		return Render(c, http.StatusBadRequest, v1Body{
+			Status:  "error",
+			Message: message,
+			Errors:  errs,
+		})
+	}
+
+	return Error(c, http.StatusBadRequest, message, errs)
+}
@@ -0,0 +1,93 @@
+package responses
+
+import (
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// xmlMap encodes a map as one element per key, encoding/xml rejects maps
+type xmlMap map[string]interface{}
+
+// implement xml.Marshaler, keys are sorted so the output is stable. Keys
+// that are not valid element names become <entry key="...">.
+func (m xmlMap) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		element := xml.StartElement{Name: xml.Name{Local: key}}
+		if !xmlName(key) {
+			element = xml.StartElement{
+				Name: xml.Name{Local: "entry"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}},
+			}
+		}
+		if err := e.EncodeElement(m[key], element); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// xmlValue replaces the maps in v, and in the envelopes holding it, with
+// xmlMaps. Maps nested in other structs are left alone.
+func xmlValue(v interface{}) interface{} {
+	switch body := v.(type) {
+	case v1Body:
+		body.Data = xmlValue(body.Data)
+		body.Items = xmlValue(body.Items)
+		body.Error = xmlValue(body.Error)
+		body.Errors = xmlValue(body.Errors)
+		return body
+	case v2Body:
+		body.Data = xmlValue(body.Data)
+		if body.Error != nil {
+			errorBody := *body.Error
+			errorBody.Details = xmlValue(errorBody.Details)
+			body.Error = &errorBody
+		}
+		return body
+	}
+
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Map:
+		m := xmlMap{}
+		iter := value.MapRange()
+		for iter.Next() {
+			m[fmt.Sprint(iter.Key().Interface())] = xmlValue(iter.Value().Interface())
+		}
+		return m
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.Map && value.Type().Elem().Kind() != reflect.Interface {
+			return v
+		}
+		items := make([]interface{}, value.Len())
+		for i := range items {
+			items[i] = xmlValue(value.Index(i).Interface())
+		}
+		return items
+	}
+	return v
+}
+
+// xmlName reports whether s can be used as an element name as is
+func xmlName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		letter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if !letter && (i == 0 || !(r == '-' || r == '.' || (r >= '0' && r <= '9'))) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/encryption"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/tenancy"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// users re-encrypted per round trip
+const reencryptBatchSize = 500
+
+// rotateKeys makes a new data key active and re-encrypts every user with it.
+// Plaintext users written before encryption was enabled get encrypted as well.
+// The old keys stay in the key store, running servers pick up the new key
+// within a minute and keep decrypting values they have not seen re-encrypted.
+func rotateKeys(ctx context.Context, keyring *encryption.Keyring) {
+	store := configs.NewKeyStore()
+	if store == nil || keyring == nil {
+		log.Fatal("ENCRYPTION_MASTER_KEY_FILE must be set to rotate keys")
+	}
+
+	keyId, err := store.Rotate(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := store.Reload(ctx, keyring); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("active data key is now %s", keyId)
+
+	userService := services.NewEncryptedUserServiceImpl(configs.Tenants.Source("users"), keyring)
+
+	// every tenant has its own users, they can only be enumerated from TENANTS
+	if configs.Tenants.Mode() == tenancy.Disabled {
+		reencryptUsers(ctx, userService)
+		return
+	}
+	tenants := configs.EnvTenants()
+	if len(tenants) == 0 {
+		log.Fatal("TENANTS must list every tenant to re-encrypt their users")
+	}
+	for _, tenant := range tenants {
+		log.Printf("re-encrypting users of tenant %s", tenant)
+		reencryptUsers(tenancy.WithTenant(ctx, tenant), userService)
+	}
+}
+
+func reencryptUsers(ctx context.Context, userService *services.UserServiceImpl) {
+	var total int64
+	after := primitive.NilObjectID
+	for {
+		last, updated, err := userService.ReencryptBatch(ctx, after, reencryptBatchSize)
+		if err != nil {
+			log.Fatalf("re-encryption stopped after %s: %v", after.Hex(), err)
+		}
+		if last.IsZero() {
+			break
+		}
+		total += updated
+		after = last
+		log.Printf("re-encrypted %d users, up to %s", total, after.Hex())
+	}
+	log.Printf("key rotation done, %d users re-encrypted", total)
+}
@@ -0,0 +1,19 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/controllers"
+)
+
+func AccountEmailRoute(app *fiber.App) {
+	for _, prefix := range apiPrefixes {
+		accountEmailRoutes(app.Group(prefix))
+	}
+}
+
+func accountEmailRoutes(router fiber.Router) {
+	router.Post("/auth/password-reset", emailLimit, controllers.RequestPasswordReset)
+	router.Post("/auth/password-reset/confirm", loginLimit, controllers.ResetPassword)
+	router.Post("/auth/email-verification", emailLimit, authReq, controllers.SendEmailVerification)
+	router.Post("/auth/email-verification/confirm", loginLimit, controllers.VerifyEmail)
+}
@@ -0,0 +1,32 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/controllers"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+)
+
+// authReq requires the credentials of an account, it looks controllers.Accounts
+// up per request since the controllers are set up after the package vars
+func authReq(c *fiber.Ctx) error {
+	return middlewares.AuthReq(controllers.Accounts)(c)
+}
+
+var accountsManage = middlewares.Permit(configs.Policy, models.PermAccountsManage)
+
+func AccountRoute(app *fiber.App) {
+	for _, prefix := range apiPrefixes {
+		accountRoutes(app.Group(prefix))
+	}
+}
+
+func accountRoutes(router fiber.Router) {
+	router.Post("/accounts", authReq, accountsManage, controllers.CreateAccount)
+	router.Get("/accounts", authReq, accountsManage, controllers.GetAccounts)
+	router.Get("/accounts/:accountId", authReq, accountsManage, controllers.GetAccount)
+	router.Patch("/accounts/:accountId", authReq, accountsManage, controllers.UpdateAccount)
+	router.Delete("/accounts/:accountId", authReq, accountsManage, controllers.DeleteAccount)
+	router.Post("/accounts/:accountId/unlock", authReq, accountsManage, controllers.UnlockAccount)
+}
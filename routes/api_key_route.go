@@ -0,0 +1,24 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/controllers"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+)
+
+var apiKeysManage = middlewares.Permit(configs.Policy, models.PermAPIKeysManage)
+
+func APIKeyRoute(app *fiber.App) {
+	for _, prefix := range apiPrefixes {
+		apiKeyRoutes(app.Group(prefix))
+	}
+}
+
+// keys are managed with the credentials of an account, never with another key
+func apiKeyRoutes(router fiber.Router) {
+	router.Post("/api-keys", authReq, apiKeysManage, controllers.CreateAPIKey)
+	router.Get("/api-keys", authReq, apiKeysManage, controllers.GetAPIKeys)
+	router.Delete("/api-keys/:keyId", authReq, apiKeysManage, controllers.RevokeAPIKey)
+}
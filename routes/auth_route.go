@@ -0,0 +1,22 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/controllers"
+	"github.com/mattchw/go-onboard/middlewares"
+)
+
+// tokenReq requires a bearer token or API key, verified by the middlewares in main
+var tokenReq = middlewares.TokenReq
+
+func AuthRoute(app *fiber.App) {
+	for _, prefix := range apiPrefixes {
+		authRoutes(app.Group(prefix))
+	}
+}
+
+func authRoutes(router fiber.Router) {
+	router.Post("/auth/login", loginLimit, controllers.Login)
+	router.Post("/auth/refresh", loginLimit, controllers.RefreshToken)
+	router.Post("/auth/logout", controllers.Logout)
+}
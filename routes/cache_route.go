@@ -0,0 +1,21 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/controllers"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+)
+
+var cacheRead = middlewares.Permit(configs.Policy, models.PermCacheRead)
+
+func CacheRoute(app *fiber.App) {
+	for _, prefix := range apiPrefixes {
+		cacheRoutes(app.Group(prefix))
+	}
+}
+
+func cacheRoutes(router fiber.Router) {
+	router.Get("/cache/stats", authReq, cacheRead, controllers.GetCacheStats)
+}
@@ -0,0 +1,27 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/controllers"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+)
+
+var (
+	jobsManage = middlewares.Permit(configs.Policy, models.PermJobsManage)
+	jobPermit  = middlewares.PermitJob(configs.Policy)
+)
+
+func JobRoute(app *fiber.App) {
+	for _, prefix := range apiPrefixes {
+		jobRoutes(app.Group(prefix))
+	}
+}
+
+func jobRoutes(router fiber.Router) {
+	router.Post("/jobs", authReq, jobsManage, jobPermit, jobCreateLimit, controllers.CreateJob)
+	router.Get("/jobs/:jobId", authReq, jobsManage, controllers.GetJob)
+	router.Post("/jobs/:jobId/cancel", authReq, jobsManage, controllers.CancelJob)
+	router.Get("/jobs/:jobId/result", authReq, jobsManage, controllers.GetJobResult)
+}
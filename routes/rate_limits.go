@@ -0,0 +1,31 @@
+package routes
+
+import (
+	"github.com/mattchw/go-onboard/configs"
+	"github.com/mattchw/go-onboard/middlewares"
+)
+
+// route limits, each can be overridden with RATE_LIMIT_<NAME>. They are built
+// once so the versioned copies of a route share their counters.
+var (
+	userWriteLimit = middlewares.RateLimit(configs.RateLimiter,
+		middlewares.RateLimitRule{Name: "users_write", Limit: configs.EnvRateLimit("users_write", "60/1m"), Key: middlewares.RateLimitByUser},
+		middlewares.RateLimitRule{Name: "users_write", Limit: configs.EnvRateLimit("users_write", "60/1m"), Key: middlewares.RateLimitByIP},
+	)
+	userExportLimit = middlewares.RateLimit(configs.RateLimiter,
+		middlewares.RateLimitRule{Name: "users_export", Limit: configs.EnvRateLimit("users_export", "10/1h"), Key: middlewares.RateLimitByIP},
+	)
+	privacyLimit = middlewares.RateLimit(configs.RateLimiter,
+		middlewares.RateLimitRule{Name: "privacy", Limit: configs.EnvRateLimit("privacy", "20/1h"), Key: middlewares.RateLimitByUser},
+	)
+	loginLimit = middlewares.RateLimit(configs.RateLimiter,
+		middlewares.RateLimitRule{Name: "login", Limit: configs.EnvRateLimit("login", "10/1m"), Key: middlewares.RateLimitByIP},
+	)
+	// every request sends emails, it is kept low against mail bombing
+	emailLimit = middlewares.RateLimit(configs.RateLimiter,
+		middlewares.RateLimitRule{Name: "emails", Limit: configs.EnvRateLimit("emails", "5/1h"), Key: middlewares.RateLimitByIP},
+	)
+	jobCreateLimit = middlewares.RateLimit(configs.RateLimiter,
+		middlewares.RateLimitRule{Name: "jobs_create", Limit: configs.EnvRateLimit("jobs_create", "20/1h"), Key: middlewares.RateLimitByUser},
+	)
+)
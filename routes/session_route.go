@@ -0,0 +1,21 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/controllers"
+)
+
+func SessionRoute(app *fiber.App) {
+	for _, prefix := range apiPrefixes {
+		sessionRoutes(app.Group(prefix))
+	}
+}
+
+func sessionRoutes(router fiber.Router) {
+	router.Post("/auth/session", loginLimit, controllers.SessionLogin)
+	router.Get("/auth/session", controllers.GetCurrentSession)
+	router.Delete("/auth/session", controllers.SessionLogout)
+	router.Get("/sessions", authReq, controllers.GetSessions)
+	router.Delete("/sessions/:sessionId", authReq, controllers.RevokeSession)
+	router.Delete("/accounts/:accountId/sessions", authReq, accountsManage, controllers.RevokeAccountSessions)
+}
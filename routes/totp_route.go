@@ -0,0 +1,21 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/controllers"
+)
+
+func TOTPRoute(app *fiber.App) {
+	for _, prefix := range apiPrefixes {
+		totpRoutes(app.Group(prefix))
+	}
+}
+
+func totpRoutes(router fiber.Router) {
+	router.Post("/auth/totp", authReq, controllers.BeginTOTP)
+	router.Get("/auth/totp/qr", authReq, controllers.GetTOTPQRCode)
+	router.Post("/auth/totp/confirm", authReq, controllers.ConfirmTOTP)
+	router.Delete("/auth/totp", authReq, controllers.DisableTOTP)
+	router.Post("/auth/totp/recovery-codes", authReq, controllers.RegenerateRecoveryCodes)
+	router.Delete("/accounts/:accountId/totp", authReq, accountsManage, controllers.ResetAccountTOTP)
+}
@@ -2,15 +2,66 @@ package routes
 
 import (
 	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/configs"
 	"github.com/mattchw/go-onboard/controllers"
 	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/policies"
+	"github.com/mattchw/go-onboard/responses"
 )
 
+// APIVersions lists the supported versions of the API, oldest first
+func APIVersions() []middlewares.APIVersion {
+	return []middlewares.APIVersion{
+		{Name: "v1", Deprecated: true, Sunset: configs.EnvAPISunset("v1"), Successor: "v2"},
+		{Name: "v2"},
+	}
+}
+
+// permissions of the user routes, they run after tokenReq
+var (
+	usersRead   = middlewares.Permit(configs.Policy, models.PermUsersRead)
+	usersWrite  = middlewares.Permit(configs.Policy, models.PermUsersWrite)
+	usersDelete = middlewares.Permit(configs.Policy, models.PermUsersDelete)
+	usersExport = middlewares.Permit(configs.Policy, models.PermUsersExport)
+)
+
+// which users the caller reaches, they run after the permissions
+var (
+	ownUser = policies.OwnUser("userId")
+	anyUser = policies.AnyUser
+)
+
+// unversioned paths serve the version negotiated through Accept-Version
+var apiPrefixes = []string{"", "/v1", "/v2"}
+
 func UserRoute(app *fiber.App) {
-	app.Get("/users", controllers.GetUsers)
-	app.Get("/users/count", controllers.GetUsersCount)
-	app.Post("/users", middlewares.AuthReq(), controllers.CreateUser)
-	app.Get("/users/:userId", controllers.GetUser)
-	app.Patch("/users/:userId", controllers.UpdateUser)
-	app.Delete("/users/:userId", controllers.DeleteUser)
+	for _, prefix := range apiPrefixes {
+		userRoutes(app.Group(prefix))
+	}
+}
+
+func userRoutes(router fiber.Router) {
+	router.Get("/users", tokenReq, usersRead, anyUser, versioned(controllers.GetUsers, map[string]fiber.Handler{
+		"v2": controllers.GetUsersPage,
+	}))
+	router.Get("/users/count", tokenReq, usersRead, anyUser, controllers.GetUsersCount)
+	router.Get("/users/export", tokenReq, usersExport, anyUser, userExportLimit, controllers.ExportUsers)
+	router.Post("/users", tokenReq, usersWrite, anyUser, userWriteLimit, controllers.CreateUser)
+	router.Get("/users/:userId", tokenReq, usersRead, ownUser, controllers.GetUser)
+	router.Patch("/users/:userId", tokenReq, usersWrite, ownUser, userWriteLimit, controllers.UpdateUser)
+	router.Delete("/users/:userId", tokenReq, usersDelete, ownUser, userWriteLimit, controllers.DeleteUser)
+	router.Get("/users/:userId/data-export", tokenReq, usersExport, ownUser, privacyLimit, controllers.ExportUserData)
+	router.Post("/users/:userId/erase", tokenReq, usersDelete, ownUser, privacyLimit, controllers.EraseUser)
+}
+
+// versioned picks the handler of the negotiated API version, falling back to
+// the shared handler for versions where the behavior did not change
+func versioned(shared fiber.Handler, overrides map[string]fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if handler, ok := overrides[responses.Version(c)]; ok {
+			return handler(c)
+		}
+		return shared(c)
+	}
 }
@@ -0,0 +1,241 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattchw/go-onboard/mail"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/passwords"
+	"github.com/mattchw/go-onboard/tokens"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrNoEmail       = errors.New("the account has no email address")
+	ErrEmailVerified = errors.New("the email address is already verified")
+)
+
+// define Account Email Service interface
+type AccountEmailService interface {
+	RequestPasswordReset(ctx context.Context, email string) error
+	ResetPassword(ctx context.Context, token string, password string) (*models.Account, error)
+	SendVerification(ctx context.Context, account *models.Account) error
+	VerifyEmail(ctx context.Context, token string) (*models.Account, error)
+}
+
+// implement accountEmailService
+type AccountEmailServiceImpl struct {
+	accounts  *AccountServiceImpl
+	signer    *tokens.ActionSigner
+	mailer    mail.Mailer
+	templates *mail.Templates
+	baseURL   string
+	resetTTL  time.Duration
+	verifyTTL time.Duration
+}
+
+// Constructor, links in emails point to pages under baseURL
+func NewAccountEmailServiceImpl(accounts *AccountServiceImpl, signer *tokens.ActionSigner, mailer mail.Mailer, templates *mail.Templates, baseURL string) *AccountEmailServiceImpl {
+	return &AccountEmailServiceImpl{
+		accounts:  accounts,
+		signer:    signer,
+		mailer:    mailer,
+		templates: templates,
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		resetTTL:  time.Hour,
+		verifyTTL: 48 * time.Hour,
+	}
+}
+
+// WithTTLs sets how long password reset and verification links work
+func (es *AccountEmailServiceImpl) WithTTLs(reset time.Duration, verify time.Duration) *AccountEmailServiceImpl {
+	es.resetTTL = reset
+	es.verifyTTL = verify
+	return es
+}
+
+// mailData is what the templates get
+type mailData struct {
+	Username  string
+	Link      string
+	Token     string
+	ExpiresIn string
+}
+
+// implement RequestPasswordReset. Every enabled account with the verified
+// address gets a link, unknown addresses are no error so they cannot be told apart.
+func (es *AccountEmailServiceImpl) RequestPasswordReset(ctx context.Context, email string) error {
+	email, err := normalizeEmail(email)
+	if err != nil || email == "" {
+		return nil
+	}
+
+	cursor, err := es.accounts.collection.Find(ctx, bson.M{"email": email, "emailVerified": true, "disabled": false})
+	if err != nil {
+		return err
+	}
+	var accounts []models.Account
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return err
+	}
+
+	for _, account := range accounts {
+		token, err := es.signer.Sign(tokens.PurposePasswordReset, account.Id.Hex(), passwordBinding(account.PasswordHash), es.resetTTL)
+		if err != nil {
+			return err
+		}
+		if err := es.send(ctx, mail.TemplatePasswordReset, &account, "/reset-password", token, es.resetTTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// implement ResetPassword. The token stops working once used and whenever
+// the password changed since it was sent.
+func (es *AccountEmailServiceImpl) ResetPassword(ctx context.Context, token string, password string) (*models.Account, error) {
+	action, err := es.signer.Verify(token, tokens.PurposePasswordReset)
+	if err != nil {
+		return nil, err
+	}
+	account, err := es.actionAccount(ctx, action)
+	if err != nil {
+		return nil, err
+	}
+	if account.Disabled || passwordBinding(account.PasswordHash) != action.Binding {
+		return nil, tokens.ErrInvalidAction
+	}
+	// a password too short is rejected before the token is used up
+	hash, err := passwords.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	if err := es.signer.Consume(ctx, action); err != nil {
+		return nil, err
+	}
+
+	var updated models.Account
+	err = es.accounts.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": account.Id, "passwordHash": account.PasswordHash},
+		bson.M{"$set": bson.M{"passwordHash": hash, "updatedAt": time.Now().UTC()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return nil, tokens.ErrInvalidAction
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// implement SendVerification, the link verifies the current address of the account
+func (es *AccountEmailServiceImpl) SendVerification(ctx context.Context, account *models.Account) error {
+	if account.Email == "" {
+		return ErrNoEmail
+	}
+	if account.EmailVerified {
+		return ErrEmailVerified
+	}
+	token, err := es.signer.Sign(tokens.PurposeVerifyEmail, account.Id.Hex(), account.Email, es.verifyTTL)
+	if err != nil {
+		return err
+	}
+	return es.send(ctx, mail.TemplateVerifyEmail, account, "/verify-email", token, es.verifyTTL)
+}
+
+// implement VerifyEmail, the token only works while the account still has
+// the address it was sent to
+func (es *AccountEmailServiceImpl) VerifyEmail(ctx context.Context, token string) (*models.Account, error) {
+	action, err := es.signer.Verify(token, tokens.PurposeVerifyEmail)
+	if err != nil {
+		return nil, err
+	}
+	account, err := es.actionAccount(ctx, action)
+	if err != nil {
+		return nil, err
+	}
+	if account.Email != action.Binding {
+		return nil, tokens.ErrInvalidAction
+	}
+	if err := es.signer.Consume(ctx, action); err != nil {
+		return nil, err
+	}
+
+	var updated models.Account
+	err = es.accounts.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": account.Id, "email": action.Binding},
+		bson.M{"$set": bson.M{"emailVerified": true, "updatedAt": time.Now().UTC()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return nil, tokens.ErrInvalidAction
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func (es *AccountEmailServiceImpl) actionAccount(ctx context.Context, action *tokens.Action) (*models.Account, error) {
+	id, err := primitive.ObjectIDFromHex(action.Subject)
+	if err != nil {
+		return nil, tokens.ErrInvalidAction
+	}
+	account, err := es.accounts.Get(ctx, id)
+	if errors.Is(err, ErrAccountNotFound) {
+		return nil, tokens.ErrInvalidAction
+	}
+	return account, err
+}
+
+func (es *AccountEmailServiceImpl) send(ctx context.Context, template string, account *models.Account, path string, token string, ttl time.Duration) error {
+	msg, err := es.templates.Render(template, account.Email, mailData{
+		Username:  account.Username,
+		Link:      es.baseURL + path + "?token=" + url.QueryEscape(token),
+		Token:     token,
+		ExpiresIn: humanDuration(ttl),
+	})
+	if err != nil {
+		return err
+	}
+	if err := es.mailer.Send(ctx, msg); err != nil {
+		log.Printf("failed to send %s to account %s: %v", template, account.Id.Hex(), err)
+		return err
+	}
+	return nil
+}
+
+// passwordBinding ties a reset token to the password it replaces without
+// putting the hash itself in the token
+func passwordBinding(hash string) string {
+	sum := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(sum[:12])
+}
+
+// humanDuration spells out a duration for emails, like 2 days or 30 minutes
+func humanDuration(d time.Duration) string {
+	unit, size := "minute", time.Minute
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		unit, size = "day", 24*time.Hour
+	case d >= time.Hour && d%time.Hour == 0:
+		unit, size = "hour", time.Hour
+	}
+	count := int64(d / size)
+	if count == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", count, unit)
+}
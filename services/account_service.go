@@ -0,0 +1,466 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mattchw/go-onboard/encryption"
+	"github.com/mattchw/go-onboard/lockout"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/passwords"
+	"github.com/mattchw/go-onboard/tenancy"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrAccountNotFound   = errors.New("account not found")
+	ErrAccountExists     = errors.New("username is taken")
+	ErrInvalidUsername   = errors.New("username must be 3 to 64 letters, digits, dots, dashes or underscores")
+	ErrInvalidEmail      = errors.New("email must be a valid address")
+	ErrInvalidUserId     = errors.New("userId must be the id of a user")
+	ErrInvalidTenants    = errors.New("tenants must be valid tenant ids")
+	ErrInvalidCredential = errors.New("invalid username or password")
+	ErrAccountsExist     = errors.New("accounts already exist")
+	ErrOTPRequired       = errors.New("two-factor authentication code required")
+	ErrInvalidOTP        = errors.New("invalid two-factor authentication code")
+	ErrTenantsOutOfScope = errors.New("tenants must be among the tenants of the caller")
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,64}$`)
+
+// verified when the username is unknown, so failed logins take as long either way
+var dummyHash, _ = passwords.Hash("not-a-real-password")
+
+type scopeKey struct{}
+
+// WithinTenants returns a context limiting the accounts reached with it to
+// those whose tenants are all among tenants. Accounts without tenants are out
+// of reach, they belong to every tenant. No tenants leaves it unlimited.
+func WithinTenants(ctx context.Context, tenants []string) context.Context {
+	if len(tenants) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, scopeKey{}, tenants)
+}
+
+// scoped narrows filter to the accounts within the tenants of ctx
+func scoped(ctx context.Context, filter bson.M) bson.M {
+	tenants, ok := ctx.Value(scopeKey{}).([]string)
+	if !ok {
+		return filter
+	}
+	filter["tenants"] = bson.M{"$exists": true, "$not": bson.M{"$elemMatch": bson.M{"$nin": tenants}}}
+	return filter
+}
+
+// inScope reports whether an account with tenants can be reached with ctx
+func inScope(ctx context.Context, tenants []string) bool {
+	scope, ok := ctx.Value(scopeKey{}).([]string)
+	if !ok {
+		return true
+	}
+	if len(tenants) == 0 {
+		return false
+	}
+	for _, tenant := range tenants {
+		found := false
+		for _, s := range scope {
+			if s == tenant {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// define Account Service interface
+type AccountService interface {
+	Create(ctx context.Context, input models.AccountInput, role string) (*models.Account, error)
+	List(ctx context.Context) ([]models.Account, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*models.Account, error)
+	Update(ctx context.Context, id primitive.ObjectID, input models.AccountInput) (*models.Account, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	Authenticate(ctx context.Context, username string, password string) (*models.Account, error)
+	AuthenticateOTP(ctx context.Context, username string, password string, otp string) (*models.Account, error)
+	LockedFor(ctx context.Context, account *models.Account) (time.Duration, error)
+	Unlock(ctx context.Context, account *models.Account) error
+}
+
+// implement accountService
+type AccountServiceImpl struct {
+	collection *mongo.Collection
+	guard      lockout.Guard
+	audit      AuditService
+	keyring    *encryption.Keyring
+	verified   *passwords.VerifyCache
+}
+
+// Constructor
+func NewAccountServiceImpl(coll *mongo.Collection) *AccountServiceImpl {
+	return &AccountServiceImpl{
+		collection: coll,
+	}
+}
+
+// EnsureIndexes makes usernames unique and finds accounts by email
+func (as *AccountServiceImpl) EnsureIndexes(ctx context.Context) error {
+	_, err := as.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+	})
+	return err
+}
+
+// implement Create
+func (as *AccountServiceImpl) Create(ctx context.Context, input models.AccountInput, role string) (*models.Account, error) {
+	if !usernamePattern.MatchString(input.Username) {
+		return nil, ErrInvalidUsername
+	}
+	email, err := normalizeEmail(input.Email)
+	if err != nil {
+		return nil, err
+	}
+	if input.UserId != "" && !primitive.IsValidObjectID(input.UserId) {
+		return nil, ErrInvalidUserId
+	}
+	if !validTenants(input.Tenants) {
+		return nil, ErrInvalidTenants
+	}
+	if !inScope(ctx, input.Tenants) {
+		return nil, ErrTenantsOutOfScope
+	}
+	hash, err := passwords.Hash(input.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	account := &models.Account{
+		Id:           primitive.NewObjectID(),
+		Username:     input.Username,
+		PasswordHash: hash,
+		Role:         role,
+		UserId:       input.UserId,
+		Tenants:      input.Tenants,
+		Email:        email,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if input.Disabled != nil {
+		account.Disabled = *input.Disabled
+	}
+
+	if _, err := as.collection.InsertOne(ctx, account); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrAccountExists
+		}
+		return nil, err
+	}
+	return account, nil
+}
+
+// Bootstrap creates the first admin, it refuses once any account exists
+func (as *AccountServiceImpl) Bootstrap(ctx context.Context, input models.AccountInput) (*models.Account, error) {
+	count, err := as.collection.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrAccountsExist
+	}
+	return as.Create(ctx, input, models.RoleAdmin)
+}
+
+// implement List
+func (as *AccountServiceImpl) List(ctx context.Context) ([]models.Account, error) {
+	cursor, err := as.collection.Find(ctx, scoped(ctx, bson.M{}), options.Find().SetSort(bson.M{"username": 1}))
+	if err != nil {
+		return nil, err
+	}
+	accounts := []models.Account{}
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// implement Get
+func (as *AccountServiceImpl) Get(ctx context.Context, id primitive.ObjectID) (*models.Account, error) {
+	return as.findOne(ctx, scoped(ctx, bson.M{"_id": id}))
+}
+
+// implement Update, only the password, the role, the user, the email, the
+// tenants and the disabled flag can change. A new email has to be verified again.
+func (as *AccountServiceImpl) Update(ctx context.Context, id primitive.ObjectID, input models.AccountInput) (*models.Account, error) {
+	if input.Tenants != nil {
+		if !validTenants(input.Tenants) {
+			return nil, ErrInvalidTenants
+		}
+		if !inScope(ctx, input.Tenants) {
+			return nil, ErrTenantsOutOfScope
+		}
+	}
+
+	set := bson.M{"updatedAt": time.Now().UTC()}
+	if input.Email != "" {
+		email, err := normalizeEmail(input.Email)
+		if err != nil {
+			return nil, err
+		}
+		// the same address sent again stays verified
+		_, err = as.collection.UpdateOne(ctx,
+			scoped(ctx, bson.M{"_id": id, "email": bson.M{"$ne": email}}),
+			bson.M{"$set": bson.M{"email": email, "emailVerified": false}},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if input.Password != "" {
+		hash, err := passwords.Hash(input.Password)
+		if err != nil {
+			return nil, err
+		}
+		set["passwordHash"] = hash
+	}
+	if input.Role != "" {
+		set["role"] = input.Role
+	}
+	if input.UserId != "" {
+		if !primitive.IsValidObjectID(input.UserId) {
+			return nil, ErrInvalidUserId
+		}
+		set["userId"] = input.UserId
+	}
+	if input.Tenants != nil {
+		set["tenants"] = input.Tenants
+	}
+	if input.Disabled != nil {
+		set["disabled"] = *input.Disabled
+	}
+
+	var account models.Account
+	err := as.collection.FindOneAndUpdate(ctx, scoped(ctx, bson.M{"_id": id}), bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&account)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// implement Delete
+func (as *AccountServiceImpl) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := as.collection.DeleteOne(ctx, scoped(ctx, bson.M{"_id": id}))
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
+
+func validTenants(tenants []string) bool {
+	for _, tenant := range tenants {
+		if !tenancy.ValidTenant(tenant) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeEmail lowercases an address, so lookups by email ignore case
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email != "" && !models.IsEmail(email) {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+// WithVerifyCache skips hashing passwords verified moments ago, for clients
+// sending them with every request like basic auth
+func (as *AccountServiceImpl) WithVerifyCache(verified *passwords.VerifyCache) *AccountServiceImpl {
+	as.verified = verified
+	return as
+}
+
+// WithLockout slows down and locks accounts after failed attempts to
+// authenticate, the locks are recorded with audit
+func (as *AccountServiceImpl) WithLockout(guard lockout.Guard, audit AuditService) *AccountServiceImpl {
+	as.guard = guard
+	as.audit = audit
+	return as
+}
+
+// implement Authenticate. Unknown usernames, disabled accounts, accounts
+// outside the tenant of ctx and wrong passwords all give ErrInvalidCredential
+// after the same amount of work.
+// Accounts with two-factor authentication give ErrOTPRequired, credentials
+// checked here cannot carry a code. With a lockout guard attempts coming too
+// fast or on a locked account give a *lockout.ThrottledError before the
+// password is checked.
+func (as *AccountServiceImpl) Authenticate(ctx context.Context, username string, password string) (*models.Account, error) {
+	return as.guarded(ctx, username, func() (*models.Account, error) {
+		account, err := as.authenticate(ctx, username, password)
+		if err == nil && account.TOTPEnabled {
+			return nil, ErrOTPRequired
+		}
+		return account, err
+	})
+}
+
+// implement AuthenticateOTP, like Authenticate but accounts with two-factor
+// authentication also need a current code or a recovery code
+func (as *AccountServiceImpl) AuthenticateOTP(ctx context.Context, username string, password string, otp string) (*models.Account, error) {
+	return as.guarded(ctx, username, func() (*models.Account, error) {
+		account, err := as.authenticate(ctx, username, password)
+		if err != nil || !account.TOTPEnabled {
+			return account, err
+		}
+		if otp == "" {
+			return nil, ErrOTPRequired
+		}
+		if err := as.verifyOTP(ctx, account, otp); err != nil {
+			return nil, err
+		}
+		return account, nil
+	})
+}
+
+// guarded runs an attempt to authenticate under the lockout guard. Wrong
+// passwords and wrong codes count as failed attempts. A right password
+// missing its code is neither, it must not clear the failed codes either.
+func (as *AccountServiceImpl) guarded(ctx context.Context, username string, attempt func() (*models.Account, error)) (*models.Account, error) {
+	if as.guard == nil {
+		return attempt()
+	}
+
+	// the client IP is put in ctx by the middleware in front of the routes
+	ip := lockout.ClientIP(ctx)
+	err := as.guard.Check(ctx, username, ip)
+	if errors.Is(err, lockout.ErrThrottled) {
+		return nil, err
+	}
+	// like rate limits, an outage of Redis does not stop everyone signing in
+	if err != nil {
+		log.Printf("lockout check of %s failed, letting it through: %v", username, err)
+		return attempt()
+	}
+
+	account, err := attempt()
+	switch {
+	case errors.Is(err, ErrInvalidCredential), errors.Is(err, ErrInvalidOTP):
+		as.failed(ctx, username, ip)
+	case errors.Is(err, ErrOTPRequired):
+		if err := as.guard.Release(ctx, username); err != nil {
+			log.Printf("failed to release attempt on %s: %v", username, err)
+		}
+	case err == nil:
+		if err := as.guard.Succeed(ctx, username); err != nil {
+			log.Printf("failed to reset failed attempts of %s: %v", username, err)
+		}
+	}
+	return account, err
+}
+
+func (as *AccountServiceImpl) failed(ctx context.Context, username string, ip string) {
+	locked, err := as.guard.Fail(ctx, username, ip)
+	if err != nil {
+		log.Printf("failed to record failed attempt on %s: %v", username, err)
+		return
+	}
+	if !locked {
+		return
+	}
+
+	err = as.audit.Record(ctx, models.AuditEvent{
+		Action:  "account.lock",
+		Actor:   "system",
+		Target:  username,
+		Details: map[string]interface{}{"ip": ip},
+	})
+	if err != nil {
+		log.Printf("failed to record audit event account.lock on %s: %v", username, err)
+	}
+}
+
+// implement LockedFor, how long the account stays locked after failed attempts
+func (as *AccountServiceImpl) LockedFor(ctx context.Context, account *models.Account) (time.Duration, error) {
+	if as.guard == nil {
+		return 0, nil
+	}
+	return as.guard.LockedFor(ctx, account.Username)
+}
+
+// implement Unlock, the lock of the account is lifted before it runs out
+func (as *AccountServiceImpl) Unlock(ctx context.Context, account *models.Account) error {
+	if as.guard == nil {
+		return nil
+	}
+	return as.guard.Unlock(ctx, account.Username)
+}
+
+func (as *AccountServiceImpl) authenticate(ctx context.Context, username string, password string) (*models.Account, error) {
+	account, err := as.findOne(ctx, bson.M{"username": username})
+	if err == ErrAccountNotFound {
+		passwords.Verify(dummyHash, password)
+		return nil, ErrInvalidCredential
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tenant, _ := tenancy.FromContext(ctx)
+	if err := as.verify(account.PasswordHash, password); err != nil || account.Disabled || !account.MemberOf(tenant) {
+		return nil, ErrInvalidCredential
+	}
+
+	// hashes made with older parameters or bcrypt are upgraded on the way
+	if passwords.NeedsRehash(account.PasswordHash) {
+		if hash, err := passwords.Hash(password); err == nil {
+			_, err = as.collection.UpdateOne(ctx, bson.M{"_id": account.Id}, bson.M{"$set": bson.M{"passwordHash": hash}})
+			if err != nil {
+				log.Printf("failed to rehash password of %s: %v", account.Username, err)
+			}
+		}
+	}
+	return account, nil
+}
+
+func (as *AccountServiceImpl) verify(hash string, password string) error {
+	if as.verified == nil {
+		return passwords.Verify(hash, password)
+	}
+	return as.verified.Verify(hash, password)
+}
+
+func (as *AccountServiceImpl) findOne(ctx context.Context, filter bson.M) (*models.Account, error) {
+	var account models.Account
+	err := as.collection.FindOne(ctx, filter).Decode(&account)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
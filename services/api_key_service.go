@@ -0,0 +1,283 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/tenancy"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// APIKeyPrefix starts every API key, secret scanners can look for it
+const APIKeyPrefix = "gob_"
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrInvalidAPIKey  = errors.New("invalid API key")
+	ErrInvalidScope   = errors.New("unknown scope")
+	ErrAPIKeyName     = errors.New("name must be 1 to 100 characters")
+	ErrAPIKeyExpired  = errors.New("expiry must be in the future")
+)
+
+// lookups are cached this long, revocation overwrites the cached entry
+const (
+	apiKeyCacheTTL = 5 * time.Minute
+	// last use is written at most this often per key
+	apiKeyUsedInterval = time.Minute
+)
+
+// cached in place of a revoked key until the cache entry would have expired
+const revokedAPIKey = "revoked"
+
+// cachedAPIKey is what lookups cache of a key. APIKey leaves its tenant out
+// of JSON, a key served from the cache must keep it.
+type cachedAPIKey struct {
+	Id        primitive.ObjectID `json:"id"`
+	Name      string             `json:"name"`
+	Prefix    string             `json:"prefix"`
+	Role      string             `json:"role"`
+	Scopes    []string           `json:"scopes"`
+	TenantId  string             `json:"tenantId,omitempty"`
+	ExpiresAt *time.Time         `json:"expiresAt,omitempty"`
+}
+
+// define API Key Service interface
+type APIKeyService interface {
+	Create(ctx context.Context, input models.APIKeyInput, createdBy string) (*models.NewAPIKey, error)
+	List(ctx context.Context) ([]models.APIKey, error)
+	Revoke(ctx context.Context, id primitive.ObjectID) error
+	Authenticate(ctx context.Context, key string) (*models.APIKey, error)
+}
+
+// implement apiKeyService
+type APIKeyServiceImpl struct {
+	collection *mongo.Collection
+	cache      redis.Cmdable
+}
+
+// Constructor
+func NewAPIKeyServiceImpl(coll *mongo.Collection, cache redis.Cmdable) *APIKeyServiceImpl {
+	return &APIKeyServiceImpl{
+		collection: coll,
+		cache:      cache,
+	}
+}
+
+// EnsureIndexes makes key hashes unique
+func (aks *APIKeyServiceImpl) EnsureIndexes(ctx context.Context) error {
+	_, err := aks.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// implement Create, the key belongs to the tenant of ctx
+func (aks *APIKeyServiceImpl) Create(ctx context.Context, input models.APIKeyInput, createdBy string) (*models.NewAPIKey, error) {
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" || len(input.Name) > 100 {
+		return nil, ErrAPIKeyName
+	}
+	for _, scope := range input.Scopes {
+		if !validScope(scope) {
+			return nil, ErrInvalidScope
+		}
+	}
+	now := time.Now().UTC()
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(now) {
+		return nil, ErrAPIKeyExpired
+	}
+
+	// gob_<8 character prefix>_<secret>, the prefix is not secret
+	random := make([]byte, 36)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	prefix := APIKeyPrefix + hex.EncodeToString(random[:4])
+	key := prefix + "_" + base64.RawURLEncoding.EncodeToString(random[4:])
+
+	tenant, _ := tenancy.FromContext(ctx)
+	apiKey := models.APIKey{
+		Id:        primitive.NewObjectID(),
+		Name:      input.Name,
+		Prefix:    prefix,
+		Hash:      hashAPIKey(key),
+		Role:      input.Role,
+		Scopes:    input.Scopes,
+		TenantId:  tenant,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		ExpiresAt: input.ExpiresAt,
+	}
+	if apiKey.Role == "" {
+		apiKey.Role = models.RoleService
+	}
+	if apiKey.Scopes == nil {
+		apiKey.Scopes = []string{}
+	}
+
+	if _, err := aks.collection.InsertOne(ctx, apiKey); err != nil {
+		return nil, err
+	}
+	return &models.NewAPIKey{APIKey: apiKey, Key: key}, nil
+}
+
+// implement List, the keys of the tenant of ctx
+func (aks *APIKeyServiceImpl) List(ctx context.Context) ([]models.APIKey, error) {
+	cursor, err := aks.collection.Find(ctx, tenantFilter(ctx, bson.M{}), options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+	keys := []models.APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// implement Revoke. The cached lookup is overwritten rather than deleted, so a
+// lookup racing the revocation cannot put the key back into the cache.
+func (aks *APIKeyServiceImpl) Revoke(ctx context.Context, id primitive.ObjectID) error {
+	var apiKey models.APIKey
+	err := aks.collection.FindOneAndUpdate(ctx,
+		tenantFilter(ctx, bson.M{"_id": id, "revokedAt": bson.M{"$exists": false}}),
+		bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}},
+	).Decode(&apiKey)
+	if err == mongo.ErrNoDocuments {
+		return ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return aks.cache.Set(ctx, aks.cacheKey(apiKey.Hash), revokedAPIKey, apiKeyCacheTTL).Err()
+}
+
+// implement Authenticate, lookups go through the Redis cache
+func (aks *APIKeyServiceImpl) Authenticate(ctx context.Context, key string) (*models.APIKey, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+	hash := hashAPIKey(key)
+
+	apiKey, err := aks.lookup(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if apiKey == nil || !apiKey.Active(now) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	aks.touch(apiKey, now)
+	return apiKey, nil
+}
+
+// lookup returns the key with hash, nil when it is unknown or revoked
+func (aks *APIKeyServiceImpl) lookup(ctx context.Context, hash string) (*models.APIKey, error) {
+	cached, err := aks.cache.Get(ctx, aks.cacheKey(hash)).Result()
+	if err == nil {
+		if cached == revokedAPIKey {
+			return nil, nil
+		}
+		var entry cachedAPIKey
+		if err := json.Unmarshal([]byte(cached), &entry); err == nil {
+			return &models.APIKey{
+				Id:        entry.Id,
+				Name:      entry.Name,
+				Prefix:    entry.Prefix,
+				Hash:      hash,
+				Role:      entry.Role,
+				Scopes:    entry.Scopes,
+				TenantId:  entry.TenantId,
+				ExpiresAt: entry.ExpiresAt,
+			}, nil
+		}
+	} else if err != redis.Nil {
+		log.Printf("API key cache unavailable, reading from Mongo: %v", err)
+	}
+
+	var apiKey models.APIKey
+	err = aks.collection.FindOne(ctx, bson.M{"hash": hash}).Decode(&apiKey)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if apiKey.RevokedAt != nil {
+		return nil, nil
+	}
+
+	entry := cachedAPIKey{
+		Id:        apiKey.Id,
+		Name:      apiKey.Name,
+		Prefix:    apiKey.Prefix,
+		Role:      apiKey.Role,
+		Scopes:    apiKey.Scopes,
+		TenantId:  apiKey.TenantId,
+		ExpiresAt: apiKey.ExpiresAt,
+	}
+	if value, err := json.Marshal(entry); err == nil {
+		aks.cache.SetNX(ctx, aks.cacheKey(hash), value, apiKeyCacheTTL)
+	}
+	apiKey.Hash = hash
+	return &apiKey, nil
+}
+
+// touch records the last use of a key, at most once per apiKeyUsedInterval
+func (aks *APIKeyServiceImpl) touch(apiKey *models.APIKey, now time.Time) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		first, err := aks.cache.SetNX(ctx, "apikey:used:"+apiKey.Id.Hex(), 1, apiKeyUsedInterval).Result()
+		if err != nil || !first {
+			return
+		}
+		_, err = aks.collection.UpdateOne(ctx, bson.M{"_id": apiKey.Id}, bson.M{"$set": bson.M{"lastUsedAt": now.UTC()}})
+		if err != nil {
+			log.Printf("failed to record use of API key %s: %v", apiKey.Prefix, err)
+		}
+	}()
+}
+
+// entries cached as APIKey under apikey:<hash> had no tenant, they are left to expire
+func (aks *APIKeyServiceImpl) cacheKey(hash string) string {
+	return "apikey:hash:" + hash
+}
+
+// keys carry 256 random bits, a plain SHA-256 is enough to protect them at rest
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func validScope(scope string) bool {
+	for _, known := range models.Scopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantFilter scopes filter to the tenant of ctx, when there is one
+func tenantFilter(ctx context.Context, filter bson.M) bson.M {
+	if tenant, ok := tenancy.FromContext(ctx); ok {
+		filter["tenantId"] = tenant
+	}
+	return filter
+}
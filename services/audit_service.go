@@ -0,0 +1,42 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/tenancy"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// define Audit Service interface
+type AuditService interface {
+	Record(ctx context.Context, event models.AuditEvent) error
+}
+
+// implement auditService, events are appended to the audit_log collection
+type AuditServiceImpl struct {
+	collection *mongo.Collection
+}
+
+// Constructor
+func NewAuditServiceImpl(coll *mongo.Collection) *AuditServiceImpl {
+	return &AuditServiceImpl{
+		collection: coll,
+	}
+}
+
+// implement Record
+func (as *AuditServiceImpl) Record(ctx context.Context, event models.AuditEvent) error {
+	event.Id = primitive.NewObjectID()
+	if event.Tenant == "" {
+		event.Tenant, _ = tenancy.FromContext(ctx)
+	}
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+
+	_, err := as.collection.InsertOne(ctx, event)
+	return err
+}
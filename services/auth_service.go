@@ -0,0 +1,173 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/tenancy"
+	"github.com/mattchw/go-onboard/tokens"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// define Auth Service interface
+type AuthService interface {
+	Login(ctx context.Context, input models.LoginInput) (*models.TokenPair, error)
+	Refresh(ctx context.Context, refreshToken string) (*models.TokenPair, error)
+	Logout(ctx context.Context, refreshToken string, claims map[string]interface{}) error
+	RevokeAll(ctx context.Context, accountId primitive.ObjectID) (int, error)
+	Verify(ctx context.Context, accessToken string) (map[string]interface{}, error)
+}
+
+// implement authService
+type AuthServiceImpl struct {
+	accounts AccountService
+	issuer   *tokens.Issuer
+	store    tokens.Store
+}
+
+// Constructor
+func NewAuthServiceImpl(accounts AccountService, issuer *tokens.Issuer, store tokens.Store) *AuthServiceImpl {
+	return &AuthServiceImpl{
+		accounts: accounts,
+		issuer:   issuer,
+		store:    store,
+	}
+}
+
+// implement Login, the session is bound to the tenant of ctx
+func (as *AuthServiceImpl) Login(ctx context.Context, input models.LoginInput) (*models.TokenPair, error) {
+	account, err := as.accounts.AuthenticateOTP(ctx, input.Username, input.Password, input.OTP)
+	if err != nil {
+		return nil, err
+	}
+
+	tenant, _ := tenancy.FromContext(ctx)
+	refreshToken, err := as.store.Create(ctx, tokens.Session{
+		Subject:   account.Id.Hex(),
+		Tenant:    tenant,
+		MFA:       account.TOTPEnabled,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return as.tokenPair(account, tenant, account.TOTPEnabled, refreshToken)
+}
+
+// implement Refresh. The refresh token is rotated and the account read again,
+// so disabled or deleted accounts and those removed from the tenant stop
+// getting access tokens.
+func (as *AuthServiceImpl) Refresh(ctx context.Context, refreshToken string) (*models.TokenPair, error) {
+	next, session, err := as.store.Rotate(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// the session ends as soon as something about it does not add up
+	tenant, _ := tenancy.FromContext(ctx)
+	if session.Tenant != tenant {
+		as.revoke(ctx, next)
+		return nil, tokens.ErrInvalidRefresh
+	}
+	accountId, err := primitive.ObjectIDFromHex(session.Subject)
+	if err != nil {
+		as.revoke(ctx, next)
+		return nil, tokens.ErrInvalidRefresh
+	}
+	account, err := as.accounts.Get(ctx, accountId)
+	if errors.Is(err, ErrAccountNotFound) || (err == nil && (account.Disabled || !account.MemberOf(tenant))) {
+		as.revoke(ctx, next)
+		return nil, tokens.ErrInvalidRefresh
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return as.tokenPair(account, tenant, session.MFA, next)
+}
+
+// implement Logout, it ends the session of the refresh token and revokes the
+// access token the claims were verified from. Unknown refresh tokens are
+// ignored, their session is already over.
+func (as *AuthServiceImpl) Logout(ctx context.Context, refreshToken string, claims map[string]interface{}) error {
+	if refreshToken != "" {
+		if err := as.store.Revoke(ctx, refreshToken); err != nil && !errors.Is(err, tokens.ErrInvalidRefresh) {
+			return err
+		}
+	}
+
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	if jti == "" || exp == 0 {
+		return nil
+	}
+	return as.store.RevokeAccess(ctx, jti, time.Unix(int64(math.Ceil(exp)), 0))
+}
+
+// implement RevokeAll, every refresh token of the account stops working.
+// Access tokens already issued stay valid until they expire.
+func (as *AuthServiceImpl) RevokeAll(ctx context.Context, accountId primitive.ObjectID) (int, error) {
+	return as.store.RevokeSubject(ctx, accountId.Hex())
+}
+
+// implement Verify, access tokens revoked by Logout are rejected
+func (as *AuthServiceImpl) Verify(ctx context.Context, accessToken string) (map[string]interface{}, error) {
+	claims, err := as.issuer.Verify(accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	jti, _ := claims["jti"].(string)
+	revoked, err := as.store.AccessRevoked(ctx, jti)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, fmt.Errorf("%w: revoked", tokens.ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+func (as *AuthServiceImpl) tokenPair(account *models.Account, tenant string, mfa bool, refreshToken string) (*models.TokenPair, error) {
+	claims := map[string]interface{}{
+		"name": account.Username,
+		"role": account.Role,
+		"amr":  AuthMethods(mfa),
+	}
+	if tenant != "" {
+		claims["tenant"] = tenant
+	}
+	if account.UserId != "" {
+		claims["uid"] = account.UserId
+	}
+
+	accessToken, expires, err := as.issuer.Issue(account.Id.Hex(), claims)
+	if err != nil {
+		return nil, err
+	}
+	return &models.TokenPair{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(math.Round(time.Until(expires).Seconds())),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// AuthMethods returns the amr claim (RFC 8176) of a sign-in
+func AuthMethods(mfa bool) []string {
+	if mfa {
+		return []string{"pwd", "otp", "mfa"}
+	}
+	return []string{"pwd"}
+}
+
+func (as *AuthServiceImpl) revoke(ctx context.Context, refreshToken string) {
+	if err := as.store.Revoke(ctx, refreshToken); err != nil {
+		log.Printf("failed to revoke refresh token session: %v", err)
+	}
+}
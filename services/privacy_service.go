@@ -0,0 +1,434 @@
+package services
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/tenancy"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+// PersonalDataCollection is where records about users are kept besides the
+// users collection. Collections and buckets live in the configured database
+// next to the jobs and carry their tenant in tenantId, or in metadata.tenantId
+// for the files of buckets.
+type PersonalDataCollection struct {
+	Name string
+	// array of the documents holding the records, pulled from it on erasure
+	Array string
+	// field of a record holding the hex of the _id of its user
+	UserField string
+	// a GridFS bucket of NDJSON files, gzipped or not, with one record per
+	// line. Files holding records of the user are deleted on erasure.
+	Bucket bool
+	// records are users encrypted like in the users collection, they are
+	// decrypted for exports
+	Encrypted bool
+}
+
+// PersonalDataCollections lists every collection with personal data besides
+// users. Data exports and erasure cover all of them, new features storing
+// data about users must be added here.
+var PersonalDataCollections = []PersonalDataCollection{
+	// users.import jobs hold the users they import in their params
+	{Name: models.JobsCollection, Array: "params.users", UserField: "id", Encrypted: true},
+	// users.export jobs store the users they exported
+	{Name: models.JobArtifactsBucket, UserField: "id", Bucket: true},
+}
+
+type bucketFile struct {
+	Id       primitive.ObjectID `bson:"_id"`
+	Filename string             `bson:"filename"`
+}
+
+// fields of the user document cleared on erasure, names are kept as a placeholder
+// since they are required
+var erasedUserFields = bson.M{
+	"firstName": "[erased]",
+	"lastName":  "[erased]",
+	"email":     "",
+	"bio":       "",
+	"age":       0,
+	"gender":    "",
+}
+
+// define Privacy Service interface
+type PrivacyService interface {
+	Export(ctx context.Context, userId primitive.ObjectID) ([]byte, error)
+	Erase(ctx context.Context, userId primitive.ObjectID, requestedBy string) (*models.ErasureTombstone, bool, error)
+}
+
+// implement privacyService
+type PrivacyServiceImpl struct {
+	tenants *tenancy.Router
+	users   *UserServiceImpl
+	db      *mongo.Database
+}
+
+// Constructor, users are those of the tenant of each call, users decrypts
+// the encrypted fields of the exported user document and db holds the
+// personal data collections
+func NewPrivacyServiceImpl(tenants *tenancy.Router, users *UserServiceImpl, db *mongo.Database) *PrivacyServiceImpl {
+	return &PrivacyServiceImpl{
+		tenants: tenants,
+		users:   users,
+		db:      db,
+	}
+}
+
+// implement Export, the zip holds the user document and its records in
+// every personal data collection
+func (ps *PrivacyServiceImpl) Export(ctx context.Context, userId primitive.ObjectID) ([]byte, error) {
+	users, err := ps.tenants.Collection(ctx, "users")
+	if err != nil {
+		return nil, err
+	}
+
+	var user bson.M
+	err = users.FindOne(ctx, bson.M{"_id": userId}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the export holds the plaintext, ciphertexts mean nothing to the user
+	decrypted, err := ps.users.FindOne(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	delete(user, tenancy.TenantField)
+	for field := range encryptedUserFields {
+		delete(user, field)
+	}
+	if decrypted.Email != "" {
+		user["email"] = decrypted.Email
+	}
+	user["bio"] = decrypted.Bio
+	user["age"] = decrypted.Age
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	if err := writeDocument(archive, "user.json", user); err != nil {
+		return nil, err
+	}
+
+	for _, source := range PersonalDataCollections {
+		find := ps.findRecords
+		if source.Bucket {
+			find = ps.findFileRecords
+		}
+		records, err := find(ctx, source, userId)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeRecords(archive, source.Name+".json", records); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// findRecords returns the records of the user in the arrays of a collection
+func (ps *PrivacyServiceImpl) findRecords(ctx context.Context, source PersonalDataCollection, userId primitive.ObjectID) ([]bson.M, error) {
+	cursor, err := ps.db.Collection(source.Name).Find(ctx,
+		sharedScope(ctx, bson.M{source.Array + "." + source.UserField: userId.Hex()}),
+		options.Find().SetProjection(bson.M{source.Array: 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var docs []bson.M
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	records := []bson.M{}
+	for _, doc := range docs {
+		items, _ := lookup(doc, source.Array).(bson.A)
+		for _, item := range items {
+			record, ok := item.(bson.M)
+			if !ok || record[source.UserField] != userId.Hex() {
+				continue
+			}
+			if source.Encrypted {
+				if err := ps.decryptRecord(record); err != nil {
+					return nil, err
+				}
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// decryptRecord replaces the encrypted fields of a user record with their plaintext
+func (ps *PrivacyServiceImpl) decryptRecord(record bson.M) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	var doc UserDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	user, err := ps.users.Decode(doc)
+	if err != nil {
+		return err
+	}
+	record["email"] = user.Email
+	record["bio"] = user.Bio
+	record["age"] = user.Age
+	return nil
+}
+
+// findFileRecords returns the records of the user in the files of a bucket
+func (ps *PrivacyServiceImpl) findFileRecords(ctx context.Context, source PersonalDataCollection, userId primitive.ObjectID) ([]bson.M, error) {
+	records := []bson.M{}
+	_, err := ps.scanFiles(ctx, source, func(file bucketFile, line bson.M) {
+		if line[source.UserField] == userId.Hex() {
+			records = append(records, line)
+		}
+	})
+	return records, err
+}
+
+// scanFiles calls visit with every line of the files of a bucket belonging
+// to the tenant of ctx
+func (ps *PrivacyServiceImpl) scanFiles(ctx context.Context, source PersonalDataCollection, visit func(file bucketFile, line bson.M)) (*gridfs.Bucket, error) {
+	bucket, err := gridfs.NewBucket(ps.db, options.GridFSBucket().SetName(source.Name))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		bucket.SetReadDeadline(deadline)
+		bucket.SetWriteDeadline(deadline)
+	}
+
+	filter := bson.M{"metadata.tenantId": bson.M{"$exists": false}}
+	if tenant, ok := tenancy.FromContext(ctx); ok {
+		filter = bson.M{"metadata.tenantId": tenant}
+	}
+	cursor, err := bucket.Find(filter)
+	if err != nil {
+		return nil, err
+	}
+	var files []bucketFile
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		var content bytes.Buffer
+		if _, err := bucket.DownloadToStream(file.Id, &content); err != nil {
+			return nil, err
+		}
+		var r io.Reader = &content
+		if bytes.HasPrefix(content.Bytes(), []byte{0x1f, 0x8b}) {
+			if r, err = gzip.NewReader(&content); err != nil {
+				return nil, err
+			}
+		}
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var line bson.M
+			if err := bson.UnmarshalExtJSON(scanner.Bytes(), false, &line); err == nil {
+				visit(file, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", file.Filename, err)
+		}
+	}
+	return bucket, nil
+}
+
+// implement Erase, personal data is anonymized in place across all collections
+// and a tombstone is recorded. Erasing twice is harmless, the second call
+// reports the existing tombstone.
+func (ps *PrivacyServiceImpl) Erase(ctx context.Context, userId primitive.ObjectID, requestedBy string) (*models.ErasureTombstone, bool, error) {
+	tombstones, err := ps.tenants.Collection(ctx, "erasure_tombstones")
+	if err != nil {
+		return nil, false, err
+	}
+	users, err := ps.tenants.Collection(ctx, "users")
+	if err != nil {
+		return nil, false, err
+	}
+
+	var existing models.ErasureTombstone
+	err = tombstones.FindOne(ctx, bson.M{"_id": userId}).Decode(&existing)
+	alreadyErased := err == nil
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, false, err
+	}
+
+	now := time.Now().UTC()
+	counts := map[string]int64{}
+
+	set := bson.M{"erasedAt": now}
+	for field, value := range erasedUserFields {
+		set[field] = value
+	}
+	result, err := users.UpdateOne(ctx, bson.M{"_id": userId, "erasedAt": bson.M{"$exists": false}}, bson.M{"$set": set})
+	if err != nil {
+		return nil, false, err
+	}
+	if result.MatchedCount == 0 && !alreadyErased {
+		count, err := users.CountDocuments(ctx, bson.M{"_id": userId})
+		if err != nil {
+			return nil, false, err
+		}
+		if count == 0 {
+			return nil, false, ErrUserNotFound
+		}
+	}
+	counts["users"] = result.ModifiedCount
+
+	for _, source := range PersonalDataCollections {
+		erase := ps.eraseRecords
+		if source.Bucket {
+			erase = ps.eraseFiles
+		}
+		count, err := erase(ctx, source, userId)
+		if err != nil {
+			return nil, false, err
+		}
+		counts[source.Name] = count
+	}
+
+	if alreadyErased {
+		return &existing, true, nil
+	}
+
+	// a concurrent erasure may have won the race, its tombstone is the one kept
+	_, err = tombstones.UpdateOne(ctx,
+		bson.M{"_id": userId},
+		bson.M{"$setOnInsert": bson.M{
+			"requestedBy": requestedBy,
+			"collections": counts,
+			"erasedAt":    now,
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	var tombstone models.ErasureTombstone
+	if err := tombstones.FindOne(ctx, bson.M{"_id": userId}).Decode(&tombstone); err != nil {
+		return nil, false, err
+	}
+
+	return &tombstone, false, nil
+}
+
+// eraseRecords pulls the records of the user from the arrays of a collection
+func (ps *PrivacyServiceImpl) eraseRecords(ctx context.Context, source PersonalDataCollection, userId primitive.ObjectID) (int64, error) {
+	result, err := ps.db.Collection(source.Name).UpdateMany(ctx,
+		sharedScope(ctx, bson.M{source.Array + "." + source.UserField: userId.Hex()}),
+		bson.M{"$pull": bson.M{source.Array: bson.M{source.UserField: userId.Hex()}}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// eraseFiles deletes the files of a bucket holding records of the user
+func (ps *PrivacyServiceImpl) eraseFiles(ctx context.Context, source PersonalDataCollection, userId primitive.ObjectID) (int64, error) {
+	matched := map[primitive.ObjectID]bool{}
+	bucket, err := ps.scanFiles(ctx, source, func(file bucketFile, line bson.M) {
+		if line[source.UserField] == userId.Hex() {
+			matched[file.Id] = true
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for id := range matched {
+		if err := bucket.Delete(id); err != nil && err != gridfs.ErrFileNotFound {
+			return 0, err
+		}
+	}
+	return int64(len(matched)), nil
+}
+
+// sharedScope restricts a filter on a collection shared by the tenants to
+// the documents of the tenant of ctx
+func sharedScope(ctx context.Context, filter bson.M) bson.M {
+	if tenant, ok := tenancy.FromContext(ctx); ok {
+		filter[tenancy.TenantField] = tenant
+	} else {
+		filter[tenancy.TenantField] = bson.M{"$exists": false}
+	}
+	return filter
+}
+
+// lookup follows a dotted path through nested documents
+func lookup(doc bson.M, path string) interface{} {
+	var value interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(bson.M)
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+// documents are written as relaxed extended JSON which keeps ObjectIDs and dates readable
+func writeDocument(archive *zip.Writer, name string, doc bson.M) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	data, err := bson.MarshalExtJSONIndent(doc, false, false, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func writeRecords(archive *zip.Writer, name string, records []bson.M) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	items := make([][]byte, len(records))
+	for i, record := range records {
+		if items[i], err = bson.MarshalExtJSONIndent(record, false, false, "  ", "  "); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(append(append([]byte("[\n  "), bytes.Join(items, []byte(",\n  "))...), []byte("\n]")...))
+	return err
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/sessions"
+	"github.com/mattchw/go-onboard/tenancy"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// devices are told apart by their User-Agent, long ones are cut
+const maxDeviceLength = 256
+
+// define Session Service interface
+type SessionService interface {
+	Login(ctx context.Context, input models.LoginInput, device string, ip string) (string, *sessions.Session, error)
+	Authenticate(ctx context.Context, token string, ip string) (*sessions.Session, *models.Account, error)
+	List(ctx context.Context, accountId primitive.ObjectID) ([]sessions.Session, error)
+	Revoke(ctx context.Context, accountId primitive.ObjectID, sessionId string) error
+	RevokeAll(ctx context.Context, accountId primitive.ObjectID) (int, error)
+}
+
+// implement sessionService
+type SessionServiceImpl struct {
+	accounts AccountService
+	store    *sessions.RedisStore
+}
+
+// Constructor
+func NewSessionServiceImpl(accounts AccountService, store *sessions.RedisStore) *SessionServiceImpl {
+	return &SessionServiceImpl{
+		accounts: accounts,
+		store:    store,
+	}
+}
+
+// implement Login, the session is bound to the tenant of ctx
+func (ss *SessionServiceImpl) Login(ctx context.Context, input models.LoginInput, device string, ip string) (string, *sessions.Session, error) {
+	account, err := ss.accounts.AuthenticateOTP(ctx, input.Username, input.Password, input.OTP)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(device) > maxDeviceLength {
+		device = device[:maxDeviceLength]
+	}
+	tenant, _ := tenancy.FromContext(ctx)
+	return ss.store.Create(ctx, sessions.Session{
+		AccountId: account.Id.Hex(),
+		Tenant:    tenant,
+		Device:    device,
+		IP:        ip,
+		MFA:       account.TOTPEnabled,
+	})
+}
+
+// implement Authenticate. The account is read on every request, so role
+// changes apply at once and disabled or deleted accounts, or those removed
+// from the tenant of the session, are signed out.
+func (ss *SessionServiceImpl) Authenticate(ctx context.Context, token string, ip string) (*sessions.Session, *models.Account, error) {
+	session, err := ss.store.Get(ctx, token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accountId, err := primitive.ObjectIDFromHex(session.AccountId)
+	if err != nil {
+		return nil, nil, sessions.ErrNoSession
+	}
+	account, err := ss.accounts.Get(ctx, accountId)
+	if errors.Is(err, ErrAccountNotFound) || (err == nil && (account.Disabled || !account.MemberOf(session.Tenant))) {
+		if err := ss.store.Revoke(ctx, session.AccountId, session.Id); err != nil && !errors.Is(err, sessions.ErrNoSession) {
+			log.Printf("failed to revoke session of unavailable account: %v", err)
+		}
+		return nil, nil, sessions.ErrNoSession
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := ss.store.Touch(ctx, session, ip); err != nil {
+		return nil, nil, err
+	}
+	return session, account, nil
+}
+
+// implement List, the CSRF tokens of the sessions are left out
+func (ss *SessionServiceImpl) List(ctx context.Context, accountId primitive.ObjectID) ([]sessions.Session, error) {
+	list, err := ss.store.List(ctx, accountId.Hex())
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		list[i].CSRFToken = ""
+	}
+	return list, nil
+}
+
+// implement Revoke
+func (ss *SessionServiceImpl) Revoke(ctx context.Context, accountId primitive.ObjectID, sessionId string) error {
+	return ss.store.Revoke(ctx, accountId.Hex(), sessionId)
+}
+
+// implement RevokeAll
+func (ss *SessionServiceImpl) RevokeAll(ctx context.Context, accountId primitive.ObjectID) (int, error) {
+	return ss.store.RevokeAll(ctx, accountId.Hex())
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mattchw/go-onboard/encryption"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/totp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// recovery codes handed out when two-factor authentication is enabled
+const recoveryCodeCount = 10
+
+var (
+	ErrTOTPEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrNoPendingTOTP  = errors.New("two-factor authentication has not been set up")
+)
+
+// define Two Factor Service interface, implemented by the account service
+type TwoFactorService interface {
+	BeginTOTP(ctx context.Context, account *models.Account, issuer string) (*models.TOTPEnrollment, error)
+	PendingTOTPURI(account *models.Account, issuer string) (string, error)
+	ConfirmTOTP(ctx context.Context, account *models.Account, code string) ([]string, error)
+	DisableTOTP(ctx context.Context, account *models.Account, code string) error
+	RegenerateRecoveryCodes(ctx context.Context, account *models.Account, code string) ([]string, error)
+	ResetTOTP(ctx context.Context, account *models.Account) error
+}
+
+// WithKeyring encrypts the TOTP secrets of accounts, nil keeps them in plain text
+func (as *AccountServiceImpl) WithKeyring(keyring *encryption.Keyring) *AccountServiceImpl {
+	as.keyring = keyring
+	return as
+}
+
+// implement BeginTOTP, a new secret is kept pending until ConfirmTOTP proves
+// the authenticator app has it
+func (as *AccountServiceImpl) BeginTOTP(ctx context.Context, account *models.Account, issuer string) (*models.TOTPEnrollment, error) {
+	if account.TOTPEnabled {
+		return nil, ErrTOTPEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	stored, err := as.sealSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := as.collection.UpdateOne(ctx,
+		bson.M{"_id": account.Id, "totpEnabled": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"totpPending": stored, "updatedAt": time.Now().UTC()}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, ErrTOTPEnabled
+	}
+
+	account.TOTPPending = stored
+	return &models.TOTPEnrollment{Secret: secret, URI: totp.URI(issuer, account.Username, secret)}, nil
+}
+
+// implement PendingTOTPURI, for the QR code of an enrollment
+func (as *AccountServiceImpl) PendingTOTPURI(account *models.Account, issuer string) (string, error) {
+	if account.TOTPPending == "" {
+		return "", ErrNoPendingTOTP
+	}
+	secret, err := as.openSecret(account.TOTPPending)
+	if err != nil {
+		return "", err
+	}
+	return totp.URI(issuer, account.Username, secret), nil
+}
+
+// implement ConfirmTOTP, a code of the pending secret enables two-factor
+// authentication and returns the recovery codes
+func (as *AccountServiceImpl) ConfirmTOTP(ctx context.Context, account *models.Account, code string) ([]string, error) {
+	if account.TOTPEnabled {
+		return nil, ErrTOTPEnabled
+	}
+	if account.TOTPPending == "" {
+		return nil, ErrNoPendingTOTP
+	}
+	secret, err := as.openSecret(account.TOTPPending)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidOTP
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	// a secret replaced by another BeginTOTP in the meantime is not enabled
+	result, err := as.collection.UpdateOne(ctx,
+		bson.M{"_id": account.Id, "totpPending": account.TOTPPending},
+		bson.M{
+			"$set": bson.M{
+				"totpEnabled":   true,
+				"totpSecret":    account.TOTPPending,
+				"totpLastStep":  step,
+				"recoveryCodes": hashes,
+				"updatedAt":     time.Now().UTC(),
+			},
+			"$unset": bson.M{"totpPending": ""},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, ErrNoPendingTOTP
+	}
+	return codes, nil
+}
+
+// implement DisableTOTP, it takes a current code or a recovery code
+func (as *AccountServiceImpl) DisableTOTP(ctx context.Context, account *models.Account, code string) error {
+	if !account.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+	if err := as.verifyOTP(ctx, account, code); err != nil {
+		return err
+	}
+	return as.ResetTOTP(ctx, account)
+}
+
+// implement RegenerateRecoveryCodes, the previous ones stop working
+func (as *AccountServiceImpl) RegenerateRecoveryCodes(ctx context.Context, account *models.Account, code string) ([]string, error) {
+	if !account.TOTPEnabled {
+		return nil, ErrTOTPNotEnabled
+	}
+	if err := as.verifyOTP(ctx, account, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	_, err = as.collection.UpdateOne(ctx, bson.M{"_id": account.Id},
+		bson.M{"$set": bson.M{"recoveryCodes": hashes, "updatedAt": time.Now().UTC()}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// implement ResetTOTP, for admins helping someone who lost their authenticator
+func (as *AccountServiceImpl) ResetTOTP(ctx context.Context, account *models.Account) error {
+	_, err := as.collection.UpdateOne(ctx, bson.M{"_id": account.Id}, bson.M{
+		"$set":   bson.M{"totpEnabled": false, "updatedAt": time.Now().UTC()},
+		"$unset": bson.M{"totpSecret": "", "totpPending": "", "totpLastStep": "", "recoveryCodes": ""},
+	})
+	return err
+}
+
+// verifyOTP accepts a code of the current time steps or an unused recovery
+// code. Both only work once, the update guarding that is atomic.
+func (as *AccountServiceImpl) verifyOTP(ctx context.Context, account *models.Account, code string) error {
+	secret, err := as.openSecret(account.TOTPSecret)
+	if err != nil {
+		return err
+	}
+
+	if step, ok := totp.Validate(secret, code, time.Now()); ok {
+		result, err := as.collection.UpdateOne(ctx,
+			bson.M{"_id": account.Id, "totpLastStep": bson.M{"$lt": step}},
+			bson.M{"$set": bson.M{"totpLastStep": step}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			return ErrInvalidOTP
+		}
+		return nil
+	}
+
+	hash := totp.HashRecoveryCode(code)
+	result, err := as.collection.UpdateOne(ctx,
+		bson.M{"_id": account.Id, "recoveryCodes": hash},
+		bson.M{"$pull": bson.M{"recoveryCodes": hash}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return ErrInvalidOTP
+	}
+	return nil
+}
+
+func (as *AccountServiceImpl) sealSecret(secret string) (string, error) {
+	if as.keyring == nil {
+		return secret, nil
+	}
+	return as.keyring.Encrypt("totpSecret", []byte(secret), encryption.Randomized)
+}
+
+func (as *AccountServiceImpl) openSecret(stored string) (string, error) {
+	if !encryption.IsEncrypted(stored) {
+		return stored, nil
+	}
+	if as.keyring == nil {
+		return "", encryption.ErrNoActiveKey
+	}
+	secret, err := as.keyring.Decrypt("totpSecret", stored)
+	return string(secret), err
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := totp.RecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = totp.HashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
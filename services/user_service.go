@@ -2,50 +2,619 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
 
+	"github.com/mattchw/go-onboard/encryption"
 	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/tenancy"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var ErrInvalidUser = errors.New("invalid user")
+
 // define User Service interface
 type UserService interface {
-	Create(ctx context.Context, payload models.User) *mongo.InsertOneResult
-	FindOne(ctx context.Context, payload models.User) models.User
-	DeleteOne(ctx context.Context, payload models.User) bool
+	Create(ctx context.Context, payload models.User) (*mongo.InsertOneResult, error)
+	Find(ctx context.Context, filter models.UserFilter, opts ...*options.FindOptions) ([]models.User, error)
+	Count(ctx context.Context, filter models.UserFilter) (int64, error)
+	FindOne(ctx context.Context, id primitive.ObjectID) (models.User, error)
+	Update(ctx context.Context, id primitive.ObjectID, payload models.User) (*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, id primitive.ObjectID) (*mongo.DeleteResult, error)
+	Export(ctx context.Context, filter models.UserFilter, w io.Writer) (int64, error)
+}
+
+// fields encrypted at rest, deterministic ones keep working in equality
+// filters. Age has too few values to be deterministic, a ciphertext would
+// give away every user of the same age, so age filters on encrypted users
+// are applied in the process.
+var encryptedUserFields = map[string]encryption.Mode{
+	"email": encryption.Deterministic,
+	"bio":   encryption.Randomized,
+	"age":   encryption.Randomized,
+}
+
+// UserDocument is a user as stored in Mongo. Encrypted fields hold strings
+// produced by the keyring, age is a number until it gets encrypted. Users are
+// kept in this form outside of Mongo too, in caches and job params, so they
+// are only decrypted by Decode.
+type UserDocument struct {
+	Id        primitive.ObjectID `bson:"_id" json:"id"`
+	FirstName string             `bson:"firstName" json:"firstName"`
+	LastName  string             `bson:"lastName" json:"lastName"`
+	Email     string             `bson:"email,omitempty" json:"email,omitempty"`
+	Bio       string             `bson:"bio" json:"bio,omitempty"`
+	Age       interface{}        `bson:"age" json:"age,omitempty"`
+	Gender    string             `bson:"gender" json:"gender,omitempty"`
 }
 
 // implement userService
 type UserServiceImpl struct {
-	collection *mongo.Collection
+	users   tenancy.Source
+	keyring *encryption.Keyring
 }
 
 // Constructor
 func NewUserServiceImpl(coll *mongo.Collection) *UserServiceImpl {
 	return &UserServiceImpl{
-		collection: coll,
+		users: tenancy.Static(coll),
 	}
 }
 
-// implement Create
-func (us *UserServiceImpl) Create(ctx context.Context, payload models.User) *mongo.InsertOneResult {
+// NewEncryptedUserServiceImpl works on the users collection of the tenant of
+// each call and encrypts PII fields with keyring, a nil keyring stores them in plaintext
+func NewEncryptedUserServiceImpl(users tenancy.Source, keyring *encryption.Keyring) *UserServiceImpl {
+	return &UserServiceImpl{
+		users:   users,
+		keyring: keyring,
+	}
+}
+
+// implement Create, a user failing validation is ErrInvalidUser
+func (us *UserServiceImpl) Create(ctx context.Context, payload models.User) (*mongo.InsertOneResult, error) {
 	newUser := models.User{
 		Id:        primitive.NewObjectID(),
 		FirstName: payload.FirstName,
 		LastName:  payload.LastName,
+		Email:     payload.Email,
 		Bio:       payload.Bio,
 		Age:       payload.Age,
 		Gender:    payload.Gender,
 	}
 
 	if err := newUser.ValidateUser(); err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUser, err)
+	}
+
+	doc, err := us.Encode(newUser)
+	if err != nil {
+		return nil, err
 	}
 
-	result, err := us.collection.InsertOne(ctx, newUser)
+	coll, err := us.users.Collection(ctx)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	return coll.InsertOne(ctx, doc)
+}
+
+// InsertMany stores users in one round trip, users without an id get one
+func (us *UserServiceImpl) InsertMany(ctx context.Context, users []models.User) (int64, error) {
+	docs := make([]interface{}, 0, len(users))
+	for _, user := range users {
+		if user.Id.IsZero() {
+			user.Id = primitive.NewObjectID()
+		}
+		doc, err := us.Encode(user)
+		if err != nil {
+			return 0, err
+		}
+		docs = append(docs, doc)
 	}
 
-	return result
+	coll, err := us.users.Collection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// a run of an import interrupted halfway stored some of them already
+	_, err = coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && onlyDuplicates(bulkErr) {
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(docs)), nil
+}
+
+// onlyDuplicates reports whether every write failed on an existing _id
+func onlyDuplicates(err mongo.BulkWriteException) bool {
+	if err.WriteConcernError != nil {
+		return false
+	}
+	for _, writeErr := range err.WriteErrors {
+		if writeErr.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+// implement Find
+func (us *UserServiceImpl) Find(ctx context.Context, filter models.UserFilter, opts ...*options.FindOptions) ([]models.User, error) {
+	docs, err := us.FindDocuments(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return us.DecodeAll(docs)
+}
+
+// FindDocuments is Find without decrypting the users. Age filters on
+// encrypted users apply after the limit and skip of opts.
+func (us *UserServiceImpl) FindDocuments(ctx context.Context, filter models.UserFilter, opts ...*options.FindOptions) ([]UserDocument, error) {
+	coll, query, err := us.prepare(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := coll.Find(ctx, query, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	docs := []UserDocument{}
+	for cursor.Next(ctx) {
+		var doc UserDocument
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		if ok, err := us.matchAge(filter, doc); err != nil || !ok {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	return docs, cursor.Err()
+}
+
+// DecodeAll decodes stored users with Decode
+func (us *UserServiceImpl) DecodeAll(docs []UserDocument) ([]models.User, error) {
+	users := make([]models.User, len(docs))
+	for i, doc := range docs {
+		user, err := us.Decode(doc)
+		if err != nil {
+			return nil, err
+		}
+		users[i] = user
+	}
+	return users, nil
+}
+
+// implement Count, encrypted ages are compared one user at a time
+func (us *UserServiceImpl) Count(ctx context.Context, filter models.UserFilter) (int64, error) {
+	coll, query, err := us.prepare(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	if !us.filtersEncryptedAge(filter) {
+		return coll.CountDocuments(ctx, query)
+	}
+
+	cursor, err := coll.Find(ctx, query, options.Find().SetProjection(bson.M{"age": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var count int64
+	for cursor.Next(ctx) {
+		var doc UserDocument
+		if err := cursor.Decode(&doc); err != nil {
+			return 0, err
+		}
+		ok, err := us.matchAge(filter, doc)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			count++
+		}
+	}
+	return count, cursor.Err()
+}
+
+// implement FindOne, mongo.ErrNoDocuments is returned for unknown ids
+func (us *UserServiceImpl) FindOne(ctx context.Context, id primitive.ObjectID) (models.User, error) {
+	doc, err := us.FindOneDocument(ctx, id)
+	if err != nil {
+		return models.User{}, err
+	}
+	return us.Decode(doc)
+}
+
+// FindOneDocument is FindOne without decrypting the user
+func (us *UserServiceImpl) FindOneDocument(ctx context.Context, id primitive.ObjectID) (UserDocument, error) {
+	coll, err := us.users.Collection(ctx)
+	if err != nil {
+		return UserDocument{}, err
+	}
+
+	var doc UserDocument
+	err = coll.FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	return doc, err
+}
+
+// implement Update
+func (us *UserServiceImpl) Update(ctx context.Context, id primitive.ObjectID, payload models.User) (*mongo.UpdateResult, error) {
+	coll, err := us.users.Collection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	payload.Id = id
+	doc, err := us.Encode(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set": bson.M{
+			"firstName": doc.FirstName,
+			"lastName":  doc.LastName,
+			"email":     doc.Email,
+			"bio":       doc.Bio,
+			"age":       doc.Age,
+		},
+	})
+}
+
+// implement DeleteOne
+func (us *UserServiceImpl) DeleteOne(ctx context.Context, id primitive.ObjectID) (*mongo.DeleteResult, error) {
+	coll, err := us.users.Collection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return coll.DeleteOne(ctx, bson.M{"_id": id})
+}
+
+// DeleteBatch deletes up to limit users matching filter and reports how many were deleted
+func (us *UserServiceImpl) DeleteBatch(ctx context.Context, filter models.UserFilter, limit int64) (int64, error) {
+	coll, query, err := us.prepare(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	// users filtered out in the process do not count towards the limit
+	findOptions := options.Find().SetProjection(bson.M{"_id": 1, "age": 1})
+	if !us.filtersEncryptedAge(filter) {
+		findOptions.SetLimit(limit)
+	}
+	cursor, err := coll.Find(ctx, query, findOptions)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var ids []primitive.ObjectID
+	for int64(len(ids)) < limit && cursor.Next(ctx) {
+		var doc UserDocument
+		if err := cursor.Decode(&doc); err != nil {
+			return 0, err
+		}
+		ok, err := us.matchAge(filter, doc)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			ids = append(ids, doc.Id)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	result, err := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// implement Export, users are written as newline-delimited JSON while the
+// cursor is iterated so the result set is never held in memory
+func (us *UserServiceImpl) Export(ctx context.Context, filter models.UserFilter, w io.Writer) (int64, error) {
+	coll, query, err := us.prepare(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	cursor, err := coll.Find(ctx, query, options.Find().SetBatchSize(500))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var count int64
+	encoder := json.NewEncoder(w)
+	for cursor.Next(ctx) {
+		var doc UserDocument
+		if err := cursor.Decode(&doc); err != nil {
+			return count, err
+		}
+		if ok, err := us.matchAge(filter, doc); err != nil || !ok {
+			if err != nil {
+				return count, err
+			}
+			continue
+		}
+		user, err := us.Decode(doc)
+		if err != nil {
+			return count, err
+		}
+		if err := encoder.Encode(user); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, cursor.Err()
+}
+
+// ReencryptBatch re-encrypts up to limit users after the given id whose fields
+// are in plaintext or encrypted with a key other than the active one. It
+// returns the last id seen, zero once every user was visited.
+func (us *UserServiceImpl) ReencryptBatch(ctx context.Context, after primitive.ObjectID, limit int64) (primitive.ObjectID, int64, error) {
+	if us.keyring == nil {
+		return primitive.NilObjectID, 0, encryption.ErrNoActiveKey
+	}
+	coll, err := us.users.Collection(ctx)
+	if err != nil {
+		return primitive.NilObjectID, 0, err
+	}
+
+	cursor, err := coll.Find(ctx,
+		bson.M{"_id": bson.M{"$gt": after}},
+		options.Find().SetSort(bson.M{"_id": 1}).SetLimit(limit),
+	)
+	if err != nil {
+		return primitive.NilObjectID, 0, err
+	}
+	var docs []UserDocument
+	if err := cursor.All(ctx, &docs); err != nil {
+		return primitive.NilObjectID, 0, err
+	}
+	if len(docs) == 0 {
+		return primitive.NilObjectID, 0, nil
+	}
+
+	active := us.keyring.ActiveKeyId()
+	var writes []mongo.WriteModel
+	for _, doc := range docs {
+		if !us.needsReencryption(doc, active) {
+			continue
+		}
+		user, err := us.Decode(doc)
+		if err != nil {
+			return primitive.NilObjectID, 0, fmt.Errorf("user %s: %w", doc.Id.Hex(), err)
+		}
+		fresh, err := us.Encode(user)
+		if err != nil {
+			return primitive.NilObjectID, 0, err
+		}
+
+		// skip documents changed since they were read, they were encrypted by the writer
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": doc.Id, "email": storedValue(doc.Email), "bio": storedValue(doc.Bio), "age": doc.Age}).
+			SetUpdate(bson.M{"$set": bson.M{"email": fresh.Email, "bio": fresh.Bio, "age": fresh.Age}}))
+	}
+
+	last := docs[len(docs)-1].Id
+	if len(writes) == 0 {
+		return last, 0, nil
+	}
+	result, err := coll.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return primitive.NilObjectID, 0, err
+	}
+	return last, result.ModifiedCount, nil
+}
+
+// empty strings were decoded from missing fields as well
+func storedValue(value string) interface{} {
+	if value == "" {
+		return bson.M{"$in": bson.A{"", nil}}
+	}
+	return value
+}
+
+// needsReencryption reports whether a field is in plaintext, encrypted with
+// a key other than the active one or in a mode it is no longer encrypted in
+func (us *UserServiceImpl) needsReencryption(doc UserDocument, active string) bool {
+	values := map[string]string{"email": doc.Email, "bio": doc.Bio}
+	switch age := doc.Age.(type) {
+	case string:
+		values["age"] = age
+	case nil:
+	default:
+		if fmt.Sprint(age) != "0" {
+			return true
+		}
+	}
+
+	for field, value := range values {
+		if value == "" {
+			continue
+		}
+		if !encryption.IsEncrypted(value) || encryption.KeyId(value) != active || encryption.ValueMode(value) != encryptedUserFields[field] {
+			return true
+		}
+	}
+	return false
+}
+
+// prepare resolves the collection of the tenant of ctx and translates filter
+func (us *UserServiceImpl) prepare(ctx context.Context, filter models.UserFilter) (tenancy.Collection, bson.M, error) {
+	coll, err := us.users.Collection(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	query, err := us.query(filter)
+	return coll, query, err
+}
+
+// query translates a filter, encrypted fields are matched on their
+// deterministic ciphertexts as well as on legacy plaintext values
+func (us *UserServiceImpl) query(filter models.UserFilter) (bson.M, error) {
+	query := filter.BSON()
+	if us.keyring == nil {
+		return query, nil
+	}
+
+	if filter.Email != "" {
+		values, err := us.keyring.DeterministicValues("email", []byte(filter.Email))
+		if err != nil {
+			return nil, err
+		}
+		query["email"] = bson.M{"$in": append(values, filter.Email)}
+	}
+
+	// encrypted ages are candidates, matchAge compares them once decrypted
+	if plainRange, ok := query["age"]; ok {
+		delete(query, "age")
+		query["$or"] = bson.A{
+			bson.M{"age": bson.M{"$type": "string"}},
+			bson.M{"age": plainRange},
+		}
+	}
+
+	return query, nil
+}
+
+// Encode turns a user into its stored form, encrypting its PII fields
+func (us *UserServiceImpl) Encode(user models.User) (UserDocument, error) {
+	doc := UserDocument{
+		Id:        user.Id,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Email:     user.Email,
+		Bio:       user.Bio,
+		Age:       user.Age,
+		Gender:    user.Gender,
+	}
+	if us.keyring == nil {
+		return doc, nil
+	}
+
+	var err error
+	if doc.Email, err = us.encrypt("email", user.Email); err != nil {
+		return doc, err
+	}
+	if doc.Bio, err = us.encrypt("bio", user.Bio); err != nil {
+		return doc, err
+	}
+	if user.Age != 0 {
+		if doc.Age, err = us.encrypt("age", strconv.Itoa(user.Age)); err != nil {
+			return doc, err
+		}
+	}
+	return doc, nil
+}
+
+// empty values are left as they are
+func (us *UserServiceImpl) encrypt(field string, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	return us.keyring.Encrypt(field, []byte(value), encryptedUserFields[field])
+}
+
+// filtersEncryptedAge reports whether filter compares ages Mongo cannot
+func (us *UserServiceImpl) filtersEncryptedAge(filter models.UserFilter) bool {
+	return us.keyring != nil && (filter.MinAge > 0 || filter.MaxAge > 0)
+}
+
+// matchAge applies the age range of filter to a user whose age is
+// encrypted, plaintext ages were already compared by Mongo
+func (us *UserServiceImpl) matchAge(filter models.UserFilter, doc UserDocument) (bool, error) {
+	encrypted, ok := doc.Age.(string)
+	if !ok || !us.filtersEncryptedAge(filter) {
+		return true, nil
+	}
+	plain, err := us.decrypt("age", encrypted)
+	if err != nil {
+		return false, err
+	}
+	age, err := strconv.Atoi(plain)
+	if err != nil {
+		return false, fmt.Errorf("decoding age: %w", err)
+	}
+	return (filter.MinAge <= 0 || age >= filter.MinAge) && (filter.MaxAge <= 0 || age <= filter.MaxAge), nil
+}
+
+// Decode turns a stored user back into a user, decrypting its PII fields
+func (us *UserServiceImpl) Decode(doc UserDocument) (models.User, error) {
+	user := models.User{
+		Id:        doc.Id,
+		FirstName: doc.FirstName,
+		LastName:  doc.LastName,
+		Gender:    doc.Gender,
+	}
+
+	var err error
+	if user.Email, err = us.decrypt("email", doc.Email); err != nil {
+		return user, err
+	}
+	if user.Bio, err = us.decrypt("bio", doc.Bio); err != nil {
+		return user, err
+	}
+
+	switch age := doc.Age.(type) {
+	case string:
+		plain, err := us.decrypt("age", age)
+		if err != nil {
+			return user, err
+		}
+		if user.Age, err = strconv.Atoi(plain); err != nil {
+			return user, fmt.Errorf("decoding age: %w", err)
+		}
+	case int:
+		user.Age = age
+	case int32:
+		user.Age = int(age)
+	case int64:
+		user.Age = int(age)
+	case float64:
+		user.Age = int(age)
+	}
+
+	return user, nil
+}
+
+// plaintext values written before encryption was enabled are returned as they are
+func (us *UserServiceImpl) decrypt(field string, value string) (string, error) {
+	if !encryption.IsEncrypted(value) {
+		return value, nil
+	}
+	if us.keyring == nil {
+		return "", fmt.Errorf("%s is encrypted but no encryption key is configured", field)
+	}
+
+	plain, err := us.keyring.Decrypt(field, value)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
 }
@@ -0,0 +1,243 @@
+package sessions
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+var ErrNoSession = errors.New("sessions: no such session")
+
+// Session is a browser signed in to an account. Its id is the hash of the
+// cookie token, it can be shown and revoked without revealing the token.
+type Session struct {
+	Id        string `json:"id" xml:"id"`
+	AccountId string `json:"accountId" xml:"accountId"`
+	Tenant    string `json:"tenant,omitempty" xml:"tenant,omitempty"`
+	Device    string `json:"device" xml:"device"`
+	IP        string `json:"ip" xml:"ip"`
+	// signed in with a second factor
+	MFA       bool      `json:"mfa" xml:"mfa"`
+	CreatedAt time.Time `json:"createdAt" xml:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen" xml:"lastSeen"`
+	ExpiresAt time.Time `json:"expiresAt" xml:"expiresAt"`
+	// sent back in a header by requests changing anything
+	CSRFToken string `json:"csrfToken,omitempty" xml:"csrfToken,omitempty"`
+	// set when listing, on the session of the request
+	Current bool `json:"current,omitempty" xml:"current,omitempty"`
+}
+
+// RedisStore keeps sessions in Redis. A session expires once it has been idle
+// for longer than idle and at the latest lifetime after it was created.
+type RedisStore struct {
+	rdb      redis.Cmdable
+	prefix   string
+	idle     time.Duration
+	lifetime time.Duration
+	now      func() time.Time
+}
+
+// Constructor
+func NewRedisStore(rdb redis.Cmdable, idle time.Duration, lifetime time.Duration) *RedisStore {
+	return &RedisStore{
+		rdb:      rdb,
+		prefix:   "session:",
+		idle:     idle,
+		lifetime: lifetime,
+		now:      time.Now,
+	}
+}
+
+// Create stores a new session and returns the token for its cookie
+func (rs *RedisStore) Create(ctx context.Context, session Session) (string, *Session, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := rs.now().UTC()
+	session.Id = sessionId(token)
+	session.CSRFToken = csrf
+	session.CreatedAt = now
+	session.LastSeen = now
+	session.ExpiresAt = now.Add(rs.lifetime)
+	session.Current = false
+	value, err := json.Marshal(session)
+	if err != nil {
+		return "", nil, err
+	}
+
+	_, err = rs.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, rs.sessionKey(session.Id), value, rs.idle)
+		pipe.SAdd(ctx, rs.accountKey(session.AccountId), session.Id)
+		pipe.Expire(ctx, rs.accountKey(session.AccountId), rs.lifetime)
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &session, nil
+}
+
+// Get returns the session of a cookie token
+func (rs *RedisStore) Get(ctx context.Context, token string) (*Session, error) {
+	return rs.get(ctx, sessionId(token))
+}
+
+// Touch records the session being used from ip and extends its idle expiry
+func (rs *RedisStore) Touch(ctx context.Context, session *Session, ip string) error {
+	now := rs.now().UTC()
+	ttl := session.ExpiresAt.Sub(now)
+	if ttl > rs.idle {
+		ttl = rs.idle
+	}
+	if ttl <= 0 {
+		return ErrNoSession
+	}
+
+	session.LastSeen = now
+	session.IP = ip
+	value, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	// XX keeps a session revoked in the meantime from coming back
+	ok, err := rs.rdb.SetXX(ctx, rs.sessionKey(session.Id), value, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoSession
+	}
+	return nil
+}
+
+// List returns the sessions of an account, the most recently used first
+func (rs *RedisStore) List(ctx context.Context, accountId string) ([]Session, error) {
+	ids, err := rs.rdb.SMembers(ctx, rs.accountKey(accountId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []Session{}, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = rs.sessionKey(id)
+	}
+	values, err := rs.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Session{}
+	var expired []interface{}
+	for i, value := range values {
+		raw, ok := value.(string)
+		var session Session
+		if !ok || json.Unmarshal([]byte(raw), &session) != nil {
+			expired = append(expired, ids[i])
+			continue
+		}
+		list = append(list, session)
+	}
+	if len(expired) > 0 {
+		rs.rdb.SRem(ctx, rs.accountKey(accountId), expired...)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list, nil
+}
+
+// Revoke ends a session of an account
+func (rs *RedisStore) Revoke(ctx context.Context, accountId string, id string) error {
+	session, err := rs.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if session.AccountId != accountId {
+		return ErrNoSession
+	}
+
+	_, err = rs.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, rs.sessionKey(id))
+		pipe.SRem(ctx, rs.accountKey(accountId), id)
+		return nil
+	})
+	return err
+}
+
+// RevokeAll ends every session of an account and returns how many there were
+func (rs *RedisStore) RevokeAll(ctx context.Context, accountId string) (int, error) {
+	ids, err := rs.rdb.SMembers(ctx, rs.accountKey(accountId)).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	keys := []string{rs.accountKey(accountId)}
+	for _, id := range ids {
+		keys = append(keys, rs.sessionKey(id))
+	}
+	deleted, err := rs.rdb.Del(ctx, keys...).Result()
+	if err != nil {
+		return 0, err
+	}
+	// the account set itself was one of the deleted keys
+	if deleted > 0 {
+		deleted--
+	}
+	return int(deleted), nil
+}
+
+func (rs *RedisStore) get(ctx context.Context, id string) (*Session, error) {
+	value, err := rs.rdb.Get(ctx, rs.sessionKey(id)).Result()
+	if err == redis.Nil {
+		return nil, ErrNoSession
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal([]byte(value), &session); err != nil {
+		return nil, ErrNoSession
+	}
+	if !rs.now().Before(session.ExpiresAt) {
+		return nil, ErrNoSession
+	}
+	return &session, nil
+}
+
+func (rs *RedisStore) sessionKey(id string) string {
+	return rs.prefix + id
+}
+
+func (rs *RedisStore) accountKey(accountId string) string {
+	return rs.prefix + "account:" + accountId
+}
+
+func sessionId(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
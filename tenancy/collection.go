@@ -0,0 +1,214 @@
+package tenancy
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection is the part of *mongo.Collection the services use
+type Collection interface {
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+}
+
+// scopedCollection adds the tenant to every filter and inserted document, and
+// refuses updates touching the tenant field
+type scopedCollection struct {
+	inner  Collection
+	tenant string
+}
+
+// Scope restricts a shared collection to the documents of one tenant
+func Scope(coll Collection, tenant string) Collection {
+	return &scopedCollection{inner: coll, tenant: tenant}
+}
+
+func (sc *scopedCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	doc, err := sc.document(document)
+	if err != nil {
+		return nil, err
+	}
+	return sc.inner.InsertOne(ctx, doc, opts...)
+}
+
+func (sc *scopedCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	docs := make([]interface{}, len(documents))
+	for i, document := range documents {
+		doc, err := sc.document(document)
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = doc
+	}
+	return sc.inner.InsertMany(ctx, docs, opts...)
+}
+
+func (sc *scopedCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	return sc.inner.Find(ctx, sc.filter(filter), opts...)
+}
+
+func (sc *scopedCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	return sc.inner.FindOne(ctx, sc.filter(filter), opts...)
+}
+
+func (sc *scopedCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	return sc.inner.CountDocuments(ctx, sc.filter(filter), opts...)
+}
+
+func (sc *scopedCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if err := checkUpdate(update); err != nil {
+		return nil, err
+	}
+	return sc.inner.UpdateOne(ctx, sc.filter(filter), update, opts...)
+}
+
+func (sc *scopedCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if err := checkUpdate(update); err != nil {
+		return nil, err
+	}
+	return sc.inner.UpdateMany(ctx, sc.filter(filter), update, opts...)
+}
+
+func (sc *scopedCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return sc.inner.DeleteOne(ctx, sc.filter(filter), opts...)
+}
+
+func (sc *scopedCollection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return sc.inner.DeleteMany(ctx, sc.filter(filter), opts...)
+}
+
+// write models are copied, the caller's models are left untouched
+func (sc *scopedCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	scoped := make([]mongo.WriteModel, len(models))
+	for i, model := range models {
+		switch m := model.(type) {
+		case *mongo.InsertOneModel:
+			doc, err := sc.document(m.Document)
+			if err != nil {
+				return nil, err
+			}
+			scoped[i] = mongo.NewInsertOneModel().SetDocument(doc)
+		case *mongo.UpdateOneModel:
+			if err := checkUpdate(m.Update); err != nil {
+				return nil, err
+			}
+			copied := *m
+			copied.Filter = sc.filter(m.Filter)
+			scoped[i] = &copied
+		case *mongo.UpdateManyModel:
+			if err := checkUpdate(m.Update); err != nil {
+				return nil, err
+			}
+			copied := *m
+			copied.Filter = sc.filter(m.Filter)
+			scoped[i] = &copied
+		case *mongo.ReplaceOneModel:
+			doc, err := sc.document(m.Replacement)
+			if err != nil {
+				return nil, err
+			}
+			copied := *m
+			copied.Filter = sc.filter(m.Filter)
+			copied.Replacement = doc
+			scoped[i] = &copied
+		case *mongo.DeleteOneModel:
+			copied := *m
+			copied.Filter = sc.filter(m.Filter)
+			scoped[i] = &copied
+		case *mongo.DeleteManyModel:
+			copied := *m
+			copied.Filter = sc.filter(m.Filter)
+			scoped[i] = &copied
+		default:
+			return nil, ErrUnsupported
+		}
+	}
+	return sc.inner.BulkWrite(ctx, scoped, opts...)
+}
+
+// the caller's filter is kept intact under $and, so no operator in it can
+// widen the match beyond the tenant. Upserts take the tenant from it too.
+func (sc *scopedCollection) filter(filter interface{}) bson.D {
+	tenant := bson.D{{Key: TenantField, Value: sc.tenant}}
+	if filter == nil {
+		return tenant
+	}
+	return bson.D{{Key: "$and", Value: bson.A{filter, tenant}}}
+}
+
+// document converts a document to bson.D carrying the tenant
+func (sc *scopedCollection) document(document interface{}) (bson.D, error) {
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	for _, elem := range doc {
+		if elem.Key == TenantField {
+			if elem.Value != sc.tenant {
+				return nil, ErrCrossTenant
+			}
+			return doc, nil
+		}
+	}
+	return append(doc, bson.E{Key: TenantField, Value: sc.tenant}), nil
+}
+
+// updates may not move documents to another tenant. Aggregation pipeline
+// updates cannot be checked and are refused.
+func checkUpdate(update interface{}) error {
+	data, err := bson.Marshal(update)
+	if err != nil {
+		return ErrUnsupported
+	}
+	var operators bson.M
+	if err := bson.Unmarshal(data, &operators); err != nil {
+		return ErrUnsupported
+	}
+
+	for operator, fields := range operators {
+		if !strings.HasPrefix(operator, "$") {
+			return ErrUnsupported
+		}
+		var names []string
+		switch doc := fields.(type) {
+		case bson.M:
+			for field, value := range doc {
+				names = append(names, field)
+				// $rename names the target field in the value
+				if target, ok := value.(string); ok && operator == "$rename" {
+					names = append(names, target)
+				}
+			}
+		case bson.D:
+			for _, elem := range doc {
+				names = append(names, elem.Key)
+				if target, ok := elem.Value.(string); ok && operator == "$rename" {
+					names = append(names, target)
+				}
+			}
+		}
+		for _, field := range names {
+			if field == TenantField || strings.HasPrefix(field, TenantField+".") {
+				return ErrCrossTenant
+			}
+		}
+	}
+	return nil
+}
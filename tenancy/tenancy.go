@@ -0,0 +1,175 @@
+package tenancy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Mode selects how the data of tenants is kept apart
+type Mode string
+
+const (
+	// Disabled serves a single tenant, data lives in the configured database
+	Disabled Mode = ""
+	// CollectionPerTenant prefixes collection names with the tenant id
+	CollectionPerTenant Mode = "collection"
+	// DatabasePerTenant gives every tenant its own database
+	DatabasePerTenant Mode = "database"
+	// SharedCollection keeps all tenants in the same collections and scopes
+	// every query and write with a tenantId field
+	SharedCollection Mode = "field"
+)
+
+// TenantField holds the tenant of documents in SharedCollection mode
+const TenantField = "tenantId"
+
+var (
+	ErrNoTenant      = errors.New("tenancy: no tenant in context")
+	ErrInvalidTenant = errors.New("tenancy: invalid tenant id")
+	ErrCrossTenant   = errors.New("tenancy: document belongs to another tenant")
+	ErrUnsupported   = errors.New("tenancy: operation cannot be scoped to a tenant")
+)
+
+// tenant ids end up in database and collection names, underscores are left
+// out so a prefixed name maps back to exactly one tenant
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// ValidTenant reports whether id can be used as a tenant id
+func ValidTenant(id string) bool {
+	return tenantPattern.MatchString(id)
+}
+
+func ParseMode(value string) (Mode, error) {
+	switch mode := Mode(value); mode {
+	case Disabled, CollectionPerTenant, DatabasePerTenant, SharedCollection:
+		return mode, nil
+	}
+	return Disabled, fmt.Errorf("tenancy: unknown mode %q, expected collection, database or field", value)
+}
+
+type contextKey struct{}
+
+// WithTenant returns a context carrying the tenant of the request
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, contextKey{}, tenant)
+}
+
+// FromContext returns the tenant set by WithTenant
+func FromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(contextKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+// Key namespaces a cache key with the tenant of ctx, if any
+func Key(ctx context.Context, key string) string {
+	if tenant, ok := FromContext(ctx); ok {
+		return "tenant:" + tenant + ":" + key
+	}
+	return key
+}
+
+// Router resolves collections for the tenant of a context
+type Router struct {
+	client   *mongo.Client
+	database string
+	mode     Mode
+}
+
+// Constructor
+func NewRouter(client *mongo.Client, database string, mode Mode) *Router {
+	return &Router{
+		client:   client,
+		database: database,
+		mode:     mode,
+	}
+}
+
+func (r *Router) Mode() Mode {
+	return r.mode
+}
+
+// Namespace returns the database and collection holding name for the tenant
+// of ctx. Without a tenant nothing is returned unless tenancy is disabled.
+func (r *Router) Namespace(ctx context.Context, name string) (string, string, error) {
+	if r.mode == Disabled {
+		return r.database, name, nil
+	}
+
+	tenant, ok := FromContext(ctx)
+	if !ok {
+		return "", "", ErrNoTenant
+	}
+	if !ValidTenant(tenant) {
+		return "", "", ErrInvalidTenant
+	}
+
+	switch r.mode {
+	case CollectionPerTenant:
+		return r.database, tenant + "_" + name, nil
+	case DatabasePerTenant:
+		return r.database + "_" + tenant, name, nil
+	default:
+		return r.database, name, nil
+	}
+}
+
+// Database returns the database of the tenant of ctx, buckets opened on it
+// must be named with Namespace
+func (r *Router) Database(ctx context.Context) (*mongo.Database, error) {
+	database, _, err := r.Namespace(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return r.client.Database(database), nil
+}
+
+// Collection returns the collection name of the tenant of ctx
+func (r *Router) Collection(ctx context.Context, name string) (Collection, error) {
+	database, collection, err := r.Namespace(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := r.client.Database(database).Collection(collection)
+	if r.mode == SharedCollection {
+		tenant, _ := FromContext(ctx)
+		return Scope(coll, tenant), nil
+	}
+	return coll, nil
+}
+
+// Source returns the collection name for whichever tenant a context carries
+func (r *Router) Source(name string) Source {
+	return routedSource{router: r, name: name}
+}
+
+// Source resolves the collection an operation works on from its context
+type Source interface {
+	Collection(ctx context.Context) (Collection, error)
+}
+
+type routedSource struct {
+	router *Router
+	name   string
+}
+
+func (rs routedSource) Collection(ctx context.Context) (Collection, error) {
+	return rs.router.Collection(ctx, rs.name)
+}
+
+type staticSource struct {
+	collection Collection
+}
+
+// Static returns a source always giving the same collection
+func Static(coll Collection) Source {
+	return staticSource{collection: coll}
+}
+
+func (ss staticSource) Collection(ctx context.Context) (Collection, error) {
+	return ss.collection, nil
+}
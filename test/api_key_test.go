@@ -0,0 +1,132 @@
+package test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/rbac"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+type stubAPIKeys struct {
+	err error
+}
+
+func (sk stubAPIKeys) Authenticate(ctx context.Context, key string) (*models.APIKey, error) {
+	if sk.err != nil {
+		return nil, sk.err
+	}
+	switch key {
+	case "gob_reader":
+		return &models.APIKey{Id: primitive.NewObjectID(), Prefix: "gob_reader", Scopes: []string{models.PermUsersRead}}, nil
+	case "gob_writer":
+		return &models.APIKey{Id: primitive.NewObjectID(), Prefix: "gob_writer", Scopes: []string{models.PermUsersRead, models.PermUsersWrite}}, nil
+	}
+	return nil, services.ErrInvalidAPIKey
+}
+
+func apiKeyApp(keys middlewares.APIKeyAuthenticator) *fiber.App {
+	app := fiber.New()
+	app.Use(middlewares.VerifyToken(stubVerifier{}))
+	app.Use(middlewares.VerifyAPIKey(keys, "X-API-Key"))
+	app.Post("/users", middlewares.TokenReq, middlewares.Permit(rbac.Default(), models.PermUsersWrite), func(c *fiber.Ctx) error {
+		return c.SendString(c.Locals("username").(string))
+	})
+	return app
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	app := apiKeyApp(stubAPIKeys{})
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"scoped key", map[string]string{"X-API-Key": "gob_writer"}, 200},
+		{"missing scope", map[string]string{"X-API-Key": "gob_reader"}, 403},
+		{"unknown key", map[string]string{"X-API-Key": "gob_revoked"}, 401},
+		{"account token", map[string]string{"Authorization": "Bearer good"}, 200},
+		{"token and key", map[string]string{"Authorization": "Bearer good", "X-API-Key": "gob_writer"}, 400},
+		{"neither", nil, 401},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/users", nil)
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+}
+
+func TestAPIKeyStoreUnavailable(t *testing.T) {
+	app := apiKeyApp(stubAPIKeys{err: errors.New("server selection timeout")})
+
+	req := httptest.NewRequest("POST", "/users", nil)
+	req.Header.Set("X-API-Key", "gob_writer")
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, 503, resp.StatusCode)
+}
+
+func TestAPIKeyActive(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+
+	require.True(t, (&models.APIKey{}).Active(now))
+	require.True(t, (&models.APIKey{ExpiresAt: &future}).Active(now))
+	require.False(t, (&models.APIKey{ExpiresAt: &past}).Active(now))
+	require.False(t, (&models.APIKey{RevokedAt: &past}).Active(now))
+}
+
+func TestAPIKeyKeepsTenantWhenCached(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("authenticate", func(mt *mtest.T) {
+		rdb, server := newRedis(mt.T)
+		keys := services.NewAPIKeyServiceImpl(mt.Coll, rdb)
+		key := services.APIKeyPrefix + "cached"
+		sum := sha256.Sum256([]byte(key))
+		id := primitive.NewObjectID()
+		// the last use was just recorded, so nothing else reaches Mongo
+		server.Set("apikey:used:"+id.Hex(), "1")
+
+		ns := mt.Coll.Database().Name() + "." + mt.Coll.Name()
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: id},
+			{Key: "prefix", Value: "gob_cached"},
+			{Key: "hash", Value: hex.EncodeToString(sum[:])},
+			{Key: "role", Value: models.RoleService},
+			{Key: "scopes", Value: bson.A{models.PermUsersRead}},
+			{Key: "tenantId", Value: "acme"},
+		}))
+
+		// the first call reads Mongo and fills the cache, the second is served from it
+		for i := 0; i < 2; i++ {
+			apiKey, err := keys.Authenticate(context.Background(), key)
+			require.NoError(t, err)
+			require.Equal(t, id, apiKey.Id)
+			require.Equal(t, "acme", apiKey.TenantId)
+			require.Equal(t, models.RoleService, apiKey.Role)
+			require.Equal(t, []string{models.PermUsersRead}, apiKey.Scopes)
+		}
+		require.Len(t, mt.GetAllStartedEvents(), 1)
+	})
+}
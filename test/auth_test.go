@@ -0,0 +1,169 @@
+package test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/lockout"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/passwords"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashing(t *testing.T) {
+	hash, err := passwords.Hash("correct horse battery staple")
+	require.NoError(t, err)
+	require.Contains(t, hash, "$argon2id$v=19$m=65536,t=3,p=2$")
+	require.NotContains(t, hash, "correct horse")
+
+	require.NoError(t, passwords.Verify(hash, "correct horse battery staple"))
+	require.ErrorIs(t, passwords.Verify(hash, "correct horse battery stapler"), passwords.ErrMismatch)
+	require.False(t, passwords.NeedsRehash(hash))
+
+	again, err := passwords.Hash("correct horse battery staple")
+	require.NoError(t, err)
+	require.NotEqual(t, hash, again)
+
+	_, err = passwords.Hash("short")
+	require.ErrorIs(t, err, passwords.ErrTooShort)
+}
+
+func TestVerifyCache(t *testing.T) {
+	hash, err := passwords.Hash("correct horse battery staple")
+	require.NoError(t, err)
+	verified := passwords.NewVerifyCache(10, time.Minute)
+
+	require.ErrorIs(t, verified.Verify(hash, "correct horse battery stapler"), passwords.ErrMismatch)
+	require.NoError(t, verified.Verify(hash, "correct horse battery staple"))
+
+	// the password verified moments ago is not hashed again, argon2id would
+	// take its 64 MiB
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	require.NoError(t, verified.Verify(hash, "correct horse battery staple"))
+	runtime.ReadMemStats(&after)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	// failures are not remembered, and a new hash misses
+	require.ErrorIs(t, verified.Verify(hash, "correct horse battery stapler"), passwords.ErrMismatch)
+	other, err := passwords.Hash("another long enough password")
+	require.NoError(t, err)
+	require.ErrorIs(t, verified.Verify(other, "correct horse battery staple"), passwords.ErrMismatch)
+}
+
+func TestBcryptHashesStillVerify(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("legacy password"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	require.NoError(t, passwords.Verify(string(hash), "legacy password"))
+	require.ErrorIs(t, passwords.Verify(string(hash), "wrong"), passwords.ErrMismatch)
+	require.True(t, passwords.NeedsRehash(string(hash)))
+
+	require.ErrorIs(t, passwords.Verify("plaintext", "plaintext"), passwords.ErrUnknownFormat)
+}
+
+type stubAuthenticator struct {
+	err error
+}
+
+func (sa stubAuthenticator) Authenticate(ctx context.Context, username string, password string) (*models.Account, error) {
+	if sa.err != nil {
+		return nil, sa.err
+	}
+	if username != "admin" || password != "a long enough password" {
+		return nil, services.ErrInvalidCredential
+	}
+	return &models.Account{Username: "admin", Role: models.RoleAdmin}, nil
+}
+
+func authApp(authenticator middlewares.Authenticator) *fiber.App {
+	app := fiber.New()
+	app.Get("/", middlewares.AuthReq(authenticator), func(c *fiber.Ctx) error {
+		account := c.Locals(middlewares.AccountKey).(*models.Account)
+		return c.SendString(account.Username)
+	})
+	return app
+}
+
+func basicAuth(username string, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestAuthReq(t *testing.T) {
+	app := authApp(stubAuthenticator{})
+
+	cases := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"valid", basicAuth("admin", "a long enough password"), 200},
+		{"wrong password", basicAuth("admin", "12345678"), 401},
+		{"missing", "", 401},
+		{"not basic", "Bearer token", 401},
+		{"garbage", "Basic !!!", 401},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, tc.status, resp.StatusCode)
+			if tc.status == 401 {
+				require.Equal(t, `Basic realm="Restricted"`, resp.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestAuthReqStoreUnavailable(t *testing.T) {
+	app := authApp(stubAuthenticator{err: errors.New("server selection timeout")})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", basicAuth("admin", "a long enough password"))
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, 503, resp.StatusCode)
+}
+
+func TestAuthReqThrottled(t *testing.T) {
+	cases := []struct {
+		name       string
+		err        error
+		retryAfter string
+		message    string
+	}{
+		{"delayed", &lockout.ThrottledError{RetryAfter: 1500 * time.Millisecond}, "2", "Too many failed attempts"},
+		{"locked", &lockout.ThrottledError{RetryAfter: 15 * time.Minute, Locked: true}, "900", "Account locked after too many failed attempts"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			app := authApp(stubAuthenticator{err: fmt.Errorf("authenticating: %w", tc.err)})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", basicAuth("admin", "a long enough password"))
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, 429, resp.StatusCode)
+			require.Equal(t, tc.retryAfter, resp.Header.Get("Retry-After"))
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Contains(t, string(body), tc.message)
+			require.ErrorIs(t, tc.err, lockout.ErrThrottled)
+		})
+	}
+}
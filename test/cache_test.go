@@ -0,0 +1,331 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattchw/go-onboard/cache"
+	"github.com/stretchr/testify/require"
+)
+
+var minute = cache.TTL{Soft: time.Minute}
+
+type cachedUser struct {
+	Name string `json:"name"`
+}
+
+func TestCacheGetOrLoad(t *testing.T) {
+	ctx := context.Background()
+	rdb, server := newRedis(t)
+	users := cache.New[[]cachedUser](cache.NewRedisStore(rdb), nil)
+
+	loads := 0
+	loader := func(ctx context.Context) ([]cachedUser, error) {
+		loads++
+		return []cachedUser{{Name: "Ada"}}, nil
+	}
+
+	first, err := users.GetOrLoad(ctx, "users", minute, loader)
+	require.NoError(t, err)
+	require.Equal(t, []cachedUser{{Name: "Ada"}}, first)
+
+	// callers get copies, changing one leaves the cached value alone
+	first[0].Name = "redacted"
+	second, err := users.GetOrLoad(ctx, "users", minute, loader)
+	require.NoError(t, err)
+	require.Equal(t, "Ada", second[0].Name)
+	require.Equal(t, 1, loads)
+	// entries are kept apart from the other keys in Redis
+	require.True(t, server.Exists("cache:users"))
+
+	require.NoError(t, users.Delete(ctx, "users"))
+	require.False(t, server.Exists("cache:users"))
+	_, err = users.GetOrLoad(ctx, "users", minute, loader)
+	require.NoError(t, err)
+	require.Equal(t, 2, loads)
+
+	// Redis being down costs a load, not the read
+	server.SetError("connection refused")
+	third, err := users.GetOrLoad(ctx, "users", minute, loader)
+	require.NoError(t, err)
+	require.Equal(t, "Ada", third[0].Name)
+	require.Equal(t, 3, loads)
+}
+
+func TestCacheDoesNotCacheFailures(t *testing.T) {
+	ctx := context.Background()
+	users := cache.New[[]cachedUser](cache.NewMemoryStore(), nil)
+
+	failure := errors.New("mongo: server selection timeout")
+	_, err := users.GetOrLoad(ctx, "users", minute, func(ctx context.Context) ([]cachedUser, error) {
+		return nil, failure
+	})
+	require.ErrorIs(t, err, failure)
+
+	loaded, err := users.GetOrLoad(ctx, "users", minute, func(ctx context.Context) ([]cachedUser, error) {
+		return []cachedUser{{Name: "Ada"}}, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, loaded, 1)
+}
+
+func TestCacheCollapsesConcurrentMisses(t *testing.T) {
+	ctx := context.Background()
+	users := cache.New[[]cachedUser](cache.NewMemoryStore(), nil)
+
+	var loads int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context) ([]cachedUser, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return []cachedUser{{Name: "Ada"}}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loaded, err := users.GetOrLoad(ctx, "users", minute, loader)
+			require.NoError(t, err)
+			require.Len(t, loaded, 1)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&loads))
+}
+
+func TestCacheSharedLoadOutlivesItsCaller(t *testing.T) {
+	users := cache.New[[]cachedUser](cache.NewMemoryStore(), nil)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loader := func(ctx context.Context) ([]cachedUser, error) {
+		close(started)
+		select {
+		case <-release:
+			return []cachedUser{{Name: "Ada"}}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// the caller starting the load gives up, the one waiting with it does not
+	first, cancel := context.WithCancel(context.Background())
+	failed := make(chan error, 1)
+	go func() {
+		_, err := users.GetOrLoad(first, "users", minute, loader)
+		failed <- err
+	}()
+	<-started
+
+	var loaded []cachedUser
+	waited := make(chan error, 1)
+	go func() {
+		var err error
+		loaded, err = users.GetOrLoad(context.Background(), "users", minute, loader)
+		waited <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-failed, context.Canceled)
+
+	close(release)
+	require.NoError(t, <-waited)
+	require.Equal(t, []cachedUser{{Name: "Ada"}}, loaded)
+}
+
+func TestCacheTags(t *testing.T) {
+	rdb, _ := newRedis(t)
+	stores := map[string]cache.Store{
+		"redis":  cache.NewRedisStore(rdb),
+		"memory": cache.NewMemoryStore(),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testCacheTags(t, store)
+		})
+	}
+}
+
+func testCacheTags(t *testing.T, store cache.Store) {
+	ctx := context.Background()
+	users := cache.New[[]cachedUser](store, nil)
+
+	name := "Ada"
+	loads := 0
+	loader := func(ctx context.Context) ([]cachedUser, error) {
+		loads++
+		return []cachedUser{{Name: name}}, nil
+	}
+	get := func(key string, tags ...string) string {
+		loaded, err := users.GetOrLoad(ctx, key, minute, loader, tags...)
+		require.NoError(t, err)
+		return loaded[0].Name
+	}
+
+	require.Equal(t, "Ada", get("users", "users:list"))
+	require.Equal(t, "Ada", get("user:1", "user:1", "users"))
+	require.Equal(t, 2, loads)
+
+	// invalidating a tag drops the entries registered under it, and only those
+	name = "Grace"
+	require.NoError(t, users.Invalidate(ctx, "users:list"))
+	require.Equal(t, "Grace", get("users", "users:list"))
+	require.Equal(t, "Ada", get("user:1", "user:1", "users"))
+	require.Equal(t, 3, loads)
+
+	require.NoError(t, users.Invalidate(ctx, "users"))
+	require.Equal(t, "Grace", get("user:1", "user:1", "users"))
+	require.Equal(t, 4, loads)
+}
+
+func TestCacheDiscardsLoadsRacingInvalidation(t *testing.T) {
+	ctx := context.Background()
+	users := cache.New[[]cachedUser](cache.NewMemoryStore(), nil)
+
+	// the write commits and invalidates while the old list is being loaded
+	_, err := users.GetOrLoad(ctx, "users", minute, func(ctx context.Context) ([]cachedUser, error) {
+		require.NoError(t, users.Invalidate(ctx, "users:list"))
+		return []cachedUser{{Name: "Ada"}}, nil
+	}, "users:list")
+	require.NoError(t, err)
+
+	loaded, err := users.GetOrLoad(ctx, "users", minute, func(ctx context.Context) ([]cachedUser, error) {
+		return []cachedUser{{Name: "Grace"}}, nil
+	}, "users:list")
+	require.NoError(t, err)
+	require.Equal(t, "Grace", loaded[0].Name)
+}
+
+func TestLocalCacheTier(t *testing.T) {
+	ctx := context.Background()
+	rdb, _ := newRedis(t)
+	store := cache.NewRedisStore(rdb)
+	users := cache.New[[]cachedUser](store, cache.NewLocal(100, time.Minute))
+
+	loader := func(ctx context.Context) ([]cachedUser, error) {
+		return []cachedUser{{Name: "Ada"}}, nil
+	}
+	for i := 0; i < 3; i++ {
+		_, err := users.GetOrLoad(ctx, "users", minute, loader, "users:list")
+		require.NoError(t, err)
+	}
+	require.Equal(t, cache.Stats{LocalHits: 2, LocalMisses: 1, StoreMisses: 1, Loads: 1}, users.Stats())
+
+	// another replica warmed Redis, this one reads it once
+	other := cache.New[[]cachedUser](store, cache.NewLocal(100, time.Minute))
+	for i := 0; i < 2; i++ {
+		_, err := other.GetOrLoad(ctx, "users", minute, loader, "users:list")
+		require.NoError(t, err)
+	}
+	require.Equal(t, cache.Stats{LocalHits: 1, LocalMisses: 1, StoreHits: 1}, other.Stats())
+
+	// invalidating drops the local copy along with the Redis entry
+	require.NoError(t, users.Invalidate(ctx, "users:list"))
+	_, err := users.GetOrLoad(ctx, "users", minute, loader, "users:list")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), users.Stats().Loads)
+}
+
+func TestCacheServesStaleWhileRevalidating(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewMemoryStore()
+	users := cache.New[[]cachedUser](store, nil)
+	ttl := cache.TTL{Soft: 100 * time.Millisecond, Hard: time.Minute}
+
+	var name atomic.Value
+	name.Store("Ada")
+	loader := func(ctx context.Context) ([]cachedUser, error) {
+		return []cachedUser{{Name: name.Load().(string)}}, nil
+	}
+	_, err := users.GetOrLoad(ctx, "users", ttl, loader)
+	require.NoError(t, err)
+
+	// another replica is refreshing, the stale value is served meanwhile
+	time.Sleep(120 * time.Millisecond)
+	name.Store("Grace")
+	token, err := store.Lock(ctx, "users", time.Minute)
+	require.NoError(t, err)
+	stale, err := users.GetOrLoad(ctx, "users", ttl, loader)
+	require.NoError(t, err)
+	require.Equal(t, "Ada", stale[0].Name)
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, int64(1), users.Stats().Loads)
+
+	// once it is gone this replica takes the lock and refreshes in the background
+	require.NoError(t, store.Unlock(ctx, "users", token))
+	stale, err = users.GetOrLoad(ctx, "users", ttl, loader)
+	require.NoError(t, err)
+	require.Equal(t, "Ada", stale[0].Name)
+	require.Eventually(t, func() bool {
+		return users.Stats().Refreshes == 1
+	}, time.Second, 5*time.Millisecond)
+	// the lock is released once the refresh is done
+	require.Eventually(t, func() bool {
+		token, err := store.Lock(ctx, "users", time.Minute)
+		return err == nil && token != "" && store.Unlock(ctx, "users", token) == nil
+	}, time.Second, 5*time.Millisecond)
+
+	fresh, err := users.GetOrLoad(ctx, "users", ttl, loader)
+	require.NoError(t, err)
+	require.Equal(t, "Grace", fresh[0].Name)
+	require.Equal(t, int64(2), users.Stats().StaleHits)
+	require.Equal(t, int64(2), users.Stats().Loads)
+}
+
+func TestRedisStoreExpiresTagVersions(t *testing.T) {
+	ctx := context.Background()
+	rdb, server := newRedis(t)
+	store := cache.NewRedisStore(rdb)
+
+	require.NoError(t, store.Invalidate(ctx, "users:list"))
+	require.Equal(t, cache.MaxTTL, server.TTL("tag:users:list"))
+
+	server.FastForward(time.Hour)
+	require.NoError(t, store.Set(ctx, "users", []byte("[]"), time.Minute, []string{"users:list", "users"}))
+	require.Equal(t, cache.MaxTTL, server.TTL("tag:users:list"))
+	require.Equal(t, time.Minute, server.TTL("cache:users"))
+	// tags never bumped are not created
+	require.False(t, server.Exists("tag:users"))
+
+	server.FastForward(cache.MaxTTL)
+	_, versions, err := store.Get(ctx, "users", []string{"users:list"})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), versions["users:list"])
+}
+
+func TestCacheBoundsHardTTL(t *testing.T) {
+	ctx := context.Background()
+	rdb, server := newRedis(t)
+	users := cache.New[[]cachedUser](cache.NewRedisStore(rdb), nil)
+
+	_, err := users.GetOrLoad(ctx, "users", cache.TTL{Soft: time.Hour, Hard: 7 * cache.MaxTTL}, func(ctx context.Context) ([]cachedUser, error) {
+		return []cachedUser{{Name: "Ada"}}, nil
+	}, "users:list")
+	require.NoError(t, err)
+	require.Equal(t, cache.MaxTTL, server.TTL("cache:users"))
+}
+
+func TestNoopStore(t *testing.T) {
+	ctx := context.Background()
+	users := cache.New[[]cachedUser](cache.NoopStore{}, nil)
+
+	loads := 0
+	for i := 0; i < 2; i++ {
+		loaded, err := users.GetOrLoad(ctx, "users", minute, func(ctx context.Context) ([]cachedUser, error) {
+			loads++
+			return []cachedUser{{Name: "Ada"}}, nil
+		}, "users:list")
+		require.NoError(t, err)
+		require.Len(t, loaded, 1)
+	}
+	require.Equal(t, 2, loads)
+	require.NoError(t, users.Invalidate(ctx, "users:list"))
+}
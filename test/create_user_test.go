@@ -6,18 +6,20 @@ import (
 
 	"github.com/mattchw/go-onboard/models"
 	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/tenancy"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
 )
 
 type UserServiceImplMock struct {
 	mock.Mock
 }
 
-func (us *UserServiceImplMock) Create(ctx context.Context, payload models.User) *mongo.InsertOneResult {
+func (us *UserServiceImplMock) Create(ctx context.Context, payload models.User) (*mongo.InsertOneResult, error) {
 	args := us.Called(ctx, payload)
-	return args.Get(0).(*mongo.InsertOneResult)
+	return args.Get(0).(*mongo.InsertOneResult), args.Error(1)
 }
 
 func TestNewUserServiceImpl(t *testing.T) {
@@ -40,10 +42,38 @@ func TestCreateUser(t *testing.T) {
 		Age:       0,
 		Gender:    "Male",
 	}
-	mock.On("Create", ctx, user).Return(&mongo.InsertOneResult{})
+	mock.On("Create", ctx, user).Return(&mongo.InsertOneResult{}, nil)
 
-	result := mock.Create(ctx, user)
+	result, err := mock.Create(ctx, user)
+	require.NoError(t, err)
 
 	print(result)
 	mock.AssertExpectations(t)
 }
+
+func TestCreateUserReturnsErrors(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("errors", func(mt *mtest.T) {
+		users := services.NewUserServiceImpl(mt.Coll)
+		ctx := context.Background()
+
+		_, err := users.Create(ctx, models.User{FirstName: "Matt"})
+		require.ErrorIs(t, err, services.ErrInvalidUser)
+
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 11000, Message: "duplicate key"}))
+		_, err = users.Create(ctx, models.User{FirstName: "Matt", LastName: "Chw"})
+		require.Error(t, err)
+
+		// a request without a tenant is refused before anything is written
+		router := tenancy.NewRouter(mt.Client, mt.DB.Name(), tenancy.SharedCollection)
+		_, err = services.NewEncryptedUserServiceImpl(router.Source("users"), nil).Create(ctx, models.User{FirstName: "Matt", LastName: "Chw"})
+		require.ErrorIs(t, err, tenancy.ErrNoTenant)
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		result, err := users.Create(ctx, models.User{FirstName: "Matt", LastName: "Chw"})
+		require.NoError(t, err)
+		require.NotNil(t, result.InsertedID)
+	})
+}
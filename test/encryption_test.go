@@ -0,0 +1,159 @@
+package test
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/mattchw/go-onboard/encryption"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/tenancy"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func newKeyring(t *testing.T) (*encryption.Keyring, encryption.DataKey) {
+	key, err := encryption.GenerateDataKey()
+	require.NoError(t, err)
+	keyring, err := encryption.NewKeyring([]encryption.DataKey{key}, key.Id)
+	require.NoError(t, err)
+	return keyring, key
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	keyring, _ := newKeyring(t)
+
+	value, err := keyring.Encrypt("bio", []byte("likes cats"), encryption.Randomized)
+	require.NoError(t, err)
+	require.True(t, encryption.IsEncrypted(value))
+	require.NotContains(t, value, "likes cats")
+
+	plain, err := keyring.Decrypt("bio", value)
+	require.NoError(t, err)
+	require.Equal(t, "likes cats", string(plain))
+
+	// ciphertexts are bound to their field
+	_, err = keyring.Decrypt("email", value)
+	require.Error(t, err)
+
+	again, err := keyring.Encrypt("bio", []byte("likes cats"), encryption.Randomized)
+	require.NoError(t, err)
+	require.NotEqual(t, value, again)
+}
+
+func TestDeterministicEncryption(t *testing.T) {
+	keyring, _ := newKeyring(t)
+
+	first, err := keyring.Encrypt("email", []byte("matt@example.com"), encryption.Deterministic)
+	require.NoError(t, err)
+	second, err := keyring.Encrypt("email", []byte("matt@example.com"), encryption.Deterministic)
+	require.NoError(t, err)
+	require.Equal(t, first, second)
+
+	other, err := keyring.Encrypt("email", []byte("someone@example.com"), encryption.Deterministic)
+	require.NoError(t, err)
+	require.NotEqual(t, first, other)
+
+	values, err := keyring.DeterministicValues("email", []byte("matt@example.com"))
+	require.NoError(t, err)
+	require.Equal(t, []string{first}, values)
+}
+
+func TestRotationKeepsOldValuesReadable(t *testing.T) {
+	keyring, oldKey := newKeyring(t)
+	old, err := keyring.Encrypt("age", []byte("30"), encryption.Deterministic)
+	require.NoError(t, err)
+
+	newKey, err := encryption.GenerateDataKey()
+	require.NoError(t, err)
+	require.NoError(t, keyring.Replace([]encryption.DataKey{oldKey, newKey}, newKey.Id))
+
+	plain, err := keyring.Decrypt("age", old)
+	require.NoError(t, err)
+	require.Equal(t, "30", string(plain))
+
+	fresh, err := keyring.Encrypt("age", []byte("30"), encryption.Deterministic)
+	require.NoError(t, err)
+	require.Equal(t, newKey.Id, encryption.KeyId(fresh))
+
+	// equality filters match values written under either key
+	values, err := keyring.DeterministicValues("age", []byte("30"))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{old, fresh}, values)
+
+	require.NoError(t, keyring.Replace([]encryption.DataKey{newKey}, newKey.Id))
+	_, err = keyring.Decrypt("age", old)
+	require.ErrorIs(t, err, encryption.ErrUnknownKey)
+}
+
+func TestWrapKey(t *testing.T) {
+	master := make([]byte, 32)
+	_, err := rand.Read(master)
+	require.NoError(t, err)
+	key, err := encryption.GenerateDataKey()
+	require.NoError(t, err)
+
+	wrapped, err := encryption.WrapKey(master, key)
+	require.NoError(t, err)
+	unwrapped, err := encryption.UnwrapKey(master, key.Id, wrapped)
+	require.NoError(t, err)
+	require.Equal(t, key, unwrapped)
+
+	// the key id is authenticated
+	_, err = encryption.UnwrapKey(master, "other", wrapped)
+	require.Error(t, err)
+
+	wrongMaster := make([]byte, 32)
+	_, err = encryption.UnwrapKey(wrongMaster, key.Id, wrapped)
+	require.Error(t, err)
+}
+
+func TestUserAgesAreEncryptedRandomly(t *testing.T) {
+	keyring, _ := newKeyring(t)
+	users := services.NewEncryptedUserServiceImpl(tenancy.Static(nil), keyring)
+
+	first, err := users.Encode(models.User{FirstName: "Ada", Age: 36})
+	require.NoError(t, err)
+	second, err := users.Encode(models.User{FirstName: "Grace", Age: 36})
+	require.NoError(t, err)
+	require.Equal(t, encryption.Randomized, encryption.ValueMode(first.Age.(string)))
+	require.NotEqual(t, first.Age, second.Age)
+
+	user, err := users.Decode(first)
+	require.NoError(t, err)
+	require.Equal(t, 36, user.Age)
+}
+
+func TestUserAgeFiltersOnEncryptedAges(t *testing.T) {
+	keyring, _ := newKeyring(t)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("find", func(mt *mtest.T) {
+		users := services.NewEncryptedUserServiceImpl(tenancy.Static(mt.Coll), keyring)
+		young, err := users.Encode(models.User{Id: primitive.NewObjectID(), FirstName: "Ada", Age: 20})
+		require.NoError(t, err)
+		old, err := users.Encode(models.User{Id: primitive.NewObjectID(), FirstName: "Grace", Age: 60})
+		require.NoError(t, err)
+
+		ns := mt.Coll.Database().Name() + "." + mt.Coll.Name()
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch,
+			bson.D{{Key: "_id", Value: young.Id}, {Key: "firstName", Value: "Ada"}, {Key: "age", Value: young.Age}},
+			bson.D{{Key: "_id", Value: old.Id}, {Key: "firstName", Value: "Grace"}, {Key: "age", Value: old.Age}},
+			// legacy plaintext ages were matched by Mongo already
+			bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "firstName", Value: "Linus"}, {Key: "age", Value: int32(40)}},
+		))
+		found, err := users.Find(context.Background(), models.UserFilter{MinAge: 30})
+		require.NoError(t, err)
+		require.Len(t, found, 2)
+		require.Equal(t, 60, found[0].Age)
+		require.Equal(t, 40, found[1].Age)
+
+		// encrypted ages are candidates of every range
+		filter := mt.GetStartedEvent().Command.Lookup("filter").Document()
+		require.Equal(t, "string", filter.Lookup("$or").Array().Index(0).Value().Document().Lookup("age", "$type").StringValue())
+	})
+}
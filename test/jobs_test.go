@@ -0,0 +1,318 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/mattchw/go-onboard/encryption"
+	"github.com/mattchw/go-onboard/jobs"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/tenancy"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+var registerTestJobs sync.Once
+
+// ran receives the ids of the test.echo jobs run, test.block waits for
+// its context to be cancelled
+var ran = make(chan primitive.ObjectID, 10)
+
+func testJobs() {
+	registerTestJobs.Do(func() {
+		jobs.Register("test.echo", jobs.Definition{
+			Validate: func(params jobs.Params) error {
+				if params["name"] == nil {
+					return errors.New("name is required")
+				}
+				return nil
+			},
+			Run: func(ctx context.Context, run *jobs.Run) error {
+				run.SetResult(map[string]interface{}{"name": run.Params()["name"]})
+				ran <- run.Job.Id
+				return nil
+			},
+		})
+		jobs.Register("test.block", jobs.Definition{
+			Run: func(ctx context.Context, run *jobs.Run) error {
+				ran <- run.Job.Id
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		})
+	})
+}
+
+func updated(n int) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+}
+
+func claimed(id primitive.ObjectID, jobType string) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.M{
+		"_id":    id,
+		"type":   jobType,
+		"status": models.JobRunning,
+		"params": bson.M{"name": "Ada"},
+	}})
+}
+
+// commands returns the started commands named name
+func commands(mt *mtest.T, name string) []bson.Raw {
+	var found []bson.Raw
+	for _, started := range mt.GetAllStartedEvents() {
+		if started.CommandName == name {
+			found = append(found, started.Command)
+		}
+	}
+	return found
+}
+
+// runPool runs a pool of one worker until stop is called
+func runPool(manager *jobs.Manager) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		jobs.NewWorkerPool(manager, 1).WithHeartbeat(20 * time.Millisecond).Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func processing(rdb *redis.Client) []string {
+	keys, _, _ := rdb.Scan(context.Background(), 0, "jobs:processing:*", 100).Result()
+	return keys
+}
+
+func list(rdb *redis.Client, key string) []string {
+	return rdb.LRange(context.Background(), key, 0, -1).Val()
+}
+
+func TestManagerEnqueue(t *testing.T) {
+	testJobs()
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("enqueue", func(mt *mtest.T) {
+		ctx := context.Background()
+		rdb, server := newRedis(mt.T)
+		manager, err := jobs.NewManager(mt.DB, rdb)
+		require.NoError(t, err)
+
+		_, err = manager.Enqueue(ctx, "test.unknown", nil)
+		require.ErrorIs(t, err, jobs.ErrUnknownType)
+		_, err = manager.Enqueue(ctx, "test.echo", nil)
+		require.ErrorIs(t, err, jobs.ErrInvalidParams)
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		job, err := manager.Enqueue(ctx, "test.echo", jobs.Params{"name": "Ada"})
+		require.NoError(t, err)
+		require.Equal(t, models.JobQueued, job.Status)
+		require.Equal(t, []string{job.Id.Hex()}, list(rdb, "jobs:queue"))
+
+		// a job that cannot be queued is not left behind
+		server.SetError("connection refused")
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), updated(1))
+		_, err = manager.Enqueue(ctx, "test.echo", jobs.Params{"name": "Ada"})
+		require.Error(t, err)
+		require.Len(t, commands(mt, "delete"), 1)
+	})
+
+	mt.Run("import ids", func(mt *mtest.T) {
+		keyring, _ := newKeyring(t)
+		jobs.RegisterUserJobs(services.NewEncryptedUserServiceImpl(tenancy.Static(mt.Coll), keyring), func(ctx context.Context) {})
+		rdb, _ := newRedis(mt.T)
+		manager, err := jobs.NewManager(mt.DB, rdb)
+		require.NoError(t, err)
+
+		// ids are assigned up front, whatever the caller sent
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		job, err := manager.Enqueue(context.Background(), "users.import", jobs.Params{"users": []interface{}{
+			map[string]interface{}{"id": "62b5a9c0f1e2d3c4b5a69788", "firstName": "Ada", "lastName": "Lovelace", "email": "ada@example.com", "age": 36},
+		}})
+		require.NoError(t, err)
+		users := job.Params["users"].([]interface{})
+		user := users[0].(map[string]interface{})
+		id := user["id"].(string)
+		require.NotEqual(t, "62b5a9c0f1e2d3c4b5a69788", id)
+		require.True(t, primitive.IsValidObjectID(id))
+
+		// the users wait in the params encrypted like they are stored
+		require.True(t, encryption.IsEncrypted(user["email"].(string)))
+		require.True(t, encryption.IsEncrypted(user["age"].(string)))
+		inserted := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		require.NotContains(t, inserted.String(), "ada@example.com")
+	})
+
+	mt.Run("cancel", func(mt *mtest.T) {
+		ctx := context.Background()
+		rdb, _ := newRedis(mt.T)
+		manager, err := jobs.NewManager(mt.DB, rdb)
+		require.NoError(t, err)
+
+		id := primitive.NewObjectID()
+		ns := mt.Coll.Database().Name() + ".jobs"
+		mt.AddMockResponses(
+			updated(1),
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: id},
+				{Key: "status", Value: models.JobCancelled},
+				{Key: "cancelRequested", Value: true},
+			}),
+		)
+		job, err := manager.Cancel(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, models.JobCancelled, job.Status)
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch))
+		_, err = manager.Get(ctx, id)
+		require.ErrorIs(t, err, jobs.ErrNotFound)
+	})
+}
+
+func TestWorkerRunsQueuedJobs(t *testing.T) {
+	testJobs()
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("run", func(mt *mtest.T) {
+		rdb, _ := newRedis(mt.T)
+		manager, err := jobs.NewManager(mt.DB, rdb)
+		require.NoError(t, err)
+
+		id := primitive.NewObjectID()
+		mt.AddMockResponses(claimed(id, "test.echo"), updated(1))
+		rdb.LPush(context.Background(), "jobs:queue", id.Hex())
+
+		stop := runPool(manager)
+		require.Equal(t, id, <-ran)
+		require.Eventually(t, func() bool { return len(processing(rdb)) == 0 }, time.Second, 5*time.Millisecond)
+		stop()
+
+		claims := commands(mt, "findAndModify")
+		require.Len(t, claims, 1)
+		worker := claims[0].Lookup("update", "$set", "worker").StringValue()
+		require.True(t, strings.HasPrefix(worker, "jobs:processing:"))
+
+		outcomes := commands(mt, "update")
+		require.Len(t, outcomes, 1)
+		update := outcomes[0].Lookup("updates").Array().Index(0).Value().Document()
+		require.Equal(t, worker, update.Lookup("q", "worker").StringValue())
+		require.Equal(t, string(models.JobSucceeded), update.Lookup("u", "$set", "status").StringValue())
+		require.Empty(t, list(rdb, "jobs:queue"))
+	})
+}
+
+func TestWorkerRequeuesJobsOnShutdown(t *testing.T) {
+	testJobs()
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("shutdown", func(mt *mtest.T) {
+		rdb, _ := newRedis(mt.T)
+		manager, err := jobs.NewManager(mt.DB, rdb)
+		require.NoError(t, err)
+
+		id := primitive.NewObjectID()
+		mt.AddMockResponses(claimed(id, "test.block"), updated(1))
+		rdb.LPush(context.Background(), "jobs:queue", id.Hex())
+
+		stop := runPool(manager)
+		require.Equal(t, id, <-ran)
+		stop()
+
+		require.Equal(t, []string{id.Hex()}, list(rdb, "jobs:queue"))
+		require.Empty(t, processing(rdb))
+		unclaims := commands(mt, "update")
+		require.Len(t, unclaims, 1)
+		update := unclaims[0].Lookup("updates").Array().Index(0).Value().Document()
+		require.Equal(t, string(models.JobQueued), update.Lookup("u", "$set", "status").StringValue())
+
+		// the pool is gone, others may recover what it left behind
+		alive, _, _ := rdb.Scan(context.Background(), 0, "jobs:alive:*", 100).Result()
+		require.Empty(t, alive)
+	})
+}
+
+func TestWorkerRecoversJobsOfDeadPools(t *testing.T) {
+	testJobs()
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("recover", func(mt *mtest.T) {
+		ctx := context.Background()
+		rdb, _ := newRedis(mt.T)
+		manager, err := jobs.NewManager(mt.DB, rdb)
+		require.NoError(t, err)
+
+		// a pool crashed while running a job, another one is still alive
+		dead, alive := primitive.NewObjectID(), primitive.NewObjectID()
+		rdb.LPush(ctx, "jobs:processing:crashed:0", dead.Hex())
+		rdb.LPush(ctx, "jobs:processing:busy:0", alive.Hex())
+		rdb.Set(ctx, "jobs:alive:busy", "now", time.Minute)
+
+		mt.AddMockResponses(updated(1), claimed(dead, "test.echo"), updated(1))
+		stop := runPool(manager)
+		require.Equal(t, dead, <-ran)
+		require.Eventually(t, func() bool { return len(processing(rdb)) == 1 }, time.Second, 5*time.Millisecond)
+		stop()
+
+		require.Equal(t, []string{alive.Hex()}, list(rdb, "jobs:processing:busy:0"))
+		updates := commands(mt, "update")
+		require.Len(t, updates, 2)
+		unclaim := updates[0].Lookup("updates").Array().Index(0).Value().Document()
+		require.Equal(t, dead, unclaim.Lookup("q", "_id").ObjectID())
+		require.Equal(t, "jobs:processing:crashed:0", unclaim.Lookup("q", "worker").StringValue())
+		require.Equal(t, string(models.JobQueued), unclaim.Lookup("u", "$set", "status").StringValue())
+	})
+}
+
+func TestExportStreamsUsers(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("export", func(mt *mtest.T) {
+		users := services.NewUserServiceImpl(mt.Coll)
+		ns := mt.Coll.Database().Name() + "." + mt.Coll.Name()
+		ada, grace := primitive.NewObjectID(), primitive.NewObjectID()
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(1, ns, mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: ada}, {Key: "firstName", Value: "Ada"}, {Key: "age", Value: int32(36)},
+			}),
+			mtest.CreateCursorResponse(0, ns, mtest.NextBatch, bson.D{
+				{Key: "_id", Value: grace}, {Key: "firstName", Value: "Grace"},
+			}),
+		)
+
+		var out bytes.Buffer
+		count, err := users.Export(context.Background(), models.UserFilter{Gender: "Female"}, &out)
+		require.NoError(t, err)
+		require.EqualValues(t, 2, count)
+
+		// one JSON document per line, the batches are streamed as they arrive
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		require.Len(t, lines, 2)
+		var first, second models.User
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+		require.Equal(t, models.User{Id: ada, FirstName: "Ada", Age: 36}, first)
+		require.Equal(t, grace, second.Id)
+
+		find := commands(mt, "find")
+		require.Len(t, find, 1)
+		require.Equal(t, "Female", find[0].Lookup("filter", "gender").StringValue())
+		require.Len(t, commands(mt, "getMore"), 1)
+	})
+}
@@ -0,0 +1,224 @@
+package test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/tokens"
+	"github.com/stretchr/testify/require"
+)
+
+func ed25519Key(t *testing.T, id string) *tokens.Key {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := tokens.NewKey(id, private)
+	require.NoError(t, err)
+	return key
+}
+
+func writeKey(t *testing.T, dir string, id string, private interface{}) {
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, id+".pem"), data, 0600))
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	issuer := tokens.NewIssuer(tokens.NewKeyring(ed25519Key(t, "k1")), "go-onboard", 15*time.Minute)
+
+	token, expires, err := issuer.Issue("62b9a8d5e1c4f0a1b2c3d4e5", map[string]interface{}{"name": "admin", "role": "admin"})
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(15*time.Minute), expires, 2*time.Second)
+
+	claims, err := issuer.Verify(token)
+	require.NoError(t, err)
+	require.Equal(t, "62b9a8d5e1c4f0a1b2c3d4e5", claims["sub"])
+	require.Equal(t, "admin", claims["name"])
+	require.Equal(t, "go-onboard", claims["iss"])
+	require.NotEmpty(t, claims["jti"])
+
+	later := issuer.WithClock(func() time.Time { return time.Now().Add(16 * time.Minute) })
+	_, err = later.Verify(token)
+	require.ErrorIs(t, err, tokens.ErrInvalidToken)
+
+	other := tokens.NewIssuer(tokens.NewKeyring(ed25519Key(t, "k1")), "go-onboard", 15*time.Minute)
+	_, err = other.Verify(token)
+	require.ErrorIs(t, err, tokens.ErrInvalidToken)
+
+	elsewhere := tokens.NewIssuer(tokens.NewKeyring(ed25519Key(t, "k1")), "somewhere-else", 15*time.Minute)
+	foreign, _, err := elsewhere.Issue("62b9a8d5e1c4f0a1b2c3d4e5", nil)
+	require.NoError(t, err)
+	_, err = issuer.Verify(foreign)
+	require.ErrorIs(t, err, tokens.ErrInvalidToken)
+}
+
+func TestVerifyRejectsOtherAlgorithms(t *testing.T) {
+	key := ed25519Key(t, "k1")
+	issuer := tokens.NewIssuer(tokens.NewKeyring(key), "go-onboard", 15*time.Minute)
+
+	// an HMAC token keyed with the public key, the classic algorithm confusion
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": "go-onboard", "sub": "someone", "exp": time.Now().Add(time.Hour).Unix(),
+	})
+	forged.Header["kid"] = "k1"
+	signed, err := forged.SignedString([]byte(key.Public().(ed25519.PublicKey)))
+	require.NoError(t, err)
+	_, err = issuer.Verify(signed)
+	require.ErrorIs(t, err, tokens.ErrInvalidToken)
+
+	unsigned := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"iss": "go-onboard", "sub": "someone"})
+	unsigned.Header["kid"] = "k1"
+	none, err := unsigned.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	_, err = issuer.Verify(none)
+	require.ErrorIs(t, err, tokens.ErrInvalidToken)
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	writeKey(t, dir, "2022-01-01", rsaKey)
+
+	keyring, err := tokens.LoadKeyring(dir, "")
+	require.NoError(t, err)
+	require.Equal(t, "2022-01-01", keyring.ActiveKeyId())
+	issuer := tokens.NewIssuer(keyring, "go-onboard", time.Hour)
+	old, _, err := issuer.Issue("subject", nil)
+	require.NoError(t, err)
+
+	// a newer key takes over signing, tokens of the old one stay valid
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	writeKey(t, dir, "2022-07-01", edKey)
+	require.NoError(t, keyring.Reload(dir, ""))
+	require.Equal(t, "2022-07-01", keyring.ActiveKeyId())
+
+	current, _, err := issuer.Issue("subject", nil)
+	require.NoError(t, err)
+	header, _, err := new(jwt.Parser).ParseUnverified(current, jwt.MapClaims{})
+	require.NoError(t, err)
+	require.Equal(t, "EdDSA", header.Method.Alg())
+	require.Equal(t, "2022-07-01", header.Header["kid"])
+
+	_, err = issuer.Verify(old)
+	require.NoError(t, err)
+
+	// removing the old key retires its tokens
+	require.NoError(t, os.Remove(filepath.Join(dir, "2022-01-01.pem")))
+	require.NoError(t, keyring.Reload(dir, ""))
+	_, err = issuer.Verify(old)
+	require.ErrorIs(t, err, tokens.ErrInvalidToken)
+
+	require.ErrorIs(t, keyring.Reload(dir, "2023-01-01"), tokens.ErrUnknownKey)
+	require.Equal(t, "2022-07-01", keyring.ActiveKeyId())
+}
+
+type stubVerifier struct {
+	err error
+}
+
+func (sv stubVerifier) Verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	if sv.err != nil {
+		return nil, sv.err
+	}
+	if token != "good" {
+		return nil, tokens.ErrInvalidToken
+	}
+	return map[string]interface{}{"sub": "62b9a8d5e1c4f0a1b2c3d4e5", "name": "admin", "role": "admin"}, nil
+}
+
+func tokenApp(verifier middlewares.TokenVerifier) *fiber.App {
+	app := fiber.New()
+	app.Use(middlewares.VerifyToken(verifier))
+	app.Get("/public", func(c *fiber.Ctx) error { return c.SendString("public") })
+	app.Get("/", middlewares.TokenReq, func(c *fiber.Ctx) error {
+		return c.SendString(c.Locals("username").(string))
+	})
+	return app
+}
+
+func TestTokenReq(t *testing.T) {
+	app := tokenApp(stubVerifier{})
+
+	cases := []struct {
+		name   string
+		path   string
+		header string
+		status int
+	}{
+		{"valid", "/", "Bearer good", 200},
+		{"missing", "/", "", 401},
+		{"basic", "/", basicAuth("admin", "a long enough password"), 401},
+		{"invalid", "/", "Bearer forged", 401},
+		{"public without token", "/public", "", 200},
+		{"public with invalid token", "/public", "Bearer forged", 401},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.path, nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, tc.status, resp.StatusCode)
+			if tc.status == 401 {
+				require.Contains(t, resp.Header.Get("WWW-Authenticate"), "Bearer")
+			}
+		})
+	}
+}
+
+func TestVerifyTokenStoreUnavailable(t *testing.T) {
+	app := tokenApp(stubVerifier{err: errors.New("redis: connection refused")})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, 503, resp.StatusCode)
+}
+
+func TestRefreshRevokeSubject(t *testing.T) {
+	rdb, _ := newRedis(t)
+	store := tokens.NewRedisStore(rdb, time.Hour)
+	ctx := context.Background()
+
+	first, err := store.Create(ctx, tokens.Session{Subject: "ada", CreatedAt: time.Now()})
+	require.NoError(t, err)
+	second, err := store.Create(ctx, tokens.Session{Subject: "ada", CreatedAt: time.Now()})
+	require.NoError(t, err)
+	other, err := store.Create(ctx, tokens.Session{Subject: "grace", CreatedAt: time.Now()})
+	require.NoError(t, err)
+	// rotated families stay indexed
+	second, _, err = store.Rotate(ctx, second)
+	require.NoError(t, err)
+
+	count, err := store.RevokeSubject(ctx, "ada")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	for _, token := range []string{first, second} {
+		_, _, err := store.Rotate(ctx, token)
+		require.ErrorIs(t, err, tokens.ErrInvalidRefresh)
+	}
+	_, _, err = store.Rotate(ctx, other)
+	require.NoError(t, err)
+
+	count, err = store.RevokeSubject(ctx, "ada")
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
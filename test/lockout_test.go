@@ -0,0 +1,169 @@
+package test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mattchw/go-onboard/lockout"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/passwords"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+var testLockoutPolicy = lockout.Policy{
+	MaxFailures:   3,
+	MaxIPFailures: 4,
+	Window:        time.Minute,
+	LockFor:       10 * time.Minute,
+	BaseDelay:     time.Second,
+	MaxDelay:      4 * time.Second,
+}
+
+var lockoutEpoch = time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// lockoutClock is a Redis stand-in running the scripts of the guard, the
+// test moves its clock. TIME follows SetTime and keys expire on FastForward.
+type lockoutClock struct {
+	server *miniredis.Miniredis
+	now    time.Time
+}
+
+func lockoutGuard(t *testing.T) (*lockout.RedisGuard, *lockoutClock) {
+	rdb, server := newRedis(t)
+	server.SetTime(lockoutEpoch)
+	return lockout.NewRedisGuard(rdb, testLockoutPolicy), &lockoutClock{server: server, now: lockoutEpoch}
+}
+
+func (lc *lockoutClock) advance(d time.Duration) {
+	lc.now = lc.now.Add(d)
+	lc.server.SetTime(lc.now)
+	lc.server.FastForward(d)
+}
+
+func requireThrottled(t *testing.T, err error, locked bool, retryAfter time.Duration) {
+	t.Helper()
+	var throttled *lockout.ThrottledError
+	require.ErrorAs(t, err, &throttled)
+	require.Equal(t, locked, throttled.Locked)
+	require.InDelta(t, retryAfter.Milliseconds(), throttled.RetryAfter.Milliseconds(), 5)
+}
+
+func TestLockoutDelaysThenLocks(t *testing.T) {
+	guard, clock := lockoutGuard(t)
+	ctx := context.Background()
+
+	// every failure doubles the wait before the next attempt
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second} {
+		require.NoError(t, guard.Check(ctx, "ada", "10.0.0.1"))
+		locked, err := guard.Fail(ctx, "ada", "10.0.0.1")
+		require.NoError(t, err)
+		require.False(t, locked, "failure %d", i+1)
+
+		requireThrottled(t, guard.Check(ctx, "ada", "10.0.0.1"), false, delay)
+		clock.advance(delay - time.Millisecond)
+		requireThrottled(t, guard.Check(ctx, "ada", "10.0.0.1"), false, time.Millisecond)
+		clock.advance(time.Millisecond)
+	}
+
+	// the threshold locks the account, whatever the password of the next attempts
+	require.NoError(t, guard.Check(ctx, "ada", "10.0.0.2"))
+	locked, err := guard.Fail(ctx, "ada", "10.0.0.2")
+	require.NoError(t, err)
+	require.True(t, locked)
+	requireThrottled(t, guard.Check(ctx, "ada", "10.0.0.3"), true, 10*time.Minute)
+	lockedFor, err := guard.LockedFor(ctx, "ada")
+	require.NoError(t, err)
+	require.Equal(t, 10*time.Minute, lockedFor)
+
+	// other accounts are not affected
+	require.NoError(t, guard.Check(ctx, "grace", "10.0.0.4"))
+
+	// the lock runs out by itself and the failures are forgotten with it
+	clock.advance(10 * time.Minute)
+	require.NoError(t, guard.Check(ctx, "ada", "10.0.0.1"))
+	lockedFor, err = guard.LockedFor(ctx, "ada")
+	require.NoError(t, err)
+	require.Zero(t, lockedFor)
+}
+
+func TestLockoutDelayIsCapped(t *testing.T) {
+	guard, clock := lockoutGuard(t)
+	ctx := context.Background()
+
+	// a failure count past the threshold only comes from attempts racing the lock
+	clock.server.HSet("lockout:failures:ada", "count", "6", "last", strconv.FormatInt(lockoutEpoch.UnixMilli(), 10))
+	requireThrottled(t, guard.Check(ctx, "ada", ""), false, testLockoutPolicy.MaxDelay)
+}
+
+func TestLockoutSucceedForgetsFailures(t *testing.T) {
+	guard, _ := lockoutGuard(t)
+	ctx := context.Background()
+
+	require.NoError(t, guard.Check(ctx, "ada", "10.0.0.1"))
+	_, err := guard.Fail(ctx, "ada", "10.0.0.1")
+	require.NoError(t, err)
+	requireThrottled(t, guard.Check(ctx, "ada", "10.0.0.1"), false, time.Second)
+
+	require.NoError(t, guard.Succeed(ctx, "ada"))
+	require.NoError(t, guard.Check(ctx, "ada", "10.0.0.1"))
+}
+
+func TestLockoutBlocksIPs(t *testing.T) {
+	guard, clock := lockoutGuard(t)
+	ctx := context.Background()
+
+	// one failure on each of many accounts stays under every account threshold
+	for _, username := range []string{"ada", "grace", "linus", "ken"} {
+		require.NoError(t, guard.Check(ctx, username, "10.0.0.1"))
+		locked, err := guard.Fail(ctx, username, "10.0.0.1")
+		require.NoError(t, err)
+		require.False(t, locked)
+	}
+
+	requireThrottled(t, guard.Check(ctx, "barbara", "10.0.0.1"), false, time.Minute)
+	require.NoError(t, guard.Check(ctx, "barbara", "10.0.0.2"))
+
+	// the block ends once the IP stopped failing for a window
+	clock.advance(time.Minute)
+	require.NoError(t, guard.Check(ctx, "edsger", "10.0.0.1"))
+}
+
+func TestLockoutIgnoresMissingCodes(t *testing.T) {
+	guard, clock := lockoutGuard(t)
+	hash, err := passwords.Hash("a long enough password")
+	require.NoError(t, err)
+	raw, err := bson.Marshal(models.Account{Id: primitive.NewObjectID(), Username: "ada", PasswordHash: hash, TOTPEnabled: true})
+	require.NoError(t, err)
+	var doc bson.D
+	require.NoError(t, bson.Unmarshal(raw, &doc))
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("missing code", func(mt *mtest.T) {
+		accounts := services.NewAccountServiceImpl(mt.Coll).WithLockout(guard, nil)
+		ctx := context.Background()
+		ns := mt.Coll.Database().Name() + "." + mt.Coll.Name()
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, doc))
+		_, err := accounts.Authenticate(ctx, "ada", "a wrong password")
+		require.ErrorIs(t, err, services.ErrInvalidCredential)
+
+		// the right password without a code is asked for the code every time,
+		// it neither counts as failed nor forgets the failure before it
+		for i := 0; i < testLockoutPolicy.MaxFailures+1; i++ {
+			clock.advance(time.Second)
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, doc))
+			_, err := accounts.Authenticate(ctx, "ada", "a long enough password")
+			require.ErrorIs(t, err, services.ErrOTPRequired)
+		}
+		require.Equal(t, "1", clock.server.HGet("lockout:failures:ada", "count"))
+	})
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattchw/go-onboard/mail"
+	"github.com/mattchw/go-onboard/tokens"
+	"github.com/stretchr/testify/require"
+)
+
+type linkData struct {
+	Username  string
+	Link      string
+	Token     string
+	ExpiresIn string
+}
+
+func TestMailTemplates(t *testing.T) {
+	data := linkData{Username: "<ada>", Link: "https://console.example.com/reset-password?token=abc", Token: "abc", ExpiresIn: "1 hour"}
+
+	msg, err := mail.DefaultTemplates().Render(mail.TemplatePasswordReset, "ada@example.com", data)
+	require.NoError(t, err)
+	require.Equal(t, "ada@example.com", msg.To)
+	require.Equal(t, "Reset your password", msg.Subject)
+	require.Contains(t, msg.Text, data.Link)
+	require.Contains(t, msg.Text, "Hello <ada>")
+	require.Contains(t, msg.HTML, `href="https://console.example.com/reset-password?token=abc"`)
+	// values in the HTML part are escaped
+	require.Contains(t, msg.HTML, "Hello &lt;ada&gt;")
+
+	_, err = mail.DefaultTemplates().Render("welcome", "ada@example.com", data)
+	require.ErrorIs(t, err, mail.ErrUnknownTemplate)
+}
+
+func TestLoadMailTemplates(t *testing.T) {
+	dir := t.TempDir()
+	custom := `{{define "subject"}}Acme password
+reset{{end}}Go to {{.Link}}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "password_reset.txt"), []byte(custom), 0o600))
+
+	templates, err := mail.LoadTemplates(dir)
+	require.NoError(t, err)
+	msg, err := templates.Render(mail.TemplatePasswordReset, "ada@example.com", linkData{Link: "https://x.example.com/r"})
+	require.NoError(t, err)
+	// subjects are kept on one line
+	require.Equal(t, "Acme password reset", msg.Subject)
+	require.Equal(t, "Go to https://x.example.com/r", msg.Text)
+	// parts without a file of their own stay built in
+	require.Contains(t, msg.HTML, "https://x.example.com/r")
+	_, err = templates.Render(mail.TemplateVerifyEmail, "ada@example.com", linkData{})
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "verify_email.txt"), []byte("no subject"), 0o600))
+	_, err = mail.LoadTemplates(dir)
+	require.Error(t, err)
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer, err := mail.NewFileMailer(dir, "Console <no-reply@example.com>")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, mailer.Send(ctx, mail.Message{To: "ada@example.com", Subject: "Plain", Text: "line one\nline two"}))
+	require.NoError(t, mailer.Send(ctx, mail.Message{To: "ada@example.com", Subject: "Both", Text: "text", HTML: "<p>html</p>"}))
+	require.ErrorIs(t, mailer.Send(ctx, mail.Message{To: "not an address", Subject: "x"}), mail.ErrInvalidAddress)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	plain, _ := os.ReadFile(files[0])
+	require.Contains(t, string(plain), "From: \"Console\" <no-reply@example.com>\r\n")
+	require.Contains(t, string(plain), "To: <ada@example.com>\r\n")
+	require.Contains(t, string(plain), "Subject: Plain\r\n")
+	require.Contains(t, string(plain), "line one\r\nline two")
+
+	both, _ := os.ReadFile(files[1])
+	require.Contains(t, string(both), "Content-Type: multipart/alternative")
+	require.Contains(t, string(both), "Content-Type: text/html")
+	require.True(t, strings.Index(string(both), "text/plain") < strings.Index(string(both), "text/html"))
+}
+
+func TestActionTokens(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signer := tokens.NewActionSigner([]byte("0123456789abcdef0123456789abcdef"), nil).WithClock(func() time.Time { return now })
+
+	token, err := signer.Sign(tokens.PurposePasswordReset, "account-1", "binding", time.Hour)
+	require.NoError(t, err)
+
+	action, err := signer.Verify(token, tokens.PurposePasswordReset)
+	require.NoError(t, err)
+	require.Equal(t, "account-1", action.Subject)
+	require.Equal(t, "binding", action.Binding)
+
+	// a reset token does not verify an email
+	_, err = signer.Verify(token, tokens.PurposeVerifyEmail)
+	require.ErrorIs(t, err, tokens.ErrInvalidAction)
+
+	// nor does it once expired, tampered with or signed with another secret
+	later := signer.WithClock(func() time.Time { return now.Add(time.Hour) })
+	_, err = later.Verify(token, tokens.PurposePasswordReset)
+	require.ErrorIs(t, err, tokens.ErrInvalidAction)
+
+	payload, signature, _ := strings.Cut(token, ".")
+	_, err = signer.Verify(payload+"x."+signature, tokens.PurposePasswordReset)
+	require.ErrorIs(t, err, tokens.ErrInvalidAction)
+	_, err = signer.Verify(payload, tokens.PurposePasswordReset)
+	require.ErrorIs(t, err, tokens.ErrInvalidAction)
+
+	other := tokens.NewActionSigner([]byte("fedcba9876543210fedcba9876543210"), nil).WithClock(func() time.Time { return now })
+	_, err = other.Verify(token, tokens.PurposePasswordReset)
+	require.ErrorIs(t, err, tokens.ErrInvalidAction)
+}
@@ -0,0 +1,233 @@
+package test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/oidc"
+	"github.com/mattchw/go-onboard/tokens"
+	"github.com/stretchr/testify/require"
+)
+
+// identityProvider stands in for the company IdP, serving discovery and keys
+type identityProvider struct {
+	server *httptest.Server
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+func newIdentityProvider(t *testing.T) *identityProvider {
+	idp := &identityProvider{keys: map[string]*rsa.PrivateKey{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   idp.server.URL,
+			"jwks_uri": idp.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		var keys []map[string]string
+		for kid, key := range idp.keys {
+			keys = append(keys, map[string]string{
+				"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256",
+				"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		w.Header().Set("Cache-Control", "max-age=3600")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	idp.addKey(t, "k1")
+	return idp
+}
+
+func (idp *identityProvider) addKey(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	idp.mu.Lock()
+	idp.keys[kid] = key
+	idp.mu.Unlock()
+}
+
+func (idp *identityProvider) sign(t *testing.T, kid string, claims jwt.MapClaims) string {
+	base := jwt.MapClaims{
+		"iss": idp.server.URL,
+		"aud": "go-onboard",
+		"sub": "00u1a2b3c4",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	for name, value := range claims {
+		base[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, base)
+	token.Header["kid"] = kid
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	signed, err := token.SignedString(idp.keys[kid])
+	require.NoError(t, err)
+	return signed
+}
+
+func oidcVerifier(t *testing.T, idp *identityProvider) *oidc.Verifier {
+	verifier, err := oidc.Discover(context.Background(), oidc.Config{
+		Issuer:         idp.server.URL,
+		Audience:       "go-onboard",
+		RequiredScopes: []string{"onboard.api"},
+		RoleClaim:      "groups",
+		Roles:          []oidc.RoleMapping{{Value: "idp-admins", Role: "admin"}, {Value: "idp-staff", Role: "viewer"}},
+		KeysMinRefresh: time.Nanosecond,
+	})
+	require.NoError(t, err)
+	return verifier
+}
+
+func TestOIDCVerify(t *testing.T) {
+	idp := newIdentityProvider(t)
+	verifier := oidcVerifier(t, idp)
+
+	token := idp.sign(t, "k1", jwt.MapClaims{
+		"scp":                []string{"onboard.api", "openid"},
+		"groups":             []string{"idp-staff", "idp-admins"},
+		"role":               "superuser",
+		"preferred_username": "jane",
+	})
+	claims, err := verifier.Verify(context.Background(), token)
+	require.NoError(t, err)
+	require.Equal(t, "admin", claims["role"])
+	require.Equal(t, "jane", claims["name"])
+	require.NotContains(t, claims, "scp")
+
+	// no mapped group, no local role
+	token = idp.sign(t, "k1", jwt.MapClaims{"scope": "onboard.api", "groups": []string{"idp-guests"}, "role": "admin"})
+	claims, err = verifier.Verify(context.Background(), token)
+	require.NoError(t, err)
+	require.NotContains(t, claims, "role")
+	require.Equal(t, "00u1a2b3c4", claims["name"])
+
+	cases := []struct {
+		name   string
+		claims jwt.MapClaims
+	}{
+		{"wrong audience", jwt.MapClaims{"scope": "onboard.api", "aud": "another-api"}},
+		{"wrong issuer", jwt.MapClaims{"scope": "onboard.api", "iss": "https://idp.example.com"}},
+		{"expired", jwt.MapClaims{"scope": "onboard.api", "exp": time.Now().Add(-time.Minute).Unix()}},
+		{"not yet valid", jwt.MapClaims{"scope": "onboard.api", "nbf": time.Now().Add(time.Hour).Unix()}},
+		{"missing scope", jwt.MapClaims{"scope": "openid"}},
+		{"missing subject", jwt.MapClaims{"scope": "onboard.api", "sub": ""}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := verifier.Verify(context.Background(), idp.sign(t, "k1", tc.claims))
+			require.ErrorIs(t, err, tokens.ErrInvalidToken)
+		})
+	}
+}
+
+func TestOIDCLocalClaims(t *testing.T) {
+	idp := newIdentityProvider(t)
+	claims := jwt.MapClaims{
+		"scope":              "onboard.api",
+		"groups":             []string{"idp-admins"},
+		"preferred_username": "jane",
+		"amr":                []string{"pwd", "otp"},
+		"uid":                "62b5a9c0f1e2d3c4b5a69788",
+		"tenant":             "globex",
+		"employee_id":        "62b5a9c0f1e2d3c4b5a69799",
+		"org":                "acme",
+	}
+
+	// claims the issuer happens to send never pass for local ones
+	claimsOf := func(verifier *oidc.Verifier) map[string]interface{} {
+		local, err := verifier.Verify(context.Background(), idp.sign(t, "k1", claims))
+		require.NoError(t, err)
+		return local
+	}
+	local := claimsOf(oidcVerifier(t, idp))
+	require.ElementsMatch(t, []string{"sub", "name", "role", "amr"}, keys(local))
+	require.Equal(t, "admin", local["role"])
+
+	mapped, err := oidc.Discover(context.Background(), oidc.Config{
+		Issuer:      idp.server.URL,
+		Audience:    "go-onboard",
+		UserClaim:   "employee_id",
+		TenantClaim: "org",
+	})
+	require.NoError(t, err)
+	local = claimsOf(mapped)
+	require.Equal(t, "62b5a9c0f1e2d3c4b5a69799", local["uid"])
+	require.Equal(t, "acme", local["tenant"])
+}
+
+func keys(m map[string]interface{}) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	idp := newIdentityProvider(t)
+	verifier := oidcVerifier(t, idp)
+
+	_, err := verifier.Verify(context.Background(), idp.sign(t, "k1", jwt.MapClaims{"scope": "onboard.api"}))
+	require.NoError(t, err)
+
+	// a key published after the set was cached is fetched on first use
+	idp.addKey(t, "k2")
+	_, err = verifier.Verify(context.Background(), idp.sign(t, "k2", jwt.MapClaims{"scope": "onboard.api"}))
+	require.NoError(t, err)
+
+	// keys the issuer never published are rejected
+	other := &identityProvider{server: idp.server, keys: map[string]*rsa.PrivateKey{}}
+	other.addKey(t, "k3")
+	_, err = verifier.Verify(context.Background(), other.sign(t, "k3", jwt.MapClaims{"scope": "onboard.api"}))
+	require.ErrorIs(t, err, tokens.ErrInvalidToken)
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newIdentityProvider(t)
+	_, err := oidc.Discover(context.Background(), oidc.Config{Issuer: idp.server.URL + "/other", Audience: "go-onboard"})
+	require.Error(t, err)
+}
+
+func TestIssuerVerifiers(t *testing.T) {
+	idp := newIdentityProvider(t)
+	app := tokenApp(middlewares.IssuerVerifiers{idp.server.URL: oidcVerifier(t, idp)})
+
+	cases := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"identity provider token", "Bearer " + idp.sign(t, "k1", jwt.MapClaims{"scope": "onboard.api", "preferred_username": "jane"}), 200},
+		{"unknown issuer", "Bearer " + idp.sign(t, "k1", jwt.MapClaims{"scope": "onboard.api", "iss": "https://idp.example.com"}), 401},
+		{"not a token", "Bearer good", 401},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", tc.header)
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package test
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/mattchw/go-onboard/openapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAPIDocumentLoads(t *testing.T) {
+	doc, err := openapi.Load()
+	require.NoError(t, err)
+	require.NotEmpty(t, doc.Paths)
+}
+
+func TestValidateRejectsMalformedUserId(t *testing.T) {
+	doc := openapi.MustLoad()
+
+	errs := doc.Validate(openapi.Request{Method: "GET", Path: "/users/not-an-object-id"})
+	require.Len(t, errs, 1)
+	require.Equal(t, "path", errs[0].In)
+	require.Equal(t, "userId", errs[0].Field)
+
+	errs = doc.Validate(openapi.Request{Method: "GET", Path: "/users/62b5a9c0f1e2d3c4b5a69788"})
+	require.Empty(t, errs)
+}
+
+func TestValidateVersionedPaths(t *testing.T) {
+	doc := openapi.MustLoad()
+
+	errs := doc.Validate(openapi.Request{Method: "GET", Path: "/v2/users/not-an-object-id"})
+	require.Len(t, errs, 1)
+
+	errs = doc.Validate(openapi.Request{Method: "GET", Path: "/v2/users", Query: url.Values{"limit": {"500"}}})
+	require.Len(t, errs, 1)
+	require.Equal(t, "limit", errs[0].Field)
+}
+
+func TestValidatePrefersLiteralPaths(t *testing.T) {
+	doc := openapi.MustLoad()
+
+	errs := doc.Validate(openapi.Request{Method: "GET", Path: "/users/count", Query: url.Values{}})
+	require.Empty(t, errs)
+}
+
+func TestValidateRequestBody(t *testing.T) {
+	doc := openapi.MustLoad()
+
+	errs := doc.Validate(openapi.Request{
+		Method:      "POST",
+		Path:        "/users",
+		ContentType: "application/json",
+		Body:        []byte(`{"firstName": "Matt", "age": 1.5, "gender": "Unknown"}`),
+	})
+	fields := map[string]string{}
+	for _, e := range errs {
+		fields[e.Field] = e.Message
+	}
+	require.Contains(t, fields, "lastName")
+	require.Contains(t, fields, "age")
+	require.Contains(t, fields, "gender")
+
+	errs = doc.Validate(openapi.Request{Method: "POST", Path: "/users", ContentType: "application/json"})
+	require.Len(t, errs, 1)
+
+	errs = doc.Validate(openapi.Request{
+		Method:      "POST",
+		Path:        "/users",
+		ContentType: "application/json",
+		Body:        []byte(`{"firstName": "Matt", "lastName": "Chw", "age": 30}`),
+	})
+	require.Empty(t, errs)
+}
+
+func TestParseRejectsInvalidPatterns(t *testing.T) {
+	_, err := openapi.Parse([]byte(`{"paths": {"/users": {"post": {"requestBody": {"content": {"application/json": {"schema": {
+		"type": "object", "properties": {"name": {"type": "string", "pattern": "^[a-z"}}
+	}}}}}}}}`))
+	require.ErrorContains(t, err, "invalid pattern")
+}
+
+func TestValidateFormats(t *testing.T) {
+	doc, err := openapi.Parse([]byte(`{
+  "openapi": "3.0.3",
+  "paths": {
+    "/events": {
+      "post": {
+        "requestBody": {
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "at": { "type": "string", "format": "date-time" },
+                  "on": { "type": "string", "format": "date" },
+                  "email": { "type": "string", "format": "email" },
+                  "color": { "type": "string", "format": "hue" }
+                }
+              }
+            }
+          }
+        }
+      }
+    }
+  }
+}`))
+	require.NoError(t, err)
+
+	validate := func(body string) []openapi.FieldError {
+		return doc.Validate(openapi.Request{Method: "POST", Path: "/events", ContentType: "application/json", Body: []byte(body)})
+	}
+	require.Empty(t, validate(`{"at": "2026-10-19T12:00:00Z", "on": "2026-10-19", "email": "ada@example.com", "color": "any"}`))
+
+	errs := validate(`{"at": "tomorrow", "on": "19/10/2026", "email": "Ada <ada@example.com>"}`)
+	require.Len(t, errs, 3)
+	require.Equal(t, "at", errs[0].Field)
+	require.Equal(t, "must be a valid date-time", errs[0].Message)
+	require.Equal(t, "email", errs[1].Field)
+	require.Equal(t, "on", errs[2].Field)
+}
+
+func TestOperationBreaksTiesAlike(t *testing.T) {
+	doc, err := openapi.Parse([]byte(`{
+  "openapi": "3.0.3",
+  "paths": {
+    "/{kind}/{id}/items": { "get": { "operationId": "anyItems" } },
+    "/things/{id}/{list}": { "get": { "operationId": "thingList" } },
+    "/{kind}/42/{list}": { "get": { "operationId": "kindList" } }
+  }
+}`))
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		op, _, values, ok := doc.Operation("GET", "/things/42/items")
+		require.True(t, ok)
+		require.Equal(t, "thingList", op.OperationID)
+		require.Equal(t, map[string]string{"id": "42", "list": "items"}, values)
+	}
+}
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/policies"
+	"github.com/mattchw/go-onboard/rbac"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	ownUserId   = "64b7f0c2a1b2c3d4e5f60718"
+	otherUserId = "64b7f0c2a1b2c3d4e5f60719"
+)
+
+func TestOwnUserPolicy(t *testing.T) {
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		claims := map[string]interface{}{"role": c.Get("X-Test-Role")}
+		if uid := c.Get("X-Test-Uid"); uid != "" {
+			claims["uid"] = uid
+		}
+		c.Locals(middlewares.ClaimsKey, claims)
+		if account := c.Get("X-Test-Account-User"); account != "" {
+			c.Locals(middlewares.AccountKey, &models.Account{Role: "user", UserId: account})
+		}
+		return c.Next()
+	})
+	read := middlewares.Permit(rbac.Default(), models.PermUsersRead)
+	ok := func(c *fiber.Ctx) error { return c.SendString("ok") }
+	app.Get("/users", read, policies.AnyUser, ok)
+	app.Get("/users/:userId", read, policies.OwnUser("userId"), ok)
+
+	cases := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{"own user", "/users/" + ownUserId, map[string]string{"X-Test-Role": "user", "X-Test-Uid": ownUserId}, 200},
+		{"user of another", "/users/" + otherUserId, map[string]string{"X-Test-Role": "user", "X-Test-Uid": ownUserId}, 404},
+		{"caller who is no user", "/users/" + ownUserId, map[string]string{"X-Test-Role": "user"}, 404},
+		{"own user of an account", "/users/" + ownUserId, map[string]string{"X-Test-Account-User": ownUserId}, 200},
+		{"admin on anyone", "/users/" + otherUserId, map[string]string{"X-Test-Role": "admin"}, 200},
+		{"viewer on anyone", "/users/" + otherUserId, map[string]string{"X-Test-Role": "viewer", "X-Test-Uid": ownUserId}, 200},
+		{"user listing everyone", "/users", map[string]string{"X-Test-Role": "user", "X-Test-Uid": ownUserId}, 403},
+		{"admin listing everyone", "/users", map[string]string{"X-Test-Role": "admin"}, 200},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.path, nil)
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package test
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/tenancy"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// artifact returns the responses GridFS sends while a file holding lines is
+// listed, then the ones it sends while it is downloaded
+func artifact(mt *mtest.T, id primitive.ObjectID, lines string) (bson.D, []bson.D) {
+	var content bytes.Buffer
+	gz := gzip.NewWriter(&content)
+	gz.Write([]byte(lines))
+	gz.Close()
+	return artifactFile(mt, id, "users-"+id.Hex()+".ndjson.gz", content.Bytes())
+}
+
+// artifactFile is like artifact for a file holding content as it is
+func artifactFile(mt *mtest.T, id primitive.ObjectID, filename string, content []byte) (bson.D, []bson.D) {
+	ns := mt.DB.Name() + "." + models.JobArtifactsBucket
+	file := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "length", Value: int64(len(content))},
+		{Key: "chunkSize", Value: int32(255 * 1024)},
+		{Key: "uploadDate", Value: primitive.NewDateTimeFromTime(time.Now())},
+		{Key: "filename", Value: filename},
+	}
+	chunk := bson.D{
+		{Key: "_id", Value: primitive.NewObjectID()},
+		{Key: "files_id", Value: id},
+		{Key: "n", Value: int32(0)},
+		{Key: "data", Value: primitive.Binary{Data: content}},
+	}
+	return file, []bson.D{
+		mtest.CreateCursorResponse(0, ns+".files", mtest.FirstBatch, file),
+		mtest.CreateCursorResponse(0, ns+".chunks", mtest.FirstBatch, chunk),
+	}
+}
+
+func privacyService(mt *mtest.T) *services.PrivacyServiceImpl {
+	router := tenancy.NewRouter(mt.Client, mt.DB.Name(), tenancy.Disabled)
+	users := services.NewUserServiceImpl(mt.DB.Collection("users"))
+	return services.NewPrivacyServiceImpl(router, users, mt.DB)
+}
+
+func TestPersonalDataCollections(t *testing.T) {
+	names := []string{}
+	for _, source := range services.PersonalDataCollections {
+		names = append(names, source.Name)
+	}
+	require.ElementsMatch(t, []string{models.JobsCollection, models.JobArtifactsBucket}, names)
+}
+
+func TestPrivacyExportCoversJobs(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("export", func(mt *mtest.T) {
+		ada, bob := primitive.NewObjectID(), primitive.NewObjectID()
+		user := bson.D{{Key: "_id", Value: ada}, {Key: "firstName", Value: "Ada"}, {Key: "email", Value: "ada@example.com"}}
+		ns := mt.DB.Name()
+		file, download := artifact(mt, primitive.NewObjectID(),
+			`{"id":"`+ada.Hex()+`","firstName":"Ada"}`+"\n"+`{"id":"`+bob.Hex()+`","firstName":"Bob"}`+"\n")
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns+".users", mtest.FirstBatch, user),
+			mtest.CreateCursorResponse(0, ns+".users", mtest.FirstBatch, user),
+			mtest.CreateCursorResponse(0, ns+".jobs", mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: primitive.NewObjectID()},
+				{Key: "params", Value: bson.D{{Key: "users", Value: bson.A{
+					bson.D{{Key: "id", Value: ada.Hex()}, {Key: "firstName", Value: "Ada"}},
+					bson.D{{Key: "id", Value: bob.Hex()}, {Key: "firstName", Value: "Bob"}},
+				}}}},
+			}),
+			mtest.CreateCursorResponse(0, ns+".job_artifacts.files", mtest.FirstBatch, file),
+		)
+		mt.AddMockResponses(download...)
+
+		archive, err := privacyService(mt).Export(context.Background(), ada)
+		require.NoError(t, err)
+
+		reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		require.NoError(t, err)
+		files := map[string]string{}
+		for _, f := range reader.File {
+			r, err := f.Open()
+			require.NoError(t, err)
+			content, err := io.ReadAll(r)
+			require.NoError(t, err)
+			files[f.Name] = string(content)
+		}
+		require.Contains(t, files, "user.json")
+		require.Contains(t, files["jobs.json"], "Ada")
+		require.NotContains(t, files["jobs.json"], "Bob")
+		require.Contains(t, files["job_artifacts.json"], ada.Hex())
+		require.NotContains(t, files["job_artifacts.json"], "Bob")
+
+		jobs := commands(mt, "find")[2]
+		require.Equal(t, ada.Hex(), jobs.Lookup("filter", "params.users.id").StringValue())
+		require.Equal(t, bson.TypeEmbeddedDocument, jobs.Lookup("filter", "tenantId").Type)
+	})
+}
+
+func TestPrivacyEraseCoversJobs(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("erase", func(mt *mtest.T) {
+		ada, bob := primitive.NewObjectID(), primitive.NewObjectID()
+		ns := mt.DB.Name()
+		withAda, adaDownload := artifact(mt, primitive.NewObjectID(), `{"id":"`+ada.Hex()+`"}`+"\n")
+		withoutAda, bobDownload := artifact(mt, primitive.NewObjectID(), `{"id":"`+bob.Hex()+`"}`+"\n")
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns+".erasure_tombstones", mtest.FirstBatch),
+			updated(1),
+			updated(2),
+			mtest.CreateCursorResponse(0, ns+".job_artifacts.files", mtest.FirstBatch, withAda, withoutAda),
+		)
+		mt.AddMockResponses(adaDownload...)
+		mt.AddMockResponses(bobDownload...)
+		mt.AddMockResponses(
+			// the file holding Ada and its chunks
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			updated(1),
+			mtest.CreateCursorResponse(0, ns+".erasure_tombstones", mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: ada},
+				{Key: "requestedBy", Value: "admin"},
+			}),
+		)
+
+		tombstone, alreadyErased, err := privacyService(mt).Erase(context.Background(), ada, "admin")
+		require.NoError(t, err)
+		require.False(t, alreadyErased)
+		require.Equal(t, ada, tombstone.UserId)
+
+		updates := commands(mt, "update")
+		require.Len(t, updates, 3)
+		pull := updates[1].Lookup("updates").Array().Index(0).Value().Document()
+		require.Equal(t, ada.Hex(), pull.Lookup("q", "params.users.id").StringValue())
+		require.Equal(t, ada.Hex(), pull.Lookup("u", "$pull", "params.users", "id").StringValue())
+
+		deletes := commands(mt, "delete")
+		require.Len(t, deletes, 2)
+		require.Equal(t, withAda[0].Value, deletes[0].Lookup("deletes").Array().Index(0).Value().Document().Lookup("q", "_id").ObjectID())
+
+		counts := updates[2].Lookup("updates").Array().Index(0).Value().Document().Lookup("u", "$setOnInsert", "collections").Document()
+		require.EqualValues(t, 2, counts.Lookup("jobs").Int64())
+		require.EqualValues(t, 1, counts.Lookup("job_artifacts").Int64())
+	})
+}
+
+func TestPrivacyBucketSourceIsTenantScoped(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("export", func(mt *mtest.T) {
+		ada := primitive.NewObjectID()
+		ns := mt.DB.Name()
+		user := bson.D{{Key: "_id", Value: ada}, {Key: "firstName", Value: "Ada"}, {Key: "tenantId", Value: "acme"}}
+		// files written by hand are plain NDJSON
+		file, download := artifactFile(mt, primitive.NewObjectID(), "users.ndjson", []byte(`{"id":"`+ada.Hex()+`","firstName":"Ada"}`+"\n"))
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns+".users", mtest.FirstBatch, user),
+			mtest.CreateCursorResponse(0, ns+".users", mtest.FirstBatch, user),
+			mtest.CreateCursorResponse(0, ns+".jobs", mtest.FirstBatch),
+			mtest.CreateCursorResponse(0, ns+".job_artifacts.files", mtest.FirstBatch, file),
+		)
+		mt.AddMockResponses(download...)
+
+		router := tenancy.NewRouter(mt.Client, mt.DB.Name(), tenancy.SharedCollection)
+		privacy := services.NewPrivacyServiceImpl(router, services.NewUserServiceImpl(mt.DB.Collection("users")), mt.DB)
+		archive, err := privacy.Export(tenancy.WithTenant(context.Background(), "acme"), ada)
+		require.NoError(t, err)
+
+		reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		require.NoError(t, err)
+		for _, f := range reader.File {
+			if f.Name != "job_artifacts.json" {
+				continue
+			}
+			r, err := f.Open()
+			require.NoError(t, err)
+			content, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Contains(t, string(content), ada.Hex())
+		}
+
+		files := commands(mt, "find")[3]
+		require.Equal(t, "job_artifacts.files", files.Lookup("find").StringValue())
+		require.Equal(t, "acme", files.Lookup("filter", "metadata.tenantId").StringValue())
+	})
+
+	mt.Run("erase", func(mt *mtest.T) {
+		ada := primitive.NewObjectID()
+		ns := mt.DB.Name()
+		file, download := artifact(mt, primitive.NewObjectID(), `{"id":"`+ada.Hex()+`"}`+"\n")
+
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns+".erasure_tombstones", mtest.FirstBatch),
+			updated(1),
+			updated(0),
+			mtest.CreateCursorResponse(0, ns+".job_artifacts.files", mtest.FirstBatch, file),
+		)
+		mt.AddMockResponses(download...)
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			updated(1),
+			mtest.CreateCursorResponse(0, ns+".erasure_tombstones", mtest.FirstBatch, bson.D{{Key: "_id", Value: ada}}),
+		)
+
+		router := tenancy.NewRouter(mt.Client, mt.DB.Name(), tenancy.SharedCollection)
+		privacy := services.NewPrivacyServiceImpl(router, services.NewUserServiceImpl(mt.DB.Collection("users")), mt.DB)
+		_, _, err := privacy.Erase(tenancy.WithTenant(context.Background(), "acme"), ada, "admin")
+		require.NoError(t, err)
+
+		files := commands(mt, "find")[1]
+		require.Equal(t, "job_artifacts.files", files.Lookup("find").StringValue())
+		require.Equal(t, "acme", files.Lookup("filter", "metadata.tenantId").StringValue())
+		deletes := commands(mt, "delete")
+		require.Len(t, deletes, 2)
+		require.Equal(t, file[0].Value, deletes[0].Lookup("deletes").Array().Index(0).Value().Document().Lookup("q", "_id").ObjectID())
+	})
+}
@@ -0,0 +1,158 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/ratelimit"
+	"github.com/stretchr/testify/require"
+)
+
+// countingLimiter allows limit.Requests calls per key and never replenishes
+type countingLimiter struct {
+	counts map[string]int
+	err    error
+}
+
+func (cl *countingLimiter) Allow(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	if cl.err != nil {
+		return ratelimit.Result{}, cl.err
+	}
+	if cl.counts[key] >= limit.Requests {
+		return ratelimit.Result{RetryAfter: 1500 * time.Millisecond, ResetAfter: limit.Period}, nil
+	}
+	cl.counts[key]++
+	return ratelimit.Result{Allowed: true, Remaining: limit.Requests - cl.counts[key], ResetAfter: limit.Period}, nil
+}
+
+func rateLimitedApp(limiter ratelimit.Limiter) *fiber.App {
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		// identity providers may give different users the same name
+		if user := c.Get("X-Test-User"); user != "" {
+			c.Locals(middlewares.ClaimsKey, map[string]interface{}{"sub": user, "name": "Matt"})
+			c.Locals("username", "Matt")
+		}
+		return c.Next()
+	})
+	app.Use(middlewares.RateLimit(limiter,
+		middlewares.RateLimitRule{Name: "ip", Limit: ratelimit.Limit{Requests: 5, Period: time.Minute}, Key: middlewares.RateLimitByIP},
+		middlewares.RateLimitRule{Name: "user", Limit: ratelimit.Limit{Requests: 2, Period: time.Minute}, Key: middlewares.RateLimitByUser},
+	))
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	})
+	return app
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	app := rateLimitedApp(&countingLimiter{counts: map[string]int{}})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "5", resp.Header.Get("RateLimit-Limit"))
+	require.Equal(t, "4", resp.Header.Get("RateLimit-Remaining"))
+	require.Equal(t, "60", resp.Header.Get("RateLimit-Reset"))
+	require.Equal(t, "5;w=60", resp.Header.Get("RateLimit-Policy"))
+}
+
+func TestRateLimitRejectsOnceExhausted(t *testing.T) {
+	app := rateLimitedApp(&countingLimiter{counts: map[string]int{}})
+
+	request := func() *http.Response {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Test-User", "oidc|1")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// the per user rule is the tighter one
+	first := request()
+	require.Equal(t, 200, first.StatusCode)
+	require.Equal(t, "2", first.Header.Get("RateLimit-Limit"))
+	require.Equal(t, "1", first.Header.Get("RateLimit-Remaining"))
+
+	require.Equal(t, 200, request().StatusCode)
+
+	limited := request()
+	require.Equal(t, 429, limited.StatusCode)
+	require.Equal(t, "2", limited.Header.Get("Retry-After"))
+	require.Equal(t, "0", limited.Header.Get("RateLimit-Remaining"))
+
+	// users are counted by subject, not by name
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Test-User", "oidc|2")
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	// anonymous requests from the same IP only count against the IP rule
+	resp, err = app.Test(httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "5", resp.Header.Get("RateLimit-Limit"))
+}
+
+func TestRateLimitFailsOpen(t *testing.T) {
+	app := rateLimitedApp(&countingLimiter{err: errors.New("connection refused")})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("RateLimit-Limit"))
+}
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ratelimit.ParseLimit("100/1m")
+	require.NoError(t, err)
+	require.Equal(t, ratelimit.Limit{Requests: 100, Period: time.Minute}, limit)
+
+	for _, value := range []string{"", "100", "0/1m", "x/1m", "10/soon", "10/-1s"} {
+		_, err := ratelimit.ParseLimit(value)
+		require.Error(t, err, value)
+	}
+}
+
+func TestRateLimitByIPTrustsOnlyConfiguredProxies(t *testing.T) {
+	cases := []struct {
+		name    string
+		proxies []string
+		forward string
+		key     string
+	}{
+		// app.Test connects from 0.0.0.0
+		{"trusted proxy", []string{"0.0.0.0"}, "203.0.113.7", "ip:203.0.113.7"},
+		{"trusted range", []string{"0.0.0.0/8"}, "203.0.113.7", "ip:203.0.113.7"},
+		{"address added by the proxy wins", []string{"0.0.0.0"}, "198.51.100.1, 203.0.113.7", "ip:203.0.113.7"},
+		{"untrusted peer", []string{"10.0.0.1"}, "203.0.113.7", "ip:0.0.0.0"},
+		{"no proxies", nil, "203.0.113.7", "ip:0.0.0.0"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			app := fiber.New(fiber.Config{
+				EnableTrustedProxyCheck: true,
+				TrustedProxies:          tc.proxies,
+				ProxyHeader:             fiber.HeaderXForwardedFor,
+			})
+			app.Get("/", func(c *fiber.Ctx) error {
+				return c.SendString(middlewares.RateLimitByIP(c))
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(fiber.HeaderXForwardedFor, tc.forward)
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			body, _ := io.ReadAll(resp.Body)
+			require.Equal(t, tc.key, string(body))
+		})
+	}
+}
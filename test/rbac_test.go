@@ -0,0 +1,173 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/jobs"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/rbac"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRolePermissions(t *testing.T) {
+	policy, err := rbac.Parse([]byte(`{"roles": {
+		"admin": {"permissions": ["*"]},
+		"editor": {"permissions": ["users:*"]},
+		"viewer": {"permissions": ["users:read"]}
+	}}`))
+	require.NoError(t, err)
+
+	admin, _ := policy.Role("admin")
+	editor, _ := policy.Role("editor")
+	viewer, _ := policy.Role("viewer")
+	require.True(t, admin.Can(models.PermAccountsManage))
+	require.True(t, editor.Can(models.PermUsersDelete))
+	require.False(t, editor.Can(models.PermAccountsManage))
+	require.True(t, viewer.Can(models.PermUsersRead))
+	require.False(t, viewer.Can(models.PermUsersWrite))
+
+	// the default policy grants cache stats without account management
+	monitor, err := rbac.Default().Role("monitor")
+	require.NoError(t, err)
+	require.True(t, monitor.Can(models.PermCacheRead))
+	require.False(t, monitor.Can(models.PermAccountsManage))
+
+	_, err = policy.Role("owner")
+	require.ErrorIs(t, err, rbac.ErrUnknownRole)
+	_, err = rbac.Parse([]byte(`{"roles": {}}`))
+	require.ErrorIs(t, err, rbac.ErrNoRoles)
+}
+
+func TestRequiresMFA(t *testing.T) {
+	policy, err := rbac.Parse([]byte(`{"roles": {"admin": {"permissions": ["*"]}}, "mfaRequired": ["users:delete", "accounts:*"]}`))
+	require.NoError(t, err)
+
+	require.True(t, policy.RequiresMFA(models.PermUsersDelete))
+	require.True(t, policy.RequiresMFA(models.PermAccountsManage))
+	require.False(t, policy.RequiresMFA(models.PermUsersRead))
+	require.True(t, rbac.Default().RequiresMFA(models.PermUsersDelete))
+}
+
+func TestFieldRules(t *testing.T) {
+	role := &rbac.Role{HiddenFields: []string{"age"}, ReadOnlyFields: []string{"gender"}}
+
+	users := []models.User{{FirstName: "Ada", Age: 36}, {FirstName: "Alan", Age: 41}}
+	role.Redact(users)
+	require.Zero(t, users[0].Age)
+	require.Zero(t, users[1].Age)
+	require.Equal(t, "Ada", users[0].FirstName)
+
+	user := models.User{FirstName: "Ada", Age: 36}
+	role.Redact(&user)
+	require.Zero(t, user.Age)
+
+	var fieldErr *rbac.FieldError
+	require.ErrorAs(t, role.CheckWrite(&models.User{FirstName: "Ada", Age: 36}), &fieldErr)
+	require.Equal(t, "age", fieldErr.Field)
+	require.ErrorAs(t, role.CheckWrite(&models.User{FirstName: "Ada", Gender: "Female"}), &fieldErr)
+	require.Equal(t, "gender", fieldErr.Field)
+	require.NoError(t, role.CheckWrite(&models.User{FirstName: "Ada"}))
+
+	update := models.User{FirstName: "Ada"}
+	role.Protect(&update, &models.User{FirstName: "Augusta", Age: 36, Gender: "Female"})
+	require.Equal(t, models.User{FirstName: "Ada", Age: 36, Gender: "Female"}, update)
+
+	// nil roles, routes without Permit, apply no rules
+	var none *rbac.Role
+	none.Redact(&user)
+	require.NoError(t, none.CheckWrite(&models.User{Age: 36}))
+}
+
+func TestPermit(t *testing.T) {
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		if role := c.Get("X-Test-Role"); role != "" {
+			claims := map[string]interface{}{"role": role}
+			if amr := c.Get("X-Test-AMR"); amr != "" {
+				claims["amr"] = []interface{}{"pwd", amr}
+			}
+			c.Locals(middlewares.ClaimsKey, claims)
+		}
+		if account := c.Get("X-Test-Account-Role"); account != "" {
+			c.Locals(middlewares.AccountKey, &models.Account{Role: account})
+		}
+		return c.Next()
+	})
+	app.Delete("/users", middlewares.Permit(rbac.Default(), models.PermUsersDelete), func(c *fiber.Ctx) error {
+		return c.SendString(c.Locals(middlewares.RoleKey).(*rbac.Role).Name)
+	})
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"admin token", map[string]string{"X-Test-Role": "admin", "X-Test-AMR": "otp"}, 200},
+		{"admin token of an identity provider", map[string]string{"X-Test-Role": "admin", "X-Test-AMR": "mfa"}, 200},
+		{"admin token without second factor", map[string]string{"X-Test-Role": "admin"}, 403},
+		{"editor token", map[string]string{"X-Test-Role": "editor"}, 403},
+		{"unknown role", map[string]string{"X-Test-Role": "owner"}, 403},
+		{"admin account over basic auth", map[string]string{"X-Test-Account-Role": "admin"}, 403},
+		{"account wins over claims", map[string]string{"X-Test-Role": "admin", "X-Test-Account-Role": "viewer"}, 403},
+		{"anonymous", nil, 401},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("DELETE", "/users", nil)
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+}
+
+func TestPermitJob(t *testing.T) {
+	jobs.Register("test.purge", jobs.Definition{Permission: models.PermUsersDelete})
+	jobs.Register("test.note", jobs.Definition{})
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		claims := map[string]interface{}{"role": c.Get("X-Test-Role")}
+		if amr := c.Get("X-Test-AMR"); amr != "" {
+			claims["amr"] = []interface{}{"pwd", amr}
+		}
+		c.Locals(middlewares.ClaimsKey, claims)
+		return c.Next()
+	})
+	app.Post("/jobs", middlewares.Permit(rbac.Default(), models.PermJobsManage), middlewares.PermitJob(rbac.Default()), func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusAccepted)
+	})
+
+	cases := []struct {
+		name   string
+		body   string
+		amr    string
+		status int
+	}{
+		{"purge with second factor", `{"type": "test.purge"}`, "otp", 202},
+		{"purge without second factor", `{"type": "test.purge"}`, "", 403},
+		{"type needing no permission", `{"type": "test.note"}`, "", 202},
+		{"unknown type", `{"type": "test.unknown"}`, "", 202},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/jobs", strings.NewReader(tc.body))
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			req.Header.Set("X-Test-Role", "admin")
+			if tc.amr != "" {
+				req.Header.Set("X-Test-AMR", tc.amr)
+			}
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+}
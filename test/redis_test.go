@@ -0,0 +1,17 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+)
+
+// newRedis starts a Redis stand-in for the test. SetError on the server
+// fails every command, like Redis going down.
+func newRedis(t *testing.T) (*redis.Client, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return rdb, server
+}
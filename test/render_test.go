@@ -0,0 +1,134 @@
+package test
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/responses"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMarshalRoundTrips(t *testing.T) {
+	user := models.User{
+		Id:        primitive.NewObjectID(),
+		FirstName: "Matt",
+		LastName:  "Chw",
+		Age:       30,
+		Gender:    "Male",
+	}
+
+	data, err := responses.Marshal(responses.MIMEMessagePack, user)
+	require.NoError(t, err)
+	decoded := map[string]interface{}{}
+	require.NoError(t, msgpack.Unmarshal(data, &decoded))
+	require.Equal(t, "Matt", decoded["firstName"])
+	require.Equal(t, user.Id.Hex(), decoded["id"])
+
+	data, err = responses.Marshal(responses.MIMECBOR, user)
+	require.NoError(t, err)
+	decoded = map[string]interface{}{}
+	require.NoError(t, cbor.Unmarshal(data, &decoded))
+	require.Equal(t, "Matt", decoded["firstName"])
+	require.Equal(t, user.Id.Hex(), decoded["id"])
+	transcoded, _, err := responses.TranscodeJSON(responses.MIMECBOR, data)
+	require.NoError(t, err)
+	var fromCBOR models.User
+	require.NoError(t, json.Unmarshal(transcoded, &fromCBOR))
+	require.Equal(t, user, fromCBOR)
+
+	data, err = responses.Marshal("application/xml", user)
+	require.NoError(t, err)
+	var fromXML models.User
+	require.NoError(t, xml.Unmarshal(data, &fromXML))
+	require.Equal(t, user, fromXML)
+}
+
+func TestTranscodeJSON(t *testing.T) {
+	body, err := msgpack.Marshal(map[string]interface{}{"firstName": "Matt", "age": 30})
+	require.NoError(t, err)
+
+	data, ok, err := responses.TranscodeJSON("application/msgpack", body)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.JSONEq(t, `{"firstName": "Matt", "age": 30}`, string(data))
+
+	_, ok, err = responses.TranscodeJSON("application/json", []byte(`{}`))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestErrorEnvelopes(t *testing.T) {
+	app := fiber.New()
+	app.Get("/:version/error", func(c *fiber.Ctx) error {
+		c.Locals(responses.VersionKey, c.Params("version"))
+		return responses.Error(c, http.StatusBadRequest, "Invalid request body", "unexpected EOF")
+	})
+	app.Get("/:version/invalid", func(c *fiber.Ctx) error {
+		c.Locals(responses.VersionKey, c.Params("version"))
+		return responses.Invalid(c, "Invalid request", []string{"age"})
+	})
+
+	body := func(path string) map[string]interface{} {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		decoded := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+		return decoded
+	}
+
+	v1 := body("/v1/error")
+	require.Equal(t, "error", v1["status"])
+	require.Equal(t, "unexpected EOF", v1["error"])
+	require.NotContains(t, v1, "errors")
+
+	v1 = body("/v1/invalid")
+	require.Equal(t, []interface{}{"age"}, v1["errors"])
+	require.NotContains(t, v1, "error")
+
+	v2 := body("/v2/invalid")
+	require.Equal(t, map[string]interface{}{
+		"status":  float64(http.StatusBadRequest),
+		"message": "Invalid request",
+		"details": []interface{}{"age"},
+	}, v2["error"])
+}
+
+func TestMarshalXMLMaps(t *testing.T) {
+	app := fiber.New()
+	app.Get("/stats", func(c *fiber.Ctx) error {
+		return responses.Success(c, http.StatusOK, "Stats", map[string]interface{}{
+			"backend": "memory",
+			"caches":  map[string]interface{}{"users": map[string]int{"loads": 2}},
+			"a b":     1,
+		})
+	})
+
+	req := httptest.NewRequest("GET", "/stats", nil)
+	req.Header.Set("Accept", "application/xml")
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var decoded struct {
+		Backend string `xml:"data>backend"`
+		Loads   int    `xml:"data>caches>users>loads"`
+		Entry   struct {
+			Key   string `xml:"key,attr"`
+			Value int    `xml:",chardata"`
+		} `xml:"data>entry"`
+	}
+	require.NoError(t, xml.NewDecoder(resp.Body).Decode(&decoded))
+	require.Equal(t, "memory", decoded.Backend)
+	require.Equal(t, 2, decoded.Loads)
+	require.Equal(t, "a b", decoded.Entry.Key)
+	require.Equal(t, 1, decoded.Entry.Value)
+}
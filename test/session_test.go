@@ -0,0 +1,96 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/sessions"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type stubSessions struct {
+	err error
+}
+
+func (ss stubSessions) Authenticate(ctx context.Context, token string, ip string) (*sessions.Session, *models.Account, error) {
+	if ss.err != nil {
+		return nil, nil, ss.err
+	}
+	if token != "valid-session" {
+		return nil, nil, sessions.ErrNoSession
+	}
+	account := &models.Account{Id: primitive.NewObjectID(), Username: "console", Role: models.RoleAdmin}
+	return &sessions.Session{Id: "s1", AccountId: account.Id.Hex(), CSRFToken: "csrf-token"}, account, nil
+}
+
+func sessionApp(store middlewares.SessionAuthenticator) *fiber.App {
+	app := fiber.New()
+	app.Use(middlewares.VerifyToken(stubVerifier{}))
+	app.Use(middlewares.VerifySession(store, "session"))
+	handler := func(c *fiber.Ctx) error {
+		return c.SendString(c.Locals("username").(string))
+	}
+	app.Get("/accounts", middlewares.AuthReq(stubAuthenticator{}), handler)
+	app.Delete("/accounts", middlewares.AuthReq(stubAuthenticator{}), handler)
+	app.Post("/users", middlewares.TokenReq, handler)
+	return app
+}
+
+func TestVerifySession(t *testing.T) {
+	app := sessionApp(stubSessions{})
+
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		cookie  string
+		headers map[string]string
+		status  int
+		body    string
+	}{
+		{"read with cookie", "GET", "/accounts", "valid-session", nil, 200, "console"},
+		{"write with CSRF token", "DELETE", "/accounts", "valid-session", map[string]string{"X-CSRF-Token": "csrf-token"}, 200, "console"},
+		{"write without CSRF token", "DELETE", "/accounts", "valid-session", nil, 403, ""},
+		{"write with wrong CSRF token", "POST", "/users", "valid-session", map[string]string{"X-CSRF-Token": "guessed"}, 403, ""},
+		{"token claims", "POST", "/users", "valid-session", map[string]string{"X-CSRF-Token": "csrf-token"}, 200, "console"},
+		{"expired session", "GET", "/accounts", "expired-session", nil, 401, ""},
+		{"bearer token wins", "POST", "/users", "valid-session", map[string]string{"Authorization": "Bearer good"}, 200, "admin"},
+		{"no cookie", "GET", "/accounts", "", nil, 401, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.cookie != "" {
+				req.Header.Set("Cookie", "session="+tc.cookie)
+			}
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, tc.status, resp.StatusCode)
+			if tc.body != "" {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.Equal(t, tc.body, string(body))
+			}
+		})
+	}
+}
+
+func TestVerifySessionStoreUnavailable(t *testing.T) {
+	app := sessionApp(stubSessions{err: errors.New("redis: connection refused")})
+
+	req := httptest.NewRequest("GET", "/accounts", nil)
+	req.Header.Set("Cookie", "session=valid-session")
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, 503, resp.StatusCode)
+}
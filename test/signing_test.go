@@ -0,0 +1,135 @@
+package test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/partners"
+	"github.com/mattchw/go-onboard/rbac"
+	"github.com/mattchw/go-onboard/signing"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	partnerSecret  = "acme-secret-0123456789abcdef0123456789"
+	rotatedSecret  = "acme-secret-fedcba9876543210fedcba9876"
+	strangerSecret = "someone-else-0123456789abcdef012345678"
+)
+
+type memoryNonces map[string]bool
+
+func (mn memoryNonces) Claim(ctx context.Context, partner string, nonce string, ttl time.Duration) (bool, error) {
+	if mn[partner+":"+nonce] {
+		return false, nil
+	}
+	mn[partner+":"+nonce] = true
+	return true, nil
+}
+
+func signingApp(t *testing.T, now time.Time) *fiber.App {
+	registry, err := partners.Parse([]byte(`{"partners": [
+		{"id": "acme", "secrets": ["` + partnerSecret + `", "` + rotatedSecret + `"], "scopes": ["users:write"]},
+		{"id": "initech", "secrets": ["` + strangerSecret + `"], "scopes": ["users:delete"]}
+	]}`))
+	require.NoError(t, err)
+	verifier := partners.NewVerifier(registry, memoryNonces{}, 5*time.Minute).WithClock(func() time.Time { return now })
+
+	app := fiber.New()
+	app.Use(middlewares.VerifySignature(verifier))
+	app.Post("/users", middlewares.TokenReq, middlewares.Permit(rbac.Default(), models.PermUsersWrite), func(c *fiber.Ctx) error {
+		return c.SendString(c.Locals("username").(string))
+	})
+	app.Delete("/users/:userId", middlewares.TokenReq, middlewares.Permit(rbac.Default(), models.PermUsersDelete), func(c *fiber.Ctx) error {
+		return c.SendString("deleted")
+	})
+	return app
+}
+
+func TestSignedRequests(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	app := signingApp(t, now)
+	body := `{"name":"Ada"}`
+
+	cases := []struct {
+		name   string
+		method string
+		keyId  string
+		secret string
+		signed time.Time
+		status int
+	}{
+		{"signed", "POST", "acme", partnerSecret, now, 200},
+		{"rotated secret", "POST", "acme", rotatedSecret, now, 200},
+		{"clock a little behind", "POST", "acme", partnerSecret, now.Add(-4 * time.Minute), 200},
+		{"clock a little ahead", "POST", "acme", partnerSecret, now.Add(4 * time.Minute), 200},
+		{"stale", "POST", "acme", partnerSecret, now.Add(-6 * time.Minute), 401},
+		{"from the future", "POST", "acme", partnerSecret, now.Add(6 * time.Minute), 401},
+		{"other secret", "POST", "acme", "acme-secret-0000000000000000000000000000", now, 401},
+		{"secret of another partner", "POST", "acme", strangerSecret, now, 401},
+		{"unknown partner", "POST", "globex", partnerSecret, now, 401},
+		{"missing scope", "DELETE", "acme", partnerSecret, now, 403},
+		// partners are exempt from the second factor, like API keys
+		{"permission requiring 2FA", "DELETE", "initech", strangerSecret, now, 200},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := "/users"
+			if tc.method == "DELETE" {
+				path = "/users/" + ownUserId
+			}
+			req := httptest.NewRequest(tc.method, path, strings.NewReader(body))
+			require.NoError(t, signing.SignRequest(req, tc.keyId, []byte(tc.secret), tc.signed))
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+}
+
+func TestSignedRequestTampering(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	app := signingApp(t, now)
+
+	send := func(method string, target string, body string, headers map[string]string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	signed := httptest.NewRequest("POST", "/users?notify=true", strings.NewReader(`{"name":"Ada"}`))
+	require.NoError(t, signing.SignRequest(signed, "acme", []byte(partnerSecret), now))
+	headers := map[string]string{}
+	for _, name := range []string{signing.HeaderKeyId, signing.HeaderTimestamp, signing.HeaderNonce, signing.HeaderSignature} {
+		headers[name] = signed.Header.Get(name)
+	}
+
+	// the body, the query and the method are all covered
+	require.Equal(t, 401, send("POST", "/users?notify=true", `{"name":"Eve"}`, headers))
+	require.Equal(t, 401, send("POST", "/users?notify=false", `{"name":"Ada"}`, headers))
+	require.Equal(t, 401, send("PUT", "/users?notify=true", `{"name":"Ada"}`, headers))
+
+	// the request goes through once, the same nonce is refused after
+	require.Equal(t, 200, send("POST", "/users?notify=true", `{"name":"Ada"}`, headers))
+	require.Equal(t, 401, send("POST", "/users?notify=true", `{"name":"Ada"}`, headers))
+
+	// so is a signature that is not hex
+	require.Equal(t, 401, send("POST", "/users", "", map[string]string{signing.HeaderSignature: "zz"}))
+}
+
+func TestParsePartners(t *testing.T) {
+	_, err := partners.Parse([]byte(`{"partners": [{"id": "acme", "secrets": ["short"]}]}`))
+	require.Error(t, err)
+	_, err = partners.Parse([]byte(`{"partners": [{"id": "acme", "secrets": []}]}`))
+	require.Error(t, err)
+	_, err = partners.Parse([]byte(`{"partners": [{"id": "acme", "secrets": ["` + partnerSecret + `"]}, {"id": "acme", "secrets": ["` + partnerSecret + `"]}]}`))
+	require.Error(t, err)
+}
@@ -0,0 +1,461 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/mattchw/go-onboard/models"
+	"github.com/mattchw/go-onboard/passwords"
+	"github.com/mattchw/go-onboard/services"
+	"github.com/mattchw/go-onboard/tenancy"
+	"github.com/mattchw/go-onboard/tokens"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// recordingCollection records the filters and documents reaching Mongo
+type recordingCollection struct {
+	filters   []interface{}
+	documents []interface{}
+	updates   []interface{}
+	models    []mongo.WriteModel
+}
+
+func (rc *recordingCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	rc.documents = append(rc.documents, document)
+	return &mongo.InsertOneResult{}, nil
+}
+
+func (rc *recordingCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	rc.documents = append(rc.documents, documents...)
+	return &mongo.InsertManyResult{InsertedIDs: documents}, nil
+}
+
+func (rc *recordingCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	rc.filters = append(rc.filters, filter)
+	return mongo.NewCursorFromDocuments(nil, nil, nil)
+}
+
+func (rc *recordingCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	rc.filters = append(rc.filters, filter)
+	return mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil)
+}
+
+func (rc *recordingCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	rc.filters = append(rc.filters, filter)
+	return 0, nil
+}
+
+func (rc *recordingCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	rc.filters = append(rc.filters, filter)
+	rc.updates = append(rc.updates, update)
+	return &mongo.UpdateResult{}, nil
+}
+
+func (rc *recordingCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	rc.filters = append(rc.filters, filter)
+	rc.updates = append(rc.updates, update)
+	return &mongo.UpdateResult{}, nil
+}
+
+func (rc *recordingCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	rc.filters = append(rc.filters, filter)
+	return &mongo.DeleteResult{}, nil
+}
+
+func (rc *recordingCollection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	rc.filters = append(rc.filters, filter)
+	return &mongo.DeleteResult{}, nil
+}
+
+func (rc *recordingCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	rc.models = append(rc.models, models...)
+	return &mongo.BulkWriteResult{}, nil
+}
+
+func scopedTo(tenant string, filter interface{}) bson.D {
+	return bson.D{{Key: "$and", Value: bson.A{filter, bson.D{{Key: "tenantId", Value: tenant}}}}}
+}
+
+func TestScopedCollectionFiltersEveryQuery(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingCollection{}
+	coll := tenancy.Scope(inner, "acme")
+
+	// even a filter trying to reach another tenant stays within acme
+	sneaky := bson.M{"$or": bson.A{bson.M{"tenantId": "globex"}, bson.M{}}}
+	coll.Find(ctx, sneaky)
+	coll.FindOne(ctx, sneaky)
+	coll.CountDocuments(ctx, sneaky)
+	coll.UpdateOne(ctx, sneaky, bson.M{"$set": bson.M{"bio": ""}})
+	coll.UpdateMany(ctx, sneaky, bson.M{"$set": bson.M{"bio": ""}})
+	coll.DeleteOne(ctx, sneaky)
+	coll.DeleteMany(ctx, sneaky)
+	coll.Find(ctx, nil)
+
+	require.Len(t, inner.filters, 8)
+	for _, filter := range inner.filters[:7] {
+		require.Equal(t, scopedTo("acme", sneaky), filter)
+	}
+	require.Equal(t, bson.D{{Key: "tenantId", Value: "acme"}}, inner.filters[7])
+}
+
+func TestScopedCollectionTagsInsertedDocuments(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingCollection{}
+	coll := tenancy.Scope(inner, "acme")
+
+	_, err := coll.InsertOne(ctx, models.User{Id: primitive.NewObjectID(), FirstName: "Matt", LastName: "Chw"})
+	require.NoError(t, err)
+	_, err = coll.InsertMany(ctx, []interface{}{bson.M{"firstName": "A"}, bson.M{"firstName": "B", "tenantId": "acme"}})
+	require.NoError(t, err)
+
+	require.Len(t, inner.documents, 3)
+	for _, document := range inner.documents {
+		require.Equal(t, "acme", document.(bson.D).Map()["tenantId"])
+	}
+
+	_, err = coll.InsertOne(ctx, bson.M{"firstName": "C", "tenantId": "globex"})
+	require.ErrorIs(t, err, tenancy.ErrCrossTenant)
+	_, err = coll.InsertMany(ctx, []interface{}{bson.M{"firstName": "D"}, bson.M{"tenantId": "globex"}})
+	require.ErrorIs(t, err, tenancy.ErrCrossTenant)
+	require.Len(t, inner.documents, 3)
+}
+
+func TestScopedCollectionRefusesMovingDocuments(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingCollection{}
+	coll := tenancy.Scope(inner, "acme")
+
+	for _, update := range []interface{}{
+		bson.M{"$set": bson.M{"tenantId": "globex"}},
+		bson.D{{Key: "$unset", Value: bson.D{{Key: "tenantId", Value: ""}}}},
+		bson.M{"$rename": bson.M{"bio": "tenantId"}},
+		bson.M{"$set": bson.M{"tenantId.name": "x"}},
+	} {
+		_, err := coll.UpdateOne(ctx, bson.M{}, update)
+		require.ErrorIs(t, err, tenancy.ErrCrossTenant, "%v", update)
+	}
+
+	// replacement documents and pipelines cannot be checked
+	_, err := coll.UpdateMany(ctx, bson.M{}, bson.M{"bio": ""})
+	require.ErrorIs(t, err, tenancy.ErrUnsupported)
+	_, err = coll.UpdateMany(ctx, bson.M{}, mongo.Pipeline{{{Key: "$set", Value: bson.M{"tenantId": "globex"}}}})
+	require.ErrorIs(t, err, tenancy.ErrUnsupported)
+
+	require.Empty(t, inner.updates)
+}
+
+func TestScopedCollectionBulkWrite(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingCollection{}
+	coll := tenancy.Scope(inner, "acme")
+
+	update := mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": 1}).SetUpdate(bson.M{"$set": bson.M{"bio": ""}})
+	deletion := mongo.NewDeleteManyModel().SetFilter(bson.M{"age": 3})
+	_, err := coll.BulkWrite(ctx, []mongo.WriteModel{update, deletion, mongo.NewInsertOneModel().SetDocument(bson.M{"a": 1})})
+	require.NoError(t, err)
+
+	require.Equal(t, scopedTo("acme", bson.M{"_id": 1}), inner.models[0].(*mongo.UpdateOneModel).Filter)
+	require.Equal(t, scopedTo("acme", bson.M{"age": 3}), inner.models[1].(*mongo.DeleteManyModel).Filter)
+	require.Equal(t, "acme", inner.models[2].(*mongo.InsertOneModel).Document.(bson.D).Map()["tenantId"])
+	// the caller's models are not modified
+	require.Equal(t, bson.M{"_id": 1}, update.Filter)
+
+	_, err = coll.BulkWrite(ctx, []mongo.WriteModel{
+		mongo.NewUpdateOneModel().SetFilter(bson.M{}).SetUpdate(bson.M{"$set": bson.M{"tenantId": "globex"}}),
+	})
+	require.ErrorIs(t, err, tenancy.ErrCrossTenant)
+}
+
+func TestUserServiceStaysWithinTenant(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingCollection{}
+	us := services.NewEncryptedUserServiceImpl(tenancy.Static(tenancy.Scope(inner, "acme")), nil)
+
+	id := primitive.NewObjectID()
+	_, err := us.FindOne(ctx, id)
+	require.ErrorIs(t, err, mongo.ErrNoDocuments)
+	_, err = us.Find(ctx, models.UserFilter{Gender: "Male"})
+	require.NoError(t, err)
+	_, err = us.DeleteOne(ctx, id)
+	require.NoError(t, err)
+
+	require.Equal(t, []interface{}{
+		scopedTo("acme", bson.M{"_id": id}),
+		scopedTo("acme", bson.M{"gender": "Male"}),
+		scopedTo("acme", bson.M{"_id": id}),
+	}, inner.filters)
+}
+
+func TestRouterNamespaces(t *testing.T) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	require.NoError(t, err)
+	acme := tenancy.WithTenant(context.Background(), "acme")
+
+	database, collection, err := tenancy.NewRouter(client, "onboard", tenancy.CollectionPerTenant).Namespace(acme, "users")
+	require.NoError(t, err)
+	require.Equal(t, []string{"onboard", "acme_users"}, []string{database, collection})
+
+	database, collection, err = tenancy.NewRouter(client, "onboard", tenancy.DatabasePerTenant).Namespace(acme, "users")
+	require.NoError(t, err)
+	require.Equal(t, []string{"onboard_acme", "users"}, []string{database, collection})
+
+	coll, err := tenancy.NewRouter(client, "onboard", tenancy.DatabasePerTenant).Collection(acme, "users")
+	require.NoError(t, err)
+	require.Equal(t, "onboard_acme", coll.(*mongo.Collection).Database().Name())
+
+	// without a tenant nothing can be reached
+	for _, mode := range []tenancy.Mode{tenancy.CollectionPerTenant, tenancy.DatabasePerTenant, tenancy.SharedCollection} {
+		_, err := tenancy.NewRouter(client, "onboard", mode).Collection(context.Background(), "users")
+		require.ErrorIs(t, err, tenancy.ErrNoTenant)
+
+		_, err = tenancy.NewRouter(client, "onboard", mode).Collection(tenancy.WithTenant(context.Background(), "../admin"), "users")
+		require.ErrorIs(t, err, tenancy.ErrInvalidTenant)
+	}
+
+	coll, err = tenancy.NewRouter(client, "onboard", tenancy.Disabled).Collection(context.Background(), "users")
+	require.NoError(t, err)
+	require.Equal(t, "users", coll.(*mongo.Collection).Name())
+}
+
+func TestResolveTenant(t *testing.T) {
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		if tenant := c.Get("X-Test-Claim"); tenant != "" {
+			c.Locals(middlewares.ClaimsKey, map[string]interface{}{"tenant": tenant})
+		}
+		return c.Next()
+	})
+	app.Use(middlewares.ResolveTenant([]string{"acme", "globex"},
+		middlewares.TenantClaim("tenant"),
+		middlewares.TenantHeader("X-Tenant-ID"),
+		middlewares.TenantSubdomain("api.example.com"),
+	))
+	app.Get("/", func(c *fiber.Ctx) error {
+		tenant, _ := tenancy.FromContext(c.UserContext())
+		return c.SendString(tenant)
+	})
+
+	cases := []struct {
+		name    string
+		host    string
+		headers map[string]string
+		status  int
+		tenant  string
+	}{
+		{"header", "example.com", map[string]string{"X-Tenant-ID": "acme"}, 200, "acme"},
+		{"subdomain", "globex.api.example.com", nil, 200, "globex"},
+		{"claim", "example.com", map[string]string{"X-Test-Claim": "acme"}, 200, "acme"},
+		{"claim and header agree", "acme.api.example.com", map[string]string{"X-Test-Claim": "acme", "X-Tenant-ID": "acme"}, 200, "acme"},
+		{"header conflicts with token", "example.com", map[string]string{"X-Test-Claim": "acme", "X-Tenant-ID": "globex"}, 403, ""},
+		{"host conflicts with header", "globex.api.example.com", map[string]string{"X-Tenant-ID": "acme"}, 403, ""},
+		{"missing", "example.com", nil, 400, ""},
+		{"invalid", "example.com", map[string]string{"X-Tenant-ID": "Acme_Corp"}, 400, ""},
+		{"unknown", "example.com", map[string]string{"X-Tenant-ID": "initech"}, 404, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://"+tc.host+"/", nil)
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, tc.status, resp.StatusCode)
+			if tc.status == 200 {
+				body, _ := io.ReadAll(resp.Body)
+				require.Equal(t, tc.tenant, string(body))
+			}
+		})
+	}
+}
+
+// memoryTokens keeps refresh token sessions in memory
+type memoryTokens struct {
+	sessions map[string]tokens.Session
+}
+
+func (mt *memoryTokens) Create(ctx context.Context, session tokens.Session) (string, error) {
+	token := primitive.NewObjectID().Hex()
+	mt.sessions[token] = session
+	return token, nil
+}
+
+func (mt *memoryTokens) Rotate(ctx context.Context, token string) (string, tokens.Session, error) {
+	session, ok := mt.sessions[token]
+	if !ok {
+		return "", tokens.Session{}, tokens.ErrInvalidRefresh
+	}
+	delete(mt.sessions, token)
+	next, err := mt.Create(ctx, session)
+	return next, session, err
+}
+
+func (mt *memoryTokens) Revoke(ctx context.Context, token string) error {
+	delete(mt.sessions, token)
+	return nil
+}
+
+func (mt *memoryTokens) RevokeSubject(ctx context.Context, subject string) (int, error) {
+	count := 0
+	for token, session := range mt.sessions {
+		if session.Subject == subject {
+			delete(mt.sessions, token)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (mt *memoryTokens) RevokeAccess(ctx context.Context, jti string, expires time.Time) error {
+	return nil
+}
+
+func (mt *memoryTokens) AccessRevoked(ctx context.Context, jti string) (bool, error) {
+	return false, nil
+}
+
+func TestAccountsOnlySignInToTheirTenants(t *testing.T) {
+	hash, err := passwords.Hash("a long enough password")
+	require.NoError(t, err)
+	account := models.Account{
+		Id:           primitive.NewObjectID(),
+		Username:     "ada",
+		PasswordHash: hash,
+		Role:         models.RoleAdmin,
+		Tenants:      []string{"acme"},
+	}
+	raw, err := bson.Marshal(account)
+	require.NoError(t, err)
+	var doc bson.D
+	require.NoError(t, bson.Unmarshal(raw, &doc))
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("sign in", func(mt *mtest.T) {
+		accounts := services.NewAccountServiceImpl(mt.Coll)
+		issuer := tokens.NewIssuer(tokens.NewKeyring(ed25519Key(t, "k1")), "go-onboard", 15*time.Minute)
+		auth := services.NewAuthServiceImpl(accounts, issuer, &memoryTokens{sessions: map[string]tokens.Session{}})
+		// the session store is only reached once the account got in
+		browser := services.NewSessionServiceImpl(accounts, nil)
+
+		app := fiber.New()
+		app.Use(middlewares.ResolveTenant([]string{"acme", "globex"}, middlewares.TenantHeader("X-Tenant-ID")))
+		app.Get("/basic", middlewares.AuthReq(accounts), func(c *fiber.Ctx) error {
+			return c.SendStatus(http.StatusOK)
+		})
+		app.Post("/login", func(c *fiber.Ctx) error {
+			pair, err := auth.Login(c.UserContext(), models.LoginInput{Username: "ada", Password: "a long enough password"})
+			if errors.Is(err, services.ErrInvalidCredential) {
+				return c.SendStatus(http.StatusUnauthorized)
+			}
+			if err != nil {
+				return err
+			}
+			claims, err := issuer.Verify(pair.AccessToken)
+			if err != nil {
+				return err
+			}
+			return c.SendString(claims["tenant"].(string))
+		})
+		app.Post("/session", func(c *fiber.Ctx) error {
+			_, _, err := browser.Login(c.UserContext(), models.LoginInput{Username: "ada", Password: "a long enough password"}, "test", "")
+			if errors.Is(err, services.ErrInvalidCredential) {
+				return c.SendStatus(http.StatusUnauthorized)
+			}
+			return err
+		})
+
+		ns := mt.Coll.Database().Name() + "." + mt.Coll.Name()
+		send := func(method string, path string, tenant string) *http.Response {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, doc))
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("X-Tenant-ID", tenant)
+			req.Header.Set(fiber.HeaderAuthorization, basicAuth("ada", "a long enough password"))
+			resp, err := app.Test(req, -1)
+			require.NoError(t, err)
+			return resp
+		}
+
+		require.Equal(t, http.StatusOK, send("GET", "/basic", "acme").StatusCode)
+		require.Equal(t, http.StatusUnauthorized, send("GET", "/basic", "globex").StatusCode)
+
+		resp := send("POST", "/login", "acme")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		require.Equal(t, "acme", string(body))
+		require.Equal(t, http.StatusUnauthorized, send("POST", "/login", "globex").StatusCode)
+
+		require.Equal(t, http.StatusUnauthorized, send("POST", "/session", "globex").StatusCode)
+	})
+}
+
+func TestAccountManagementStaysWithinTenants(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("tenant admin", func(mt *mtest.T) {
+		accounts := services.NewAccountServiceImpl(mt.Coll)
+		acme := services.WithinTenants(context.Background(), []string{"acme"})
+		input := func(tenants ...string) models.AccountInput {
+			return models.AccountInput{Username: "grace", Password: "a long enough password", Tenants: tenants}
+		}
+
+		// accounts of another tenant, of every tenant or of both cannot be made
+		_, err := accounts.Create(acme, input("globex"), models.RoleAdmin)
+		require.ErrorIs(t, err, services.ErrTenantsOutOfScope)
+		_, err = accounts.Create(acme, input(), models.RoleAdmin)
+		require.ErrorIs(t, err, services.ErrTenantsOutOfScope)
+		_, err = accounts.Update(acme, primitive.NewObjectID(), input("acme", "globex"))
+		require.ErrorIs(t, err, services.ErrTenantsOutOfScope)
+		require.Empty(t, mt.GetAllStartedEvents())
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		_, err = accounts.Create(acme, input("acme"), models.RoleAdmin)
+		require.NoError(t, err)
+
+		// accounts of other tenants are not found
+		ns := mt.Coll.Database().Name() + "." + mt.Coll.Name()
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch))
+		_, err = accounts.Get(acme, primitive.NewObjectID())
+		require.ErrorIs(t, err, services.ErrAccountNotFound)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch))
+		_, err = accounts.List(acme)
+		require.NoError(t, err)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}))
+		require.ErrorIs(t, accounts.Delete(acme, primitive.NewObjectID()), services.ErrAccountNotFound)
+
+		require.Len(t, commands(mt, "find"), 2)
+		require.Len(t, commands(mt, "delete"), 1)
+		within := bson.M{"$exists": true, "$not": bson.M{"$elemMatch": bson.M{"$nin": bson.A{"acme"}}}}
+		for _, name := range []string{"find", "delete"} {
+			for _, command := range commands(mt, name) {
+				var filter bson.M
+				if name == "find" {
+					require.NoError(t, bson.Unmarshal(command.Lookup("filter").Document(), &filter))
+				} else {
+					require.NoError(t, bson.Unmarshal(command.Lookup("deletes").Array().Index(0).Value().Document().Lookup("q").Document(), &filter))
+				}
+				require.Equal(t, within, filter["tenants"])
+			}
+		}
+
+		// admins without tenants manage every account
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		_, err = accounts.Create(context.Background(), input("globex"), models.RoleAdmin)
+		require.NoError(t, err)
+	})
+}
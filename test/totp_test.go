@@ -0,0 +1,97 @@
+package test
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattchw/go-onboard/totp"
+	"github.com/stretchr/testify/require"
+)
+
+// base32 of the RFC 6238 SHA-1 test secret 12345678901234567890
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, the last 6 of its 8 digits
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		code, err := totp.Code(rfcSecret, time.Unix(unix, 0))
+		require.NoError(t, err)
+		require.Equal(t, want, code)
+	}
+
+	_, err := totp.Code("not base32!", time.Now())
+	require.Error(t, err)
+}
+
+func TestTOTPValidate(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	code, _ := totp.Code(rfcSecret, now)
+
+	step, ok := totp.Validate(rfcSecret, code, now)
+	require.True(t, ok)
+	require.Equal(t, totp.Step(now), step)
+
+	// a step of clock drift either way is accepted, two are not
+	_, ok = totp.Validate(rfcSecret, code, now.Add(totp.Period))
+	require.True(t, ok)
+	_, ok = totp.Validate(rfcSecret, code, now.Add(-totp.Period))
+	require.True(t, ok)
+	_, ok = totp.Validate(rfcSecret, code, now.Add(2*totp.Period))
+	require.False(t, ok)
+
+	_, ok = totp.Validate(rfcSecret, "000000", now)
+	require.False(t, ok)
+	_, ok = totp.Validate(rfcSecret, code[:5], now)
+	require.False(t, ok)
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	require.NoError(t, err)
+	require.Len(t, secret, 32)
+	other, _ := totp.GenerateSecret()
+	require.NotEqual(t, secret, other)
+
+	uri, err := url.Parse(totp.URI("go-onboard", "ada lovelace", secret))
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", uri.Scheme)
+	require.Equal(t, "totp", uri.Host)
+	require.Equal(t, "/go-onboard:ada lovelace", uri.Path)
+	require.Equal(t, secret, uri.Query().Get("secret"))
+	require.Equal(t, "go-onboard", uri.Query().Get("issuer"))
+	require.Equal(t, "6", uri.Query().Get("digits"))
+	require.Equal(t, "30", uri.Query().Get("period"))
+
+	png, err := totp.QRCode(uri.String(), 256)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(png, []byte("\x89PNG\r\n\x1a\n")))
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := totp.RecoveryCodes(10)
+	require.NoError(t, err)
+	require.Len(t, codes, 10)
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		require.Regexp(t, `^[a-z2-9]{4}-[a-z2-9]{4}-[a-z2-9]{4}$`, code)
+		require.False(t, seen[code])
+		seen[code] = true
+	}
+
+	// typed back with other case, spaces or without hyphens they still match
+	hash := totp.HashRecoveryCode(codes[0])
+	require.Equal(t, hash, totp.HashRecoveryCode(strings.ToUpper(codes[0])))
+	require.Equal(t, hash, totp.HashRecoveryCode(strings.ReplaceAll(codes[0], "-", " ")))
+	require.Equal(t, hash, totp.HashRecoveryCode(strings.ReplaceAll(codes[0], "-", "")))
+	require.NotEqual(t, hash, totp.HashRecoveryCode(codes[1]))
+}
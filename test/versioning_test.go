@@ -0,0 +1,47 @@
+package test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattchw/go-onboard/middlewares"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersioningDeprecatesOnlyRequestedVersions(t *testing.T) {
+	app := fiber.New()
+	app.Use(middlewares.Versioning([]middlewares.APIVersion{
+		{Name: "v1", Deprecated: true, Sunset: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), Successor: "v2"},
+		{Name: "v2"},
+	}, "v1"))
+	app.Get("/*", func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	// unversioned requests are served v1 without being told to migrate
+	resp, err := app.Test(httptest.NewRequest("GET", "/users/count", nil))
+	require.NoError(t, err)
+	require.Equal(t, "v1", resp.Header.Get("Content-Version"))
+	require.Empty(t, resp.Header.Get("Deprecation"))
+	require.Empty(t, resp.Header.Get("Link"))
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/v1/users/count", nil))
+	require.NoError(t, err)
+	require.Equal(t, "true", resp.Header.Get("Deprecation"))
+	require.Equal(t, "Fri, 01 Jan 2027 00:00:00 GMT", resp.Header.Get("Sunset"))
+	require.Equal(t, `</v2/users/count>; rel="successor-version"`, resp.Header.Get("Link"))
+
+	req := httptest.NewRequest("GET", "/users/count", nil)
+	req.Header.Set("Accept-Version", "1")
+	resp, err = app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, "true", resp.Header.Get("Deprecation"))
+	require.Equal(t, `</v2/users/count>; rel="successor-version"`, resp.Header.Get("Link"))
+
+	req = httptest.NewRequest("GET", "/users/count", nil)
+	req.Header.Set("Accept-Version", "v2")
+	resp, err = app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, "v2", resp.Header.Get("Content-Version"))
+	require.Empty(t, resp.Header.Get("Deprecation"))
+}
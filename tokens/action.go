@@ -0,0 +1,134 @@
+package tokens
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// purposes of action tokens, a token only works for the purpose it was signed for
+const (
+	PurposePasswordReset = "password_reset"
+	PurposeVerifyEmail   = "verify_email"
+)
+
+var (
+	ErrInvalidAction = errors.New("tokens: invalid or expired action token")
+	ErrActionUsed    = errors.New("tokens: action token already used")
+)
+
+// Action is what an action token, sent in an email, allows
+type Action struct {
+	Purpose string `json:"p"`
+	Subject string `json:"s"`
+	// state the token is bound to, like the email address it verifies. The
+	// action is refused once that state changed.
+	Binding   string `json:"b,omitempty"`
+	Nonce     string `json:"n"`
+	ExpiresAt int64  `json:"e"`
+}
+
+// ActionSigner signs single-use action tokens with HMAC-SHA256. Tokens are
+// stateless until used, Consume then remembers their nonce in Redis until
+// they expire.
+type ActionSigner struct {
+	secret []byte
+	rdb    redis.Cmdable
+	prefix string
+	now    func() time.Time
+}
+
+// Constructor, secret should hold at least 32 random bytes
+func NewActionSigner(secret []byte, rdb redis.Cmdable) *ActionSigner {
+	return &ActionSigner{
+		secret: secret,
+		rdb:    rdb,
+		prefix: "action:",
+		now:    time.Now,
+	}
+}
+
+// WithClock returns a copy of the signer reading the time from now
+func (as *ActionSigner) WithClock(now func() time.Time) *ActionSigner {
+	copy := *as
+	copy.now = now
+	return &copy
+}
+
+// Sign returns a token allowing purpose on subject for ttl
+func (as *ActionSigner) Sign(purpose string, subject string, binding string, ttl time.Duration) (string, error) {
+	nonce, err := randomId()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(Action{
+		Purpose:   purpose,
+		Subject:   subject,
+		Binding:   binding,
+		Nonce:     nonce,
+		ExpiresAt: as.now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(as.sign(encoded)), nil
+}
+
+// Verify checks the signature, purpose and expiry of a token without using it up
+func (as *ActionSigner) Verify(token string, purpose string) (*Action, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidAction
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, as.sign(encoded)) {
+		return nil, ErrInvalidAction
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidAction
+	}
+
+	var action Action
+	if err := json.Unmarshal(payload, &action); err != nil {
+		return nil, ErrInvalidAction
+	}
+	if action.Purpose != purpose || action.Subject == "" || action.Nonce == "" {
+		return nil, ErrInvalidAction
+	}
+	if as.now().Unix() >= action.ExpiresAt {
+		return nil, ErrInvalidAction
+	}
+	return &action, nil
+}
+
+// Consume marks a verified action as used, a second call gives ErrActionUsed
+func (as *ActionSigner) Consume(ctx context.Context, action *Action) error {
+	ttl := time.Unix(action.ExpiresAt, 0).Sub(as.now())
+	if ttl <= 0 {
+		return ErrInvalidAction
+	}
+	// kept a second longer than the token, which expires on whole seconds
+	fresh, err := as.rdb.SetNX(ctx, as.prefix+"used:"+action.Nonce, action.Purpose, ttl+time.Second).Result()
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrActionUsed
+	}
+	return nil
+}
+
+func (as *ActionSigner) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, as.secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,179 @@
+package tokens
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	ErrNoKeys         = errors.New("tokens: no signing keys")
+	ErrUnknownKey     = errors.New("tokens: unknown signing key")
+	ErrUnsupportedKey = errors.New("tokens: only RSA and Ed25519 keys are supported")
+)
+
+// Key signs tokens with RS256 when it is an RSA key and EdDSA when it is an
+// Ed25519 key. The key id travels in the kid header of every token it signs.
+type Key struct {
+	Id      string
+	Method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+// NewKey wraps a private key, RSA keys shorter than 2048 bits are refused
+func NewKey(id string, private crypto.Signer) (*Key, error) {
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("tokens: RSA key %s has %d bits, at least 2048 are required", id, k.N.BitLen())
+		}
+		return &Key{Id: id, Method: jwt.SigningMethodRS256, private: k}, nil
+	case ed25519.PrivateKey:
+		return &Key{Id: id, Method: jwt.SigningMethodEdDSA, private: k}, nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// Public returns the key tokens signed by this key are verified with
+func (k *Key) Public() crypto.PublicKey {
+	return k.private.Public()
+}
+
+// Keyring holds the active signing key and the retired keys tokens issued
+// before a rotation are still verified with
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   map[string]*Key
+	active *Key
+}
+
+// NewKeyring signs with active and verifies with every key given
+func NewKeyring(active *Key, retired ...*Key) *Keyring {
+	kr := &Keyring{}
+	kr.set(active, retired)
+	return kr
+}
+
+// LoadKeyring reads every <kid>.pem private key in dir. Tokens are signed with
+// the key named active or, when active is empty, with the key whose id sorts
+// last, so dropping 2022-07-01.pem next to 2022-01-01.pem rotates the key.
+func LoadKeyring(dir string, active string) (*Keyring, error) {
+	kr := &Keyring{}
+	if err := kr.Reload(dir, active); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// Reload re-reads the keys in dir, the keyring is left unchanged on error
+func (kr *Keyring) Reload(dir string, active string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	var keys []*Key
+	for _, path := range paths {
+		key, err := loadKey(path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%w in %s", ErrNoKeys, dir)
+	}
+
+	signing := keys[len(keys)-1]
+	if active != "" {
+		signing = nil
+		for _, key := range keys {
+			if key.Id == active {
+				signing = key
+			}
+		}
+		if signing == nil {
+			return fmt.Errorf("%w %s in %s", ErrUnknownKey, active, dir)
+		}
+	}
+
+	kr.set(signing, keys)
+	return nil
+}
+
+// ActiveKeyId returns the id of the key new tokens are signed with
+func (kr *Keyring) ActiveKeyId() string {
+	return kr.Active().Id
+}
+
+// Active returns the key new tokens are signed with
+func (kr *Keyring) Active() *Key {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.active
+}
+
+// Get returns the key with the given id
+func (kr *Keyring) Get(id string) (*Key, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	key, ok := kr.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+func (kr *Keyring) set(active *Key, keys []*Key) {
+	byId := map[string]*Key{active.Id: active}
+	for _, key := range keys {
+		byId[key.Id] = key
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys = byId
+	kr.active = active
+}
+
+func loadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("tokens: reading key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("tokens: %s is not PEM encoded", path)
+	}
+
+	var private interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("tokens: %s holds a %s, expected a private key", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tokens: parsing %s: %w", path, err)
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	return NewKey(strings.TrimSuffix(filepath.Base(path), ".pem"), signer)
+}
@@ -0,0 +1,239 @@
+package tokens
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+var (
+	ErrInvalidRefresh = errors.New("tokens: invalid refresh token")
+	// a rotated refresh token came back, its whole family has been revoked
+	ErrRefreshReused = errors.New("tokens: refresh token reused")
+)
+
+// Session is what a refresh token stands for. Every rotation issues a new
+// token in the same family, revoking the family signs the session out.
+type Session struct {
+	Family  string `json:"family"`
+	Subject string `json:"subject"`
+	Tenant  string `json:"tenant,omitempty"`
+	// signed in with a second factor
+	MFA       bool      `json:"mfa,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Rotated   bool      `json:"rotated"`
+}
+
+// Store keeps refresh token sessions and revoked access tokens
+type Store interface {
+	// Create starts a session and returns its first refresh token
+	Create(ctx context.Context, session Session) (string, error)
+	// Rotate exchanges a refresh token for a new one of the same session
+	Rotate(ctx context.Context, token string) (string, Session, error)
+	// Revoke ends the session of a refresh token
+	Revoke(ctx context.Context, token string) error
+	// RevokeSubject ends every session of a subject and returns how many there were
+	RevokeSubject(ctx context.Context, subject string) (int, error)
+	// RevokeAccess rejects the access token with the given jti until it expires
+	RevokeAccess(ctx context.Context, jti string, expires time.Time) error
+	// AccessRevoked reports whether RevokeAccess was called for the jti
+	AccessRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+// rotating marks the old token as used instead of deleting it, presenting it
+// again revokes the family. That catches a stolen token used after the owner
+// rotated it, and the owner after the thief did.
+var rotate = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if not current or redis.call("EXISTS", KEYS[2]) == 0 then
+  return 0
+end
+
+local session = cjson.decode(current)
+if session.rotated then
+  redis.call("DEL", KEYS[2])
+  return -1
+end
+
+session.rotated = true
+redis.call("SET", KEYS[1], cjson.encode(session), "KEEPTTL")
+redis.call("SET", KEYS[3], ARGV[1], "PX", ARGV[2])
+redis.call("PEXPIRE", KEYS[2], ARGV[2])
+redis.call("PEXPIRE", KEYS[4], ARGV[2])
+return 1
+`)
+
+// RedisStore keeps sessions in Redis, refresh tokens are only stored hashed
+type RedisStore struct {
+	rdb    redis.Cmdable
+	prefix string
+	ttl    time.Duration
+}
+
+// Constructor, ttl is how long a refresh token stays usable without rotation
+func NewRedisStore(rdb redis.Cmdable, ttl time.Duration) *RedisStore {
+	return &RedisStore{
+		rdb:    rdb,
+		prefix: "auth:",
+		ttl:    ttl,
+	}
+}
+
+// implement Create
+func (rs *RedisStore) Create(ctx context.Context, session Session) (string, error) {
+	family, err := randomId()
+	if err != nil {
+		return "", err
+	}
+	session.Family = family
+	session.Rotated = false
+
+	token, value, err := rs.newToken(session)
+	if err != nil {
+		return "", err
+	}
+
+	// the families of a subject are indexed so they can all be revoked, the
+	// index lives as long as the longest lived of them
+	_, err = rs.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, rs.familyKey(family), session.Subject, rs.ttl)
+		pipe.Set(ctx, rs.tokenKey(token), value, rs.ttl)
+		pipe.SAdd(ctx, rs.subjectKey(session.Subject), family)
+		pipe.PExpire(ctx, rs.subjectKey(session.Subject), rs.ttl)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// implement Rotate
+func (rs *RedisStore) Rotate(ctx context.Context, token string) (string, Session, error) {
+	session, err := rs.session(ctx, token)
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	next, value, err := rs.newToken(session)
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	keys := []string{rs.tokenKey(token), rs.familyKey(session.Family), rs.tokenKey(next), rs.subjectKey(session.Subject)}
+	result, err := rotate.Run(ctx, rs.rdb, keys, value, rs.ttl.Milliseconds()).Int()
+	if err != nil {
+		return "", Session{}, err
+	}
+	switch result {
+	case -1:
+		return "", Session{}, ErrRefreshReused
+	case 0:
+		return "", Session{}, ErrInvalidRefresh
+	}
+	return next, session, nil
+}
+
+// implement Revoke
+func (rs *RedisStore) Revoke(ctx context.Context, token string) error {
+	session, err := rs.session(ctx, token)
+	if err != nil {
+		return err
+	}
+	return rs.rdb.Del(ctx, rs.familyKey(session.Family)).Err()
+}
+
+// implement RevokeSubject, families that already ended are not counted
+func (rs *RedisStore) RevokeSubject(ctx context.Context, subject string) (int, error) {
+	families, err := rs.rdb.SMembers(ctx, rs.subjectKey(subject)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(families) == 0 {
+		return 0, nil
+	}
+
+	keys := make([]string, len(families))
+	for i, family := range families {
+		keys[i] = rs.familyKey(family)
+	}
+	deleted, err := rs.rdb.Del(ctx, keys...).Result()
+	if err != nil {
+		return 0, err
+	}
+	rs.rdb.SRem(ctx, rs.subjectKey(subject), toInterfaces(families)...)
+	return int(deleted), nil
+}
+
+// implement RevokeAccess
+func (rs *RedisStore) RevokeAccess(ctx context.Context, jti string, expires time.Time) error {
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return nil
+	}
+	return rs.rdb.Set(ctx, rs.prefix+"revoked:"+jti, 1, ttl).Err()
+}
+
+// implement AccessRevoked
+func (rs *RedisStore) AccessRevoked(ctx context.Context, jti string) (bool, error) {
+	count, err := rs.rdb.Exists(ctx, rs.prefix+"revoked:"+jti).Result()
+	return count > 0, err
+}
+
+func (rs *RedisStore) session(ctx context.Context, token string) (Session, error) {
+	value, err := rs.rdb.Get(ctx, rs.tokenKey(token)).Result()
+	if err == redis.Nil {
+		return Session{}, ErrInvalidRefresh
+	}
+	if err != nil {
+		return Session{}, err
+	}
+
+	var session Session
+	if err := json.Unmarshal([]byte(value), &session); err != nil {
+		return Session{}, ErrInvalidRefresh
+	}
+	return session, nil
+}
+
+// newToken returns a random refresh token and the session stored under its hash
+func (rs *RedisStore) newToken(session Session) (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	session.Rotated = false
+	value, err := json.Marshal(session)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), string(value), nil
+}
+
+func (rs *RedisStore) tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return rs.prefix + "refresh:" + hex.EncodeToString(sum[:])
+}
+
+func (rs *RedisStore) familyKey(family string) string {
+	return rs.prefix + "family:" + family
+}
+
+func (rs *RedisStore) subjectKey(subject string) string {
+	return rs.prefix + "subject:" + subject
+}
+
+func toInterfaces(values []string) []interface{} {
+	items := make([]interface{}, len(values))
+	for i, value := range values {
+		items[i] = value
+	}
+	return items
+}
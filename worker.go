@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mattchw/go-onboard/controllers"
+	"github.com/mattchw/go-onboard/jobs"
+)
+
+// runWorkers consumes the job queue until ctx is cancelled
+func runWorkers(ctx context.Context, size int) {
+	if size == 0 {
+		return
+	}
+
+	fmt.Printf("Starting %d job workers\n", size)
+	jobs.NewWorkerPool(controllers.JobManager, size).Run(ctx)
+}